@@ -3,10 +3,14 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/mimic/internal/core/cache"
 	"github.com/mimic/internal/core/config"
+	"github.com/mimic/internal/core/journal"
 	"github.com/mimic/internal/core/logger"
+	"github.com/mimic/internal/core/metastore"
 	"github.com/mimic/internal/core/wrappers"
 	"github.com/mimic/internal/fs"
 	flag "github.com/spf13/pflag"
@@ -36,12 +40,44 @@ func main() {
 	}
 	defer logger.Close()
 	cache := cache.NewNodeCache(cfg.TTL, cfg.MaxEntries)
+	if cfg.StaleTTL != 0 {
+		cache.SetStale(cfg.StaleTTL)
+	}
+	if cfg.NegativeTTL != 0 {
+		cache.SetNegativeTTL(cfg.NegativeTTL)
+	}
+	if cfg.PersistMetadata && cfg.CacheDir != "" {
+		store, err := metastore.Open(filepath.Join(cfg.CacheDir, "metadata", journal.Namespace(cfg.URL, cfg.Username)+".jsonl"))
+		if err != nil {
+			logger.Errorf("Metadata store disabled: %v", err)
+		} else {
+			n, err := store.Load(cache)
+			if err != nil {
+				logger.Errorf("Metadata store load failed path=%s: %v", store.Path(), err)
+			}
+			logger.Logf("[Cache] restored %d metadata entries from %s", n, store.Path())
+			cache.SetPersister(store)
+			defer func() {
+				if err := store.Close(); err != nil {
+					logger.Errorf("Metadata store close failed path=%s: %v", store.Path(), err)
+				}
+			}()
+		}
+	}
+	defer cache.StartSweeper(max(cfg.TTL, time.Second))()
+	defer func() { logger.Logf("[Cache] metadata cache %s", cache.Stats()) }()
 
 	webdavClient := wrappers.NewWebdavClient(cache, cfg.URL, cfg.Username, cfg.Password)
-	filesystem := fs.New(webdavClient, logger)
+	webdavClient.SetChunking(int64(cfg.ChunkThresholdMB)<<20, int64(cfg.ChunkSizeMB)<<20, cfg.ChunkUploadsURL)
+	webdavClient.SetServerLocks(cfg.ServerLocks, cfg.LockTimeout)
+	filesystem, err := fs.New(webdavClient, logger, cfg)
+	if err != nil {
+		logger.Errorf("Filesystem init failed: %v", err)
+		os.Exit(1)
+	}
 
 	defer filesystem.Unmount()
-	if err := filesystem.Mount(cfg.Mountpoint, []string{}); err != nil {
+	if err := filesystem.Mount(cfg.Mountpoint, fs.MountOptions(cfg)); err != nil {
 		logger.Errorf("Mount failed: %v", err)
 		os.Exit(1)
 	}
@@ -1,14 +1,39 @@
 package cache
 
-import "sync"
+import (
+	"cmp"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBudget is the memory the buffers of a BufferCache may hold before
+// Reclaim evicts clean pages.
+const DefaultBudget = 256 * 1024 * 1024 // 256 MB
+
+// reclaimSlack makes Reclaim free down to budget - budget/reclaimSlack.
+const reclaimSlack = 10
 
 // BufferCache stores FileBuffer entries by path.
 type BufferCache struct {
 	entries sync.Map // map[string]*FileBuffer
+	// mu serializes Acquire and DropIdle so a buffer is never dropped while
+	// a new handle is attaching to it.
+	mu sync.Mutex
+
+	// policy counts the memory of all buffers; it spills once SetSpill
+	// gave it a directory
+	policy *SpillPolicy
+	budget int64 // <= 0: never evict
+
+	evictedPages   atomic.Int64
+	evictedBuffers atomic.Int64
 }
 
 func NewBufferCache() *BufferCache {
-	return &BufferCache{}
+	return &BufferCache{policy: &SpillPolicy{}, budget: DefaultBudget}
 }
 
 // Get returns the buffer for a path if present.
@@ -30,10 +55,8 @@ func (bc *BufferCache) GetOrCreate(path string) *FileBuffer {
 	}
 
 	fb := &FileBuffer{
-		BufferSnapshot: BufferSnapshot{
-			Data: make([]byte, 0),
-		},
 		HandleCount: 1,
+		policy:      bc.policy,
 	}
 	actual, _ := bc.entries.LoadOrStore(path, fb)
 	return actual.(*FileBuffer)
@@ -47,3 +70,174 @@ func (bc *BufferCache) Set(path string, buffer *FileBuffer) {
 func (bc *BufferCache) Delete(path string) {
 	bc.entries.Delete(path)
 }
+
+// Rename moves the buffers for oldPath and the files below it to the same
+// places below newPath, as renaming the file or directory does. Buffers
+// there already are replaced.
+func (bc *BufferCache) Rename(oldPath, newPath string) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	for _, p := range bc.Under(oldPath) {
+		if v, ok := bc.entries.LoadAndDelete(p); ok {
+			bc.entries.Store(newPath+strings.TrimPrefix(p, oldPath), v)
+		}
+	}
+}
+
+// Under returns the paths of the buffers for p and the files below it.
+func (bc *BufferCache) Under(p string) []string {
+	dir := strings.TrimSuffix(p, "/") + "/"
+	var paths []string
+	bc.entries.Range(func(k, _ any) bool {
+		if key := k.(string); key == p || strings.HasPrefix(key, dir) {
+			paths = append(paths, key)
+		}
+		return true
+	})
+	return paths
+}
+
+// Acquire returns the buffer for a path, creating it if missing, and counts
+// one more handle on it.
+func (bc *BufferCache) Acquire(path string) *FileBuffer {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	v, _ := bc.entries.LoadOrStore(path, &FileBuffer{policy: bc.policy})
+	fb := v.(*FileBuffer)
+	fb.IncHandle()
+	return fb
+}
+
+// DropIdle removes the buffer for a path once no handle uses it and it holds
+// no dirty data. busy may veto the drop (e.g. while an upload still needs
+// the buffer to serve reads). Returns true if the buffer was dropped.
+func (bc *BufferCache) DropIdle(path string, busy func(path string) bool) bool {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	fb, ok := bc.Get(path)
+	if !ok || !fb.Idle() {
+		return false
+	}
+	if busy != nil && busy(path) {
+		return false
+	}
+	bc.entries.Delete(path)
+	fb.Clear()
+	return true
+}
+
+// SetSpill lets buffers created from now on move their image to temporary
+// files below dir once it exceeds fileLimit bytes, or once all buffers
+// together hold more than totalLimit bytes in memory. Limits <= 0 select
+// the defaults. Each cache uses its own subdirectory, removed by Close.
+func (bc *BufferCache) SetSpill(dir string, fileLimit, totalLimit int64) error {
+	if fileLimit <= 0 {
+		fileLimit = DefaultSpillFileLimit
+	}
+	if totalLimit <= 0 {
+		totalLimit = DefaultSpillTotalLimit
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	own, err := os.MkdirTemp(dir, "buffers-")
+	if err != nil {
+		return err
+	}
+	bc.policy.Dir = own
+	bc.policy.FileLimit = fileLimit
+	bc.policy.TotalLimit = totalLimit
+	return nil
+}
+
+// Spill returns the spill policy, nil when spilling is off.
+func (bc *BufferCache) Spill() *SpillPolicy {
+	if bc.policy.Dir == "" {
+		return nil
+	}
+	return bc.policy
+}
+
+// SetBudget sets the memory all buffers may hold before Reclaim evicts. A
+// budget <= 0 turns eviction off.
+func (bc *BufferCache) SetBudget(bytes int64) {
+	bc.budget = bytes
+}
+
+// InMemory returns the bytes of page content all buffers keep in memory.
+func (bc *BufferCache) InMemory() int64 {
+	return bc.policy.InMemory()
+}
+
+// Evictions returns how many clean pages and idle buffers Reclaim dropped.
+func (bc *BufferCache) Evictions() (pages, buffers int64) {
+	return bc.evictedPages.Load(), bc.evictedBuffers.Load()
+}
+
+// Reclaim brings the buffers back below the budget, least recently used
+// first: buffers without handles and dirty data are dropped whole, then
+// clean pages of the remaining buffers are evicted. Dirty pages are never
+// evicted. It frees a little more than needed so that not every call past
+// the budget has to sort the buffers. busy may veto dropping a buffer, as
+// for DropIdle. Returns the bytes freed.
+func (bc *BufferCache) Reclaim(busy func(path string) bool) int64 {
+	if bc.budget <= 0 || bc.policy.InMemory() <= bc.budget {
+		return 0
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	type entry struct {
+		path string
+		fb   *FileBuffer
+	}
+	var lru []entry
+	bc.entries.Range(func(k, v any) bool {
+		lru = append(lru, entry{k.(string), v.(*FileBuffer)})
+		return true
+	})
+	slices.SortFunc(lru, func(a, b entry) int {
+		return cmp.Compare(a.fb.LastUse(), b.fb.LastUse())
+	})
+
+	start := bc.policy.InMemory()
+	target := bc.budget - bc.budget/reclaimSlack
+	over := func() int64 { return bc.policy.InMemory() - target }
+
+	kept := lru[:0]
+	for _, e := range lru {
+		if over() > 0 && e.fb.Idle() && (busy == nil || !busy(e.path)) {
+			bc.entries.Delete(e.path)
+			e.fb.Clear()
+			bc.evictedBuffers.Add(1)
+			continue
+		}
+		kept = append(kept, e)
+	}
+	for _, e := range kept {
+		if over() <= 0 {
+			break
+		}
+		bc.evictedPages.Add(e.fb.evictClean(over()) / PageSize)
+	}
+	return start - bc.policy.InMemory()
+}
+
+// Close drops all buffers and removes their temporary files.
+func (bc *BufferCache) Close() error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	bc.entries.Range(func(k, v any) bool {
+		v.(*FileBuffer).Clear()
+		bc.entries.Delete(k)
+		return true
+	})
+	if bc.policy.Dir != "" {
+		return os.RemoveAll(bc.policy.Dir)
+	}
+	return nil
+}
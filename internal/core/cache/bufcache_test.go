@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+)
+
+func fillRemote(t *testing.T, fb *FileBuffer, pages int) {
+	t.Helper()
+	if err := fb.WriteRemoteAt(0, bytes.Repeat([]byte("r"), pages*PageSize)); err != nil {
+		t.Fatalf("WriteRemoteAt failed: %v", err)
+	}
+}
+
+func TestReclaim_DropsIdleBuffersFirst(t *testing.T) {
+	bc := NewBufferCache()
+	bc.SetBudget(8 * PageSize)
+
+	idle := bc.Acquire("/idle")
+	fillRemote(t, idle, 4)
+	idle.DecHandle()
+
+	open := bc.Acquire("/open")
+	fillRemote(t, open, 6)
+
+	freed := bc.Reclaim(nil)
+	if _, ok := bc.Get("/idle"); ok {
+		t.Fatalf("idle buffer should be dropped")
+	}
+	if freed != 4*PageSize || open.Pages() != 6 {
+		t.Fatalf("freed=%d open pages=%d, want only the idle buffer dropped", freed, open.Pages())
+	}
+	if _, buffers := bc.Evictions(); buffers != 1 {
+		t.Fatalf("evicted buffers: want 1 got %d", buffers)
+	}
+}
+
+func TestReclaim_EvictsCleanPagesLRU(t *testing.T) {
+	bc := NewBufferCache()
+	bc.SetBudget(4 * PageSize)
+
+	fb := bc.Acquire("/f")
+	fillRemote(t, fb, 6)
+	_ = fb.WriteAt(5*PageSize, []byte("dirty"))
+	// page 0 was used last
+	_, _ = fb.ReadAt(0, 1)
+
+	bc.Reclaim(nil)
+	if bc.InMemory() >= 4*PageSize {
+		t.Fatalf("still over budget: %d", bc.InMemory())
+	}
+	if !fb.IsValidAt(0) || !fb.IsValidAt(5*PageSize) {
+		t.Fatalf("recently used and dirty pages must stay")
+	}
+	if fb.IsValidAt(PageSize) {
+		t.Fatalf("least recently used clean page should be evicted")
+	}
+	if pages, _ := bc.Evictions(); pages == 0 {
+		t.Fatalf("expected evicted pages to be counted")
+	}
+}
+
+func TestReclaim_KeepsPinnedPages(t *testing.T) {
+	bc := NewBufferCache()
+	bc.SetBudget(2 * PageSize)
+
+	fb := bc.Acquire("/f")
+	fillRemote(t, fb, 2)
+	fb.Pin()
+	if err := fb.WriteRemoteAt(2*PageSize, bytes.Repeat([]byte("n"), 2*PageSize)); err != nil {
+		t.Fatalf("WriteRemoteAt failed: %v", err)
+	}
+	bc.Reclaim(nil)
+	if !fb.Present(2*PageSize, 2*PageSize) {
+		t.Fatalf("pages fetched while pinned were evicted")
+	}
+	fb.Unpin()
+
+	if err := fb.WriteRemoteAt(4*PageSize, bytes.Repeat([]byte("m"), PageSize)); err != nil {
+		t.Fatalf("WriteRemoteAt failed: %v", err)
+	}
+	bc.Reclaim(nil)
+	if fb.IsValidAt(2*PageSize) || !fb.IsValidAt(4*PageSize) {
+		t.Fatalf("after Unpin the oldest page should be reclaimed")
+	}
+}
+
+func TestReclaim_DisabledBudget(t *testing.T) {
+	bc := NewBufferCache()
+	bc.SetBudget(0)
+
+	fb := bc.Acquire("/f")
+	fillRemote(t, fb, 4)
+	if freed := bc.Reclaim(nil); freed != 0 || fb.Pages() != 4 {
+		t.Fatalf("disabled budget evicted %d bytes", freed)
+	}
+}
+
+func TestFileBuffer_EvictsCleanBeforeSpilling(t *testing.T) {
+	fb, p := newSpillBuffer(t, 4*PageSize, 0)
+
+	// reading through a large file keeps the buffer in memory
+	for i := range 16 {
+		if err := fb.WriteRemoteAt(int64(i)*PageSize, bytes.Repeat([]byte("r"), PageSize)); err != nil {
+			t.Fatalf("WriteRemoteAt failed: %v", err)
+		}
+	}
+	if fb.Spilled() || p.InMemory() > 4*PageSize {
+		t.Fatalf("clean data should be evicted, spilled=%v inMemory=%d", fb.Spilled(), p.InMemory())
+	}
+
+	// dirty data cannot be evicted and goes to disk
+	if err := fb.WriteAt(0, bytes.Repeat([]byte("w"), 5*PageSize)); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if !fb.Spilled() {
+		t.Fatalf("expected dirty data past the limit to spill")
+	}
+}
+
+func TestRename_MovesBuffersBelow(t *testing.T) {
+	bc := NewBufferCache()
+	file := bc.Acquire("/dir/a")
+	nested := bc.Acquire("/dir/sub/b")
+	other := bc.Acquire("/dirt")
+
+	bc.Rename("/dir", "/moved")
+	if fb, ok := bc.Get("/moved/a"); !ok || fb != file {
+		t.Fatalf("/dir/a was not moved")
+	}
+	if fb, ok := bc.Get("/moved/sub/b"); !ok || fb != nested {
+		t.Fatalf("/dir/sub/b was not moved")
+	}
+	if _, ok := bc.Get("/dir/a"); ok {
+		t.Fatalf("old path still has a buffer")
+	}
+	if fb, ok := bc.Get("/dirt"); !ok || fb != other {
+		t.Fatalf("a sibling sharing the prefix was moved")
+	}
+}
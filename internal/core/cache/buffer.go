@@ -1,9 +1,14 @@
 package cache
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -12,71 +17,610 @@ var (
 	ErrOutOfBounds    = errors.New("read/write out of bounds")
 )
 
-type BufferSnapshot struct {
-	Data []byte
-	Base int64
-	Mask Mask
+// Extent is a contiguous range of the file.
+type Extent struct {
+	Offset int64
+	Length int64
 }
 
-// FileBuffer represents a file image kept in memory for a mapped path.
+// Snapshot is a copy of the dirty pages of a buffer taken for an upload. It
+// reads at absolute file offsets; Extents lists the ranges it holds. Pages
+// the buffer kept in its spill file are copied to another temporary file
+// instead of memory.
+type Snapshot struct {
+	Extents []Extent
+	// Seq identifies the buffer state the snapshot was taken at, see
+	// FileBuffer.MarkCommitted.
+	Seq uint64
+
+	// Truncated is set when the file was truncated to TruncSize before the
+	// extents were written, so the remote file has to be resized first.
+	Truncated bool
+	TruncSize int64
+
+	// ModTime, when set, is the modification time to give the file.
+	ModTime time.Time
+
+	pages map[int64][]byte // nil content lives in spill
+	spill *spillFile
+}
+
+// Len returns the number of bytes in the snapshot's extents.
+func (s *Snapshot) Len() int64 {
+	var n int64
+	for _, e := range s.Extents {
+		n += e.Length
+	}
+	return n
+}
+
+// End returns the end offset of the last extent, 0 without extents.
+func (s *Snapshot) End() int64 {
+	if len(s.Extents) == 0 {
+		return 0
+	}
+	last := s.Extents[len(s.Extents)-1]
+	return last.Offset + last.Length
+}
+
+// ReadAt reads the snapshot at an absolute file offset. Bytes outside the
+// extents read as zeros.
+func (s *Snapshot) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+	for done := 0; done < len(p); {
+		pos := off + int64(done)
+		idx, in := pos/PageSize, pos%PageSize
+		dst := p[done:min(len(p), done+int(PageSize-in))]
+		data, ok := s.pages[idx]
+		switch {
+		case ok && data != nil:
+			copy(dst, data[in:])
+		case ok:
+			if err := s.spill.readAt(dst, pos); err != nil {
+				return done, err
+			}
+		default:
+			clear(dst)
+		}
+		done += len(dst)
+	}
+	return len(p), nil
+}
+
+// Release frees the temporary file of a snapshot that copied spilled pages.
+func (s *Snapshot) Release() {
+	if s.spill != nil {
+		s.spill.close()
+		s.spill = nil
+	}
+}
+
+// clock orders page and buffer accesses for LRU eviction.
+var clock atomic.Uint64
+
+// page is one PageSize block of a buffer.
+type page struct {
+	data []byte        // nil while the page lives in the spill file
+	used atomic.Uint64 // clock tick of the last access
+}
+
+// FileBuffer holds the pages of a file that were written locally or fetched
+// from the server, keyed by page index, so sparse writes into large files
+// only cost memory for the pages they touch. A page is present once it is
+// in the map and dirty until an upload covering its last write committed.
+// Once the buffer outgrows the limits of its SpillPolicy its pages move to a
+// temporary file at their file offsets. Clean pages may be evicted under
+// memory pressure, see BufferCache.Reclaim.
 type FileBuffer struct {
-	BufferSnapshot
 	mu          sync.RWMutex
-	Dirty       bool
+	Dirty       bool // writes not yet handed to an upload
 	HandleCount int
+
+	// Truncated is set while a truncation to TruncSize waits for the remote
+	// file to be resized.
+	Truncated bool
+	TruncSize int64
+	truncSeq  uint64 // seq of the last truncation, see CommitTruncate
+
+	pages map[int64]*page
+	dirty map[int64]uint64 // page index -> seq of the write that dirtied it
+	seq   uint64
+	end   int64 // end offset of the buffered data
+	mem   int64 // bytes of page content kept in memory
+
+	policy *SpillPolicy // nil: never spill
+	spill  *spillFile
+	used   atomic.Uint64 // clock tick of the last access
+
+	pins   int    // active Pin calls
+	pinned uint64 // clock tick of the first active Pin
+
+	etag string // version of the remote file the buffer is based on
+
+	// modification time set for the file since it was last changed, zero
+	// if none; uploads keep it on the server
+	mtime time.Time
+}
+
+// touch records an access to p.
+func (fb *FileBuffer) touch(p *page) {
+	now := clock.Add(1)
+	p.used.Store(now)
+	fb.used.Store(now)
+}
+
+// spillToDisk moves the pages kept in memory to a temporary file. On failure
+// they stay in memory. Caller holds fb.mu.
+func (fb *FileBuffer) spillToDisk() error {
+	sf, err := newSpillFile(fb.policy.Dir, "buf-*.spill")
+	if err != nil {
+		return err
+	}
+	for idx, p := range fb.pages {
+		if _, err := sf.f.WriteAt(p.data, idx*PageSize); err != nil {
+			sf.close()
+			return err
+		}
+	}
+	for _, p := range fb.pages {
+		p.data = nil
+	}
+	fb.policy.account(-fb.mem)
+	fb.mem = 0
+	fb.spill = sf
+	return nil
+}
+
+// page returns page idx, adding a zeroed page if it is not present. Caller
+// holds fb.mu.
+func (fb *FileBuffer) page(idx int64) (p *page, created bool) {
+	if p, ok := fb.pages[idx]; ok {
+		return p, false
+	}
+	if fb.pages == nil {
+		fb.pages = make(map[int64]*page)
+	}
+	if fb.spill == nil && fb.policy.shouldSpill(fb.mem, fb.mem+PageSize) {
+		// clean pages can be fetched again, drop some before going to disk
+		if fb.evictLocked(max(PageSize, fb.mem/8)) == 0 {
+			_ = fb.spillToDisk()
+		}
+	}
+	p = &page{}
+	if fb.spill == nil {
+		p.data = make([]byte, PageSize)
+		fb.mem += PageSize
+		fb.policy.account(PageSize)
+	}
+	fb.pages[idx] = p
+	return p, true
+}
+
+// writePage stores src at in bytes into page idx. Caller holds fb.mu.
+func (fb *FileBuffer) writePage(idx int64, p *page, in int64, src []byte) error {
+	fb.touch(p)
+	if p.data != nil {
+		copy(p.data[in:], src)
+		return nil
+	}
+	_, err := fb.spill.f.WriteAt(src, idx*PageSize+in)
+	return err
+}
+
+// readPage copies page idx from in bytes into dst. Caller holds fb.mu.
+func (fb *FileBuffer) readPage(idx int64, p *page, in int64, dst []byte) error {
+	fb.touch(p)
+	if p.data != nil {
+		copy(dst, p.data[in:])
+		return nil
+	}
+	return fb.spill.readAt(dst, idx*PageSize+in)
+}
+
+// dropPage removes page idx. Caller holds fb.mu.
+func (fb *FileBuffer) dropPage(idx int64) {
+	if p, ok := fb.pages[idx]; ok && p.data != nil {
+		fb.mem -= PageSize
+		fb.policy.account(-PageSize)
+	}
+	delete(fb.pages, idx)
+	delete(fb.dirty, idx)
+}
+
+// evictClean drops clean pages kept in memory, least recently used first,
+// until at least want bytes were freed. Returns the bytes freed.
+func (fb *FileBuffer) evictClean(want int64) int64 {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return fb.evictLocked(want)
+}
+
+// evictLocked is evictClean for callers holding fb.mu. Pages touched since
+// the buffer was pinned are kept.
+func (fb *FileBuffer) evictLocked(want int64) int64 {
+	var idxs []int64
+	for idx, p := range fb.pages {
+		if _, dirty := fb.dirty[idx]; dirty || p.data == nil {
+			continue
+		}
+		if fb.pins > 0 && p.used.Load() > fb.pinned {
+			continue
+		}
+		idxs = append(idxs, idx)
+	}
+	slices.SortFunc(idxs, func(a, b int64) int {
+		return cmp.Compare(fb.pages[a].used.Load(), fb.pages[b].used.Load())
+	})
+
+	var freed int64
+	for _, idx := range idxs {
+		if freed >= want {
+			break
+		}
+		fb.dropPage(idx)
+		freed += PageSize
+	}
+	return freed
+}
+
+// Pin keeps the pages touched from now on until the matching Unpin, so data
+// fetched for a read or a partial write is not evicted before it was used.
+func (fb *FileBuffer) Pin() {
+	fb.mu.Lock()
+	if fb.pins == 0 {
+		fb.pinned = clock.Load()
+	}
+	fb.pins++
+	fb.mu.Unlock()
+}
+
+func (fb *FileBuffer) Unpin() {
+	fb.mu.Lock()
+	if fb.pins > 0 {
+		fb.pins--
+	}
+	fb.mu.Unlock()
+}
+
+// LastUse returns the clock tick of the last access to the buffer.
+func (fb *FileBuffer) LastUse() uint64 {
+	return fb.used.Load()
+}
+
+// write stores data at offset page by page. With remote set, pages that are
+// already present are left alone and new pages stay clean. Caller holds
+// fb.mu.
+func (fb *FileBuffer) write(offset int64, data []byte, remote bool) error {
+	if !remote {
+		fb.mtime = time.Time{}
+		fb.seq++
+		if fb.dirty == nil {
+			fb.dirty = make(map[int64]uint64)
+		}
+	}
+	for done := 0; done < len(data); {
+		pos := offset + int64(done)
+		idx, in := pos/PageSize, pos%PageSize
+		src := data[done:min(len(data), done+int(PageSize-in))]
+		done += len(src)
+
+		p, created := fb.page(idx)
+		if remote && !created {
+			continue
+		}
+		if err := fb.writePage(idx, p, in, src); err != nil {
+			if created {
+				fb.dropPage(idx)
+			}
+			return err
+		}
+		if !remote {
+			fb.dirty[idx] = fb.seq
+		}
+	}
+	fb.end = max(fb.end, offset+int64(len(data)))
+	return nil
+}
+
+// TakeSnapshot copies the dirty pages for an upload and clears the Dirty
+// flag in one step, so writes that land after the snapshot make the buffer
+// dirty again. The pages stay dirty until MarkCommitted confirms the upload.
+// The caller must Release the snapshot.
+func (fb *FileBuffer) TakeSnapshot() (*Snapshot, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	snap := &Snapshot{
+		Seq:       fb.seq,
+		Truncated: fb.Truncated,
+		TruncSize: fb.TruncSize,
+		ModTime:   fb.mtime,
+		pages:     make(map[int64][]byte, len(fb.dirty)),
+	}
+	idxs := slices.Sorted(maps.Keys(fb.dirty))
+	for _, idx := range idxs {
+		if data := fb.pages[idx].data; data != nil {
+			snap.pages[idx] = slices.Clone(data)
+			continue
+		}
+		if snap.spill == nil {
+			sf, err := newSpillFile(fb.policy.Dir, "snap-*.spill")
+			if err != nil {
+				return nil, err
+			}
+			snap.spill = sf
+		}
+		buf := make([]byte, PageSize)
+		err := fb.spill.readAt(buf, idx*PageSize)
+		if err == nil {
+			_, err = snap.spill.f.WriteAt(buf, idx*PageSize)
+		}
+		if err != nil {
+			snap.Release()
+			return nil, err
+		}
+		snap.pages[idx] = nil
+	}
+
+	// runs of consecutive dirty pages form the extents, the last one ends
+	// with the buffered data
+	for i := 0; i < len(idxs); {
+		j := i + 1
+		for j < len(idxs) && idxs[j] == idxs[j-1]+1 {
+			j++
+		}
+		start := idxs[i] * PageSize
+		end := min((idxs[j-1]+1)*PageSize, fb.end)
+		if end > start {
+			snap.Extents = append(snap.Extents, Extent{Offset: start, Length: end - start})
+		}
+		i = j
+	}
+
+	fb.Dirty = false
+	return snap, nil
+}
+
+// MarkCommitted cleans the pages covered by an upload of the snapshot taken
+// at seq. Pages written after the snapshot stay dirty.
+func (fb *FileBuffer) MarkCommitted(seq uint64) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	for idx, s := range fb.dirty {
+		if s <= seq {
+			delete(fb.dirty, idx)
+		}
+	}
+}
+
+// ETag returns the version of the remote file the buffer is based on, ""
+// if it is not known.
+func (fb *FileBuffer) ETag() string {
+	fb.mu.RLock()
+	defer fb.mu.RUnlock()
+	return fb.etag
+}
+
+// SetETag records the version of the remote file the buffer matches, e.g.
+// the one an upload produced.
+func (fb *FileBuffer) SetETag(etag string) {
+	fb.mu.Lock()
+	fb.etag = etag
+	fb.mu.Unlock()
+}
+
+// Revalidate records the version of the remote file seen when a handle was
+// opened. A buffer without uncommitted changes adopts it and drops the pages
+// cached from an older version. One with changes keeps the version they are
+// based on, so their upload detects the conflict.
+func (fb *FileBuffer) Revalidate(etag string) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	if etag == "" || etag == fb.etag {
+		return
+	}
+	if fb.etag != "" {
+		if fb.Dirty || fb.Truncated || len(fb.dirty) > 0 {
+			return
+		}
+		fb.discardClean()
+	}
+	fb.etag = etag
+}
+
+// DiscardClean drops every clean page, in memory or spilled, e.g. after the
+// remote file was replaced by a version they do not belong to.
+func (fb *FileBuffer) DiscardClean() {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.discardClean()
+}
+
+// discardClean is DiscardClean for callers holding fb.mu.
+func (fb *FileBuffer) discardClean() {
+	var zeros []byte
+	top := int64(0) // end of the last page kept
+	for idx, p := range fb.pages {
+		if _, dirty := fb.dirty[idx]; dirty {
+			top = max(top, (idx+1)*PageSize)
+			continue
+		}
+		// a page created here later must not see the old content
+		if p.data == nil && fb.spill != nil {
+			if zeros == nil {
+				zeros = make([]byte, PageSize)
+			}
+			_, _ = fb.spill.f.WriteAt(zeros, idx*PageSize)
+		}
+		fb.dropPage(idx)
+	}
+	fb.end = min(fb.end, top)
 }
 
-func (fb *FileBuffer) BasePos() int64 {
+// Truncate drops the pages past size and remembers the new length until
+// CommitTruncate confirms that the remote file was resized. An extension
+// only records the size: no page or spill space is taken for the zeros,
+// absent pages read as zeros.
+func (fb *FileBuffer) Truncate(size int64) error {
+	if size < 0 {
+		return ErrNegativeLength
+	}
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	last, in := size/PageSize, size%PageSize
+	top := int64(0) // end of the last page kept
+	for idx := range fb.pages {
+		if idx > last || idx == last && in == 0 {
+			fb.dropPage(idx)
+			continue
+		}
+		top = max(top, (idx+1)*PageSize)
+	}
+	// the cut off part of the last page reads as zeros once the file grows
+	if p, ok := fb.pages[last]; ok && p.data != nil {
+		clear(p.data[in:])
+	}
+	if fb.spill != nil {
+		// never grown: the spill file only holds the kept pages
+		if err := fb.spill.f.Truncate(min(size, top)); err != nil {
+			return err
+		}
+	}
+	fb.end = min(fb.end, size, top)
+
+	fb.seq++
+	fb.truncSeq = fb.seq
+	fb.Truncated = true
+	fb.TruncSize = size
+	fb.Dirty = true
+	fb.mtime = time.Time{}
+	return nil
+}
+
+// SetModTime sets the modification time uploads give the file until it is
+// written to again.
+func (fb *FileBuffer) SetModTime(t time.Time) {
+	fb.mu.Lock()
+	fb.mtime = t
+	fb.mu.Unlock()
+}
+
+// ModTime returns the modification time set with SetModTime, zero if the
+// file was written to since or it was not set.
+func (fb *FileBuffer) ModTime() time.Time {
 	fb.mu.RLock()
 	defer fb.mu.RUnlock()
-	return fb.Base
+	return fb.mtime
 }
 
-func (fb *FileBuffer) CopyBuffer() *BufferSnapshot {
+// Truncation returns the pending truncation size, if any.
+func (fb *FileBuffer) Truncation() (int64, bool) {
 	fb.mu.RLock()
 	defer fb.mu.RUnlock()
-	if len(fb.Data) == 0 {
-		return &BufferSnapshot{Data: nil, Base: fb.Base, Mask: nil}
-	}
-	cp := make([]byte, len(fb.Data))
-	copy(cp, fb.Data)
-	return &BufferSnapshot{Data: cp, Base: fb.Base, Mask: fb.Mask}
+	return fb.TruncSize, fb.Truncated
 }
 
-func (fb *FileBuffer) SetBase(b int64) {
+// CommitTruncate clears a pending truncation after an upload of the
+// snapshot taken at seq resized the remote file. A truncation made after
+// the snapshot stays pending, even to the same size.
+func (fb *FileBuffer) CommitTruncate(seq uint64) {
 	fb.mu.Lock()
 	defer fb.mu.Unlock()
-	fb.Base = b
+	if fb.Truncated && fb.truncSeq <= seq {
+		fb.Truncated = false
+		fb.TruncSize = 0
+	}
 }
 
+// ReadAt returns length bytes from offset. Pages that are not present read
+// as zeros; reading past the buffered data fails with ErrOutOfBounds.
 func (fb *FileBuffer) ReadAt(offset int64, length int) ([]byte, error) {
 	if length < 0 {
 		return nil, ErrNegativeLength
 	}
-	fb.mu.RLock()
-	defer fb.mu.RUnlock()
-
 	if offset < 0 {
 		return nil, ErrNegativeOffset
 	}
-	end := offset + int64(length)
-	if end > int64(len(fb.Data)) {
+	fb.mu.RLock()
+	defer fb.mu.RUnlock()
+
+	if offset+int64(length) > fb.end {
 		return nil, ErrOutOfBounds
 	}
-
 	out := make([]byte, length)
-	copy(out, fb.Data[offset:end])
+	for done := 0; done < length; {
+		pos := offset + int64(done)
+		idx, in := pos/PageSize, pos%PageSize
+		dst := out[done:min(length, done+int(PageSize-in))]
+		if p, ok := fb.pages[idx]; ok {
+			if err := fb.readPage(idx, p, in, dst); err != nil {
+				return nil, err
+			}
+		}
+		done += len(dst)
+	}
 	return out, nil
 }
 
+// ReadInto copies the buffered bytes at the absolute file offset into dst
+// and returns how many contiguous bytes were present.
+func (fb *FileBuffer) ReadInto(dst []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, ErrNegativeOffset
+	}
+	fb.mu.RLock()
+	defer fb.mu.RUnlock()
+
+	n := int(min(int64(len(dst)), fb.end-offset))
+	done := 0
+	for done < n {
+		pos := offset + int64(done)
+		idx, in := pos/PageSize, pos%PageSize
+		p, ok := fb.pages[idx]
+		if !ok {
+			break
+		}
+		part := dst[done:min(n, done+int(PageSize-in))]
+		if err := fb.readPage(idx, p, in, part); err != nil {
+			return 0, err
+		}
+		done += len(part)
+	}
+	return done, nil
+}
+
+// Present reports whether the absolute range [offset, offset+length) is
+// held by the buffer.
+func (fb *FileBuffer) Present(offset, length int64) bool {
+	if offset < 0 || length <= 0 {
+		return false
+	}
+	fb.mu.RLock()
+	defer fb.mu.RUnlock()
+	if offset+length > fb.end {
+		return false
+	}
+	for idx := offset / PageSize; idx*PageSize < offset+length; idx++ {
+		p, ok := fb.pages[idx]
+		if !ok {
+			return false
+		}
+		fb.touch(p)
+	}
+	return true
+}
+
 func (fb *FileBuffer) String() string {
 	fb.mu.RLock()
 	defer fb.mu.RUnlock()
-	return fmt.Sprintf("Buffer: dirty=%v base=%d len=%d", fb.Dirty, fb.Base, len(fb.Data))
+	return fmt.Sprintf("Buffer: dirty=%v pages=%d dirty_pages=%d end=%d spilled=%v", fb.Dirty, len(fb.pages), len(fb.dirty), fb.end, fb.spill != nil)
 }
 
-// WriteAt writes data at the given offset, growing the buffer if needed.
-// It sets the Dirty flag.
+// WriteAt writes data at the given offset, adding pages as needed. The
+// touched pages and the buffer become dirty.
 func (fb *FileBuffer) WriteAt(offset int64, data []byte) error {
 	if len(data) == 0 {
 		return nil
@@ -87,59 +631,16 @@ func (fb *FileBuffer) WriteAt(offset int64, data []byte) error {
 	fb.mu.Lock()
 	defer fb.mu.Unlock()
 
-	// no data yet, create new buffer
-	if len(fb.Data) == 0 {
-		fb.Base = offset
-		fb.Data = make([]byte, len(data))
-		copy(fb.Data, data)
-		fb.Mask = make(Mask, maskSize(int64(len(data))))
-		fb.Mask.smearPages(0, int64(len(data)))
-		fb.Dirty = true
-		return nil
-	}
-
-	// if offset is within current data range
-	relStart := offset - fb.Base
-
-	// within current data
-	if relStart >= 0 {
-		// calculate end within buffer
-		end := relStart + int64(len(data))
-		if end > int64(len(fb.Data)) {
-			// grow if new end exceeds current size
-			newData := make([]byte, end)
-			copy(newData, fb.Data)
-			fb.Data = newData
-		}
-		fb.Mask.smearPages(relStart, end)
-		copy(fb.Data[relStart:end], data)
-		fb.Dirty = true
-		return nil
+	if err := fb.write(offset, data, false); err != nil {
+		return err
 	}
-
-	// relStart < 0: incoming write starts before current base; prepend.
-	// Calculate how many bytes we need to prepend.
-	prepend := int64(0 - relStart)
-	newLen := prepend + int64(len(fb.Data))
-	newData := make([]byte, newLen)
-	// copy incoming data at offset 0
-	copy(newData[0:len(data)], data)
-	// copy existing data after the prepend region
-	copy(newData[prepend:newLen], fb.Data)
-
-	fb.Mask = fb.Mask.shiftedRight(prepend, int64(len(newData)))
-	fb.Mask.smearPages(0, int64(len(data)))
-
-	fb.Base = offset
-	fb.Data = newData
 	fb.Dirty = true
 	return nil
 }
 
 // WriteRemoteAt writes data fetched from remote into the buffer but does not
 // mark the buffer as dirty. It will not overwrite pages that are already
-// present (mask indicates presence) — only pages that are not marked will
-// be populated.
+// present — only pages that are missing will be populated.
 func (fb *FileBuffer) WriteRemoteAt(offset int64, data []byte) error {
 	if len(data) == 0 {
 		return nil
@@ -147,91 +648,58 @@ func (fb *FileBuffer) WriteRemoteAt(offset int64, data []byte) error {
 	if offset < 0 {
 		return ErrNegativeOffset
 	}
-
 	fb.mu.Lock()
 	defer fb.mu.Unlock()
-
-	// no data yet, create new buffer and mark presence for incoming data
-	if len(fb.Data) == 0 {
-		fb.Base = offset
-		fb.Data = make([]byte, len(data))
-		copy(fb.Data, data)
-		fb.Mask = make(Mask, maskSize(int64(len(data))))
-		fb.Mask.smearPages(0, int64(len(data)))
-		return nil
-	}
-
-	relStart := offset - fb.Base
-
-	// if write starts within current data
-	if relStart >= 0 {
-		end := relStart + int64(len(data))
-		if end > int64(len(fb.Data)) {
-			newData := make([]byte, end)
-			copy(newData, fb.Data)
-			fb.Data = newData
-		}
-
-		startPageIdx := relStart >> 12
-		endPageIdx := (end + PageSize - 1) >> 12
-
-		for pageIdx := startPageIdx; pageIdx < endPageIdx; pageIdx++ {
-			pageStart := pageIdx << 12
-			pageEnd := pageStart + PageSize
-
-			writeStart := max(pageStart, relStart)
-			writeEnd := min(pageEnd, end)
-			if writeEnd <= writeStart {
-				continue
-			}
-
-			// page index is relative to buffer (since relStart is relative)
-			if fb.Mask.IsDirtyPage(pageIdx) {
-				// already present/dirty: skip this page
-				continue
-			}
-
-			srcStart := int(writeStart - relStart)
-			dstStart := int(writeStart)
-			copy(fb.Data[dstStart:dstStart+int(writeEnd-writeStart)], data[srcStart:srcStart+int(writeEnd-writeStart)])
-			fb.Mask.smearPages(writeStart, writeEnd-writeStart)
-		}
-		return nil
-	}
-
-	// prepend case: incoming data starts before current base
-	prepend := int64(0 - relStart)
-	newLen := prepend + int64(len(fb.Data))
-	newData := make([]byte, newLen)
-	copy(newData[0:len(data)], data)
-	copy(newData[prepend:newLen], fb.Data)
-
-	fb.Mask = fb.Mask.shiftedRight(prepend, int64(len(newData)))
-	fb.Mask.smearPages(0, int64(len(data)))
-	fb.Base = offset
-	fb.Data = newData
-	return nil
+	return fb.write(offset, data, true)
 }
 
 func (fb *FileBuffer) Clear() {
 	fb.mu.Lock()
-	fb.Data = nil
+	if fb.spill != nil {
+		fb.spill.close()
+		fb.spill = nil
+	}
+	fb.policy.account(-fb.mem)
+	fb.mem = 0
+	fb.pages = nil
+	fb.dirty = nil
+	fb.end = 0
 	fb.Dirty = false
-	fb.Mask.clear()
+	fb.Truncated = false
+	fb.TruncSize = 0
 	fb.mu.Unlock()
 }
 
+// IsValidAt reports whether the page holding byte i is present.
 func (fb *FileBuffer) IsValidAt(i int64) bool {
-	if i < fb.Base || i >= fb.Base+int64(len(fb.Data)) {
+	fb.mu.RLock()
+	defer fb.mu.RUnlock()
+	if i < 0 || i >= fb.end {
 		return false
 	}
-	return fb.Mask.IsDirty(i - fb.Base)
+	_, ok := fb.pages[i/PageSize]
+	return ok
 }
 
+// Size returns the end offset of the buffered data.
 func (fb *FileBuffer) Size() int64 {
 	fb.mu.RLock()
 	defer fb.mu.RUnlock()
-	return int64(len(fb.Data))
+	return fb.end
+}
+
+// Pages returns the number of present pages.
+func (fb *FileBuffer) Pages() int {
+	fb.mu.RLock()
+	defer fb.mu.RUnlock()
+	return len(fb.pages)
+}
+
+// Spilled reports whether the pages live in a temporary file.
+func (fb *FileBuffer) Spilled() bool {
+	fb.mu.RLock()
+	defer fb.mu.RUnlock()
+	return fb.spill != nil
 }
 
 func (fb *FileBuffer) MarkClean() {
@@ -240,6 +708,27 @@ func (fb *FileBuffer) MarkClean() {
 	fb.mu.Unlock()
 }
 
+// MarkDirty flags the buffer as holding data the server has not seen, e.g.
+// after an upload of a snapshot failed.
+func (fb *FileBuffer) MarkDirty() {
+	fb.mu.Lock()
+	fb.Dirty = true
+	fb.mu.Unlock()
+}
+
+func (fb *FileBuffer) IsDirty() bool {
+	fb.mu.RLock()
+	defer fb.mu.RUnlock()
+	return fb.Dirty
+}
+
+// Idle reports whether no handle uses the buffer and it holds no dirty data.
+func (fb *FileBuffer) Idle() bool {
+	fb.mu.RLock()
+	defer fb.mu.RUnlock()
+	return fb.HandleCount == 0 && !fb.Dirty
+}
+
 func (fb *FileBuffer) IncHandle() {
 	fb.mu.Lock()
 	fb.HandleCount++
@@ -253,14 +742,3 @@ func (fb *FileBuffer) DecHandle() {
 	}
 	fb.mu.Unlock()
 }
-
-func (fb *FileBuffer) DirtyRange(start, length int64) bool {
-	fb.mu.RLock()
-	defer fb.mu.RUnlock()
-	for i := start; i < start+length; i++ {
-		if !fb.Mask.IsDirty(i) {
-			return false
-		}
-	}
-	return true
-}
@@ -1,7 +1,10 @@
 package cache
 
 import (
+	"bytes"
+	"io"
 	"testing"
+	"time"
 )
 
 func TestFileBuffer_WriteAppendRead(t *testing.T) {
@@ -14,15 +17,11 @@ func TestFileBuffer_WriteAppendRead(t *testing.T) {
 		t.Fatalf("WriteAt(4,A) failed: %v", err)
 	}
 
-	cp := fb.CopyBuffer()
-	if fb.Base != 0 {
-		t.Fatalf("CopyBuffer base: want 0 got %d", fb.Base)
-	}
-	if string(cp.Data) != "BASEA" {
-		t.Fatalf("buffer content: want %q got %q", "BASEA", string(cp.Data))
+	if fb.Size() != 5 {
+		t.Fatalf("size: want 5 got %d", fb.Size())
 	}
 
-	// Validate mask bits
+	// Validate presence
 	for i := int64(0); i < 5; i++ {
 		if !fb.IsValidAt(i) {
 			t.Fatalf("expected valid bit at %d", i)
@@ -39,37 +38,22 @@ func TestFileBuffer_WriteAppendRead(t *testing.T) {
 	}
 }
 
-func TestFileBuffer_PrependBehavior(t *testing.T) {
+func TestFileBuffer_WriteBeforeExisting(t *testing.T) {
 	var fb FileBuffer
 
 	if err := fb.WriteAt(4, []byte("X")); err != nil {
 		t.Fatalf("initial WriteAt failed: %v", err)
 	}
-
-	if fb.Base != 4 {
-		t.Fatalf("initial base: want 4 got %d", fb.Base)
-	}
-	if len(fb.Data) != 1 || fb.Data[0] != 'X' {
-		t.Fatalf("initial data: want %q got %q", "X", string(fb.Data))
-	}
-
 	if err := fb.WriteAt(0, []byte("BASE")); err != nil {
-		t.Fatalf("prepend WriteAt failed: %v", err)
+		t.Fatalf("WriteAt before existing data failed: %v", err)
 	}
 
-	cp := fb.CopyBuffer()
-	if fb.Base != 0 {
-		t.Fatalf("after prepend base: want 0 got %d", fb.Base)
+	out, err := fb.ReadAt(0, 5)
+	if err != nil || string(out) != "BASEX" {
+		t.Fatalf("content: want %q got %q (err=%v)", "BASEX", out, err)
 	}
-	if string(cp.Data) != "BASEX" {
-		t.Fatalf("after prepend content: want %q got %q", "BASEX", string(cp.Data))
-	}
-
-	// mask: indices 0..4 should be valid (0..3 from BASE, 4 from X)
-	for i := int64(0); i <= 4; i++ {
-		if !fb.IsValidAt(i) {
-			t.Fatalf("expected valid bit at %d after prepend", i)
-		}
+	if fb.Pages() != 1 {
+		t.Fatalf("pages: want 1 got %d", fb.Pages())
 	}
 }
 
@@ -83,48 +67,114 @@ func TestFileBuffer_OverwriteWithin(t *testing.T) {
 	if err := fb.WriteAt(1, []byte("i")); err != nil {
 		t.Fatalf("WriteAt overwrite failed: %v", err)
 	}
-	cp := fb.CopyBuffer()
-	if string(cp.Data) != "HiLLO" {
-		t.Fatalf("overwrite result: want %q got %q", "HiLLO", string(cp.Data))
+	out, _ := fb.ReadAt(0, 5)
+	if string(out) != "HiLLO" {
+		t.Fatalf("overwrite result: want %q got %q", "HiLLO", string(out))
 	}
-	// mask should mark first 4 bytes valid
-	for i := range int64(5) {
-		if !fb.IsValidAt(i) {
-			t.Fatalf("expected valid bit at %d after overwrite", i)
-		}
+}
+
+func TestFileBuffer_SparseWrites(t *testing.T) {
+	var fb FileBuffer
+
+	const far = 8 << 30 // 8 GB
+	if err := fb.WriteAt(0, []byte("head")); err != nil {
+		t.Fatalf("WriteAt(0) failed: %v", err)
+	}
+	if err := fb.WriteAt(far, []byte("tail")); err != nil {
+		t.Fatalf("WriteAt(8GB) failed: %v", err)
+	}
+
+	// only the two touched pages are allocated
+	if fb.Pages() != 2 || fb.mem != 2*PageSize {
+		t.Fatalf("pages: want 2 (%d bytes) got %d (%d bytes)", 2*PageSize, fb.Pages(), fb.mem)
+	}
+	if fb.Size() != far+4 {
+		t.Fatalf("size: want %d got %d", far+4, fb.Size())
+	}
+	if fb.IsValidAt(PageSize) || fb.Present(0, 2*PageSize) {
+		t.Fatalf("gap between the writes must not be present")
+	}
+
+	dst := make([]byte, 8)
+	if n, err := fb.ReadInto(dst, far); err != nil || n != 4 || string(dst[:n]) != "tail" {
+		t.Fatalf("ReadInto at 8GB: n=%d err=%v got %q", n, err, dst[:n])
+	}
+	// reading stops at the first missing page
+	big := make([]byte, 2*PageSize)
+	if n, _ := fb.ReadInto(big, 0); n != PageSize {
+		t.Fatalf("ReadInto over the gap: want %d got %d", PageSize, n)
 	}
 }
 
-func TestFileBuffer_PartialMaskGap(t *testing.T) {
+func TestFileBuffer_RemoteKeepsLocalPages(t *testing.T) {
 	var fb FileBuffer
 
-	// create a small sparse buffer: write at offsets 5 and 7
-	if err := fb.WriteAt(5, []byte("A")); err != nil {
-		t.Fatalf("WriteAt(5,A) failed: %v", err)
+	if err := fb.WriteAt(PageSize, []byte("local")); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
 	}
-	if err := fb.WriteAt(7, []byte("B")); err != nil {
-		t.Fatalf("WriteAt(7,B) failed: %v", err)
+	remote := bytes.Repeat([]byte("r"), 3*PageSize)
+	if err := fb.WriteRemoteAt(0, remote); err != nil {
+		t.Fatalf("WriteRemoteAt failed: %v", err)
 	}
 
-	cp := fb.CopyBuffer()
-	if fb.Base != 5 {
-		t.Fatalf("sparse base: want 5 got %d", fb.Base)
+	out, _ := fb.ReadAt(0, 3*PageSize)
+	if out[0] != 'r' || string(out[PageSize:PageSize+5]) != "local" || out[PageSize+5] != 0 || out[2*PageSize] != 'r' {
+		t.Fatalf("remote data overwrote the local page")
 	}
-	// expected internal data layout: indices 0:'A',1:0,2:'B' -> length 3
-	if len(cp.Data) != 3 {
-		t.Fatalf("sparse data length: want 3 got %d", len(cp.Data))
+	if !fb.Present(0, 3*PageSize) {
+		t.Fatalf("expected all pages present")
 	}
-	if cp.Data[0] != 'A' || cp.Data[1] != 0 || cp.Data[2] != 'B' {
-		t.Fatalf("sparse data content: want [%q,0,%q] got [%q,%d,%q]",
-			'A', 'B', cp.Data[0], cp.Data[1], cp.Data[2])
+
+	// only the locally written page goes to the upload
+	snap, err := fb.TakeSnapshot()
+	if err != nil {
+		t.Fatalf("TakeSnapshot failed: %v", err)
 	}
+	defer snap.Release()
+	if len(snap.Extents) != 1 || snap.Extents[0] != (Extent{Offset: PageSize, Length: PageSize}) {
+		t.Fatalf("extents: got %+v", snap.Extents)
+	}
+}
 
-	// mask: only offsets 0 and 2 (absolute 5 and 7) should be valid
-	// mask: with page-based mask implementation bytes within the same page
-	// (absolute offsets base..base+2) will all be considered valid
-	if !fb.IsValidAt(fb.Base+0) || !fb.IsValidAt(fb.Base+1) || !fb.IsValidAt(fb.Base+2) {
-		t.Fatalf("sparse mask (page-granular): expected [true,true,true], got [%v,%v,%v]",
-			fb.IsValidAt(fb.Base+0), fb.IsValidAt(fb.Base+1), fb.IsValidAt(fb.Base+2))
+func TestFileBuffer_SnapshotExtents(t *testing.T) {
+	var fb FileBuffer
+
+	_ = fb.WriteAt(0, bytes.Repeat([]byte("a"), PageSize+1))
+	_ = fb.WriteAt(5*PageSize, []byte("end"))
+
+	snap, err := fb.TakeSnapshot()
+	if err != nil {
+		t.Fatalf("TakeSnapshot failed: %v", err)
+	}
+	want := []Extent{{Offset: 0, Length: 2 * PageSize}, {Offset: 5 * PageSize, Length: 3}}
+	if len(snap.Extents) != 2 || snap.Extents[0] != want[0] || snap.Extents[1] != want[1] {
+		t.Fatalf("extents: want %+v got %+v", want, snap.Extents)
+	}
+	if fb.IsDirty() {
+		t.Fatalf("snapshot must clear the dirty flag")
+	}
+
+	got, err := io.ReadAll(io.NewSectionReader(snap, 5*PageSize, 3))
+	if err != nil || string(got) != "end" {
+		t.Fatalf("snapshot read: got %q err=%v", got, err)
+	}
+
+	// writes after the snapshot survive its commit
+	_ = fb.WriteAt(5*PageSize, []byte("new"))
+	fb.MarkCommitted(snap.Seq)
+	next, _ := fb.TakeSnapshot()
+	if len(next.Extents) != 1 || next.Extents[0] != want[1] {
+		t.Fatalf("extents after commit: want %+v got %+v", want[1:], next.Extents)
+	}
+
+	// a failed upload leaves its pages dirty for the next snapshot
+	again, _ := fb.TakeSnapshot()
+	if len(again.Extents) != 1 {
+		t.Fatalf("uncommitted pages lost: %+v", again.Extents)
+	}
+	fb.MarkCommitted(again.Seq)
+	if last, _ := fb.TakeSnapshot(); len(last.Extents) != 0 {
+		t.Fatalf("expected no extents after commit, got %+v", last.Extents)
 	}
 }
 
@@ -147,7 +197,191 @@ func TestFileBuffer_ClearAndBounds(t *testing.T) {
 	if fb.IsValidAt(0) {
 		t.Fatalf("after Clear expected no valid bits")
 	}
-	if buf := fb.CopyBuffer(); buf != nil {
-		t.Fatalf("after Clear expected nil buffer copy, got len %d", len(buf.Data))
+	if fb.Pages() != 0 || fb.Present(0, 1) {
+		t.Fatalf("after Clear expected no pages, got %d", fb.Pages())
+	}
+}
+
+func TestFileBuffer_TruncateShrinkAndExtend(t *testing.T) {
+	var fb FileBuffer
+
+	data := make([]byte, 3*PageSize)
+	for i := range data {
+		data[i] = 'x'
+	}
+	if err := fb.WriteAt(0, data); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	fb.MarkClean()
+
+	if err := fb.Truncate(PageSize + 10); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if fb.Size() != PageSize+10 {
+		t.Fatalf("after shrink size: want %d got %d", PageSize+10, fb.Size())
+	}
+	if !fb.IsDirty() {
+		t.Fatalf("truncate must mark the buffer dirty")
+	}
+	if !fb.IsValidAt(PageSize) || fb.IsValidAt(2*PageSize) || fb.Pages() != 2 {
+		t.Fatalf("pages after shrink: want page 1 kept and page 2 dropped")
+	}
+	if size, ok := fb.Truncation(); !ok || size != PageSize+10 {
+		t.Fatalf("truncation: want (%d,true) got (%d,%v)", PageSize+10, size, ok)
+	}
+	first, err := fb.TakeSnapshot()
+	if err != nil {
+		t.Fatalf("TakeSnapshot failed: %v", err)
+	}
+	first.Release()
+
+	// extending only records the size, the data stays as it is
+	if err := fb.Truncate(10 * PageSize); err != nil {
+		t.Fatalf("Truncate extend failed: %v", err)
+	}
+	snap, err := fb.TakeSnapshot()
+	if err != nil {
+		t.Fatalf("TakeSnapshot failed: %v", err)
+	}
+	if !snap.Truncated || snap.TruncSize != 10*PageSize || snap.Len() != PageSize+10 {
+		t.Fatalf("snapshot: got truncated=%v size=%d len=%d", snap.Truncated, snap.TruncSize, snap.Len())
+	}
+
+	// the cut off part of the last page does not come back
+	_ = fb.WriteAt(PageSize+20, []byte("y"))
+	out, _ := fb.ReadAt(PageSize+9, 12)
+	if out[0] != 'x' || out[1] != 0 || out[10] != 0 || out[11] != 'y' {
+		t.Fatalf("stale bytes after shrink and extend: %q", out)
+	}
+
+	// an older commit does not clear the newer truncation
+	fb.CommitTruncate(first.Seq)
+	if _, ok := fb.Truncation(); !ok {
+		t.Fatalf("older commit cleared pending truncation")
+	}
+	fb.CommitTruncate(snap.Seq)
+	if _, ok := fb.Truncation(); ok {
+		t.Fatalf("truncation still pending after commit")
+	}
+}
+
+func TestFileBuffer_RepeatedTruncateStaysPending(t *testing.T) {
+	var fb FileBuffer
+
+	_ = fb.Truncate(0)
+	_ = fb.WriteAt(0, []byte("abc"))
+	s1, err := fb.TakeSnapshot()
+	if err != nil {
+		t.Fatalf("TakeSnapshot failed: %v", err)
+	}
+	s1.Release()
+
+	// truncated again to the same size while s1 is uploaded
+	_ = fb.Truncate(0)
+	_ = fb.WriteAt(0, []byte("x"))
+	fb.MarkCommitted(s1.Seq)
+	fb.CommitTruncate(s1.Seq)
+
+	s2, err := fb.TakeSnapshot()
+	if err != nil {
+		t.Fatalf("TakeSnapshot failed: %v", err)
+	}
+	defer s2.Release()
+	if !s2.Truncated || s2.TruncSize != 0 {
+		t.Fatalf("second truncation lost: truncated=%v size=%d", s2.Truncated, s2.TruncSize)
+	}
+	if len(s2.Extents) != 1 || s2.Extents[0] != (Extent{Offset: 0, Length: 1}) {
+		t.Fatalf("extents: %+v", s2.Extents)
+	}
+}
+
+func TestFileBuffer_TruncateBelowData(t *testing.T) {
+	var fb FileBuffer
+
+	if err := fb.WriteAt(2*PageSize, []byte("tail")); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := fb.Truncate(100); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if fb.Size() != 0 || fb.Pages() != 0 {
+		t.Fatalf("after truncate below data: size=%d pages=%d", fb.Size(), fb.Pages())
+	}
+	snap, _ := fb.TakeSnapshot()
+	if len(snap.Extents) != 0 || !snap.Truncated {
+		t.Fatalf("snapshot after truncate: extents=%+v truncated=%v", snap.Extents, snap.Truncated)
+	}
+}
+
+func TestFileBuffer_Revalidate(t *testing.T) {
+	var fb FileBuffer
+
+	fb.Revalidate(`"v1"`)
+	_ = fb.WriteRemoteAt(0, bytes.Repeat([]byte("r"), 2*PageSize))
+
+	// the same version keeps the cached pages
+	fb.Revalidate(`"v1"`)
+	if fb.Pages() != 2 {
+		t.Fatalf("pages dropped for an unchanged version")
+	}
+
+	// local changes keep the version they are based on
+	_ = fb.WriteAt(PageSize, []byte("local"))
+	fb.Revalidate(`"v2"`)
+	if fb.ETag() != `"v1"` || fb.Pages() != 2 {
+		t.Fatalf("dirty buffer adopted a new version: etag=%s pages=%d", fb.ETag(), fb.Pages())
+	}
+
+	// once committed, a newer version drops the stale clean pages
+	snap, _ := fb.TakeSnapshot()
+	fb.MarkCommitted(snap.Seq)
+	fb.Revalidate(`"v2"`)
+	if fb.ETag() != `"v2"` || fb.Pages() != 0 || fb.Size() != 0 {
+		t.Fatalf("after revalidate: etag=%s pages=%d size=%d", fb.ETag(), fb.Pages(), fb.Size())
+	}
+}
+
+func TestFileBuffer_DiscardCleanKeepsDirty(t *testing.T) {
+	var fb FileBuffer
+
+	_ = fb.WriteRemoteAt(0, bytes.Repeat([]byte("r"), 3*PageSize))
+	_ = fb.WriteAt(0, []byte("mine"))
+	fb.DiscardClean()
+
+	if fb.Pages() != 1 || !fb.IsValidAt(0) || fb.Size() != PageSize {
+		t.Fatalf("after discard: pages=%d size=%d", fb.Pages(), fb.Size())
+	}
+}
+
+func TestFileBuffer_ModTimeUntilWritten(t *testing.T) {
+	var fb FileBuffer
+	if err := fb.WriteAt(0, []byte("data")); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	mtime := time.Unix(1500000000, 0)
+	fb.SetModTime(mtime)
+
+	snap, err := fb.TakeSnapshot()
+	if err != nil {
+		t.Fatalf("TakeSnapshot failed: %v", err)
+	}
+	defer snap.Release()
+	if !snap.ModTime.Equal(mtime) {
+		t.Fatalf("snapshot mtime %v, want %v", snap.ModTime, mtime)
+	}
+
+	// later changes take the time they are made
+	if err := fb.WriteAt(4, []byte("more")); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if !fb.ModTime().IsZero() {
+		t.Fatalf("mtime kept after a write")
+	}
+	fb.SetModTime(mtime)
+	if err := fb.Truncate(2); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if !fb.ModTime().IsZero() {
+		t.Fatalf("mtime kept after a truncation")
 	}
 }
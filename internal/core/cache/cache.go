@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"container/list"
 	"fmt"
 	"os"
 	"path"
@@ -12,6 +13,8 @@ import (
 const (
 	DefaultTTL        = time.Minute
 	DefaultMaxEntries = 1000
+	DefaultStale      = 10 * time.Minute
+	DefaultNegTTL     = 10 * time.Second
 )
 
 type CacheEntry struct {
@@ -19,12 +22,70 @@ type CacheEntry struct {
 	IsDir     bool
 	Children  []os.FileInfo
 	ExpiresAt time.Time
+
+	// ETag identifies the version the entry was read from: the getetag of a
+	// file, the collection tag of a listing. Entries with one stay around as
+	// stale after they expire, so they can be revalidated.
+	ETag string
+
+	// Missing marks a negative entry: the path did not exist.
+	Missing bool
 }
 
+// NodeCache caches file metadata and directory listings for ttl. It holds
+// at most maxEntries entries; past that the least recently used ones are
+// evicted. A negative maxEntries leaves the cache unbounded. Expired entries
+// with an ETag are kept for another stale period, see Stale. Paths known not
+// to exist are remembered for negTTL, see Missing.
 type NodeCache struct {
-	entries    sync.Map // map[string]*CacheEntry
+	mu         sync.Mutex
+	entries    map[string]*list.Element // values are *node
+	lru        list.List                // front: most recently used
 	ttl        time.Duration
+	stale      time.Duration
+	negTTL     time.Duration // 0: no negative caching
 	maxEntries int
+	persister  Persister // nil: entries live in memory only
+
+	hits, misses, evictions, expirations, revalidations, negHits uint64
+}
+
+type node struct {
+	key   string
+	entry *CacheEntry
+	saved string // ETag the persister holds for key, "" if none
+}
+
+// Persister keeps the entries that carry an ETag beyond the life of the
+// process, so a later mount can Restore them. It is called with the cache
+// locked and must not block; a persister that queues the changes can
+// implement Flusher to write them out.
+type Persister interface {
+	Put(path string, entry *CacheEntry)
+	Delete(path string)
+}
+
+// Flusher is implemented by persisters that queue changes. The sweeper
+// calls Flush, without the cache locked, after every sweep.
+type Flusher interface {
+	Flush() error
+}
+
+// CacheStats counts the lookups and removals of a NodeCache since it was
+// created.
+type CacheStats struct {
+	Entries       int
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64 // entries dropped to stay within maxEntries
+	Expirations   uint64 // entries dropped because their ttl passed
+	Revalidations uint64 // stale entries confirmed unchanged by the server
+	NegativeHits  uint64 // lookups answered as not existing
+}
+
+func (s CacheStats) String() string {
+	return fmt.Sprintf("entries=%d hits=%d misses=%d evictions=%d expirations=%d revalidations=%d negative-hits=%d",
+		s.Entries, s.Hits, s.Misses, s.Evictions, s.Expirations, s.Revalidations, s.NegativeHits)
 }
 
 // String implements fmt.Stringer and returns a concise summary.
@@ -36,25 +97,30 @@ func (c *NodeCache) String() string {
 // If maxKeys > 0 it includes up to that many entry keys in the output;
 // if maxKeys <= 0 it omits the keys and only prints counts/settings.
 func (c *NodeCache) Summary(maxKeys int) string {
-	total := 0
+	nodes := c.nodes()
 	keys := make([]string, 0, 8)
-
-	c.entries.Range(func(k, v any) bool {
-		total++
-		if maxKeys > 0 && len(keys) < maxKeys {
-			if ks, ok := k.(string); ok {
-				keys = append(keys, ks)
-			} else {
-				keys = append(keys, fmt.Sprintf("%v", k))
-			}
+	for _, n := range nodes {
+		if maxKeys <= 0 || len(keys) >= maxKeys {
+			break
 		}
-		return true
-	})
+		keys = append(keys, n.key)
+	}
 
 	if maxKeys > 0 {
-		return fmt.Sprintf("NodeCache{entries=%d, ttl=%s, maxEntries=%d, keys=%v}", total, c.ttl, c.maxEntries, keys)
+		return fmt.Sprintf("NodeCache{entries=%d, ttl=%s, maxEntries=%d, keys=%v}", len(nodes), c.ttl, c.maxEntries, keys)
 	}
-	return fmt.Sprintf("NodeCache{entries=%d, ttl=%s, maxEntries=%d}", total, c.ttl, c.maxEntries)
+	return fmt.Sprintf("NodeCache{entries=%d, ttl=%s, maxEntries=%d}", len(nodes), c.ttl, c.maxEntries)
+}
+
+// nodes returns the cached entries, most recently used first.
+func (c *NodeCache) nodes() []*node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	nodes := make([]*node, 0, c.lru.Len())
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		nodes = append(nodes, e.Value.(*node))
+	}
+	return nodes
 }
 
 // Format implements fmt.Formatter to support %#v / %+v friendly output.
@@ -63,20 +129,16 @@ func (c *NodeCache) Format(f fmt.State, verb rune) {
 	case 'v':
 		if f.Flag('+') || f.Flag('#') {
 			var b strings.Builder
-			fmt.Fprintf(&b, "NodeCache{entries=%d, ttl=%s, maxEntries=%d}\n", func() int {
-				cnt := 0
-				c.entries.Range(func(_, _ interface{}) bool { cnt++; return true })
-				return cnt
-			}(), c.ttl, c.maxEntries)
-
-			c.entries.Range(func(k, v interface{}) bool {
-				key, _ := k.(string)
-				fmt.Fprintf(&b, "Key: %s\n", key)
-
-				entry, ok := v.(*CacheEntry)
-				if !ok || entry == nil {
+			nodes := c.nodes()
+			fmt.Fprintf(&b, "NodeCache{entries=%d, ttl=%s, maxEntries=%d}\n", len(nodes), c.ttl, c.maxEntries)
+
+			for _, n := range nodes {
+				fmt.Fprintf(&b, "Key: %s\n", n.key)
+
+				entry := n.entry
+				if entry == nil {
 					fmt.Fprintln(&b, "  <invalid or nil entry>")
-					return true
+					continue
 				}
 
 				fmt.Fprintf(&b, "  IsDir: %v\n", entry.IsDir)
@@ -105,9 +167,7 @@ func (c *NodeCache) Format(f fmt.State, verb rune) {
 					}
 					fmt.Fprintln(&b, "]")
 				}
-
-				return true
-			})
+			}
 
 			fmt.Fprint(f, b.String())
 			return
@@ -121,91 +181,286 @@ func (c *NodeCache) Format(f fmt.State, verb rune) {
 }
 
 func (c *NodeCache) NewEntry(f os.FileInfo) *CacheEntry {
-	return &CacheEntry{
+	entry := &CacheEntry{
 		Info:      f,
 		IsDir:     f.IsDir(),
 		Children:  nil,
 		ExpiresAt: time.Now().Add(c.ttl),
 	}
+	// the getetag of a collection does not cover its members
+	if e, ok := f.(interface{ ETag() string }); ok && !f.IsDir() {
+		entry.ETag = e.ETag()
+	}
+	return entry
 }
 
+// NewNodeCache returns a cache keeping entries for ttl. A zero maxEntries
+// selects DefaultMaxEntries, a negative one leaves the cache unbounded.
 func NewNodeCache(ttl time.Duration, maxEntries int) *NodeCache {
+	if maxEntries == 0 {
+		maxEntries = DefaultMaxEntries
+	}
 	return &NodeCache{
+		entries:    make(map[string]*list.Element),
 		ttl:        ttl,
+		stale:      DefaultStale,
+		negTTL:     DefaultNegTTL,
 		maxEntries: maxEntries,
 	}
 }
 
-func (c *NodeCache) Get(path string) (*CacheEntry, bool) {
-	if val, ok := c.entries.Load(path); ok {
-		entry, ok2 := val.(*CacheEntry)
-		if !ok2 {
-			c.entries.Delete(path)
-			return nil, false
-		}
-		if time.Now().Before(entry.ExpiresAt) {
-			return entry, true
+// SetStale sets how long expired entries with an ETag are kept for
+// revalidation. Zero drops entries as soon as they expire.
+func (c *NodeCache) SetStale(d time.Duration) {
+	c.mu.Lock()
+	c.stale = max(d, 0)
+	c.mu.Unlock()
+}
+
+// dead reports whether an entry can neither be served nor revalidated
+// anymore. Caller holds c.mu.
+func (c *NodeCache) dead(entry *CacheEntry, now time.Time) bool {
+	if entry.ETag == "" {
+		return !now.Before(entry.ExpiresAt)
+	}
+	return !now.Before(entry.ExpiresAt.Add(c.stale))
+}
+
+// lookup returns the live entry for path and marks it used. An expired
+// entry is removed unless it can still be revalidated. Caller holds c.mu.
+func (c *NodeCache) lookup(path string) (*CacheEntry, bool) {
+	el, ok := c.entries[path]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	n := el.Value.(*node)
+	if now := time.Now(); !now.Before(n.entry.ExpiresAt) {
+		if c.dead(n.entry, now) {
+			c.remove(el)
+			c.expirations++
 		}
-		c.entries.Delete(path)
+		c.misses++
+		return nil, false
+	}
+	if n.entry.Missing {
+		c.misses++
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	c.hits++
+	return n.entry, true
+}
+
+// store adds or replaces the entry for path and evicts the least recently
+// used entries past maxEntries. Caller holds c.mu.
+func (c *NodeCache) store(path string, entry *CacheEntry) *node {
+	if el, ok := c.entries[path]; ok {
+		n := el.Value.(*node)
+		n.entry = entry
+		c.lru.MoveToFront(el)
+		return n
+	}
+	n := &node{key: path, entry: entry}
+	c.entries[path] = c.lru.PushFront(n)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+	return n
+}
+
+// persist hands a changed entry to the persister. An unchanged ETag means
+// the persister already holds an equivalent entry. Caller holds c.mu.
+func (c *NodeCache) persist(n *node) {
+	if c.persister == nil {
+		return
+	}
+	switch tag := n.entry.ETag; {
+	case tag == "" && n.saved != "":
+		c.persister.Delete(n.key)
+	case tag != "" && tag != n.saved:
+		c.persister.Put(n.key, n.entry)
+	}
+	n.saved = n.entry.ETag
+}
+
+// remove drops an entry. Caller holds c.mu.
+func (c *NodeCache) remove(el *list.Element) {
+	n := el.Value.(*node)
+	if n.saved != "" && c.persister != nil {
+		c.persister.Delete(n.key)
 	}
-	return nil, false
+	delete(c.entries, n.key)
+	c.lru.Remove(el)
+}
+
+// delete drops the entry for path, if any. Caller holds c.mu.
+func (c *NodeCache) delete(path string) {
+	if el, ok := c.entries[path]; ok {
+		c.remove(el)
+	}
+}
+
+func (c *NodeCache) Get(path string) (*CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lookup(path)
 }
 
 func (c *NodeCache) Set(path string, entry *CacheEntry) {
 	entry.ExpiresAt = time.Now().Add(c.ttl)
-	c.entries.Store(path, entry)
+	c.mu.Lock()
+	c.persist(c.store(path, entry))
+	c.mu.Unlock()
 }
 
 func (c *NodeCache) GetChildren(path string) ([]os.FileInfo, bool) {
-	if val, ok := c.entries.Load(path); ok {
-		entry, ok2 := val.(*CacheEntry)
-		if !ok2 {
-			c.entries.Delete(path)
-			return nil, false
-		}
-		if time.Now().After(entry.ExpiresAt) {
-			c.entries.Delete(path)
-			return nil, false
-		}
-		// children nil means "not cached"
-		if entry.Children == nil {
-			return nil, false
-		}
-		return entry.Children, true
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.lookup(path)
+	// children nil means "not cached"
+	if !ok || entry.Children == nil {
+		return nil, false
+	}
+	return entry.Children, true
+}
+
+// SetChildren caches the listing of a collection read at version etag,
+// "" if the server does not report collection tags.
+func (c *NodeCache) SetChildren(path string, children []os.FileInfo, etag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var info os.FileInfo
+	if el, ok := c.entries[path]; ok {
+		info = el.Value.(*node).entry.Info
+	}
+	// a new entry, readers may still hold the old one
+	c.persist(c.store(path, &CacheEntry{
+		Info:      info,
+		IsDir:     true,
+		Children:  children,
+		ExpiresAt: time.Now().Add(c.ttl),
+		ETag:      etag,
+	}))
+}
+
+// SetNegativeTTL sets how long a path is remembered as missing. Zero or
+// less turns negative caching off.
+func (c *NodeCache) SetNegativeTTL(d time.Duration) {
+	c.mu.Lock()
+	c.negTTL = max(d, 0)
+	c.mu.Unlock()
+}
+
+// SetMissing records that path does not exist, e.g. after a 404.
+func (c *NodeCache) SetMissing(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.negTTL == 0 {
+		return
 	}
-	return nil, false
+	c.persist(c.store(path, &CacheEntry{Missing: true, ExpiresAt: time.Now().Add(c.negTTL)}))
 }
 
-func (c *NodeCache) SetChildren(path string, children []os.FileInfo) {
-	var entry *CacheEntry
-	if val, ok := c.entries.Load(path); ok {
-		if e, ok2 := val.(*CacheEntry); ok2 {
-			entry = e
+// Missing reports whether p is known not to exist: it has a negative
+// entry, or the cached listing of its parent does not contain it.
+func (c *NodeCache) Missing(p string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.negTTL == 0 {
+		return false
+	}
+
+	now := time.Now()
+	if el, ok := c.entries[p]; ok && now.Before(el.Value.(*node).entry.ExpiresAt) {
+		if el.Value.(*node).entry.Missing {
+			c.lru.MoveToFront(el)
+			c.negHits++
+			return true
 		}
+		return false
+	}
+
+	dir, name := path.Split(strings.TrimRight(p, "/"))
+	if name == "" {
+		return false
+	}
+	el, ok := c.entries[strings.TrimRight(dir, "/")+"/"]
+	if !ok {
+		return false
+	}
+	listing := el.Value.(*node).entry
+	if listing.Missing || listing.Children == nil || !now.Before(listing.ExpiresAt) {
+		return false
 	}
-	if entry == nil {
-		entry = &CacheEntry{
-			Info:      nil,
-			IsDir:     true,
-			Children:  children,
-			ExpiresAt: time.Now().Add(c.ttl),
+	for _, fi := range listing.Children {
+		if fi.Name() == name {
+			return false
 		}
-	} else {
-		entry.Children = children
-		entry.IsDir = true
-		entry.ExpiresAt = time.Now().Add(c.ttl)
 	}
-	c.entries.Store(path, entry)
+	c.negHits++
+	return true
+}
+
+// SetPersister mirrors the entries that carry an ETag to p from now on.
+func (c *NodeCache) SetPersister(p Persister) {
+	c.mu.Lock()
+	c.persister = p
+	c.mu.Unlock()
+}
+
+// Restore adds an entry a persister kept from an earlier mount. It starts
+// out expired, so it is only served once the server confirmed its ETag, and
+// is dropped if that does not happen within the stale period.
+func (c *NodeCache) Restore(path string, entry *CacheEntry) {
+	if entry.ETag == "" {
+		return
+	}
+	entry.ExpiresAt = time.Now()
+	c.mu.Lock()
+	c.store(path, entry).saved = entry.ETag
+	c.mu.Unlock()
+}
+
+// Stale returns the entry for path even when it expired, as long as it can
+// be revalidated: it has an ETag and is within the stale period. The caller
+// compares the ETag with the server's and calls Revalidated when they match.
+func (c *NodeCache) Stale(path string) (*CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+	n := el.Value.(*node)
+	if n.entry.ETag == "" || c.dead(n.entry, time.Now()) {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return n.entry, true
+}
+
+// Revalidated renews the ttl of the entry for path after the server
+// confirmed that its version did not change.
+func (c *NodeCache) Revalidated(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[path]; ok {
+		el.Value.(*node).entry.ExpiresAt = time.Now().Add(c.ttl)
+		c.revalidations++
+	}
 }
 
 func (c *NodeCache) InvalidateTree(path string) {
-	c.entries.Range(func(key, value interface{}) bool {
-		k := key.(string)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, el := range c.entries {
 		if strings.HasPrefix(k, path) {
-			c.entries.Delete(k)
+			c.remove(el)
 		}
-		return true
-	})
+	}
 }
 
 func (c *NodeCache) Invalidate(p string) {
@@ -213,17 +468,93 @@ func (c *NodeCache) Invalidate(p string) {
 		return
 	}
 
-	c.entries.Delete(p)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.delete(p)
 
 	if !strings.HasSuffix(p, "/") {
-		c.entries.Delete(p + "/")
+		c.delete(p + "/")
 	}
 
 	parent := path.Dir(p)
 	if parent != p {
-		c.entries.Delete(parent)
+		c.delete(parent)
 		if !strings.HasSuffix(parent, "/") {
-			c.entries.Delete(parent + "/")
+			c.delete(parent + "/")
+		}
+	}
+}
+
+// Sweep removes the expired entries that can no longer be revalidated and
+// returns how many it removed.
+func (c *NodeCache) Sweep() int {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for _, el := range c.entries {
+		if c.dead(el.Value.(*node).entry, now) {
+			c.remove(el)
+			removed++
 		}
 	}
+	c.expirations += uint64(removed)
+	return removed
+}
+
+// flush writes out the changes a Flusher persister queued. A failure is
+// left for the owner of the persister to report.
+func (c *NodeCache) flush() {
+	c.mu.Lock()
+	f, ok := c.persister.(Flusher)
+	c.mu.Unlock()
+	if ok {
+		_ = f.Flush()
+	}
+}
+
+// StartSweeper runs Sweep every interval in the background, so expired
+// entries do not wait for a lookup to be removed, and flushes the persister.
+// Call the returned function to stop it.
+func (c *NodeCache) StartSweeper(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				c.Sweep()
+				c.flush()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Len returns the number of cached entries, stale ones included.
+func (c *NodeCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Stats returns the counters of the cache.
+func (c *NodeCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Entries:       c.lru.Len(),
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Evictions:     c.evictions,
+		Expirations:   c.expirations,
+		Revalidations: c.revalidations,
+		NegativeHits:  c.negHits,
+	}
 }
@@ -60,7 +60,7 @@ func TestSetGetAndChildren(t *testing.T) {
 
 	child1 := makeFI("a", false, 1)
 	child2 := makeFI("b", true, 0)
-	c.SetChildren("/dir", []os.FileInfo{child1, child2})
+	c.SetChildren("/dir", []os.FileInfo{child1, child2}, "")
 
 	children, ok := c.GetChildren("/dir")
 	if !ok {
@@ -136,3 +136,167 @@ func TestSummaryIncludesKeys(t *testing.T) {
 
 	_ = c.String()
 }
+
+func TestMaxEntriesEvictsLeastRecentlyUsed(t *testing.T) {
+	c := cache.NewNodeCache(time.Minute, 3)
+
+	c.Set("/a", c.NewEntry(makeFI("a", false, 0)))
+	c.Set("/b", c.NewEntry(makeFI("b", false, 0)))
+	c.Set("/c", c.NewEntry(makeFI("c", false, 0)))
+	// /a becomes the most recently used entry
+	if _, ok := c.Get("/a"); !ok {
+		dumpAndFail(t, c, "/a should be present")
+	}
+	c.Set("/d", c.NewEntry(makeFI("d", false, 0)))
+
+	if c.Len() != 3 {
+		dumpAndFail(t, c, "cache holds %d entries, want 3", c.Len())
+	}
+	if _, ok := c.Get("/b"); ok {
+		dumpAndFail(t, c, "/b was least recently used and should be evicted")
+	}
+	for _, k := range []string{"/a", "/c", "/d"} {
+		if _, ok := c.Get(k); !ok {
+			dumpAndFail(t, c, "%s should remain", k)
+		}
+	}
+	if st := c.Stats(); st.Evictions != 1 || st.Hits != 4 || st.Misses != 1 {
+		dumpAndFail(t, c, "unexpected stats: %s", st)
+	}
+}
+
+func TestSetChildrenCountsTowardsLimit(t *testing.T) {
+	c := cache.NewNodeCache(time.Minute, 2)
+
+	c.SetChildren("/d1/", []os.FileInfo{makeFI("x", false, 0)}, "")
+	c.Set("/d1", c.NewEntry(makeFI("d1", true, 0)))
+	c.SetChildren("/d2/", []os.FileInfo{makeFI("y", false, 0)}, "")
+
+	if _, ok := c.GetChildren("/d1/"); ok {
+		dumpAndFail(t, c, "oldest listing should be evicted")
+	}
+	if _, ok := c.GetChildren("/d2/"); !ok {
+		dumpAndFail(t, c, "newest listing should remain")
+	}
+}
+
+func TestSweepRemovesExpired(t *testing.T) {
+	c := cache.NewNodeCache(30*time.Millisecond, -1)
+	for i := range 50 {
+		c.Set(fmt.Sprintf("/f%d", i), c.NewEntry(makeFI("f", false, 0)))
+	}
+	if c.Len() != 50 {
+		dumpAndFail(t, c, "unbounded cache holds %d entries, want 50", c.Len())
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	c.Set("/fresh", c.NewEntry(makeFI("fresh", false, 0)))
+
+	if n := c.Sweep(); n != 50 {
+		dumpAndFail(t, c, "Sweep removed %d entries, want 50", n)
+	}
+	if c.Len() != 1 || c.Stats().Expirations != 50 {
+		dumpAndFail(t, c, "after sweep: %s", c.Stats())
+	}
+}
+
+func TestSweeperRunsInBackground(t *testing.T) {
+	c := cache.NewNodeCache(10*time.Millisecond, 100)
+	stop := c.StartSweeper(5 * time.Millisecond)
+	defer stop()
+
+	c.Set("/tmp", c.NewEntry(makeFI("tmp", false, 0)))
+	deadline := time.Now().Add(time.Second)
+	for c.Len() != 0 {
+		if time.Now().After(deadline) {
+			dumpAndFail(t, c, "sweeper did not remove the expired entry")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStaleEntriesCanBeRevalidated(t *testing.T) {
+	c := cache.NewNodeCache(20*time.Millisecond, 100)
+	c.SetChildren("/dir/", []os.FileInfo{makeFI("a", false, 0)}, "tag-1")
+	c.Set("/plain", c.NewEntry(makeFI("plain", false, 0)))
+
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := c.GetChildren("/dir/"); ok {
+		dumpAndFail(t, c, "expired listing must not be served")
+	}
+	entry, ok := c.Stale("/dir/")
+	if !ok || entry.ETag != "tag-1" {
+		dumpAndFail(t, c, "expected a stale entry with its tag")
+	}
+	if _, ok := c.Stale("/plain"); ok {
+		dumpAndFail(t, c, "entries without an ETag cannot be revalidated")
+	}
+
+	c.Revalidated("/dir/")
+	if _, ok := c.GetChildren("/dir/"); !ok {
+		dumpAndFail(t, c, "revalidated listing should be served again")
+	}
+	if st := c.Stats(); st.Revalidations != 1 {
+		dumpAndFail(t, c, "unexpected stats: %s", st)
+	}
+
+	// past the stale period the entry is gone for good
+	c.SetStale(0)
+	time.Sleep(40 * time.Millisecond)
+	if n := c.Sweep(); n != 2 || c.Len() != 0 {
+		dumpAndFail(t, c, "Sweep removed %d entries", n)
+	}
+}
+
+func TestMissingEntriesExpire(t *testing.T) {
+	c := cache.NewNodeCache(time.Minute, 100)
+	c.SetNegativeTTL(20 * time.Millisecond)
+
+	c.SetMissing("/gone")
+	if !c.Missing("/gone") {
+		dumpAndFail(t, c, "expected /gone to be missing")
+	}
+	if _, ok := c.Get("/gone"); ok {
+		dumpAndFail(t, c, "negative entries must not be served as attributes")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if c.Missing("/gone") {
+		dumpAndFail(t, c, "negative entry outlived its TTL")
+	}
+	if st := c.Stats(); st.NegativeHits != 1 {
+		dumpAndFail(t, c, "unexpected stats: %s", st)
+	}
+}
+
+func TestMissingFromListing(t *testing.T) {
+	c := cache.NewNodeCache(time.Minute, 100)
+	c.SetChildren("/dir/", []os.FileInfo{makeFI("a", false, 0)}, "")
+	c.SetChildren("/", []os.FileInfo{makeFI("dir", true, 0)}, "")
+
+	if c.Missing("/dir/a") {
+		dumpAndFail(t, c, "listed child reported missing")
+	}
+	if !c.Missing("/dir/b") || !c.Missing("/other") {
+		dumpAndFail(t, c, "names absent from a listing should be missing")
+	}
+	if c.Missing("/unlisted/x") {
+		dumpAndFail(t, c, "no listing, no answer")
+	}
+
+	// creating a file drops the listing with the parent
+	c.Invalidate("/dir/b")
+	if c.Missing("/dir/b") {
+		dumpAndFail(t, c, "invalidated listing still answers")
+	}
+}
+
+func TestNegativeCachingDisabled(t *testing.T) {
+	c := cache.NewNodeCache(time.Minute, 100)
+	c.SetNegativeTTL(0)
+	c.SetChildren("/dir/", nil, "")
+	c.SetMissing("/gone")
+	if c.Missing("/gone") || c.Missing("/dir/x") || c.Len() != 1 {
+		dumpAndFail(t, c, "negative caching should be off")
+	}
+}
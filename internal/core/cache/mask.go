@@ -80,52 +80,3 @@ func (m *Mask) IsDirtyRange(start, length int64) bool {
 func (m *Mask) clear() {
 	*m = nil
 }
-
-// shiftedRight returns a new Mask shifted by shiftedBytes to the right,
-// needed when the buffer is grown at the beginning.
-// for growing at the end, use smearPages instead.
-func (m Mask) shiftedRight(shiftedBytes int64, newLen int64) Mask {
-	newMaskBytes := maskSize(newLen)
-	newMask := make([]byte, newMaskBytes)
-
-	// nothing to shift or empty mask
-	if shiftedBytes == 0 || len(m) == 0 {
-		copy(newMask, m)
-		return newMask
-	}
-
-	shiftedPages := shiftedBytes >> 12
-	if shiftedPages == 0 {
-		// less than a page shift, copy existing mask
-		copy(newMask, m)
-		return newMask
-	}
-
-	if shiftedPages%8 == 0 {
-		// byte-aligned shift
-		byteShift := shiftedPages >> 3
-		for i := 0; i < len(m); i++ {
-			newIdx := i + int(byteShift)
-			if newIdx >= len(newMask) {
-				break
-			}
-			newMask[newIdx] = m[i]
-		}
-		return newMask
-	}
-
-	// left shift pages inside the byte array, preserve carry
-	// for larger shifts subtract multiples of 8 and use newMask[i + byteShift]
-	byteOffset := shiftedPages >> 3
-	shiftedPages = shiftedPages & 7
-	byteCarry := byte(0)
-	for i := range m {
-		currentByteState := m[i]
-		newByteState := (currentByteState << uint(shiftedPages)) | byteCarry
-		newMask[i+int(byteOffset)] = newByteState
-		// prepare carry for next byte
-		byteCarry = (currentByteState >> uint(8-shiftedPages)) & 0xFF
-	}
-
-	return newMask
-}
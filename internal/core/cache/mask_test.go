@@ -59,54 +59,3 @@ func TestMaskClear(t *testing.T) {
 		t.Fatalf("clear: expected page to be unset")
 	}
 }
-
-func TestShiftedRight_PageShift(t *testing.T) {
-	var m Mask
-	// mark page 0, page 1, and page 5
-	m.smearPages(0, PageSize*2)
-	m.smearPages(PageSize*5, PageSize)
-
-	oldLen := int64(PageSize * 6)
-	shiftBy := int64(PageSize * 3)
-	newLen := int64(oldLen + shiftBy)
-	newMask := m.shiftedRight(shiftBy, newLen)
-
-	// old page 0 -> new at offset shiftBy
-	if !newMask.IsDirty(0 + shiftBy) {
-		t.Fatalf("shiftedRight: expected old page 0 to move to %d", shiftBy)
-	}
-	// old page 1 -> new at shiftBy + PageSize
-	if !newMask.IsDirty(PageSize + shiftBy) {
-		t.Fatalf("shiftedRight: expected old page 1 to move to %d", PageSize+shiftBy)
-	}
-	// old page 5 -> new at shiftBy + 5*PageSize
-	if !newMask.IsDirty(5*PageSize + shiftBy) {
-		t.Fatalf("shiftedRight: expected old page 5 to move to %d", 5*PageSize+shiftBy)
-	}
-}
-
-func TestShiftedRight_ByteAlignedShift(t *testing.T) {
-	var m Mask
-	// mark page 0, page 1, and page 5
-	m.smearPages(0, PageSize*2)
-	m.smearPages(PageSize*5, PageSize)
-
-	oldLen := int64(PageSize * 6)
-	shiftedPages := int64(8) // byte-aligned shift (8 pages -> 1 mask byte)
-	shiftBy := int64(PageSize * shiftedPages)
-	newLen := int64(oldLen + shiftBy)
-	newMask := m.shiftedRight(shiftBy, newLen)
-
-	// old page 0 -> new at offset shiftBy
-	if !newMask.IsDirty(0 + shiftBy) {
-		t.Fatalf("shiftedRight (byte-aligned): expected old page 0 to move to %d", shiftBy)
-	}
-	// old page 1 -> new at shiftBy + PageSize
-	if !newMask.IsDirty(PageSize + shiftBy) {
-		t.Fatalf("shiftedRight (byte-aligned): expected old page 1 to move to %d", PageSize+shiftBy)
-	}
-	// old page 5 -> new at shiftBy + 5*PageSize
-	if !newMask.IsDirty(5*PageSize + shiftBy) {
-		t.Fatalf("shiftedRight (byte-aligned): expected old page 5 to move to %d", 5*PageSize+shiftBy)
-	}
-}
@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+const (
+	DefaultSpillFileLimit  = 64 * 1024 * 1024  // 64 MB
+	DefaultSpillTotalLimit = 512 * 1024 * 1024 // 512 MB
+)
+
+// SpillPolicy decides when a FileBuffer moves its image from memory to a
+// temporary file. One policy is shared by all buffers of a BufferCache.
+type SpillPolicy struct {
+	Dir        string
+	FileLimit  int64 // bytes one buffer may keep in memory
+	TotalLimit int64 // bytes all buffers together may keep in memory
+
+	used atomic.Int64
+}
+
+// InMemory returns the number of image bytes buffers currently keep in memory.
+func (p *SpillPolicy) InMemory() int64 {
+	if p == nil {
+		return 0
+	}
+	return p.used.Load()
+}
+
+func (p *SpillPolicy) account(delta int64) {
+	if p != nil {
+		p.used.Add(delta)
+	}
+}
+
+// shouldSpill reports whether growing an in-memory image from cur to next
+// bytes would exceed one of the limits.
+func (p *SpillPolicy) shouldSpill(cur, next int64) bool {
+	if p == nil || p.Dir == "" {
+		return false
+	}
+	if p.FileLimit > 0 && next > p.FileLimit {
+		return true
+	}
+	return p.TotalLimit > 0 && p.used.Load()+next-cur > p.TotalLimit
+}
+
+// spillFile is a temporary file holding a buffer image. It is removed when
+// closed.
+type spillFile struct {
+	f *os.File
+}
+
+func newSpillFile(dir, pattern string) (*spillFile, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &spillFile{f: f}, nil
+}
+
+// readAt fills dst from off; bytes past the end of the file read as zeros.
+func (s *spillFile) readAt(dst []byte, off int64) error {
+	n, err := s.f.ReadAt(dst, off)
+	clear(dst[n:])
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+func (s *spillFile) close() {
+	name := s.f.Name()
+	_ = s.f.Close()
+	_ = os.Remove(name)
+}
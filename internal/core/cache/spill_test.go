@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func newSpillBuffer(t *testing.T, fileLimit, totalLimit int64) (*FileBuffer, *SpillPolicy) {
+	t.Helper()
+	p := &SpillPolicy{Dir: t.TempDir(), FileLimit: fileLimit, TotalLimit: totalLimit}
+	return &FileBuffer{policy: p}, p
+}
+
+func spillFiles(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	return len(entries)
+}
+
+func TestSpill_FileLimit(t *testing.T) {
+	fb, p := newSpillBuffer(t, 2*PageSize, 0)
+
+	head := bytes.Repeat([]byte("a"), PageSize)
+	if err := fb.WriteAt(0, head); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if fb.Spilled() || p.InMemory() != PageSize {
+		t.Fatalf("small image must stay in memory: spilled=%v inMemory=%d", fb.Spilled(), p.InMemory())
+	}
+
+	tail := bytes.Repeat([]byte("b"), 2*PageSize)
+	if err := fb.WriteAt(PageSize, tail); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if !fb.Spilled() || p.InMemory() != 0 {
+		t.Fatalf("expected spill: spilled=%v inMemory=%d", fb.Spilled(), p.InMemory())
+	}
+	if fb.Size() != 3*PageSize {
+		t.Fatalf("size after spill: want %d got %d", 3*PageSize, fb.Size())
+	}
+
+	got := make([]byte, 2)
+	if n, err := fb.ReadInto(got, PageSize-1); err != nil || n != 2 || string(got) != "ab" {
+		t.Fatalf("ReadInto across the spill boundary: n=%d err=%v got=%q", n, err, got)
+	}
+	if !fb.Present(0, 3*PageSize) {
+		t.Fatalf("spilled pages must stay present")
+	}
+
+	// remote data does not overwrite present pages on disk either
+	if err := fb.WriteRemoteAt(0, bytes.Repeat([]byte("r"), 4*PageSize)); err != nil {
+		t.Fatalf("WriteRemoteAt failed: %v", err)
+	}
+	out, _ := fb.ReadAt(0, 4*PageSize)
+	if out[0] != 'a' || out[PageSize] != 'b' || out[3*PageSize] != 'r' {
+		t.Fatalf("unexpected image after remote fill: %q %q %q", out[0], out[PageSize], out[3*PageSize])
+	}
+}
+
+func TestSpill_TotalLimit(t *testing.T) {
+	p := &SpillPolicy{Dir: t.TempDir(), TotalLimit: 3 * PageSize}
+	a := &FileBuffer{policy: p}
+	b := &FileBuffer{policy: p}
+
+	_ = a.WriteAt(0, make([]byte, 2*PageSize))
+	_ = b.WriteAt(0, make([]byte, 2*PageSize))
+	if a.Spilled() || !b.Spilled() {
+		t.Fatalf("second buffer should spill: a=%v b=%v", a.Spilled(), b.Spilled())
+	}
+
+	a.Clear()
+	if p.InMemory() != 0 {
+		t.Fatalf("Clear must release accounted memory, got %d", p.InMemory())
+	}
+}
+
+func TestSpill_SnapshotAndTruncate(t *testing.T) {
+	fb, p := newSpillBuffer(t, PageSize, 0)
+
+	data := bytes.Repeat([]byte("0123456789"), PageSize)
+	if err := fb.WriteAt(100, data); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if !fb.Spilled() {
+		t.Fatalf("expected spilled buffer")
+	}
+
+	snap, err := fb.TakeSnapshot()
+	if err != nil {
+		t.Fatalf("TakeSnapshot failed: %v", err)
+	}
+	if snap.spill == nil || len(snap.Extents) != 1 || snap.Extents[0] != (Extent{Offset: 0, Length: 100 + int64(len(data))}) {
+		t.Fatalf("unexpected snapshot: spilled=%v extents=%+v", snap.spill != nil, snap.Extents)
+	}
+	got, err := io.ReadAll(io.NewSectionReader(snap, 100, int64(len(data))))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("snapshot content mismatch: err=%v", err)
+	}
+
+	if err := fb.Truncate(110); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	out, _ := fb.ReadAt(100, 10)
+	if fb.Size() != 110 || string(out) != "0123456789" {
+		t.Fatalf("after truncate: size=%d content=%q", fb.Size(), out)
+	}
+
+	// an extension takes no pages and leaves the spill file as it is
+	pages := fb.Pages()
+	if err := fb.Truncate(10 << 30); err != nil {
+		t.Fatalf("Truncate extend failed: %v", err)
+	}
+	if fi, err := fb.spill.f.Stat(); err != nil || fi.Size() > 2*PageSize || fb.Pages() != pages {
+		t.Fatalf("extension filled the buffer: spill=%v pages=%d err=%v", fi.Size(), fb.Pages(), err)
+	}
+
+	snap.Release()
+	fb.Clear()
+	if n := spillFiles(t, p.Dir); n != 0 {
+		t.Fatalf("expected temporary files removed, %d left", n)
+	}
+}
@@ -21,18 +21,31 @@ func NormalizePath(p string) (string, error) {
 	return s, nil
 }
 
-func EmptyFileStat(hidden bool) *fuse.Stat_t {
-	uid, gid, _ := fuse.Getcontext()
+// Owner is the ownership and the permission bits stats report for files
+// that have none stored (see Ownership), as WebDAV knows neither.
+type Owner struct {
+	UID, GID uint32
+	DirMask  uint32 // bits cleared from 0777 for directories
+	FileMask uint32 // bits cleared from 0666 for files
+}
+
+// DirPerm returns the permission bits of directories without stored ones.
+func (o Owner) DirPerm() uint32 { return 0o777 &^ o.DirMask }
+
+// FilePerm returns the permission bits of files without stored ones.
+func (o Owner) FilePerm() uint32 { return 0o666 &^ o.FileMask }
+
+func EmptyFileStat(hidden bool, o Owner) *fuse.Stat_t {
 	Flags := uint32(0)
 	if hidden {
 		Flags = fuse.UF_HIDDEN
 	}
 	return &fuse.Stat_t{
-		Mode:     fuse.S_IFREG | 0o644,
+		Mode:     fuse.S_IFREG | o.FilePerm(),
 		Nlink:    1,
 		Size:     0,
-		Uid:      uid,
-		Gid:      gid,
+		Uid:      o.UID,
+		Gid:      o.GID,
 		Atim:     fuse.NewTimespec(time.Now()),
 		Mtim:     fuse.NewTimespec(time.Now()),
 		Ctim:     fuse.NewTimespec(time.Now()),
@@ -42,24 +55,32 @@ func EmptyFileStat(hidden bool) *fuse.Stat_t {
 	}
 }
 
-func FileInfoCast(f os.FileInfo) *fuse.Stat_t {
+func FileInfoCast(f os.FileInfo, o Owner) *fuse.Stat_t {
 	stat := &fuse.Stat_t{}
-	perm := uint32(f.Mode().Perm())
+	perm, uid, gid := Ownership(f)
 
 	if f.IsDir() {
-		stat.Mode = fuse.S_IFDIR | perm
+		stat.Mode = fuse.S_IFDIR | permOr(perm, o.DirPerm())
 		stat.Nlink = 2
 		stat.Size = 0
+	} else if f.Mode()&os.ModeSymlink != 0 {
+		stat.Mode = fuse.S_IFLNK | 0o777
+		stat.Nlink = 1
+		stat.Size = f.Size()
 	} else {
-		stat.Mode = fuse.S_IFREG | perm
+		stat.Mode = fuse.S_IFREG | permOr(perm, o.FilePerm())
 		stat.Nlink = 1
 		stat.Size = f.Size()
 	}
 
-	uid, gid, _ := fuse.Getcontext()
-
-	stat.Uid = uid
-	stat.Gid = gid
+	stat.Uid = o.UID
+	if uid != nil {
+		stat.Uid = *uid
+	}
+	stat.Gid = o.GID
+	if gid != nil {
+		stat.Gid = *gid
+	}
 	stat.Mtim = fuse.NewTimespec(f.ModTime())
 	stat.Atim = fuse.NewTimespec(f.ModTime())
 	stat.Ctim = fuse.NewTimespec(f.ModTime())
@@ -72,3 +93,32 @@ func FileInfoCast(f os.FileInfo) *fuse.Stat_t {
 
 	return stat
 }
+
+func permOr(perm *uint32, def uint32) uint32 {
+	if perm == nil {
+		return def
+	}
+	return *perm
+}
+
+// owned is implemented by attributes carrying what chmod and chown set.
+type owned interface {
+	Ownership() (perm, uid, gid *uint32)
+}
+
+// Ownership returns the permission bits, owner and group stored for f with
+// chmod and chown, nil for those it has none.
+func Ownership(f os.FileInfo) (perm, uid, gid *uint32) {
+	if o, ok := f.(owned); ok {
+		return o.Ownership()
+	}
+	return nil, nil, nil
+}
+
+// ETag returns the entity tag the server reported for f, "" if it has none.
+func ETag(f os.FileInfo) string {
+	if e, ok := f.(interface{ ETag() string }); ok {
+		return e.ETag()
+	}
+	return ""
+}
@@ -22,12 +22,110 @@ type Config struct {
 
 	TTL        time.Duration `toml:"ttl"`
 	MaxEntries int           `toml:"max-entries"`
+	// how long expired entries are kept to be revalidated with their ETag
+	// instead of fetched again; zero selects the default, negative disables
+	StaleTTL time.Duration `toml:"stale-ttl"`
+	// how long a path that was not found is answered as missing without
+	// asking the server; zero selects the default, negative disables
+	NegativeTTL time.Duration `toml:"negative-ttl"`
+	// PersistMetadata keeps the metadata cache in CacheDir across mounts
+	PersistMetadata bool `toml:"persist-metadata"`
 
 	Verbose bool   `toml:"verbose"`
 	StdLog  string `toml:"std"`
 	ErrLog  string `toml:"err"`
+
+	// SpoolDir holds the write-back journal of data not yet uploaded.
+	// Empty selects the per-user cache directory, "none" disables journaling.
+	SpoolDir string `toml:"spool-dir"`
+
+	// CacheDir holds temporary data such as buffers spilled to disk.
+	// Empty selects the per-user cache directory.
+	CacheDir string `toml:"cache-dir"`
+	// in-memory limits for file buffers before they spill to CacheDir;
+	// zero selects the defaults
+	BufferFileLimitMB   int `toml:"buffer-file-limit-mb"`
+	BufferMemoryLimitMB int `toml:"buffer-memory-limit-mb"`
+	// memory all buffers may hold before clean pages and unused buffers are
+	// evicted; zero selects the default, negative disables eviction
+	BufferBudgetMB int `toml:"buffer-budget-mb"`
+	// downloaded file data kept in CacheDir across mounts, by ETag; zero
+	// selects the default size, negative disables it
+	ContentCacheMB int `toml:"content-cache-mb"`
+	// largest window prefetched ahead of sequential reads; zero selects the
+	// default, negative disables prefetching
+	ReadaheadMaxMB int `toml:"readahead-max-mb"`
+
+	// background uploads; zero selects the defaults
+	UploadWorkers int `toml:"upload-workers"`
+	UploadRetries int `toml:"upload-retries"`
+
+	// chunked uploads (Nextcloud chunking v2) for files above the threshold;
+	// a zero threshold disables them, an empty uploads URL is derived from
+	// a .../remote.php/dav/files/<user> server URL
+	ChunkThresholdMB int    `toml:"chunk-threshold-mb"`
+	ChunkSizeMB      int    `toml:"chunk-size-mb"`
+	ChunkUploadsURL  string `toml:"chunk-uploads-url"`
+
+	// ConflictPolicy decides what happens to an upload of a file that was
+	// changed on the server since it was opened; empty selects ConflictCopy
+	ConflictPolicy string `toml:"conflict-policy"`
+
+	// how often the server is asked for changes made by other clients;
+	// zero selects the default, negative disables watching
+	WatchInterval time.Duration `toml:"watch-interval"`
+
+	// how long the kernel caches attributes, names and missing names
+	// (FUSE attr_timeout, entry_timeout, negative_timeout); zero derives
+	// them from the cache policy, negative disables them
+	AttrTimeout     time.Duration `toml:"attr-timeout"`
+	EntryTimeout    time.Duration `toml:"entry-timeout"`
+	NegativeTimeout time.Duration `toml:"negative-timeout"`
+	// KernelCache is a KernelCache* policy for the kernel page cache;
+	// empty selects KernelCacheAuto
+	KernelCache string `toml:"kernel-cache"`
+	// DirectIO bypasses the kernel page cache
+	DirectIO bool `toml:"direct-io"`
+	// MountOptions are passed to the FUSE mount as -o options
+	MountOptions []string `toml:"mount-options"`
+
+	// owner and group of every file; unset selects the mounting user
+	UID *uint32 `toml:"uid"`
+	GID *uint32 `toml:"gid"`
+	// permission bits cleared, in octal: Umask for files and directories,
+	// DMask and FMask for directories or files alone; empty selects the
+	// default umask
+	Umask string `toml:"umask"`
+	DMask string `toml:"dmask"`
+	FMask string `toml:"fmask"`
+	// PersistPermissions stores chmod and chown as dead properties instead
+	// of ignoring them
+	PersistPermissions bool `toml:"persist-permissions"`
+
+	// ServerLocks backs write locks with WebDAV locks on the server, which
+	// it drops when they are not refreshed within LockTimeout; zero selects
+	// the default
+	ServerLocks bool          `toml:"server-locks"`
+	LockTimeout time.Duration `toml:"lock-timeout"`
 }
 
+// Values of KernelCache.
+const (
+	KernelCacheAuto   = "auto"   // pages are kept across opens while the file's ETag is unchanged
+	KernelCacheAlways = "always" // pages are always kept (FUSE kernel_cache)
+	KernelCacheOff    = "off"    // pages are dropped on every open
+)
+
+// SpoolDisabled is the SpoolDir value that turns the write-back journal off.
+const SpoolDisabled = "none"
+
+// Values of ConflictPolicy.
+const (
+	ConflictFail      = "fail"      // the upload fails, close/fsync report EIO
+	ConflictOverwrite = "overwrite" // the local version replaces the server's
+	ConflictCopy      = "copy"      // the local version is saved next to the server's
+)
+
 const defaultConfig = `# server
 username = "user"
 password = "pass"
@@ -40,6 +138,12 @@ max-entries = 100
 verbose = false
 err = "stderr"
 std = "stdout"
+
+# write-back journal ("" = default cache dir, "none" = disabled)
+spool-dir = ""
+
+# temporary data such as spilled buffers ("" = default cache dir)
+cache-dir = ""
 `
 
 // On Linux/macOS uses XDG_CONFIG_HOME or ~/.config; on Windows uses %APPDATA%.
@@ -71,6 +175,15 @@ func userConfigPath(appName, filename string) (string, error) {
 	return filepath.Join(dir, filename), nil
 }
 
+// On Linux/macOS uses XDG_CACHE_HOME or ~/.cache; on Windows uses %LocalAppData%.
+func userCachePath(appName, sub string) (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, appName, sub), nil
+}
+
 func writeDefaultConfig(path, content string) error {
 	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0o700); err != nil {
@@ -130,6 +243,18 @@ func ParseCommandLineArgs() (*Config, error) {
 		verbosePtr    = flag.BoolP("verbose", "v", false, "enable verbose logging")
 		stdlogPtr     = flag.StringP("stdlog", "s", "", "path to standard log file")
 		errlogPtr     = flag.StringP("errlog", "e", "", "path to error log file")
+		spoolPtr      = flag.String("spool-dir", "", "write-back journal directory (\"none\" disables)")
+		cacheDirPtr   = flag.String("cache-dir", "", "directory for temporary cache data")
+		persistPtr    = flag.Bool("persist-metadata", false, "keep the metadata cache on disk across mounts")
+		conflictPtr   = flag.String("conflict-policy", "", "on conflicting remote changes: fail, overwrite or copy")
+		watchPtr      = flag.Duration("watch-interval", 0, "how often to poll for remote changes (negative disables)")
+		uidPtr        = flag.Uint32("uid", 0, "owner of every file (default the mounting user)")
+		gidPtr        = flag.Uint32("gid", 0, "group of every file (default the mounting user's)")
+		umaskPtr      = flag.String("umask", "", "octal permission bits cleared for files and directories")
+		dmaskPtr      = flag.String("dmask", "", "octal permission bits cleared for directories")
+		fmaskPtr      = flag.String("fmask", "", "octal permission bits cleared for files")
+		permsPtr      = flag.Bool("persist-permissions", false, "store chmod and chown on the server as dead properties")
+		srvLocksPtr   = flag.Bool("server-locks", false, "hold write locks on the server (WebDAV LOCK)")
 		wherePtr      = flag.Bool("where-config", false, "print the path to the config file and exit")
 	)
 
@@ -165,6 +290,56 @@ func ParseCommandLineArgs() (*Config, error) {
 	if flag.Lookup("errlog").Changed {
 		cfg.ErrLog = *errlogPtr
 	}
+	if flag.Lookup("spool-dir").Changed {
+		cfg.SpoolDir = *spoolPtr
+	}
+	if flag.Lookup("cache-dir").Changed {
+		cfg.CacheDir = *cacheDirPtr
+	}
+	if flag.Lookup("persist-metadata").Changed {
+		cfg.PersistMetadata = *persistPtr
+	}
+	if flag.Lookup("conflict-policy").Changed {
+		cfg.ConflictPolicy = *conflictPtr
+	}
+	if flag.Lookup("watch-interval").Changed {
+		cfg.WatchInterval = *watchPtr
+	}
+	if flag.Lookup("uid").Changed {
+		cfg.UID = uidPtr
+	}
+	if flag.Lookup("gid").Changed {
+		cfg.GID = gidPtr
+	}
+	if flag.Lookup("umask").Changed {
+		cfg.Umask = *umaskPtr
+	}
+	if flag.Lookup("dmask").Changed {
+		cfg.DMask = *dmaskPtr
+	}
+	if flag.Lookup("fmask").Changed {
+		cfg.FMask = *fmaskPtr
+	}
+	if flag.Lookup("persist-permissions").Changed {
+		cfg.PersistPermissions = *permsPtr
+	}
+	if flag.Lookup("server-locks").Changed {
+		cfg.ServerLocks = *srvLocksPtr
+	}
+	if cfg.CacheDir == "" {
+		p, perr := userCachePath("mimic", "")
+		if perr != nil {
+			return nil, perr
+		}
+		cfg.CacheDir = p
+	}
+	if cfg.SpoolDir == "" {
+		p, perr := userCachePath("mimic", "spool")
+		if perr != nil {
+			return nil, perr
+		}
+		cfg.SpoolDir = p
+	}
 	if flag.Lookup("user").Changed && *userPtr != "" {
 		parts := strings.SplitN(*userPtr, ":", 2)
 		cfg.Username = parts[0]
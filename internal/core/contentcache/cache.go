@@ -0,0 +1,370 @@
+package contentcache
+
+import (
+	"cmp"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// On-disk layout: every cached file version has a data file holding the
+// downloaded ranges at their offsets and an index file naming the path, the
+// ETag and the ranges present. Both are named after a hash of the path, so
+// a path has at most one cached version; data of another version is
+// dropped when it is looked up or replaced. The index is written after the
+// data is synced, so after a crash it never claims data that is not there.
+//
+// File I/O runs outside the cache lock, on entries pinned for it. A version
+// dropped while pinned keeps its files until the last pin is gone, and the
+// path is not cached again before.
+const (
+	dataExt  = ".data"
+	indexExt = ".json"
+)
+
+// extent is a range [Off, End) of data present in a data file.
+type extent struct {
+	Off int64 `json:"off"`
+	End int64 `json:"end"`
+}
+
+type index struct {
+	Path   string   `json:"path"`
+	ETag   string   `json:"etag"`
+	Ranges []extent `json:"ranges"` // sorted, neither overlapping nor adjacent
+}
+
+// size returns the bytes the ranges hold.
+func (x *index) size() int64 {
+	var n int64
+	for _, e := range x.Ranges {
+		n += e.End - e.Off
+	}
+	return n
+}
+
+// covers reports whether [off, end) is present.
+func (x *index) covers(off, end int64) bool {
+	for _, e := range x.Ranges {
+		if e.Off <= off && end <= e.End {
+			return true
+		}
+	}
+	return false
+}
+
+// add records [off, end) as present, merging it with the ranges it
+// overlaps or touches.
+func (x *index) add(off, end int64) {
+	out := make([]extent, 0, len(x.Ranges)+1)
+	for _, e := range x.Ranges {
+		if e.End < off || end < e.Off {
+			out = append(out, e)
+			continue
+		}
+		off, end = min(off, e.Off), max(end, e.End)
+	}
+	out = append(out, extent{Off: off, End: end})
+	slices.SortFunc(out, func(a, b extent) int { return cmp.Compare(a.Off, b.Off) })
+	x.Ranges = out
+}
+
+type entry struct {
+	key string // file name stem
+	idx index
+
+	pins    int        // ReadAt and WriteAt calls using the files
+	removed bool       // dropped from the cache; files go with the last pin
+	indexMu sync.Mutex // serializes writes of the index file
+}
+
+// Stats are the counters of a Cache.
+type Stats struct {
+	Entries   int
+	Bytes     int64
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("entries=%d bytes=%d hits=%d misses=%d evictions=%d",
+		s.Entries, s.Bytes, s.Hits, s.Misses, s.Evictions)
+}
+
+// Cache keeps downloaded file data on disk, keyed by path and ETag, so it
+// can be read again without asking the server as long as the file did not
+// change. Past limit bytes the least recently used versions are evicted.
+type Cache struct {
+	dir   string
+	limit int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // by path; values are *entry
+	lru     list.List                // front: most recently used
+	size    int64
+	doomed  map[string]*entry // removed entries still pinned, by key
+
+	hits, misses, evictions uint64
+}
+
+// Open opens (creating if necessary) the cache in dir and evicts what
+// exceeds limit. Versions left by earlier runs are ordered by when they were
+// last written.
+func Open(dir string, limit int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("cannot create content cache directory: %w", err)
+	}
+	c := &Cache{dir: dir, limit: limit, entries: make(map[string]*list.Element), doomed: make(map[string]*entry)}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+indexExt))
+	if err != nil {
+		return nil, err
+	}
+	type found struct {
+		e       *entry
+		written time.Time
+	}
+	var all []found
+	for _, name := range names {
+		key := strings.TrimSuffix(filepath.Base(name), indexExt)
+		fi, err := os.Stat(name)
+		data, rerr := os.ReadFile(name)
+		e := &entry{key: key}
+		if err != nil || rerr != nil || json.Unmarshal(data, &e.idx) != nil || e.idx.Path == "" || key != keyOf(e.idx.Path) {
+			c.removeFiles(key)
+			continue
+		}
+		if _, err := os.Stat(c.file(key, dataExt)); err != nil {
+			c.removeFiles(key)
+			continue
+		}
+		all = append(all, found{e, fi.ModTime()})
+	}
+	slices.SortFunc(all, func(a, b found) int { return a.written.Compare(b.written) })
+	for _, f := range all {
+		c.entries[f.e.idx.Path] = c.lru.PushFront(f.e)
+		c.size += f.e.idx.size()
+	}
+	c.evict()
+	return c, nil
+}
+
+func keyOf(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Cache) file(key, ext string) string {
+	return filepath.Join(c.dir, key+ext)
+}
+
+func (c *Cache) removeFiles(key string) {
+	_ = os.Remove(c.file(key, indexExt))
+	_ = os.Remove(c.file(key, dataExt))
+}
+
+// remove drops an entry with its files, which a pinned entry keeps until
+// unpinned. Caller holds c.mu.
+func (c *Cache) remove(el *list.Element) {
+	e := el.Value.(*entry)
+	c.lru.Remove(el)
+	delete(c.entries, e.idx.Path)
+	c.size -= e.idx.size()
+	e.removed = true
+	if e.pins > 0 {
+		c.doomed[e.key] = e
+		return
+	}
+	c.removeFiles(e.key)
+}
+
+// unpin ends a use of the files of e. Caller holds c.mu.
+func (c *Cache) unpin(e *entry) {
+	e.pins--
+	if e.pins == 0 && e.removed {
+		delete(c.doomed, e.key)
+		c.removeFiles(e.key)
+	}
+}
+
+// evict drops least recently used versions until the cache fits its limit.
+// Caller holds c.mu.
+func (c *Cache) evict() {
+	for c.size > c.limit {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+		c.remove(el)
+		c.evictions++
+	}
+}
+
+// ReadAt fills p with the data at off of the version etag of path. Returns
+// false, leaving p undefined, unless all of it is cached.
+func (c *Cache) ReadAt(path, etag string, p []byte, off int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[path]
+	if !ok {
+		c.misses++
+		return false
+	}
+	e := el.Value.(*entry)
+	if e.idx.ETag != etag {
+		// the file changed since it was cached
+		c.remove(el)
+		c.misses++
+		return false
+	}
+	if !e.idx.covers(off, off+int64(len(p))) {
+		c.misses++
+		return false
+	}
+	e.pins++
+	defer c.unpin(e)
+	c.mu.Unlock()
+
+	f, err := os.Open(c.file(e.key, dataExt))
+	if err == nil {
+		_, err = io.ReadFull(io.NewSectionReader(f, off, int64(len(p))), p)
+		_ = f.Close()
+	}
+
+	c.mu.Lock()
+	if err != nil {
+		if !e.removed {
+			c.remove(el)
+		}
+		c.misses++
+		return false
+	}
+	if !e.removed {
+		c.lru.MoveToFront(el)
+	}
+	c.hits++
+	return true
+}
+
+// WriteAt stores data read at off from the version etag of path. Data of
+// another version of path is dropped first; while that is still read,
+// nothing is stored.
+func (c *Cache) WriteAt(path, etag string, data []byte, off int64) error {
+	if len(data) == 0 || etag == "" || int64(len(data)) > c.limit {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[path]
+	if ok && el.Value.(*entry).idx.ETag != etag {
+		c.remove(el)
+		ok = false
+	}
+	if !ok {
+		if _, busy := c.doomed[keyOf(path)]; busy {
+			return nil
+		}
+		el = c.lru.PushFront(&entry{key: keyOf(path), idx: index{Path: path, ETag: etag}})
+		c.entries[path] = el
+	}
+	e := el.Value.(*entry)
+	end := off + int64(len(data))
+	if e.idx.covers(off, end) {
+		c.lru.MoveToFront(el)
+		return nil
+	}
+
+	e.pins++
+	defer c.unpin(e)
+	c.mu.Unlock()
+
+	f, err := os.OpenFile(c.file(e.key, dataExt), os.O_CREATE|os.O_WRONLY, 0o600)
+	if err == nil {
+		_, err = f.WriteAt(data, off)
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	c.mu.Lock()
+	if err != nil || e.removed {
+		if !e.removed {
+			c.remove(el)
+		}
+		return err
+	}
+	before := e.idx.size()
+	e.idx.add(off, end)
+	c.size += e.idx.size() - before
+	c.lru.MoveToFront(el)
+	c.evict()
+	c.mu.Unlock()
+
+	err = c.writeIndex(e)
+
+	c.mu.Lock()
+	if err != nil && !e.removed {
+		c.remove(el)
+	}
+	return err
+}
+
+// writeIndex replaces the index file of e with its ranges at the time of
+// writing, unless e was dropped. Caller holds a pin of e, not c.mu.
+func (c *Cache) writeIndex(e *entry) error {
+	e.indexMu.Lock()
+	defer e.indexMu.Unlock()
+
+	c.mu.Lock()
+	if e.removed {
+		c.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(&e.idx)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := c.file(e.key, indexExt+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.file(e.key, indexExt))
+}
+
+// Remove drops the cached data of path, e.g. after it was deleted.
+func (c *Cache) Remove(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[path]; ok {
+		c.remove(el)
+	}
+}
+
+// Stats returns the counters of the cache.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{
+		Entries:   c.lru.Len(),
+		Bytes:     c.size,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
@@ -0,0 +1,155 @@
+package contentcache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func openCache(t *testing.T, dir string, limit int64) *Cache {
+	t.Helper()
+	c, err := Open(dir, limit)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return c
+}
+
+func mustWrite(t *testing.T, c *Cache, path, etag string, data []byte, off int64) {
+	t.Helper()
+	if err := c.WriteAt(path, etag, data, off); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+}
+
+func TestCache_ServesMatchingVersion(t *testing.T) {
+	c := openCache(t, t.TempDir(), 1<<20)
+
+	mustWrite(t, c, "/f", `"v1"`, []byte("hello"), 0)
+	mustWrite(t, c, "/f", `"v1"`, []byte("world"), 5)
+
+	got := make([]byte, 8)
+	if !c.ReadAt("/f", `"v1"`, got, 2) || string(got) != "lloworld" {
+		t.Fatalf("ReadAt over merged ranges: %q", got)
+	}
+	if c.ReadAt("/f", `"v1"`, make([]byte, 4), 8) {
+		t.Fatalf("range past the cached data must miss")
+	}
+
+	// another version replaces the cached one
+	if c.ReadAt("/f", `"v2"`, make([]byte, 5), 0) {
+		t.Fatalf("data of another version must not be served")
+	}
+	if c.ReadAt("/f", `"v1"`, make([]byte, 5), 0) {
+		t.Fatalf("outdated version should be dropped")
+	}
+	if st := c.Stats(); st.Hits != 1 || st.Entries != 0 || st.Bytes != 0 {
+		t.Fatalf("unexpected stats: %s", st)
+	}
+}
+
+func TestCache_SurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	c := openCache(t, dir, 1<<20)
+	mustWrite(t, c, "/docs/a.bin", `"a"`, bytes.Repeat([]byte("a"), 4096), 4096)
+
+	c = openCache(t, dir, 1<<20)
+	got := make([]byte, 4096)
+	if !c.ReadAt("/docs/a.bin", `"a"`, got, 4096) || !bytes.Equal(got, bytes.Repeat([]byte("a"), 4096)) {
+		t.Fatalf("cached data lost across Open")
+	}
+	if c.ReadAt("/docs/a.bin", `"a"`, got, 0) {
+		t.Fatalf("range never written must miss")
+	}
+}
+
+func TestCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := openCache(t, t.TempDir(), 10)
+
+	mustWrite(t, c, "/a", "a", []byte("aaaa"), 0)
+	mustWrite(t, c, "/b", "b", []byte("bbbb"), 0)
+	// /a was used last
+	c.ReadAt("/a", "a", make([]byte, 4), 0)
+	mustWrite(t, c, "/c", "c", []byte("cccc"), 0)
+
+	if c.ReadAt("/b", "b", make([]byte, 4), 0) {
+		t.Fatalf("least recently used entry should be evicted")
+	}
+	if !c.ReadAt("/a", "a", make([]byte, 4), 0) || !c.ReadAt("/c", "c", make([]byte, 4), 0) {
+		t.Fatalf("recently used entries must stay")
+	}
+	if st := c.Stats(); st.Evictions != 1 || st.Bytes != 8 {
+		t.Fatalf("unexpected stats: %s", st)
+	}
+
+	// the limit also holds for what an earlier run left behind
+	c = openCache(t, c.dir, 4)
+	if st := c.Stats(); st.Entries != 1 || st.Bytes != 4 {
+		t.Fatalf("reopen with a lower limit: %s", st)
+	}
+}
+
+func TestCache_DropsTornEntries(t *testing.T) {
+	dir := t.TempDir()
+	c := openCache(t, dir, 1<<20)
+	mustWrite(t, c, "/a", "a", []byte("aaaa"), 0)
+	mustWrite(t, c, "/b", "b", []byte("bbbb"), 0)
+
+	// a crash between writing the data and the index of /b
+	if err := os.WriteFile(filepath.Join(dir, keyOf("/b")+indexExt), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c = openCache(t, dir, 1<<20)
+	if c.ReadAt("/b", "b", make([]byte, 4), 0) || !c.ReadAt("/a", "a", make([]byte, 4), 0) {
+		t.Fatalf("only the intact entry should be restored")
+	}
+	if _, err := os.Stat(filepath.Join(dir, keyOf("/b")+dataExt)); !os.IsNotExist(err) {
+		t.Fatalf("data of a torn entry should be removed")
+	}
+}
+
+func TestCache_ConcurrentVersions(t *testing.T) {
+	dir := t.TempDir()
+	c := openCache(t, dir, 1<<20)
+
+	// versions replace each other while being read; a hit must only ever
+	// return data of the version asked for
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				v := byte('a' + (w+i)%4)
+				etag := string(v)
+				if i%2 == 0 {
+					if err := c.WriteAt("/f", etag, bytes.Repeat([]byte{v}, 4096), 0); err != nil {
+						t.Errorf("WriteAt failed: %v", err)
+						return
+					}
+					continue
+				}
+				got := make([]byte, 4096)
+				if c.ReadAt("/f", etag, got, 0) && !bytes.Equal(got, bytes.Repeat([]byte{v}, 4096)) {
+					t.Errorf("version %s read as %q...", etag, got[:8])
+					return
+				}
+				if i%7 == 0 {
+					c.Remove("/f")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	st := c.Stats()
+	if st.Entries > 1 || st.Bytes > 4096 {
+		t.Fatalf("unexpected stats: %s", st)
+	}
+	// dropped versions left no files behind
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 2*st.Entries {
+		t.Fatalf("files %q for %d entries", names, st.Entries)
+	}
+}
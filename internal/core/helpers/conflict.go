@@ -0,0 +1,22 @@
+package helpers
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// ConflictName returns the name a conflicting local version of p is saved
+// under next to the server's version: "name (conflict <host> <time>).ext".
+// The time avoids characters Windows does not allow in file names.
+func ConflictName(p, host string, t time.Time) string {
+	dir, file := path.Split(p)
+	ext := path.Ext(file)
+	// dotfiles like ".bashrc" have no extension
+	if ext == file {
+		ext = ""
+	}
+	base := strings.TrimSuffix(file, ext)
+	return fmt.Sprintf("%s%s (conflict %s %s)%s", dir, base, host, t.Format("2006-01-02 150405"), ext)
+}
@@ -0,0 +1,25 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConflictName(t *testing.T) {
+	at := time.Date(2024, 3, 9, 14, 5, 7, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"/docs/report.txt", "/docs/report (conflict laptop 2024-03-09 140507).txt"},
+		{"/archive.tar.gz", "/archive.tar (conflict laptop 2024-03-09 140507).gz"},
+		{"/notes", "/notes (conflict laptop 2024-03-09 140507)"},
+		{"/home/.bashrc", "/home/.bashrc (conflict laptop 2024-03-09 140507)"},
+		{"/home/.config.json", "/home/.config (conflict laptop 2024-03-09 140507).json"},
+	}
+	for _, tt := range tests {
+		if got := ConflictName(tt.in, "laptop", at); got != tt.want {
+			t.Errorf("ConflictName(%q): want %q got %q", tt.in, tt.want, got)
+		}
+	}
+}
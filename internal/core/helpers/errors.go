@@ -1,15 +1,40 @@
 package helpers
 
-import "strings"
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+// StatusCode returns the HTTP status a failed WebDAV request carries in
+// err, 0 when it carries none. The code is taken from the typed error, never
+// from the message, which may contain digits of paths or chunk names.
+func StatusCode(err error) int {
+	var se gowebdav.StatusError
+	if errors.As(err, &se) {
+		return se.Status
+	}
+	return 0
+}
 
 func IsNotExistErr(err error) bool {
-	return err != nil && (strings.Contains(err.Error(), "404") || strings.Contains(err.Error(), "not found"))
+	return err != nil && (StatusCode(err) == http.StatusNotFound || errors.Is(err, fs.ErrNotExist))
 }
 
 func IsForbiddenErr(err error) bool {
-	return err != nil && (strings.Contains(err.Error(), "403") || strings.Contains(err.Error(), "forbidden"))
+	return StatusCode(err) == http.StatusForbidden
 }
 
 func IsRangeNotSatisfiableErr(err error) bool {
-	return err != nil && (strings.Contains(err.Error(), "416") || strings.Contains(strings.ToLower(err.Error()), "range not satisfiable"))
+	return StatusCode(err) == http.StatusRequestedRangeNotSatisfiable
+}
+
+func IsInsufficientStorageErr(err error) bool {
+	return StatusCode(err) == http.StatusInsufficientStorage
+}
+
+func IsPreconditionFailedErr(err error) bool {
+	return StatusCode(err) == http.StatusPreconditionFailed
 }
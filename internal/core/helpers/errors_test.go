@@ -0,0 +1,42 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+func TestStatusErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		notExist     bool
+		precondition bool
+		noSpace      bool
+	}{
+		{name: "nil", err: nil},
+		{name: "404", err: gowebdav.NewPathError("PROPFIND", "/a", 404), notExist: true},
+		{name: "wrapped 412", err: fmt.Errorf("upload: %w", gowebdav.NewPathError("PUT", "/a", 412)), precondition: true},
+		{name: "507", err: gowebdav.NewPathError("Write", "/a", 507), noSpace: true},
+		{name: "local missing file", err: &os.PathError{Op: "open", Path: "/x", Err: os.ErrNotExist}, notExist: true},
+		// digits in the message are not a status
+		{name: "digits in path", err: gowebdav.NewPathError("PUT", "/report-412-404-507.txt", 500)},
+		{name: "untyped text", err: errors.New("PUT chunk 00412: 404")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsNotExistErr(tt.err); got != tt.notExist {
+				t.Errorf("IsNotExistErr = %v, want %v", got, tt.notExist)
+			}
+			if got := IsPreconditionFailedErr(tt.err); got != tt.precondition {
+				t.Errorf("IsPreconditionFailedErr = %v, want %v", got, tt.precondition)
+			}
+			if got := IsInsufficientStorageErr(tt.err); got != tt.noSpace {
+				t.Errorf("IsInsufficientStorageErr = %v, want %v", got, tt.noSpace)
+			}
+		})
+	}
+}
@@ -2,12 +2,14 @@ package helpers
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/mimic/internal/core/cache"
 )
 
 const (
-	READAHEAD_DEFAULT int64 = 64 * 1024 // 64 KB mimimum readahead
+	READAHEAD_DEFAULT int64 = 64 * 1024       // 64 KB mimimum readahead
+	READAHEAD_MAX     int64 = 8 * 1024 * 1024 // default limit of the adaptive window
 )
 
 func PageAlignedRange(offset, length, remoteSize int64) (int64, int64) {
@@ -27,3 +29,89 @@ func PageAlignedRange(offset, length, remoteSize int64) (int64, int64) {
 
 	return reqPageStart, readAheadLen
 }
+
+// Readahead follows the reads of one handle and sizes the window to fetch
+// ahead of them. Every read continuing where the last one ended doubles the
+// window, up to the maximum; any other read starts over at
+// READAHEAD_DEFAULT and stops prefetching until the reads are sequential
+// again.
+type Readahead struct {
+	mu       sync.Mutex
+	max      int64
+	window   int64
+	next     int64 // where a sequential read starts
+	ahead    int64 // end of the data prefetched so far
+	inflight bool
+}
+
+// NewReadahead returns a Readahead whose window grows up to max bytes.
+func NewReadahead(max int64) *Readahead {
+	return &Readahead{max: max, window: READAHEAD_DEFAULT}
+}
+
+// Observe records a read of [offset, offset+length) and returns the window
+// to prefetch after it, 0 for a read that is not part of a sequence.
+func (r *Readahead) Observe(offset, length int64) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// reads overlapping the end of the last one still count: the kernel
+	// splits and reorders large reads a little
+	sequential := r.next > 0 && offset <= r.next && offset+length > r.next
+	if !sequential {
+		r.window = READAHEAD_DEFAULT
+		r.ahead = 0
+		r.next = offset + length
+		return 0
+	}
+	r.next = offset + length
+	r.window = min(2*r.window, max(r.max, READAHEAD_DEFAULT))
+	return r.window
+}
+
+// Claim returns the range to prefetch for a sequence reading from offset
+// with the given window, or ok false when it is mostly prefetched already or
+// another prefetch still runs. A claimed range must be released with Done.
+func (r *Readahead) Claim(offset, window, size int64) (start, end int64, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.inflight || window <= 0 {
+		return 0, 0, false
+	}
+	start = max(offset, r.ahead)
+	start -= start % cache.PageSize
+	end = min(offset+window, size)
+	// wait until at least half a window is missing
+	if end-start < window/2 && end < size || start >= end {
+		return 0, 0, false
+	}
+	r.inflight = true
+	r.ahead = end
+	return start, end, true
+}
+
+// Done releases the range of the last Claim. A failed prefetch is retried
+// by the next Claim.
+func (r *Readahead) Done(start int64, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inflight = false
+	if !ok {
+		r.ahead = min(r.ahead, start)
+	}
+}
+
+// PrefetchParts splits [start, end) into up to n page aligned parts of at
+// least READAHEAD_DEFAULT bytes, to be fetched in parallel.
+func PrefetchParts(start, end int64, n int) [][2]int64 {
+	if end <= start {
+		return nil
+	}
+	part := max((end-start+int64(n)-1)/int64(n), READAHEAD_DEFAULT)
+	part += (cache.PageSize - part%cache.PageSize) % cache.PageSize
+	var out [][2]int64
+	for off := start; off < end; off += part {
+		out = append(out, [2]int64{off, min(off+part, end)})
+	}
+	return out
+}
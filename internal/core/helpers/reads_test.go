@@ -74,3 +74,71 @@ func TestPageAlignedRange(t *testing.T) {
 		})
 	}
 }
+
+func TestReadaheadGrowsForSequentialReads(t *testing.T) {
+	r := NewReadahead(1024 * 1024)
+
+	if w := r.Observe(0, 4096); w != 0 {
+		t.Fatalf("first read should not prefetch, window=%d", w)
+	}
+	want := READAHEAD_DEFAULT
+	for off := int64(4096); off < 10*4096; off += 4096 {
+		want = min(2*want, 1024*1024)
+		if w := r.Observe(off, 4096); w != want {
+			t.Fatalf("read at %d: window=%d want %d", off, w, want)
+		}
+	}
+
+	// a seek starts over
+	if w := r.Observe(1<<30, 4096); w != 0 {
+		t.Fatalf("random read should not prefetch, window=%d", w)
+	}
+	if w := r.Observe(1<<30+4096, 4096); w != 2*READAHEAD_DEFAULT {
+		t.Fatalf("window after a seek: %d", w)
+	}
+}
+
+func TestReadaheadClaim(t *testing.T) {
+	r := NewReadahead(1024 * 1024)
+	const window = 256 * 1024
+
+	start, end, ok := r.Claim(4096, window, 10*1024*1024)
+	if !ok || start != 4096 || end != 4096+window {
+		t.Fatalf("Claim = %d, %d, %v", start, end, ok)
+	}
+	if _, _, ok := r.Claim(8192, window, 10*1024*1024); ok {
+		t.Fatalf("a second prefetch must wait for the running one")
+	}
+	r.Done(start, true)
+
+	// most of the window is prefetched already
+	if _, _, ok := r.Claim(8192, window, 10*1024*1024); ok {
+		t.Fatalf("prefetched range claimed again")
+	}
+	start, end, ok = r.Claim(window, window, 10*1024*1024)
+	if !ok || start != 4096+window || end != 2*window {
+		t.Fatalf("Claim continuing the prefetch = %d, %d, %v", start, end, ok)
+	}
+	// a failed prefetch is retried
+	r.Done(start, false)
+	if s, _, ok := r.Claim(window, window, 10*1024*1024); !ok || s != start {
+		t.Fatalf("failed range not claimed again: %d %v", s, ok)
+	}
+	r.Done(start, true)
+
+	// the file ends before the window
+	if s, e, ok := r.Claim(2*window, window, 2*window+100); !ok || s != 2*window || e != 2*window+100 {
+		t.Fatalf("Claim at the end = %d, %d, %v", s, e, ok)
+	}
+}
+
+func TestPrefetchParts(t *testing.T) {
+	parts := PrefetchParts(0, 1024*1024, 4)
+	if len(parts) != 4 || parts[0] != [2]int64{0, 256 * 1024} || parts[3][1] != 1024*1024 {
+		t.Fatalf("unexpected parts: %v", parts)
+	}
+	// small windows are not split below READAHEAD_DEFAULT
+	if parts := PrefetchParts(4096, 4096+100000, 4); len(parts) != 2 || parts[1][1] != 4096+100000 {
+		t.Fatalf("unexpected parts: %v", parts)
+	}
+}
@@ -0,0 +1,511 @@
+package journal
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// On-disk layout: every journaled path owns one or more segment files named
+// <sha256(path)[:32]>-<generation>.jnl inside the spool directory. A segment
+// starts with a header (magic + path) followed by records:
+//
+//	kind(1) | offset(8) | length(4) | crc32(4) | data(length)
+//
+// A write record ('W') carries data for offset; a truncate record ('T') has
+// no data and stores the new file size in the offset field.
+//
+// Segments are append-only. Seal closes the active segment so that an upload
+// of everything written so far can be matched to a generation; once that
+// upload succeeds, Discard removes all segments up to that generation.
+const (
+	segmentExt = ".jnl"
+	magic      = "MIMICJ1\n"
+
+	recordWrite    byte = 'W'
+	recordTruncate byte = 'T'
+
+	recordHeaderSize = 1 + 8 + 4 + 4
+	maxPathLen       = 1<<16 - 1
+)
+
+var (
+	ErrCorrupt     = errors.New("corrupt journal segment")
+	ErrPathTooLong = errors.New("journal path too long")
+)
+
+type segment struct {
+	file *os.File
+	gen  uint64
+}
+
+// Journal persists dirty writes to a local spool directory so that data
+// which has not reached the server yet survives crashes and can be replayed
+// on the next mount.
+type Journal struct {
+	dir string
+
+	mu     sync.Mutex
+	active map[string]*segment // path -> open segment
+	gens   map[string]uint64   // path -> highest generation seen
+}
+
+// Extent is a contiguous range of journaled bytes.
+type Extent struct {
+	Offset int64
+	Data   []byte
+}
+
+// record is one journaled operation.
+type record struct {
+	kind byte
+	Extent
+}
+
+// Recovery reports the outcome of replaying one journaled path.
+type Recovery struct {
+	Path    string
+	Bytes   int64
+	Extents int
+	Err     error
+}
+
+// Namespace returns a directory name unique to a server/user pair so that
+// several mounts can share one spool directory without replaying each
+// other's journals.
+func Namespace(url, username string) string {
+	sum := sha256.Sum256([]byte(username + "@" + url))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Open opens (creating if necessary) the journal rooted at dir.
+func Open(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("cannot create spool directory: %w", err)
+	}
+
+	j := &Journal{
+		dir:    dir,
+		active: make(map[string]*segment),
+		gens:   make(map[string]uint64),
+	}
+	return j, nil
+}
+
+// Dir returns the spool directory used by the journal.
+func (j *Journal) Dir() string {
+	return j.dir
+}
+
+func pathKey(p string) string {
+	sum := sha256.Sum256([]byte(p))
+	return hex.EncodeToString(sum[:16])
+}
+
+func segmentName(key string, gen uint64) string {
+	return fmt.Sprintf("%s-%08d%s", key, gen, segmentExt)
+}
+
+func parseSegmentName(name string) (key string, gen uint64, ok bool) {
+	if !strings.HasSuffix(name, segmentExt) {
+		return "", 0, false
+	}
+	base := strings.TrimSuffix(name, segmentExt)
+	idx := strings.LastIndexByte(base, '-')
+	if idx <= 0 {
+		return "", 0, false
+	}
+	gen, err := strconv.ParseUint(base[idx+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return base[:idx], gen, true
+}
+
+// segmentsFor lists the on-disk generations for key in ascending order.
+func (j *Journal) segmentsFor(key string) ([]uint64, error) {
+	matches, err := filepath.Glob(filepath.Join(j.dir, key+"-*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+	gens := make([]uint64, 0, len(matches))
+	for _, m := range matches {
+		k, gen, ok := parseSegmentName(filepath.Base(m))
+		if ok && k == key {
+			gens = append(gens, gen)
+		}
+	}
+	sort.Slice(gens, func(a, b int) bool { return gens[a] < gens[b] })
+	return gens, nil
+}
+
+// openSegmentLocked returns the active segment for p, creating a new
+// generation if there is none. Caller must hold j.mu.
+func (j *Journal) openSegmentLocked(p string) (*segment, error) {
+	if seg, ok := j.active[p]; ok {
+		return seg, nil
+	}
+	if len(p) > maxPathLen {
+		return nil, ErrPathTooLong
+	}
+
+	key := pathKey(p)
+	gen, known := j.gens[p]
+	if !known {
+		existing, err := j.segmentsFor(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(existing) > 0 {
+			gen = existing[len(existing)-1]
+		}
+	}
+	gen++
+
+	f, err := os.OpenFile(filepath.Join(j.dir, segmentName(key, gen)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(magic)+2+len(p))
+	header = append(header, magic...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(p)))
+	header = append(header, p...)
+	if _, err := f.Write(header); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	seg := &segment{file: f, gen: gen}
+	j.active[p] = seg
+	j.gens[p] = gen
+	return seg, nil
+}
+
+// Append records a write of data at offset for path p.
+func (j *Journal) Append(p string, offset int64, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return j.appendRecord(p, recordWrite, offset, data)
+}
+
+// Truncate records that p was truncated or extended to size bytes.
+func (j *Journal) Truncate(p string, size int64) error {
+	return j.appendRecord(p, recordTruncate, size, nil)
+}
+
+func (j *Journal) appendRecord(p string, kind byte, offset int64, data []byte) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	seg, err := j.openSegmentLocked(p)
+	if err != nil {
+		return err
+	}
+
+	rec := make([]byte, recordHeaderSize, recordHeaderSize+len(data))
+	rec[0] = kind
+	binary.BigEndian.PutUint64(rec[1:9], uint64(offset))
+	binary.BigEndian.PutUint32(rec[9:13], uint32(len(data)))
+	binary.BigEndian.PutUint32(rec[13:17], crc32.ChecksumIEEE(data))
+	rec = append(rec, data...)
+
+	_, err = seg.file.Write(rec)
+	return err
+}
+
+// Sync flushes the active segment of p to stable storage.
+func (j *Journal) Sync(p string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	seg, ok := j.active[p]
+	if !ok {
+		return nil
+	}
+	return seg.file.Sync()
+}
+
+// Seal syncs and closes the active segment of p and returns its generation.
+// Writes appended afterwards go to a new segment. The returned generation is
+// meant to be passed to Discard once everything written so far has been
+// committed to the server. A zero generation means nothing was journaled.
+func (j *Journal) Seal(p string) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	seg, ok := j.active[p]
+	if !ok {
+		return j.gens[p], nil
+	}
+	delete(j.active, p)
+
+	err := seg.file.Sync()
+	if cerr := seg.file.Close(); err == nil {
+		err = cerr
+	}
+	return seg.gen, err
+}
+
+// Discard removes all sealed segments of p up to and including gen.
+func (j *Journal) Discard(p string, gen uint64) error {
+	if gen == 0 {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	gens, err := j.segmentsFor(pathKey(p))
+	if err != nil {
+		return err
+	}
+
+	var errs error
+	for _, g := range gens {
+		if g > gen {
+			break
+		}
+		if seg, ok := j.active[p]; ok && seg.gen == g {
+			continue
+		}
+		if err := os.Remove(filepath.Join(j.dir, segmentName(pathKey(p), g))); err != nil && !os.IsNotExist(err) {
+			errs = errors.Join(errs, err)
+		}
+	}
+	return errs
+}
+
+// Close closes all active segments. Journaled data stays on disk.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var errs error
+	for p, seg := range j.active {
+		errs = errors.Join(errs, seg.file.Sync(), seg.file.Close())
+		delete(j.active, p)
+	}
+	return errs
+}
+
+// readSegment returns the path stored in a segment and its records in write
+// order. A torn record at the end of the segment (crash during append) is
+// ignored; everything before it is returned.
+func readSegment(file string) (string, []record, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	head := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return "", nil, ErrCorrupt
+	}
+	if string(head[:len(magic)]) != magic {
+		return "", nil, ErrCorrupt
+	}
+	pathBuf := make([]byte, binary.BigEndian.Uint16(head[len(magic):]))
+	if _, err := io.ReadFull(r, pathBuf); err != nil {
+		return "", nil, ErrCorrupt
+	}
+
+	var records []record
+	hdr := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			break
+		}
+		if hdr[0] != recordWrite && hdr[0] != recordTruncate {
+			break
+		}
+		offset := int64(binary.BigEndian.Uint64(hdr[1:9]))
+		length := binary.BigEndian.Uint32(hdr[9:13])
+		sum := binary.BigEndian.Uint32(hdr[13:17])
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(data) != sum || offset < 0 {
+			break
+		}
+		if hdr[0] == recordTruncate && length != 0 {
+			break
+		}
+		records = append(records, record{kind: hdr[0], Extent: Extent{Offset: offset, Data: data}})
+	}
+
+	return string(pathBuf), records, nil
+}
+
+// truncation summarizes the truncate records of a path: the remote file has
+// to be cut to Min bytes (dropping everything after it) and then resized to
+// Last bytes, before the extents are written.
+type truncation struct {
+	Set       bool
+	Min, Last int64
+}
+
+// clipExtents drops the bytes of extents at or past size.
+func clipExtents(extents []Extent, size int64) []Extent {
+	out := extents[:0]
+	for _, e := range extents {
+		if e.Offset >= size {
+			continue
+		}
+		if end := e.Offset + int64(len(e.Data)); end > size {
+			e.Data = e.Data[:size-e.Offset]
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// mergeExtents applies records in order and returns the resulting disjoint
+// extents sorted by offset. Later records override earlier ones where they
+// overlap; adjacent extents are coalesced. Truncate records cut the extents
+// written before them.
+func mergeExtents(records []record) ([]Extent, truncation) {
+	var out []Extent
+	var trunc truncation
+	for _, rec := range records {
+		if rec.kind == recordTruncate {
+			out = clipExtents(out, rec.Offset)
+			if !trunc.Set || rec.Offset < trunc.Min {
+				trunc.Min = rec.Offset
+			}
+			trunc.Set = true
+			trunc.Last = rec.Offset
+			continue
+		}
+
+		start := rec.Offset
+		end := rec.Offset + int64(len(rec.Data))
+
+		lo, hi := start, end
+		var kept, touched []Extent
+		for _, e := range out {
+			eEnd := e.Offset + int64(len(e.Data))
+			if eEnd < start || e.Offset > end {
+				kept = append(kept, e)
+				continue
+			}
+			touched = append(touched, e)
+			lo = min(lo, e.Offset)
+			hi = max(hi, eEnd)
+		}
+
+		buf := rec.Data
+		if len(touched) > 0 {
+			buf = make([]byte, hi-lo)
+			for _, e := range touched {
+				copy(buf[e.Offset-lo:], e.Data)
+			}
+			copy(buf[start-lo:], rec.Data)
+		}
+		out = append(kept, Extent{Offset: lo, Data: buf})
+	}
+
+	sort.Slice(out, func(a, b int) bool { return out[a].Offset < out[b].Offset })
+	return out, trunc
+}
+
+// Replay uploads every journaled path using truncate and write and removes
+// the segments of paths that were committed successfully. Segments of paths
+// that fail are kept for the next attempt.
+func (j *Journal) Replay(write func(p string, offset int64, data []byte) error, truncate func(p string, size int64) error) ([]Recovery, error) {
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byKey := make(map[string][]uint64)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		key, gen, ok := parseSegmentName(e.Name())
+		if !ok {
+			continue
+		}
+		byKey[key] = append(byKey[key], gen)
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for k := range byKey {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var report []Recovery
+	for _, key := range keys {
+		gens := byKey[key]
+		sort.Slice(gens, func(a, b int) bool { return gens[a] < gens[b] })
+
+		var p string
+		var records []record
+		var rerr error
+		for _, gen := range gens {
+			sp, recs, err := readSegment(filepath.Join(j.dir, segmentName(key, gen)))
+			if err != nil {
+				rerr = errors.Join(rerr, fmt.Errorf("segment %d: %w", gen, err))
+				continue
+			}
+			p = sp
+			records = append(records, recs...)
+		}
+
+		if p == "" {
+			report = append(report, Recovery{Path: key, Err: rerr})
+			continue
+		}
+
+		rec := Recovery{Path: p, Err: rerr}
+		extents, trunc := mergeExtents(records)
+		if trunc.Set {
+			err := truncate(p, trunc.Min)
+			if err == nil && trunc.Last != trunc.Min {
+				err = truncate(p, trunc.Last)
+			}
+			if err != nil {
+				rec.Err = errors.Join(rec.Err, err)
+				extents = nil
+			}
+		}
+		for _, ext := range extents {
+			if err := write(p, ext.Offset, ext.Data); err != nil {
+				rec.Err = errors.Join(rec.Err, err)
+				break
+			}
+			rec.Bytes += int64(len(ext.Data))
+			rec.Extents++
+		}
+
+		if rec.Err == nil {
+			for _, gen := range gens {
+				if err := os.Remove(filepath.Join(j.dir, segmentName(key, gen))); err != nil && !os.IsNotExist(err) {
+					rec.Err = errors.Join(rec.Err, err)
+				}
+			}
+		}
+		report = append(report, rec)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,160 @@
+package journal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type write struct {
+	path   string
+	offset int64
+	data   string
+}
+
+func replayAll(t *testing.T, j *Journal) ([]Recovery, []write) {
+	t.Helper()
+	var got []write
+	report, err := j.Replay(func(p string, offset int64, data []byte) error {
+		got = append(got, write{p, offset, string(data)})
+		return nil
+	}, func(p string, size int64) error {
+		t.Fatalf("unexpected truncate of %s to %d", p, size)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	return report, got
+}
+
+func TestReplayMergesRecords(t *testing.T) {
+	dir := t.TempDir()
+	j, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	_ = j.Append("/doc.txt", 0, []byte("hello"))
+	_ = j.Append("/doc.txt", 5, []byte(" world"))
+	_ = j.Append("/doc.txt", 0, []byte("J"))
+	_ = j.Append("/doc.txt", 100, []byte("tail"))
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	j2, _ := Open(dir)
+	report, got := replayAll(t, j2)
+
+	want := []write{{"/doc.txt", 0, "Jello world"}, {"/doc.txt", 100, "tail"}}
+	if len(got) != len(want) {
+		t.Fatalf("replayed writes: want %v got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("replayed write %d: want %v got %v", i, want[i], got[i])
+		}
+	}
+	if len(report) != 1 || report[0].Bytes != 15 || report[0].Extents != 2 || report[0].Err != nil {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	if _, again := replayAll(t, j2); len(again) != 0 {
+		t.Fatalf("segments should be removed after successful replay, got %v", again)
+	}
+}
+
+func TestDiscardKeepsNewerGenerations(t *testing.T) {
+	j, _ := Open(t.TempDir())
+
+	_ = j.Append("/f", 0, []byte("old"))
+	gen, err := j.Seal("/f")
+	if err != nil || gen == 0 {
+		t.Fatalf("Seal: gen=%d err=%v", gen, err)
+	}
+	_ = j.Append("/f", 3, []byte("new"))
+
+	if err := j.Discard("/f", gen); err != nil {
+		t.Fatalf("Discard failed: %v", err)
+	}
+	_ = j.Close()
+
+	_, got := replayAll(t, j)
+	if len(got) != 1 || got[0] != (write{"/f", 3, "new"}) {
+		t.Fatalf("only the newer generation should remain, got %v", got)
+	}
+}
+
+func TestTornRecordIsIgnored(t *testing.T) {
+	dir := t.TempDir()
+	j, _ := Open(dir)
+	_ = j.Append("/f", 0, []byte("complete"))
+	_ = j.Append("/f", 8, []byte("partial-record"))
+	_ = j.Close()
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(matches) != 1 {
+		t.Fatalf("expected one segment, got %v", matches)
+	}
+	fi, _ := os.Stat(matches[0])
+	if err := os.Truncate(matches[0], fi.Size()-4); err != nil {
+		t.Fatalf("truncate segment: %v", err)
+	}
+
+	_, got := replayAll(t, j)
+	if len(got) != 1 || got[0] != (write{"/f", 0, "complete"}) {
+		t.Fatalf("expected only the complete record, got %v", got)
+	}
+}
+
+func TestFailedReplayKeepsSegments(t *testing.T) {
+	j, _ := Open(t.TempDir())
+	_ = j.Append("/f", 0, []byte("data"))
+	_ = j.Close()
+
+	report, err := j.Replay(func(string, int64, []byte) error { return errors.New("offline") }, nil)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(report) != 1 || report[0].Err == nil {
+		t.Fatalf("expected failure in report, got %+v", report)
+	}
+
+	_, got := replayAll(t, j)
+	if len(got) != 1 || !bytes.Equal([]byte(got[0].data), []byte("data")) {
+		t.Fatalf("segment should survive failed replay, got %v", got)
+	}
+}
+
+func TestReplayTruncate(t *testing.T) {
+	j, _ := Open(t.TempDir())
+	_ = j.Append("/f", 0, []byte("0123456789"))
+	_ = j.Truncate("/f", 4)
+	_ = j.Append("/f", 6, []byte("xy"))
+	_ = j.Truncate("/f", 7)
+	_ = j.Close()
+
+	var ops []string
+	report, err := j.Replay(func(p string, offset int64, data []byte) error {
+		ops = append(ops, fmt.Sprintf("W %d %s", offset, data))
+		return nil
+	}, func(p string, size int64) error {
+		ops = append(ops, fmt.Sprintf("T %d", size))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+
+	// cut to the smallest size first, then grow to the final one
+	want := []string{"T 4", "T 7", "W 0 0123", "W 6 x"}
+	if fmt.Sprint(ops) != fmt.Sprint(want) {
+		t.Fatalf("replayed ops: want %v got %v", want, ops)
+	}
+	if len(report) != 1 || report[0].Err != nil || report[0].Bytes != 5 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+}
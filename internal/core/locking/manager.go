@@ -1,20 +1,27 @@
 package locking
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"errors"
+	"slices"
 	"sync"
-	"time"
 )
 
 var (
 	ErrWouldBlock = errors.New("lock would block")
 	ErrNotOwner   = errors.New("not lock owner")
+	// ErrDeadlock is returned by AcquireWait when waiting would deadlock
+	// (EDEADLK): an owner holding a lock in the way waits, directly or not,
+	// for one the caller holds.
+	ErrDeadlock = errors.New("resource deadlock avoided")
 )
 
 type LockType int16
 
-// LockInfo describes an active lock
+// LockInfo describes an active lock. End is exclusive, 0 means up to the
+// end of the file.
 type LockInfo struct {
 	Owner []byte
 	Start uint64
@@ -29,142 +36,331 @@ const (
 	F_UNLCK LockType = 3
 )
 
+// eof is the end of ranges reaching the end of the file.
+const eof = ^uint64(0)
+
 type lockEntry struct {
-	info LockInfo
+	info LockInfo // End is eof for ranges up to the end of the file
 }
 
 type lockList struct {
-	mu    sync.Mutex
-	cond  *sync.Cond
 	locks []lockEntry
+	// changed is closed, and replaced, whenever locks are released or
+	// downgraded, waking the waiters
+	changed chan struct{}
+}
+
+// request is a lock an owner waits for in AcquireWait.
+type request struct {
+	key        string
+	start, end uint64
+	lockType   LockType
 }
 
+// LockManager keeps byte-range locks with the semantics of fcntl(2) record
+// locks: an owner holds at most one lock type per byte, so locking a range
+// it holds converts it (upgrade or downgrade) and unlocking part of a lock
+// splits it; adjacent ranges of the same type are merged.
 type LockManager struct {
-	mu    sync.Mutex
-	table map[string]*lockList
+	mu      sync.Mutex
+	table   map[string]*lockList
+	waiting map[string]request // by owner, see AcquireWait
 }
 
 func NewLockManager() *LockManager {
-	return &LockManager{table: make(map[string]*lockList)}
+	return &LockManager{table: make(map[string]*lockList), waiting: make(map[string]request)}
 }
 
-func (lm *LockManager) getList(key string) *lockList {
-	lm.mu.Lock()
-	defer lm.mu.Unlock()
+// getListLocked returns the locks of key, created when create is set and
+// it has none. Caller holds lm.mu.
+func (lm *LockManager) getListLocked(key string, create bool) *lockList {
 	l, ok := lm.table[key]
-	if !ok {
-		l = &lockList{}
-		l.cond = sync.NewCond(&l.mu)
+	if !ok && create {
+		l = &lockList{changed: make(chan struct{})}
 		lm.table[key] = l
 	}
 	return l
 }
 
+func normEnd(end uint64) uint64 {
+	if end == 0 {
+		return eof
+	}
+	return end
+}
+
 func overlap(aStart, aEnd, bStart, bEnd uint64) bool {
-	if aEnd <= 0 {
-		aEnd = uint64(^uint64(0) >> 1) // large
+	return aStart < bEnd && bStart < aEnd
+}
+
+// conflictsLocked returns the owners whose locks on key keep owner from
+// taking lockType over [start, end). Caller holds lm.mu.
+func (lm *LockManager) conflictsLocked(key string, owner []byte, start, end uint64, lockType LockType) []string {
+	l := lm.getListLocked(key, false)
+	if l == nil || lockType == F_UNLCK {
+		return nil
 	}
-	if bEnd <= 0 {
-		bEnd = uint64(^uint64(0) >> 1)
+	var owners []string
+	for _, e := range l.locks {
+		if string(e.info.Owner) == string(owner) || !overlap(start, end, e.info.Start, e.info.End) {
+			continue
+		}
+		// shared vs shared ok
+		if (e.info.Type == F_WRLCK || lockType == F_WRLCK) && !slices.Contains(owners, string(e.info.Owner)) {
+			owners = append(owners, string(e.info.Owner))
+		}
 	}
-	return aStart < bEnd && bStart < aEnd
+	return owners
 }
 
-// Acquire tries to acquire a lock non-blocking. Returns ErrWouldBlock if conflict.
-func (lm *LockManager) Acquire(key string, owner []byte, start, end uint64, lockType LockType) error {
-	l := lm.getList(key)
-	l.mu.Lock()
-	defer l.mu.Unlock()
+// setLocked makes owner hold lockType over [start, end) of key, F_UNLCK
+// releasing the range. Parts of its locks outside the range are kept, and
+// the result is merged with adjacent locks of the same type. Reports
+// whether owner held anything in the range. Caller holds lm.mu.
+func (lm *LockManager) setLocked(key string, owner []byte, start, end uint64, lockType LockType) bool {
+	l := lm.getListLocked(key, lockType != F_UNLCK)
+	if l == nil {
+		return false
+	}
 
+	held := false
+	weakened := false
+	locks := make([]lockEntry, 0, len(l.locks)+2)
 	for _, e := range l.locks {
-		if overlap(start, end, e.info.Start, e.info.End) {
-			// shared vs shared ok
-			if e.info.Type == F_WRLCK || lockType == F_WRLCK {
-				return ErrWouldBlock
+		if string(e.info.Owner) != string(owner) || !overlap(start, end, e.info.Start, e.info.End) {
+			locks = append(locks, e)
+			continue
+		}
+		held = true
+		if e.info.Type == F_WRLCK && lockType != F_WRLCK || lockType == F_UNLCK {
+			weakened = true
+		}
+		if e.info.Start < start {
+			before := e
+			before.info.End = start
+			locks = append(locks, before)
+		}
+		if e.info.End > end {
+			after := e
+			after.info.Start = end
+			locks = append(locks, after)
+		}
+	}
+	if lockType != F_UNLCK {
+		locks = append(locks, lockEntry{info: LockInfo{Owner: append([]byte(nil), owner...), Start: start, End: end, Type: lockType, PID: -1}})
+	}
+	l.locks = mergeLocks(locks)
+
+	if weakened {
+		close(l.changed)
+		l.changed = make(chan struct{})
+	}
+	if len(l.locks) == 0 {
+		delete(lm.table, key)
+	}
+	return held
+}
+
+// mergeLocks sorts locks by owner and start and joins the touching ranges
+// of one owner and type.
+func mergeLocks(locks []lockEntry) []lockEntry {
+	slices.SortFunc(locks, func(a, b lockEntry) int {
+		if c := bytes.Compare(a.info.Owner, b.info.Owner); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.info.Start, b.info.Start)
+	})
+	out := locks[:0]
+	for _, e := range locks {
+		if n := len(out); n > 0 {
+			last := &out[n-1].info
+			if string(last.Owner) == string(e.info.Owner) && last.Type == e.info.Type && e.info.Start <= last.End {
+				last.End = max(last.End, e.info.End)
+				continue
 			}
 		}
+		out = append(out, e)
 	}
+	return out
+}
 
-	le := lockEntry{info: LockInfo{Owner: append([]byte(nil), owner...), Start: start, End: end, Type: lockType, PID: -1}}
-	l.locks = append(l.locks, le)
+// deadlockLocked reports whether owner waiting for blockers would close a
+// cycle: one of them waits, directly or through other owners, for owner.
+// Caller holds lm.mu.
+func (lm *LockManager) deadlockLocked(owner string, blockers []string) bool {
+	seen := make(map[string]bool)
+	var waitsFor func(o string) bool
+	waitsFor = func(o string) bool {
+		if o == owner {
+			return true
+		}
+		if seen[o] {
+			return false
+		}
+		seen[o] = true
+		r, ok := lm.waiting[o]
+		if !ok {
+			return false
+		}
+		for _, b := range lm.conflictsLocked(r.key, []byte(o), r.start, r.end, r.lockType) {
+			if waitsFor(b) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, b := range blockers {
+		if waitsFor(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// Acquire tries to acquire a lock non-blocking. Returns ErrWouldBlock if
+// another owner holds a conflicting one. A range owner holds already is
+// converted to lockType; F_UNLCK releases it.
+func (lm *LockManager) Acquire(key string, owner []byte, start, end uint64, lockType LockType) error {
+	end = normEnd(end)
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	if len(lm.conflictsLocked(key, owner, start, end, lockType)) > 0 {
+		return ErrWouldBlock
+	}
+	lm.setLocked(key, owner, start, end, lockType)
 	return nil
 }
 
 // AcquireWait waits until the lock can be acquired or context is cancelled.
+// Returns ErrDeadlock instead of waiting for an owner that waits for the
+// caller.
 func (lm *LockManager) AcquireWait(ctx context.Context, key string, owner []byte, start, end uint64, lockType LockType) error {
-	l := lm.getList(key)
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	end = normEnd(end)
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	defer delete(lm.waiting, string(owner))
 
 	for {
-		conflict := false
-		for _, e := range l.locks {
-			if overlap(start, end, e.info.Start, e.info.End) {
-				if e.info.Type == F_WRLCK || lockType == F_WRLCK {
-					conflict = true
-					break
-				}
-			}
-		}
-		if !conflict {
-			le := lockEntry{info: LockInfo{Owner: append([]byte(nil), owner...), Start: start, End: end, Type: lockType, PID: -1}}
-			l.locks = append(l.locks, le)
+		blockers := lm.conflictsLocked(key, owner, start, end, lockType)
+		if len(blockers) == 0 {
+			lm.setLocked(key, owner, start, end, lockType)
 			return nil
 		}
+		if lm.deadlockLocked(string(owner), blockers) {
+			return ErrDeadlock
+		}
+		lm.waiting[string(owner)] = request{key: key, start: start, end: end, lockType: lockType}
 
-		// wait with context
-		done := make(chan struct{})
-		go func() {
-			l.cond.Wait()
-			close(done)
-		}()
-
+		changed := lm.getListLocked(key, false).changed
+		lm.mu.Unlock()
 		select {
 		case <-ctx.Done():
-			// Wake up any sleepers and return
-			l.cond.Broadcast()
+			lm.mu.Lock()
 			return ctx.Err()
-		case <-done:
-			// try again
-		case <-time.After(5 * time.Second):
-			// periodic wake to recheck context
+		case <-changed:
+			lm.mu.Lock()
 		}
 	}
 }
 
-// Release releases locks that match owner and overlapping range. Returns ErrNotOwner if no matching lock.
+// Release releases the locks owner holds in the range, splitting those
+// reaching beyond it. Returns ErrNotOwner if owner holds none there.
 func (lm *LockManager) Release(key string, owner []byte, start, end uint64) error {
-	l := lm.getList(key)
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
 
-	removed := false
-	var remaining []lockEntry
+	if !lm.setLocked(key, owner, start, normEnd(end), F_UNLCK) {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// ReleaseOwner releases every lock owner holds on key, as closing a file
+// does for fcntl locks.
+func (lm *LockManager) ReleaseOwner(key string, owner []byte) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.setLocked(key, owner, 0, eof, F_UNLCK)
+}
+
+// Owned returns the locks owner holds on key within the range, cut to it.
+// Passed to Restore, they undo a later Acquire of the range.
+func (lm *LockManager) Owned(key string, owner []byte, start, end uint64) []LockInfo {
+	end = normEnd(end)
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	l := lm.getListLocked(key, false)
+	if l == nil {
+		return nil
+	}
+	var owned []LockInfo
 	for _, e := range l.locks {
-		if string(e.info.Owner) == string(owner) && overlap(start, end, e.info.Start, e.info.End) {
-			removed = true
+		if string(e.info.Owner) != string(owner) || !overlap(start, end, e.info.Start, e.info.End) {
 			continue
 		}
-		remaining = append(remaining, e)
+		info := e.info
+		info.Start, info.End = max(info.Start, start), min(info.End, end)
+		owned = append(owned, info)
 	}
-	if !removed {
-		return ErrNotOwner
+	return owned
+}
+
+// Restore makes the locks owner holds within the range those of prev, as
+// returned by Owned before the range changed.
+func (lm *LockManager) Restore(key string, owner []byte, start, end uint64, prev []LockInfo) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lm.setLocked(key, owner, start, normEnd(end), F_UNLCK)
+	for _, info := range prev {
+		lm.setLocked(key, owner, info.Start, info.End, info.Type)
 	}
-	l.locks = remaining
-	l.cond.Broadcast()
-	return nil
 }
 
-// Query returns one conflicting lock (if any). Returns (info, true) if conflict exists.
+// Query returns one lock overlapping the range (if any). Returns (info,
+// true) if one exists.
 func (lm *LockManager) Query(key string, start, end uint64) (LockInfo, bool) {
-	l := lm.getList(key)
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	end = normEnd(end)
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
 
+	l := lm.getListLocked(key, false)
+	if l == nil {
+		return LockInfo{}, false
+	}
 	for _, e := range l.locks {
 		if overlap(start, end, e.info.Start, e.info.End) {
-			return e.info, true
+			return e.info.external(), true
 		}
 	}
 	return LockInfo{}, false
 }
+
+// Holds reports whether a lock of lockType is held on key.
+func (lm *LockManager) Holds(key string, lockType LockType) bool {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	l := lm.getListLocked(key, false)
+	if l == nil {
+		return false
+	}
+	for _, e := range l.locks {
+		if e.info.Type == lockType {
+			return true
+		}
+	}
+	return false
+}
+
+// external returns a copy of the stored lock with End 0 for locks up to
+// the end of the file.
+func (i LockInfo) external() LockInfo {
+	i.Owner = append([]byte(nil), i.Owner...)
+	if i.End == eof {
+		i.End = 0
+	}
+	return i
+}
@@ -0,0 +1,363 @@
+package metastore
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mimic/internal/core/cache"
+)
+
+// On-disk layout: one file of JSON lines, each a record putting or deleting
+// the cache entry of a path. Records are appended as the cache changes; the
+// file is rewritten with only the live entries when it is loaded and when it
+// grew well past them. Records are queued as the cache changes, and encoded
+// and written by Flush, which the cache sweeper calls. Every restored entry is revalidated against the
+// server by its ETag before it is served, so records lost in a crash only
+// cost a refetch.
+const (
+	opPut    = "put"
+	opDelete = "del"
+
+	writeBuffer = 64 * 1024
+	// rewrite the file on Close once this many records were appended
+	compactAfter = 10000
+)
+
+// fileInfo is the persisted form of an os.FileInfo.
+type fileInfo struct {
+	FName    string      `json:"name"`
+	FSize    int64       `json:"size"`
+	FMode    os.FileMode `json:"mode"`
+	FModTime time.Time   `json:"mtime"`
+	FDir     bool        `json:"dir,omitempty"`
+	FETag    string      `json:"etag,omitempty"`
+	FTarget  string      `json:"target,omitempty"`
+	FPerm    *uint32     `json:"perm,omitempty"`
+	FUID     *uint32     `json:"uid,omitempty"`
+	FGID     *uint32     `json:"gid,omitempty"`
+}
+
+func (fi *fileInfo) Name() string       { return fi.FName }
+func (fi *fileInfo) Size() int64        { return fi.FSize }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.FMode }
+func (fi *fileInfo) ModTime() time.Time { return fi.FModTime }
+func (fi *fileInfo) IsDir() bool        { return fi.FDir }
+func (fi *fileInfo) Sys() any           { return nil }
+func (fi *fileInfo) ETag() string       { return fi.FETag }
+func (fi *fileInfo) Target() string     { return fi.FTarget }
+
+func (fi *fileInfo) Ownership() (perm, uid, gid *uint32) { return fi.FPerm, fi.FUID, fi.FGID }
+
+// owned is implemented by attributes carrying what chmod and chown set.
+type owned interface {
+	Ownership() (perm, uid, gid *uint32)
+}
+
+func newFileInfo(f os.FileInfo) *fileInfo {
+	fi := &fileInfo{
+		FName:    f.Name(),
+		FSize:    f.Size(),
+		FMode:    f.Mode(),
+		FModTime: f.ModTime(),
+		FDir:     f.IsDir(),
+	}
+	if e, ok := f.(interface{ ETag() string }); ok {
+		fi.FETag = e.ETag()
+	}
+	if l, ok := f.(interface{ Target() string }); ok {
+		fi.FTarget = l.Target()
+	}
+	if o, ok := f.(owned); ok {
+		fi.FPerm, fi.FUID, fi.FGID = o.Ownership()
+	}
+	return fi
+}
+
+// record is one line of the store.
+type record struct {
+	Op       string      `json:"op"`
+	Path     string      `json:"path"`
+	Info     *fileInfo   `json:"info,omitempty"`
+	IsDir    bool        `json:"isdir,omitempty"`
+	Listed   bool        `json:"listed,omitempty"` // Children holds a listing
+	Children []*fileInfo `json:"children,omitempty"`
+	ETag     string      `json:"etag,omitempty"`
+	Fetched  time.Time   `json:"fetched,omitzero"`
+}
+
+func (r *record) entry() *cache.CacheEntry {
+	e := &cache.CacheEntry{IsDir: r.IsDir, ETag: r.ETag}
+	if r.Info != nil {
+		e.Info = r.Info
+	}
+	if r.Listed {
+		e.Children = make([]os.FileInfo, len(r.Children))
+		for i, c := range r.Children {
+			e.Children[i] = c
+		}
+	}
+	return e
+}
+
+// Store persists the metadata cache entries that carry an ETag across
+// mounts. It implements cache.Persister.
+type Store struct {
+	path string
+
+	// mu guards the queue; Put and Delete run with the cache locked and
+	// only take it
+	mu       sync.Mutex
+	queue    []*record // not yet written, see Flush
+	appended int
+	closed   bool // Close ran or a write failed; later records are dropped
+
+	// wmu guards the file and serializes writing the queue. Taken before mu.
+	wmu sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+	err error // first write error; the store stops writing after it
+}
+
+// Open opens (creating if necessary) the store file at path.
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("cannot create metadata directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{path: path, f: f, w: bufio.NewWriterSize(f, writeBuffer)}, nil
+}
+
+// Path returns the file backing the store.
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Load restores the stored entries into c and compacts the file. Lines
+// that cannot be decoded, e.g. the torn last line after a crash, are
+// skipped. Returns the number of restored entries.
+func (s *Store) Load(c *cache.NodeCache) (int, error) {
+	s.wmu.Lock()
+	live, order, err := s.read()
+	if err == nil {
+		err = s.rewrite(live, order)
+	}
+	s.wmu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	// c may already persist to s and evict while restoring
+	for _, p := range order {
+		c.Restore(p, live[p].entry())
+	}
+	return len(order), nil
+}
+
+// read replays the file into the live records, keyed by path, and returns
+// their paths in the order they were last written. Caller holds s.wmu.
+func (s *Store) read() (map[string]*record, []string, error) {
+	if err := s.flush(); err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	live := make(map[string]*record)
+	seq := make(map[string]int)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 64<<20)
+	for n := 0; sc.Scan(); n++ {
+		var r record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil || r.Path == "" {
+			continue
+		}
+		switch r.Op {
+		case opPut:
+			live[r.Path] = &r
+			seq[r.Path] = n
+		case opDelete:
+			delete(live, r.Path)
+			delete(seq, r.Path)
+		}
+	}
+	if err := sc.Err(); err != nil && !errors.Is(err, bufio.ErrTooLong) {
+		return nil, nil, err
+	}
+
+	order := make([]string, 0, len(live))
+	for p := range live {
+		order = append(order, p)
+	}
+	slices.SortFunc(order, func(a, b string) int { return cmp.Compare(seq[a], seq[b]) })
+	return live, order, nil
+}
+
+// rewrite replaces the file with the live records. Caller holds s.wmu.
+func (s *Store) rewrite(live map[string]*record, order []string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(tmp, writeBuffer)
+	enc := json.NewEncoder(w)
+	for _, p := range order {
+		if err = enc.Encode(live[p]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		_ = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	_ = s.f.Close()
+	s.f = f
+	s.w = bufio.NewWriterSize(f, writeBuffer)
+	s.mu.Lock()
+	s.appended = len(s.queue)
+	s.mu.Unlock()
+	return nil
+}
+
+// append queues one record for the next Flush.
+func (s *Store) append(r *record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.queue = append(s.queue, r)
+	s.appended++
+}
+
+// flush encodes the queued records and writes them to the file. Caller
+// holds s.wmu.
+func (s *Store) flush() error {
+	s.mu.Lock()
+	queue := s.queue
+	s.queue = nil
+	s.mu.Unlock()
+
+	for _, r := range queue {
+		if s.err != nil {
+			break
+		}
+		data, err := json.Marshal(r)
+		if err == nil {
+			data = append(data, '\n')
+			_, err = s.w.Write(data)
+		}
+		s.err = err
+	}
+	if s.err == nil {
+		s.err = s.w.Flush()
+	}
+	if s.err != nil {
+		s.mu.Lock()
+		s.closed = true
+		s.queue = nil
+		s.mu.Unlock()
+	}
+	return s.err
+}
+
+// Put records the entry of path.
+func (s *Store) Put(path string, entry *cache.CacheEntry) {
+	r := &record{
+		Op:      opPut,
+		Path:    path,
+		IsDir:   entry.IsDir,
+		ETag:    entry.ETag,
+		Fetched: time.Now(),
+	}
+	if entry.Info != nil {
+		r.Info = newFileInfo(entry.Info)
+	}
+	if entry.Children != nil {
+		r.Listed = true
+		r.Children = make([]*fileInfo, len(entry.Children))
+		for i, c := range entry.Children {
+			r.Children[i] = newFileInfo(c)
+		}
+	}
+
+	s.append(r)
+}
+
+// Delete records that path has no entry anymore.
+func (s *Store) Delete(path string) {
+	s.append(&record{Op: opDelete, Path: path})
+}
+
+// Flush writes the queued records to the file. Returns the first write
+// error of the store.
+func (s *Store) Flush() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	return s.flush()
+}
+
+// Close flushes the store, compacting the file if it grew a lot since it
+// was loaded, and closes it. Later changes are not recorded.
+func (s *Store) Close() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	s.closed = true
+	appended := s.appended
+	s.mu.Unlock()
+	err := s.flush()
+	if err == nil && appended > compactAfter {
+		var (
+			live  map[string]*record
+			order []string
+		)
+		if live, order, err = s.read(); err == nil {
+			err = s.rewrite(live, order)
+		}
+	}
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	s.f = nil
+	if err == nil {
+		err = s.err
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package metastore
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mimic/internal/core/cache"
+)
+
+func taggedInfo(name, etag string, size int64) os.FileInfo {
+	return &fileInfo{FName: name, FSize: size, FMode: 0o644, FModTime: time.Unix(1700000000, 0), FETag: etag}
+}
+
+func openStore(t *testing.T, p string) *Store {
+	t.Helper()
+	s, err := Open(p)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return s
+}
+
+func TestStore_RestoresAcrossMounts(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "meta", "store.jsonl")
+
+	c := cache.NewNodeCache(time.Minute, 100)
+	s := openStore(t, p)
+	c.SetPersister(s)
+	c.Set("/a.txt", c.NewEntry(taggedInfo("a.txt", `"e1"`, 3)))
+	c.Set("/b.txt", c.NewEntry(taggedInfo("b.txt", `"e2"`, 4)))
+	c.SetChildren("/docs/", []os.FileInfo{taggedInfo("x", `"e3"`, 1)}, "ctag-1")
+	c.Set("/untagged", c.NewEntry(&fileInfo{FName: "untagged", FDir: true}))
+	c.Invalidate("/b.txt")
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	next := cache.NewNodeCache(time.Minute, 100)
+	s = openStore(t, p)
+	defer s.Close()
+	n, err := s.Load(next)
+	if err != nil || n != 2 {
+		t.Fatalf("Load: n=%d err=%v, want 2 entries", n, err)
+	}
+
+	// restored entries are only served after revalidation
+	if _, ok := next.Get("/a.txt"); ok {
+		t.Fatalf("restored entry served without revalidation")
+	}
+	entry, ok := next.Stale("/a.txt")
+	if !ok || entry.ETag != `"e1"` || entry.Info.Size() != 3 || entry.Info.Name() != "a.txt" {
+		t.Fatalf("restored file entry: %+v ok=%v", entry, ok)
+	}
+	listing, ok := next.Stale("/docs/")
+	if !ok || listing.ETag != "ctag-1" || len(listing.Children) != 1 || listing.Children[0].Name() != "x" {
+		t.Fatalf("restored listing: %+v ok=%v", listing, ok)
+	}
+	if e, ok := listing.Children[0].(interface{ ETag() string }); !ok || e.ETag() != `"e3"` {
+		t.Fatalf("child lost its etag")
+	}
+	if _, ok := next.Stale("/b.txt"); ok {
+		t.Fatalf("invalidated entry was restored")
+	}
+}
+
+func TestStore_LoadCompactsAndSkipsTornLines(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "store.jsonl")
+
+	c := cache.NewNodeCache(time.Minute, 100)
+	s := openStore(t, p)
+	c.SetPersister(s)
+	for i := range 5 {
+		// every new version replaces the record of the previous one
+		c.Set("/f", c.NewEntry(taggedInfo("f", strings.Repeat("v", i+1), int64(i))))
+	}
+	// the same version is not written again
+	c.Set("/f", c.NewEntry(taggedInfo("f", "vvvvv", 4)))
+	if s.appended != 5 {
+		t.Fatalf("appended %d records, want 5", s.appended)
+	}
+	_ = s.Close()
+
+	f, _ := os.OpenFile(p, os.O_APPEND|os.O_WRONLY, 0)
+	_, _ = f.WriteString(`{"op":"put","path":"/torn","info":{"na`)
+	_ = f.Close()
+
+	s = openStore(t, p)
+	defer s.Close()
+	next := cache.NewNodeCache(time.Minute, 100)
+	if n, err := s.Load(next); err != nil || n != 1 {
+		t.Fatalf("Load: n=%d err=%v", n, err)
+	}
+	data, _ := os.ReadFile(p)
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Fatalf("compacted file has %d lines, want 1:\n%s", lines, data)
+	}
+	if e, ok := next.Stale("/f"); !ok || e.Info.Size() != 4 {
+		t.Fatalf("latest version not restored: %+v", e)
+	}
+}
+
+func TestStore_SweeperFlushes(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "store.jsonl")
+
+	c := cache.NewNodeCache(time.Minute, 100)
+	s := openStore(t, p)
+	defer s.Close()
+	c.SetPersister(s)
+	stop := c.StartSweeper(5 * time.Millisecond)
+	defer stop()
+
+	// the record reaches the file without Close, so a crash keeps it
+	c.Set("/a.txt", c.NewEntry(taggedInfo("a.txt", `"e1"`, 3)))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		data, _ := os.ReadFile(p)
+		if strings.Contains(string(data), `"path":"/a.txt"`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("record not written by the sweeper:\n%s", data)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFileInfo_KeepsOwnership(t *testing.T) {
+	perm, uid := uint32(0o755), uint32(0)
+	data, err := json.Marshal(newFileInfo(&fileInfo{FName: "run.sh", FPerm: &perm, FUID: &uid}))
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var out fileInfo
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	p, u, g := out.Ownership()
+	if p == nil || *p != 0o755 || u == nil || *u != 0 || g != nil {
+		t.Fatalf("restored perm=%v uid=%v gid=%v", p, u, g)
+	}
+}
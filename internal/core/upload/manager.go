@@ -0,0 +1,341 @@
+package upload
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWorkers = 4
+	DefaultRetries = 5
+	DefaultBackoff = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+)
+
+var ErrClosed = errors.New("upload manager closed")
+
+// Extent is a range of the file a job commits.
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// Job is a snapshot of a dirty buffer waiting to be committed to the server.
+type Job struct {
+	Path string
+	// Data holds an image that goes to file offset Base. Snapshots of sparse
+	// buffers are given as Source, read at absolute file offsets, together
+	// with the Extents to commit instead.
+	Data    []byte
+	Base    int64
+	Source  io.ReaderAt
+	Extents []Extent
+	Create  bool
+	// Truncated asks for the remote file to be resized to TruncSize before
+	// the data is written.
+	Truncated bool
+	TruncSize int64
+	// ModTime, when set, is the modification time the file gets.
+	ModTime time.Time
+	// Gen is the journal generation covered by this snapshot.
+	Gen uint64
+	// Seq identifies the buffer state the snapshot was taken at.
+	Seq uint64
+	// ConflictCopy is the name the job's local changes were saved under
+	// after a conflict, so a retry overwrites that copy instead of adding
+	// another.
+	ConflictCopy string
+	// Release, when set, is called once the job finished or was replaced
+	// by a newer one, to free the resources of its snapshot.
+	Release func()
+}
+
+// Ranges returns the ranges of the file the job commits.
+func (j *Job) Ranges() []Extent {
+	if j.Source != nil {
+		return j.Extents
+	}
+	if len(j.Data) == 0 {
+		return nil
+	}
+	return []Extent{{Offset: j.Base, Length: int64(len(j.Data))}}
+}
+
+// Len returns the number of bytes the job commits.
+func (j *Job) Len() int64 {
+	var n int64
+	for _, e := range j.Ranges() {
+		n += e.Length
+	}
+	return n
+}
+
+// Reader returns the job's data, read at absolute file offsets.
+func (j *Job) Reader() io.ReaderAt {
+	if j.Source != nil {
+		return j.Source
+	}
+	return imageReader{data: j.Data, base: j.Base}
+}
+
+// imageReader reads data located at file offset base.
+type imageReader struct {
+	data []byte
+	base int64
+}
+
+func (r imageReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < r.base {
+		return 0, errors.New("read before image")
+	}
+	return bytes.NewReader(r.data).ReadAt(p, off-r.base)
+}
+
+func (j *Job) release() {
+	if j.Release != nil {
+		j.Release()
+	}
+}
+
+// Options configure a Manager. Zero values select the defaults.
+type Options struct {
+	Workers int
+	Retries int
+	Backoff time.Duration
+
+	// Upload commits a job. It is called from worker goroutines.
+	Upload func(job *Job) error
+	// Retryable reports whether a failed upload may succeed when retried.
+	// When nil every error is retried.
+	Retryable func(err error) bool
+	// Done is called after a job finished, successfully or not, before
+	// waiters are released. Pending does not count the finished job anymore.
+	Done func(job *Job, err error)
+}
+
+type entry struct {
+	job  *Job
+	done chan struct{}
+	err  error
+}
+
+// Manager uploads dirty buffers in the background. Jobs for the same path
+// are serialized; a job queued while an older one for the same path has not
+// started yet replaces it, so repeated saves are coalesced into one upload.
+type Manager struct {
+	opts Options
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	order    []string          // paths with a pending job, in queue order
+	pending  map[string]*entry // queued, not started
+	inflight map[string]*entry // being uploaded
+	failed   map[string]error  // last failure per path, until reported
+	closed   bool
+
+	wg sync.WaitGroup
+}
+
+func NewManager(opts Options) *Manager {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+	if opts.Retries <= 0 {
+		opts.Retries = DefaultRetries
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = DefaultBackoff
+	}
+
+	m := &Manager{
+		opts:     opts,
+		pending:  make(map[string]*entry),
+		inflight: make(map[string]*entry),
+		failed:   make(map[string]error),
+	}
+	m.cond = sync.NewCond(&m.mu)
+
+	for range opts.Workers {
+		m.wg.Add(1)
+		go m.worker()
+	}
+	return m
+}
+
+// Enqueue schedules job for upload, coalescing it with a queued job for the
+// same path if there is one.
+func (m *Manager) Enqueue(job *Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	if e, ok := m.pending[job.Path]; ok {
+		e.job.release()
+		e.job = job
+		return nil
+	}
+
+	m.pending[job.Path] = &entry{job: job, done: make(chan struct{})}
+	if _, busy := m.inflight[job.Path]; !busy {
+		m.order = append(m.order, job.Path)
+		m.cond.Signal()
+	}
+	return nil
+}
+
+// Pending reports whether an upload for path is queued or running.
+func (m *Manager) Pending(path string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, queued := m.pending[path]
+	_, running := m.inflight[path]
+	return queued || running
+}
+
+// Wait blocks until every upload queued for path so far has finished and
+// returns the first unreported failure for it, if any.
+func (m *Manager) Wait(path string) error {
+	m.mu.Lock()
+	var waits []chan struct{}
+	if e, ok := m.inflight[path]; ok {
+		waits = append(waits, e.done)
+	}
+	if e, ok := m.pending[path]; ok {
+		waits = append(waits, e.done)
+	}
+	m.mu.Unlock()
+
+	for _, w := range waits {
+		<-w
+	}
+	return m.Err(path)
+}
+
+// Cancel drops the job queued for path and waits for a running one to
+// finish, e.g. before the file is removed or replaced. A failure recorded
+// for path is forgotten. Done is not called for the dropped job. Reports
+// whether a job was dropped.
+func (m *Manager) Cancel(path string) bool {
+	m.mu.Lock()
+	e, dropped := m.pending[path]
+	if dropped {
+		delete(m.pending, path)
+		m.order = slices.DeleteFunc(m.order, func(p string) bool { return p == path })
+		e.job.release()
+		close(e.done)
+	}
+	var running chan struct{}
+	if e, ok := m.inflight[path]; ok {
+		running = e.done
+	}
+	m.mu.Unlock()
+
+	if running != nil {
+		<-running
+	}
+	m.mu.Lock()
+	delete(m.failed, path)
+	m.mu.Unlock()
+	return dropped
+}
+
+// Err returns and clears the last upload failure recorded for path.
+func (m *Manager) Err(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.failed[path]
+	delete(m.failed, path)
+	return err
+}
+
+// Close stops accepting jobs, waits for queued uploads to finish and stops
+// the workers.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	m.closed = true
+	m.cond.Broadcast()
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+func (m *Manager) next() (*entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for len(m.order) == 0 {
+		if m.closed {
+			return nil, false
+		}
+		m.cond.Wait()
+	}
+
+	path := m.order[0]
+	m.order = m.order[1:]
+
+	e := m.pending[path]
+	delete(m.pending, path)
+	m.inflight[path] = e
+	return e, true
+}
+
+func (m *Manager) finish(e *entry) {
+	m.mu.Lock()
+	path := e.job.Path
+	delete(m.inflight, path)
+	if e.err != nil {
+		m.failed[path] = e.err
+	} else {
+		delete(m.failed, path)
+	}
+	if _, ok := m.pending[path]; ok {
+		m.order = append(m.order, path)
+		m.cond.Signal()
+	}
+	m.mu.Unlock()
+
+	if m.opts.Done != nil {
+		m.opts.Done(e.job, e.err)
+	}
+	e.job.release()
+	close(e.done)
+}
+
+func (m *Manager) worker() {
+	defer m.wg.Done()
+	for {
+		e, ok := m.next()
+		if !ok {
+			return
+		}
+
+		e.err = m.run(e.job)
+		m.finish(e)
+	}
+}
+
+func (m *Manager) run(job *Job) error {
+	backoff := m.opts.Backoff
+	var err error
+	for attempt := 0; attempt < m.opts.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff = min(backoff*2, maxBackoff)
+		}
+
+		err = m.opts.Upload(job)
+		if err == nil {
+			return nil
+		}
+		if m.opts.Retryable != nil && !m.opts.Retryable(err) {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,216 @@
+package upload
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCoalescesQueuedJobs(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var mu sync.Mutex
+	var uploaded []string
+
+	m := NewManager(Options{
+		Workers: 1,
+		Upload: func(job *Job) error {
+			if string(job.Data) == "first" {
+				close(started)
+				<-release
+			}
+			mu.Lock()
+			uploaded = append(uploaded, string(job.Data))
+			mu.Unlock()
+			return nil
+		},
+	})
+	defer m.Close()
+
+	_ = m.Enqueue(&Job{Path: "/a", Data: []byte("first")})
+	// wait until the first job is running so later ones stay queued
+	<-started
+	_ = m.Enqueue(&Job{Path: "/a", Data: []byte("second")})
+	_ = m.Enqueue(&Job{Path: "/a", Data: []byte("third")})
+	close(release)
+
+	if err := m.Wait("/a"); err != nil {
+		t.Fatalf("Wait returned error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(uploaded) != 2 || uploaded[0] != "first" || uploaded[1] != "third" {
+		t.Fatalf("expected [first third], got %v", uploaded)
+	}
+}
+
+func TestRetriesUntilSuccess(t *testing.T) {
+	attempts := 0
+	m := NewManager(Options{
+		Workers: 1,
+		Retries: 3,
+		Backoff: time.Millisecond,
+		Upload: func(job *Job) error {
+			attempts++
+			if attempts < 3 {
+				return errors.New("temporary")
+			}
+			return nil
+		},
+	})
+	defer m.Close()
+
+	_ = m.Enqueue(&Job{Path: "/r"})
+	if err := m.Wait("/r"); err != nil {
+		t.Fatalf("expected success after retries, got %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestPermanentErrorReportedOnce(t *testing.T) {
+	permanent := errors.New("403 forbidden")
+	var done []error
+	m := NewManager(Options{
+		Workers:   1,
+		Retries:   5,
+		Backoff:   time.Millisecond,
+		Upload:    func(job *Job) error { return permanent },
+		Retryable: func(err error) bool { return err != permanent },
+		Done:      func(job *Job, err error) { done = append(done, err) },
+	})
+	defer m.Close()
+
+	_ = m.Enqueue(&Job{Path: "/p"})
+	if err := m.Wait("/p"); err != permanent {
+		t.Fatalf("expected permanent error, got %v", err)
+	}
+	if err := m.Err("/p"); err != nil {
+		t.Fatalf("error should be reported only once, got %v", err)
+	}
+	if len(done) != 1 || done[0] != permanent {
+		t.Fatalf("Done should run once with the error, got %v", done)
+	}
+}
+
+func TestCloseDrainsQueue(t *testing.T) {
+	var mu sync.Mutex
+	count := 0
+	m := NewManager(Options{
+		Workers: 2,
+		Upload: func(job *Job) error {
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			count++
+			mu.Unlock()
+			return nil
+		},
+	})
+
+	for _, p := range []string{"/1", "/2", "/3", "/4"} {
+		_ = m.Enqueue(&Job{Path: p})
+	}
+	m.Close()
+
+	if count != 4 {
+		t.Fatalf("expected all 4 jobs uploaded before Close returned, got %d", count)
+	}
+	if err := m.Enqueue(&Job{Path: "/5"}); err != ErrClosed {
+		t.Fatalf("expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestReleasesReplacedAndFinishedJobs(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	m := NewManager(Options{
+		Workers: 1,
+		Upload: func(job *Job) error {
+			if job.Seq == 1 {
+				close(started)
+				<-release
+			}
+			return nil
+		},
+	})
+	defer m.Close()
+
+	var mu sync.Mutex
+	released := map[int64]bool{}
+	job := func(n int64) *Job {
+		return &Job{Path: "/s", Seq: uint64(n), Release: func() {
+			mu.Lock()
+			released[n] = true
+			mu.Unlock()
+		}}
+	}
+
+	_ = m.Enqueue(job(1))
+	<-started
+	_ = m.Enqueue(job(2))
+	_ = m.Enqueue(job(3)) // replaces 2
+	close(release)
+	_ = m.Wait("/s")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !released[1] || !released[2] || !released[3] {
+		t.Fatalf("expected all snapshots released, got %v", released)
+	}
+}
+
+func TestCancelDropsQueuedJob(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var mu sync.Mutex
+	var uploaded []string
+
+	m := NewManager(Options{
+		Workers: 1,
+		Upload: func(job *Job) error {
+			if string(job.Data) == "running" {
+				close(started)
+				<-release
+			}
+			mu.Lock()
+			uploaded = append(uploaded, string(job.Data))
+			mu.Unlock()
+			return nil
+		},
+	})
+	defer m.Close()
+
+	_ = m.Enqueue(&Job{Path: "/a", Data: []byte("running")})
+	<-started
+	_ = m.Enqueue(&Job{Path: "/a", Data: []byte("queued")})
+
+	cancelled := make(chan struct{})
+	go func() {
+		if !m.Cancel("/a") {
+			t.Errorf("Cancel should report the queued job")
+		}
+		close(cancelled)
+	}()
+	select {
+	case <-cancelled:
+		t.Fatalf("Cancel returned while an upload was running")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	<-cancelled
+
+	if m.Pending("/a") {
+		t.Fatalf("no upload should be pending after Cancel")
+	}
+	if err := m.Wait("/a"); err != nil {
+		t.Fatalf("Wait returned error: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(uploaded) != 1 || uploaded[0] != "running" {
+		t.Fatalf("expected only [running], got %v", uploaded)
+	}
+}
@@ -0,0 +1,226 @@
+package wrappers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultChunkSize = 10 * 1024 * 1024 // 10 MB
+	maxChunks        = 10000            // Nextcloud limit per upload
+)
+
+// SetChunking enables chunked uploads for files larger than threshold bytes,
+// split into chunks of size bytes. A threshold <= 0 disables chunking. The
+// uploads collection is derived from a Nextcloud style base URL
+// (.../remote.php/dav/files/<user>) unless uploadsURL is given.
+func (w *WebdavClient) SetChunking(threshold, size int64, uploadsURL string) {
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	if uploadsURL == "" {
+		uploadsURL = deriveUploadsURL(w.baseURL)
+	}
+	w.chunkThreshold = threshold
+	w.chunkSize = size
+	w.uploadsURL = strings.TrimRight(uploadsURL, "/")
+}
+
+// deriveUploadsURL maps .../remote.php/dav/files/<user>[/...] to
+// .../remote.php/dav/uploads/<user>. Returns "" for other servers.
+func deriveUploadsURL(baseURL string) string {
+	const marker = "/remote.php/dav/files/"
+	idx := strings.Index(baseURL, marker)
+	if idx < 0 {
+		return ""
+	}
+	user, _, _ := strings.Cut(baseURL[idx+len(marker):], "/")
+	if user == "" {
+		return ""
+	}
+	return baseURL[:idx] + "/remote.php/dav/uploads/" + user
+}
+
+func (w *WebdavClient) useChunking(size int64) bool {
+	return w.chunkThreshold > 0 && w.uploadsURL != "" && size > w.chunkThreshold
+}
+
+// chunkUpload is a chunked upload that has not completed yet.
+type chunkUpload struct {
+	size  int64
+	mtime time.Time
+
+	mu sync.Mutex
+	// sums holds the SHA-256 of every chunk PUT so far, by chunk name; a
+	// chunk the server has is only kept when it holds the same data
+	sums map[string][sha256.Size]byte
+}
+
+// sent reports whether the chunk uploaded for this upload had sum.
+func (u *chunkUpload) sent(chunk string, sum [sha256.Size]byte) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	s, ok := u.sums[chunk]
+	return ok && s == sum
+}
+
+// record notes that chunk was uploaded with sum.
+func (u *chunkUpload) record(chunk string, sum [sha256.Size]byte) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.sums == nil {
+		u.sums = make(map[string][sha256.Size]byte)
+	}
+	u.sums[chunk] = sum
+}
+
+// chunkUpload returns the unfinished upload of size bytes to name, begun
+// now unless an earlier attempt left one. Data given a modification time
+// with ModTimed only continues an upload for that time.
+func (w *WebdavClient) chunkUpload(name string, size int64) *chunkUpload {
+	var mtime time.Time
+	if m := w.modTime(name); m != nil {
+		mtime = m.mtime
+	}
+	if v, ok := w.chunkUploads.Load(name); ok {
+		if u := v.(*chunkUpload); u.size == size && (mtime.IsZero() || u.mtime.Equal(mtime)) {
+			return u
+		}
+	}
+	if mtime.IsZero() {
+		mtime = time.Now()
+	}
+	u := &chunkUpload{size: size, mtime: mtime}
+	w.chunkUploads.Store(name, u)
+	return u
+}
+
+// id names the upload collection after the target, the size and the time,
+// so a retry finds the chunks a failed attempt left behind. Which of them
+// still hold the data being sent tell the sums of the upload.
+func (u *chunkUpload) id(name string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d", name, u.size, u.mtime.UnixNano())
+	return "mimic-" + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// uploadedChunks lists the chunks already present in an upload collection
+// with their sizes. A missing collection yields an empty map.
+func (w *WebdavClient) uploadedChunks(dirURL string) (map[string]int64, error) {
+	ms, err := w.davPropfind(dirURL+"/", "1", `<d:propfind xmlns:d="DAV:"><d:prop><d:getcontentlength/></d:prop></d:propfind>`)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := make(map[string]int64)
+	for i := range ms.Responses {
+		r := &ms.Responses[i]
+		if strings.HasSuffix(r.Href, "/") {
+			continue
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(r.props()[xml.Name{Space: davNS, Local: "getcontentlength"}]), 10, 64)
+		if err != nil {
+			continue
+		}
+		chunks[r.name()] = size
+	}
+	return chunks, nil
+}
+
+// chunkedUpload uploads data with Nextcloud chunking v2: MKCOL an upload
+// collection, PUT numbered chunks into it and MOVE the virtual .file onto
+// the destination to assemble them. Chunks that a previous attempt already
+// uploaded with the same content are skipped.
+func (w *WebdavClient) chunkedUpload(name string, r io.ReaderAt, size int64) error {
+	chunkSize := max(w.chunkSize, (size+maxChunks-1)/maxChunks)
+	dest := buildURL(w.baseURL, name)
+	upload := w.chunkUpload(name, size)
+	dirURL := w.uploadsURL + "/" + upload.id(name)
+	total := strconv.FormatInt(size, 10)
+	common := map[string]string{
+		"Destination":     dest,
+		"OC-Total-Length": total,
+	}
+
+	existing := map[string]int64{}
+	code, _, _, err := davRequest("MKCOL", dirURL, w.username, w.password, nil, common)
+	if err != nil {
+		return err
+	}
+	switch {
+	case code == 405:
+		// collection survived an earlier attempt: resume
+		if existing, err = w.uploadedChunks(dirURL); err != nil {
+			return err
+		}
+	case code < 200 || code >= 300:
+		return statusErr("chunked upload MKCOL", name, code)
+	}
+
+	for i, off := 1, int64(0); off < size; i, off = i+1, off+chunkSize {
+		end := min(off+chunkSize, size)
+		chunk := fmt.Sprintf("%05d", i)
+		sum, err := chunkSum(r, off, end-off)
+		if err != nil {
+			return err
+		}
+		if size, ok := existing[chunk]; ok && size == end-off && upload.sent(chunk, sum) {
+			continue
+		}
+
+		code, _, _, err := davRequest("PUT", dirURL+"/"+chunk, w.username, w.password, io.NewSectionReader(r, off, end-off), common)
+		if err != nil {
+			return err
+		}
+		if err := statusErr("chunked upload PUT", name, code); err != nil {
+			return err
+		}
+		upload.record(chunk, sum)
+	}
+
+	code, hdr, _, err := davRequest("MOVE", dirURL+"/.file", w.username, w.password, nil, w.conditional(name, map[string]string{
+		"Destination":     dest,
+		"OC-Total-Length": total,
+		"Overwrite":       "T",
+	}))
+	if err != nil {
+		return err
+	}
+	if err := statusErr("chunked upload MOVE", name, code); err != nil {
+		return err
+	}
+	w.chunkUploads.CompareAndDelete(name, upload)
+	w.advance(name, hdr)
+	return nil
+}
+
+// DiscardUpload forgets the unfinished chunked upload of name and deletes
+// the chunks it left on the server, once the upload failed for good. The
+// next upload of name starts over.
+func (w *WebdavClient) DiscardUpload(name string) {
+	v, ok := w.chunkUploads.LoadAndDelete(name)
+	if !ok {
+		return
+	}
+	dirURL := w.uploadsURL + "/" + v.(*chunkUpload).id(name)
+	// best effort: the server expires abandoned uploads too
+	_, _, _, _ = davRequest("DELETE", dirURL, w.username, w.password, nil, nil)
+}
+
+// chunkSum returns the SHA-256 of length bytes of r at off.
+func chunkSum(r io.ReaderAt, off, length int64) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, off, length)); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
@@ -0,0 +1,120 @@
+package wrappers
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/mimic/internal/core/casters"
+	"github.com/mimic/internal/core/helpers"
+	"github.com/studio-b12/gowebdav"
+)
+
+// guard holds the version of a file the requests of a Guarded call expect
+// to find on the server.
+type guard struct {
+	mu   sync.Mutex
+	etag string
+}
+
+func (g *guard) get() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.etag
+}
+
+func (g *guard) set(etag string) {
+	g.mu.Lock()
+	g.etag = etag
+	g.mu.Unlock()
+}
+
+// Guarded runs fn with every request that modifies name made conditional on
+// the server still holding version etag. Requests carry If-Match and fail
+// with a 412 status error when someone else changed the file
+// in the meantime. Each successful write moves the expectation to the
+// version it produced, so fn may send several requests. With an empty etag
+// the first write is unconditional. Returns the ETag of the version fn left
+// on the server, "" when the server does not report one. When fn fails that
+// is the version its successful requests produced, which a retry expects.
+func (w *WebdavClient) Guarded(name, etag string, fn func() error) (string, error) {
+	g := &guard{etag: etag}
+	w.guards.Store(name, g)
+	defer w.guards.CompareAndDelete(name, g)
+
+	if err := fn(); err != nil {
+		if helpers.IsPreconditionFailedErr(err) {
+			// the cached attributes describe the version we expected
+			w.cache.Invalidate(name)
+		}
+		return g.get(), err
+	}
+	return g.get(), nil
+}
+
+// guard returns the guard of a running Guarded call for name, or nil.
+func (w *WebdavClient) guard(name string) *guard {
+	if g, ok := w.guards.Load(name); ok {
+		return g.(*guard)
+	}
+	return nil
+}
+
+// conditional adds If-Match for a guarded name to headers, the lock token
+// of a locked one, and the modification time to keep inside ModTimed.
+func (w *WebdavClient) conditional(name string, headers map[string]string) map[string]string {
+	headers = w.withModTime(name, headers)
+	headers = w.withLockTokens(headers, name)
+	g := w.guard(name)
+	if g == nil {
+		return headers
+	}
+	if etag := g.get(); etag != "" {
+		if headers == nil {
+			headers = map[string]string{}
+		}
+		headers["If-Match"] = etag
+	}
+	return headers
+}
+
+// advance records the version a successful write of name produced. Servers
+// that do not return the new ETag are asked for it.
+func (w *WebdavClient) advance(name string, hdr http.Header) {
+	w.recordModTime(name, hdr)
+	g := w.guard(name)
+	if g == nil {
+		return
+	}
+	etag := hdr.Get("ETag")
+	if etag == "" {
+		etag = hdr.Get("OC-ETag")
+	}
+	if etag == "" {
+		if fi, err := w.client.Stat(name); err == nil {
+			etag = casters.ETag(fi)
+		}
+	}
+	g.set(etag)
+}
+
+// put replaces name with the body in a single PUT that honours the guard.
+func (w *WebdavClient) put(name string, body *io.SectionReader) error {
+	code, hdr, _, err := davRequest("PUT", buildURL(w.baseURL, name), w.username, w.password, body, w.conditional(name, nil))
+	if err != nil {
+		return err
+	}
+	if err := statusErr("PUT", name, code); err != nil {
+		return err
+	}
+	w.advance(name, hdr)
+	return nil
+}
+
+// statusErr returns an error carrying the status for a non-2xx code.
+func statusErr(op, name string, code int) error {
+	if code >= 200 && code < 300 {
+		return nil
+	}
+	return gowebdav.NewPathError(op, name, code)
+}
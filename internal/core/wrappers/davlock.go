@@ -0,0 +1,336 @@
+package wrappers
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mimic/internal/core/locking"
+)
+
+const (
+	// DefaultLockTimeout is how long the server keeps a lock without a
+	// refresh unless SetServerLocks says otherwise.
+	DefaultLockTimeout = 5 * time.Minute
+	// how often LockWait asks again for a lock another client holds
+	lockRetry = time.Second
+)
+
+// lockInfo asks for an exclusive write lock (RFC 4918 section 9.10).
+const lockInfo = `<?xml version="1.0" encoding="utf-8"?>` +
+	`<d:lockinfo xmlns:d="DAV:"><d:lockscope><d:exclusive/></d:lockscope>` +
+	`<d:locktype><d:write/></d:locktype><d:owner>mimic</d:owner></d:lockinfo>`
+
+// davLock is a lock held on the server for the write locks of a file.
+type davLock struct {
+	token string
+	stop  chan struct{} // closed to end the refresh
+	// ready is closed once the LOCK request finished, with err its failure
+	ready chan struct{}
+	err   error
+}
+
+// SetServerLocks backs write locks with exclusive WebDAV locks on the
+// server, so other clients see them. The server drops a lock that is not
+// refreshed within timeout (zero selects DefaultLockTimeout); held locks
+// are refreshed well before. Writes, renames and deletes of a locked file
+// send its lock token.
+func (w *WebdavClient) SetServerLocks(enabled bool, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultLockTimeout
+	}
+	w.serverLocks = enabled
+	w.lockTimeout = timeout
+}
+
+// serverLock takes the server lock of name for a write lock, unless it is
+// held already. Fails with locking.ErrWouldBlock when another client holds
+// one. The LOCK request goes out without davMu held; concurrent callers
+// wait for its outcome. An UNLOCK of name still in flight is waited for, as
+// the server would refuse the LOCK until it went through.
+func (w *WebdavClient) serverLock(name string, lockType locking.LockType) error {
+	if !w.serverLocks || lockType != locking.F_WRLCK {
+		return nil
+	}
+	w.davMu.Lock()
+	for {
+		unlocked, ok := w.davUnlocks[name]
+		if !ok {
+			break
+		}
+		w.davMu.Unlock()
+		<-unlocked
+		w.davMu.Lock()
+	}
+	if l, ok := w.davLocks[name]; ok {
+		w.davMu.Unlock()
+		<-l.ready
+		return l.err
+	}
+	if w.davLocks == nil {
+		w.davLocks = make(map[string]*davLock)
+	}
+	l := &davLock{stop: make(chan struct{}), ready: make(chan struct{})}
+	w.davLocks[name] = l
+	w.davMu.Unlock()
+
+	token, timeout, err := w.lockRequest(name)
+
+	w.davMu.Lock()
+	defer w.davMu.Unlock()
+	l.token, l.err = token, err
+	close(l.ready)
+	switch {
+	case w.davLocks[name] != l:
+		// released or moved meanwhile; whoever removed it unlocks it
+	case err != nil:
+		delete(w.davLocks, name)
+	default:
+		go w.refreshLock(name, l, timeout)
+	}
+	return err
+}
+
+// lockRequest sends the LOCK request for name and returns the token and
+// timeout the server granted.
+func (w *WebdavClient) lockRequest(name string) (string, time.Duration, error) {
+	headers := map[string]string{
+		"Content-Type": "application/xml; charset=utf-8",
+		"Depth":        "0",
+		"Timeout":      lockTimeoutHeader(w.lockTimeout),
+	}
+	code, hdr, data, err := davRequest("LOCK", buildURL(w.baseURL, name), w.username, w.password, strings.NewReader(lockInfo), headers)
+	if err != nil {
+		return "", 0, err
+	}
+	if code == http.StatusLocked {
+		return "", 0, locking.ErrWouldBlock
+	}
+	if err := statusErr("LOCK", name, code); err != nil {
+		return "", 0, err
+	}
+	token := strings.Trim(strings.TrimSpace(hdr.Get("Lock-Token")), "<>")
+	if token == "" {
+		return "", 0, fmt.Errorf("LOCK %s: no lock token in the reply", name)
+	}
+	if code == http.StatusCreated {
+		// locking a missing name created an empty file
+		w.cache.Invalidate(name)
+	}
+	return token, grantedTimeout(data, w.lockTimeout), nil
+}
+
+// serverLockWait is serverLock retrying while another client holds the
+// lock, until ctx is done.
+func (w *WebdavClient) serverLockWait(ctx context.Context, name string, lockType locking.LockType) error {
+	for {
+		err := w.serverLock(name, lockType)
+		if err != locking.ErrWouldBlock {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockRetry):
+		}
+	}
+}
+
+// serverUnlock releases the server lock of name once no write lock on it
+// is left. The check and the removal share one critical section, so a
+// concurrent Lock either keeps the server lock or takes a new one once the
+// UNLOCK went through.
+func (w *WebdavClient) serverUnlock(name string) error {
+	if !w.serverLocks {
+		return nil
+	}
+	w.davMu.Lock()
+	l, ok := w.davLocks[name]
+	if !ok || w.lm.Holds(name, locking.F_WRLCK) {
+		w.davMu.Unlock()
+		return nil
+	}
+	delete(w.davLocks, name)
+	if w.davUnlocks == nil {
+		w.davUnlocks = make(map[string]chan struct{})
+	}
+	unlocked := make(chan struct{})
+	w.davUnlocks[name] = unlocked
+	w.davMu.Unlock()
+
+	defer func() {
+		w.davMu.Lock()
+		delete(w.davUnlocks, name)
+		w.davMu.Unlock()
+		close(unlocked)
+	}()
+	<-l.ready
+	close(l.stop)
+	if l.err != nil {
+		return nil
+	}
+	return w.unlockRequest(name, l.token)
+}
+
+// unlockRequest sends the UNLOCK request for the lock token of name.
+func (w *WebdavClient) unlockRequest(name, token string) error {
+	headers := map[string]string{"Lock-Token": "<" + token + ">"}
+	code, _, _, err := davRequest("UNLOCK", buildURL(w.baseURL, name), w.username, w.password, nil, headers)
+	if err != nil {
+		return err
+	}
+	if code == http.StatusConflict || code == http.StatusPreconditionFailed || code == http.StatusNotFound {
+		// the lock expired or went with the file
+		return nil
+	}
+	return statusErr("UNLOCK", name, code)
+}
+
+// refreshLock renews the server lock l of name every half timeout until it
+// is released. A lock the server no longer knows is forgotten; writes then
+// go out without it.
+func (w *WebdavClient) refreshLock(name string, l *davLock, timeout time.Duration) {
+	interval := max(timeout/2, time.Second)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+		}
+		headers := map[string]string{
+			"If":      "(<" + l.token + ">)",
+			"Timeout": lockTimeoutHeader(w.lockTimeout),
+		}
+		code, _, _, err := davRequest("LOCK", buildURL(w.baseURL, name), w.username, w.password, nil, headers)
+		if err != nil || code >= 500 {
+			// try again with the next tick
+			continue
+		}
+		if code >= 300 {
+			w.dropServerLock(name, l)
+			return
+		}
+	}
+}
+
+// dropServerLock forgets the server lock l of name without unlocking it,
+// as the server no longer has it.
+func (w *WebdavClient) dropServerLock(name string, l *davLock) {
+	w.davMu.Lock()
+	defer w.davMu.Unlock()
+	if w.davLocks[name] == l {
+		delete(w.davLocks, name)
+		close(l.stop)
+	}
+}
+
+// lockToken returns the token of the server lock of name, "" for none.
+func (w *WebdavClient) lockToken(name string) string {
+	if !w.serverLocks {
+		return ""
+	}
+	w.davMu.Lock()
+	defer w.davMu.Unlock()
+	if l, ok := w.davLocks[name]; ok {
+		return l.token
+	}
+	return ""
+}
+
+// withLockTokens adds an If header submitting the lock tokens of the
+// locked names among names to headers. The lists are tagged with the
+// resource, so one header serves both ends of a MOVE.
+func (w *WebdavClient) withLockTokens(headers map[string]string, names ...string) map[string]string {
+	var lists []string
+	for _, name := range names {
+		if token := w.lockToken(name); token != "" {
+			lists = append(lists, "<"+buildURL(w.baseURL, name)+"> (<"+token+">)")
+		}
+	}
+	if len(lists) == 0 {
+		return headers
+	}
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	headers["If"] = strings.Join(lists, " ")
+	return headers
+}
+
+// lockMoved forgets the server locks a MOVE or DELETE ended: the server
+// drops the lock of a removed or replaced resource. A replaced destination
+// still write locked here is locked again.
+func (w *WebdavClient) lockMoved(removed, replaced string) {
+	w.davMu.Lock()
+	for _, name := range []string{removed, replaced} {
+		if l, ok := w.davLocks[name]; ok {
+			delete(w.davLocks, name)
+			close(l.stop)
+		}
+	}
+	w.davMu.Unlock()
+	if replaced != "" && w.lm.Holds(replaced, locking.F_WRLCK) {
+		_ = w.serverLock(replaced, locking.F_WRLCK)
+	}
+}
+
+// remove deletes name with its lock token.
+func (w *WebdavClient) remove(name string) error {
+	code, _, _, err := davRequest("DELETE", buildURL(w.baseURL, name), w.username, w.password, nil, w.withLockTokens(nil, name))
+	if err != nil {
+		return err
+	}
+	if err := statusErr("DELETE", name, code); err != nil {
+		return err
+	}
+	w.lockMoved(name, "")
+	return nil
+}
+
+// move renames oldname to newname with the lock tokens of both.
+func (w *WebdavClient) move(oldname, newname string) error {
+	headers := w.withLockTokens(map[string]string{
+		"Destination": buildURL(w.baseURL, newname),
+		"Overwrite":   "T",
+	}, oldname, newname)
+	code, _, _, err := davRequest("MOVE", buildURL(w.baseURL, oldname), w.username, w.password, nil, headers)
+	if err != nil {
+		return err
+	}
+	if err := statusErr("MOVE", oldname, code); err != nil {
+		return err
+	}
+	w.lockMoved(oldname, newname)
+	return nil
+}
+
+func lockTimeoutHeader(d time.Duration) string {
+	return "Second-" + strconv.FormatInt(int64(d/time.Second), 10)
+}
+
+// grantedTimeout returns the timeout of a LOCK reply, def when the server
+// did not say or granted an infinite one.
+func grantedTimeout(data []byte, def time.Duration) time.Duration {
+	// <d:prop><d:lockdiscovery><d:activelock>...<d:timeout>Second-600
+	var reply struct {
+		Timeout string `xml:"lockdiscovery>activelock>timeout"`
+	}
+	if err := xml.Unmarshal(data, &reply); err != nil {
+		return def
+	}
+	secs, ok := strings.CutPrefix(strings.TrimSpace(reply.Timeout), "Second-")
+	if !ok {
+		return def
+	}
+	n, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil || n <= 0 {
+		return def
+	}
+	return time.Duration(n) * time.Second
+}
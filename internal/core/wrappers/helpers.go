@@ -6,18 +6,23 @@ import (
 	"io"
 	"net/http"
 	"strings"
+
+	"github.com/studio-b12/gowebdav"
 )
 
 func buildURL(baseURL, name string) string {
 	base := strings.TrimRight(baseURL, "/")
 	path := strings.TrimLeft(name, "/")
-	return base + "/" + path
+	return base + "/" + gowebdav.PathEscape(path)
 }
 
-func davRequest(method, url, uname, pass string, body io.Reader, headers map[string]string) (int, []byte, error) {
+func davRequest(method, url, uname, pass string, body io.Reader, headers map[string]string) (int, http.Header, []byte, error) {
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
-		return 0, nil, err
+		return 0, nil, nil, err
+	}
+	if sr, ok := body.(*io.SectionReader); ok {
+		req.ContentLength = sr.Size()
 	}
 	for k, v := range headers {
 		req.Header.Set(k, v)
@@ -27,29 +32,64 @@ func davRequest(method, url, uname, pass string, body io.Reader, headers map[str
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return 0, nil, err
+		return 0, nil, nil, err
 	}
 	defer resp.Body.Close()
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return 0, nil, err
+		return 0, nil, nil, err
 	}
-	return resp.StatusCode, data, nil
+	return resp.StatusCode, resp.Header, data, nil
 }
 
 func (w *WebdavClient) commit(name string, data []byte) error {
+	if size := int64(len(data)); size > streamThreshold || w.useChunking(size) || w.conditionalWrite(name) {
+		return w.commitFrom(name, bytes.NewReader(data), size)
+	}
 	defer w.cache.Invalidate(name)
-	if len(data) > streamThreshold {
-		return w.client.WriteStream(name, bytes.NewReader(data), 0644)
-	} else {
-		return w.client.Write(name, data, 0644)
+	return w.client.Write(name, data, 0644)
+}
+
+// commitFrom replaces the remote file with size bytes read from r. Large
+// files are streamed (or chunked) instead of being read into memory.
+// Uploads inside Guarded go out as a conditional PUT.
+func (w *WebdavClient) commitFrom(name string, r io.ReaderAt, size int64) error {
+	defer w.cache.Invalidate(name)
+	if w.useChunking(size) {
+		return w.chunkedUpload(name, r, size)
+	}
+	if w.conditionalWrite(name) {
+		return w.put(name, io.NewSectionReader(r, 0, size))
 	}
+	if size > streamThreshold {
+		return w.client.WriteStreamWithLength(name, io.NewSectionReader(r, 0, size), size, 0644)
+	}
+	data, err := readSection(r, 0, size)
+	if err != nil {
+		return err
+	}
+	return w.client.Write(name, data, 0644)
+}
+
+// conditionalWrite reports whether writes of name need headers only
+// requests sent with davRequest carry (see conditional).
+func (w *WebdavClient) conditionalWrite(name string) bool {
+	return w.guard(name) != nil || w.modTime(name) != nil || w.lockToken(name) != ""
+}
+
+// readSection reads n bytes at off from r into memory.
+func readSection(r io.ReaderAt, off, n int64) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(io.NewSectionReader(r, off, n), buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
 }
 
 // tryPartialPut attempts a non-standard partial PUT using Content-Range header.
-// Returns (true, nil) if the server accepted the partial update (2xx),
-// (false, nil) if server rejected (non-2xx), or (false, err) on network error.
-func (w *WebdavClient) tryPartialPut(name string, offset int64, data []byte) (bool, error) {
+// Returns the status code and headers of the response; 2xx means the server
+// accepted the partial update. err is only set on network errors.
+func (w *WebdavClient) tryPartialPut(name string, offset int64, data []byte) (int, http.Header, error) {
 	url := buildURL(w.baseURL, name)
 
 	// Content-Range: bytes <start>-<end>
@@ -59,15 +99,13 @@ func (w *WebdavClient) tryPartialPut(name string, offset int64, data []byte) (bo
 		"Content-Range": crange,
 	}
 
-	code, _, err := davRequest("PUT", url, w.username, w.password, bytes.NewReader(data), headers)
-	if err != nil {
-		return false, err
-	}
+	return w.partialRequest("PUT", url, name, data, headers)
+}
 
-	if code >= 200 && code < 300 {
-		return true, nil
-	}
-	return false, nil
+// partialRequest sends a partial update of name, conditional when guarded.
+func (w *WebdavClient) partialRequest(method, url, name string, data []byte, headers map[string]string) (int, http.Header, error) {
+	code, hdr, _, err := davRequest(method, url, w.username, w.password, bytes.NewReader(data), w.conditional(name, headers))
+	return code, hdr, err
 }
 
 func (w *WebdavClient) fetch(name string) ([]byte, error) {
@@ -90,3 +128,26 @@ func (w *WebdavClient) fetch(name string) ([]byte, error) {
 	}
 	return all, nil
 }
+
+// zeroPadded reads as data followed by zeros up to size bytes, so a file
+// extended by truncate is uploaded without allocating its zeros.
+type zeroPadded struct {
+	data []byte
+	size int64
+}
+
+func (z zeroPadded) ReadAt(p []byte, off int64) (int, error) {
+	if off >= z.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), z.size-off))
+	copied := 0
+	if off < int64(len(z.data)) {
+		copied = copy(p[:n], z.data[off:])
+	}
+	clear(p[copied:n])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,185 @@
+package wrappers
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mimic/internal/core/casters"
+	"github.com/mimic/internal/core/helpers"
+)
+
+// mtimeMode is how the server lets clients set modification times.
+type mtimeMode int32
+
+const (
+	mtimeUnknown mtimeMode = iota
+	// PROPPATCH of DAV:lastmodified with Unix seconds (ownCloud, Nextcloud)
+	mtimeLastModified
+	// PROPPATCH of DAV:getlastmodified with an HTTP date
+	mtimeGetLastModified
+	mtimeNone
+)
+
+var (
+	lastModified = xml.Name{Space: davNS, Local: "lastmodified"}
+
+	// ErrModTimeUnsupported is returned by SetModTime when the server
+	// does not let clients set modification times.
+	ErrModTimeUnsupported = errors.New("server does not support setting modification times")
+)
+
+// modTime is the modification time a ModTimed call asks uploads to keep.
+type modTime struct {
+	mtime    time.Time
+	accepted atomic.Bool // the server took it from the last write
+}
+
+// ModTimed runs fn with the writes of name asking the server to keep mtime
+// as the modification time of the file (X-OC-MTime). When the last write
+// did not take it, it is set with SetModTime afterwards; on servers that
+// support neither the file keeps the time of the upload.
+func (w *WebdavClient) ModTimed(name string, mtime time.Time, fn func() error) error {
+	m := &modTime{mtime: mtime}
+	w.modTimes.Store(name, m)
+	defer w.modTimes.CompareAndDelete(name, m)
+
+	if err := fn(); err != nil {
+		return err
+	}
+	if m.accepted.Load() {
+		return nil
+	}
+	if err := w.SetModTime(name, mtime); err != nil && !errors.Is(err, ErrModTimeUnsupported) {
+		return err
+	}
+	return nil
+}
+
+// modTime returns the modification time of a running ModTimed call for
+// name, or nil.
+func (w *WebdavClient) modTime(name string) *modTime {
+	if m, ok := w.modTimes.Load(name); ok {
+		return m.(*modTime)
+	}
+	return nil
+}
+
+// SetModTime sets the modification time of name on the server with a
+// PROPPATCH of DAV:lastmodified, as ownCloud and Nextcloud take it, or of
+// DAV:getlastmodified, which some servers let clients set. Servers storing
+// unknown properties as dead ones accept either without effect, so the
+// first attempts are checked against the time the server reports after
+// them. Returns ErrModTimeUnsupported when neither works.
+func (w *WebdavClient) SetModTime(name string, mtime time.Time) error {
+	mtime = mtime.Truncate(time.Second)
+	switch mode := mtimeMode(w.mtime.Load()); mode {
+	case mtimeNone:
+		return &os.PathError{Op: "setmtime", Path: name, Err: ErrModTimeUnsupported}
+	case mtimeUnknown:
+		if err := w.detectModTime(name, mtime); err != nil {
+			return err
+		}
+	default:
+		if err := w.patchModTime(name, mode, mtime); err != nil {
+			return err
+		}
+	}
+	w.modTimeChanged(name, mtime)
+	return nil
+}
+
+// detectModTime tries the ways of setting the modification time of name
+// and remembers the first that works.
+func (w *WebdavClient) detectModTime(name string, mtime time.Time) error {
+	for _, mode := range []mtimeMode{mtimeLastModified, mtimeGetLastModified} {
+		err := w.patchModTime(name, mode, mtime)
+		if helpers.IsNotExistErr(err) {
+			return err
+		}
+		if err != nil {
+			continue
+		}
+		fi, _, err := w.propfind(name, "0")
+		if err != nil {
+			return err
+		}
+		if fi.ModTime().Equal(mtime) {
+			w.mtime.Store(int32(mode))
+			return nil
+		}
+		// stored as a dead property
+		prop, _ := modTimeProp(mode, mtime)
+		_ = w.proppatch(name, nil, []xml.Name{prop})
+	}
+	w.mtime.Store(int32(mtimeNone))
+	return &os.PathError{Op: "setmtime", Path: name, Err: ErrModTimeUnsupported}
+}
+
+func (w *WebdavClient) patchModTime(name string, mode mtimeMode, mtime time.Time) error {
+	prop, value := modTimeProp(mode, mtime)
+	return w.proppatch(name, map[xml.Name]string{prop: value}, nil)
+}
+
+// modTimeProp returns the property setting the modification time in mode
+// and its value for mtime.
+func modTimeProp(mode mtimeMode, mtime time.Time) (xml.Name, string) {
+	if mode == mtimeLastModified {
+		return lastModified, strconv.FormatInt(mtime.Unix(), 10)
+	}
+	return getLastModified, mtime.UTC().Format(http.TimeFormat)
+}
+
+// modTimeChanged updates the cached attributes of name after its
+// modification time was set. A running Guarded call learns the version the
+// change left, should the server have given the file a new ETag.
+func (w *WebdavClient) modTimeChanged(name string, mtime time.Time) {
+	if g := w.guard(name); g != nil {
+		if tag, err := w.version(name, false); err == nil && tag != "" {
+			g.set(tag)
+		}
+	}
+	w.updateCached(name, func(fi *fileInfo) { fi.modified = mtime })
+}
+
+// withModTime adds X-OC-MTime for a name inside ModTimed to the headers of
+// a write.
+func (w *WebdavClient) withModTime(name string, headers map[string]string) map[string]string {
+	m := w.modTime(name)
+	if m == nil {
+		return headers
+	}
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	headers["X-OC-MTime"] = strconv.FormatInt(m.mtime.Unix(), 10)
+	return headers
+}
+
+// recordModTime records whether a successful write of name inside ModTimed
+// kept the modification time it asked for.
+func (w *WebdavClient) recordModTime(name string, hdr http.Header) {
+	if m := w.modTime(name); m != nil {
+		m.accepted.Store(hdr.Get("X-OC-MTime") == "accepted")
+	}
+}
+
+// infoOf copies the attributes of fi.
+func infoOf(fi os.FileInfo) *fileInfo {
+	out := &fileInfo{
+		name:     fi.Name(),
+		size:     fi.Size(),
+		modified: fi.ModTime(),
+		etag:     casters.ETag(fi),
+		dir:      fi.IsDir(),
+	}
+	if l, ok := fi.(interface{ Target() string }); ok {
+		out.target = l.Target()
+	}
+	out.perm, out.uid, out.gid = casters.Ownership(fi)
+	return out
+}
@@ -0,0 +1,163 @@
+package wrappers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/mimic/internal/core/helpers"
+)
+
+// partialMode describes how the server accepts in-place updates of a byte
+// range, so WriteOffset does not have to download and re-upload the file.
+type partialMode int32
+
+const (
+	partialUnknown      partialMode = iota
+	partialNone                     // server only supports whole-file PUT
+	partialContentRange             // Apache mod_dav: PUT with Content-Range
+	partialSabrePatch               // SabreDAV/Nextcloud: PATCH with X-Update-Range
+)
+
+func (m partialMode) String() string {
+	switch m {
+	case partialNone:
+		return "none"
+	case partialContentRange:
+		return "content-range"
+	case partialSabrePatch:
+		return "sabredav-patch"
+	default:
+		return "unknown"
+	}
+}
+
+// partialMode returns the detected partial update capability, probing the
+// server on first use, next to name, the file about to be written.
+func (w *WebdavClient) partialMode(name string) partialMode {
+	w.partialOnce.Do(func() {
+		w.partial.Store(int32(w.detectPartialMode(name)))
+	})
+	return partialMode(w.partial.Load())
+}
+
+// disablePartial stops using partial updates after the server refused one.
+func (w *WebdavClient) disablePartial() {
+	w.partialOnce.Do(func() {})
+	w.partial.Store(int32(partialNone))
+}
+
+// detectPartialMode checks the DAV header for SabreDAV's partial update
+// plugin and otherwise probes Content-Range PUT on a scratch file in the
+// directory of name, which the mount can write to, unlike the server root
+// on many servers. A server that silently ignores Content-Range would
+// replace the whole file with the fragment, so the probe verifies the
+// result instead of trusting the status. Any failure means no partial
+// updates.
+func (w *WebdavClient) detectPartialMode(name string) partialMode {
+	code, hdr, _, err := davRequest("OPTIONS", buildURL(w.baseURL, "/"), w.username, w.password, nil, nil)
+	if err == nil && code >= 200 && code < 300 {
+		for _, v := range hdr.Values("DAV") {
+			if strings.Contains(strings.ToLower(v), "sabredav-partialupdate") {
+				return partialSabrePatch
+			}
+		}
+	}
+
+	var rnd [6]byte
+	if _, err := rand.Read(rnd[:]); err != nil {
+		return partialNone
+	}
+	probe := path.Join(path.Dir(path.Clean("/"+name)), ".mimic-probe-"+hex.EncodeToString(rnd[:]))
+	if err := w.client.Write(probe, []byte("0123"), 0644); err != nil {
+		// a failed PUT may still have left the file
+		_ = w.client.Remove(probe)
+		return partialNone
+	}
+	defer w.removeProbe(probe)
+
+	code, _, err = w.tryPartialPut(probe, 1, []byte("X"))
+	if err != nil || code < 200 || code >= 300 {
+		return partialNone
+	}
+	got, err := w.client.Read(probe)
+	if err != nil || string(got) != "0X23" {
+		return partialNone
+	}
+	return partialContentRange
+}
+
+// removeProbe deletes the scratch file of detectPartialMode, asking once
+// more should the first DELETE fail, so it does not stay in listings.
+func (w *WebdavClient) removeProbe(probe string) {
+	if err := w.client.Remove(probe); err != nil && !helpers.IsNotExistErr(err) {
+		_ = w.client.Remove(probe)
+	}
+}
+
+// tryPartialPatch updates a byte range with SabreDAV's PATCH extension.
+// Writing exactly at the end of the file uses the append form.
+func (w *WebdavClient) tryPartialPatch(name string, offset, size int64, data []byte) (int, http.Header, error) {
+	url := buildURL(w.baseURL, name)
+
+	urange := fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(data))-1)
+	if offset == size {
+		urange = "append"
+	}
+	headers := map[string]string{
+		"Content-Type":   "application/x-sabredav-partialupdate",
+		"X-Update-Range": urange,
+	}
+
+	return w.partialRequest("PATCH", url, name, data, headers)
+}
+
+// writePartial tries to update [offset, offset+len(data)) in place. It
+// returns (true, nil) when the server applied the update and (false, nil)
+// when the caller has to fall back to a whole-file upload. A guarded update
+// of a file that changed on the server fails with a 412 error.
+func (w *WebdavClient) writePartial(name string, data []byte, offset int64) (bool, error) {
+	mode := w.partialMode(name)
+	if mode == partialNone || len(data) == 0 {
+		return false, nil
+	}
+
+	fi, err := w.client.Stat(name)
+	if err != nil || fi.IsDir() {
+		return false, nil
+	}
+	// neither extension can leave a hole past the current end
+	if offset > fi.Size() {
+		return false, nil
+	}
+
+	var (
+		code int
+		hdr  http.Header
+	)
+	switch mode {
+	case partialSabrePatch:
+		code, hdr, err = w.tryPartialPatch(name, offset, fi.Size(), data)
+	case partialContentRange:
+		code, hdr, err = w.tryPartialPut(name, offset, data)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case code >= 200 && code < 300:
+		w.advance(name, hdr)
+		return true, nil
+	case code == http.StatusPreconditionFailed:
+		return false, statusErr("partial update", name, code)
+	case code == http.StatusBadRequest, code == http.StatusMethodNotAllowed,
+		code == http.StatusNotImplemented, code == http.StatusUnsupportedMediaType:
+		// the server does not implement the extension after all
+		w.disablePartial()
+	}
+	return false, nil
+}
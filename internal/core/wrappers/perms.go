@@ -0,0 +1,68 @@
+package wrappers
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+)
+
+// Dead properties holding what chmod and chown set, as WebDAV has neither
+// permission bits nor owners.
+var (
+	modeProp = xml.Name{Space: mimicNS, Local: "mode"} // octal, e.g. "0755"
+	uidProp  = xml.Name{Space: mimicNS, Local: "uid"}
+	gidProp  = xml.Name{Space: mimicNS, Local: "gid"}
+)
+
+// SetMode stores the permission bits of name (07777 of a chmod mode) as
+// the mimic:mode dead property.
+func (w *WebdavClient) SetMode(name string, mode uint32) error {
+	mode &= 0o7777
+	if err := w.proppatch(name, map[xml.Name]string{modeProp: "0" + strconv.FormatUint(uint64(mode), 8)}, nil); err != nil {
+		return err
+	}
+	w.updateCached(name, func(fi *fileInfo) { fi.perm = &mode })
+	return nil
+}
+
+// SetOwner stores the owner and group of name as the mimic:uid and
+// mimic:gid dead properties. A nil uid or gid is left unchanged, like -1
+// for chown.
+func (w *WebdavClient) SetOwner(name string, uid, gid *uint32) error {
+	set := make(map[xml.Name]string, 2)
+	if uid != nil {
+		set[uidProp] = strconv.FormatUint(uint64(*uid), 10)
+	}
+	if gid != nil {
+		set[gidProp] = strconv.FormatUint(uint64(*gid), 10)
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	if err := w.proppatch(name, set, nil); err != nil {
+		return err
+	}
+	w.updateCached(name, func(fi *fileInfo) {
+		if uid != nil {
+			fi.uid = uid
+		}
+		if gid != nil {
+			fi.gid = gid
+		}
+	})
+	return nil
+}
+
+// parseOwnership reads the stored permission bits, owner and group of a
+// PROPFIND response, nil for those it has none.
+func parseOwnership(props map[xml.Name]string) (perm, uid, gid *uint32) {
+	parse := func(name xml.Name, base int, limit uint32) *uint32 {
+		v, err := strconv.ParseUint(strings.TrimSpace(props[name]), base, 32)
+		if err != nil || uint32(v) > limit {
+			return nil
+		}
+		n := uint32(v)
+		return &n
+	}
+	return parse(modeProp, 8, 0o7777), parse(uidProp, 10, ^uint32(0)), parse(gidProp, 10, ^uint32(0))
+}
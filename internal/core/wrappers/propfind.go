@@ -0,0 +1,171 @@
+package wrappers
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+const davNS = "DAV:"
+
+// propValue is one property element of a propstat; the raw inner XML is
+// kept so callers can decode structured values (resourcetype, quotas, ...).
+type propValue struct {
+	XMLName xml.Name
+	Inner   string `xml:",innerxml"`
+}
+
+type propstat struct {
+	Prop struct {
+		Values []propValue `xml:",any"`
+	} `xml:"DAV: prop"`
+	Status string `xml:"DAV: status"`
+}
+
+type msResponse struct {
+	Href      string     `xml:"DAV: href"`
+	Status    string     `xml:"DAV: status"`
+	Propstats []propstat `xml:"DAV: propstat"`
+}
+
+type multistatus struct {
+	Responses []msResponse `xml:"DAV: response"`
+	SyncToken string       `xml:"DAV: sync-token"`
+}
+
+// props returns the properties the server reported with a 2xx status,
+// keyed by their namespaced name.
+func (r *msResponse) props() map[xml.Name]string {
+	out := make(map[xml.Name]string)
+	for _, ps := range r.Propstats {
+		if !statusOK(ps.Status) {
+			continue
+		}
+		for _, p := range ps.Prop.Values {
+			out[p.XMLName] = p.Inner
+		}
+	}
+	return out
+}
+
+// name returns the unescaped last path segment of the response href.
+func (r *msResponse) name() string {
+	p := strings.TrimSuffix(r.Href, "/")
+	if u, err := url.Parse(p); err == nil {
+		p = u.Path
+	}
+	if unesc, err := url.PathUnescape(p); err == nil {
+		p = unesc
+	}
+	return path.Base(p)
+}
+
+// statusOK reports whether an "HTTP/1.1 200 OK" style status line is 2xx.
+func statusOK(status string) bool {
+	fields := strings.Fields(status)
+	return len(fields) >= 2 && strings.HasPrefix(fields[1], "2")
+}
+
+func parseMultistatus(data []byte) (*multistatus, error) {
+	var ms multistatus
+	if err := xml.NewDecoder(bytes.NewReader(data)).Decode(&ms); err != nil {
+		return nil, err
+	}
+	return &ms, nil
+}
+
+// davPropfind issues a PROPFIND against a full URL and parses the reply.
+func (w *WebdavClient) davPropfind(rawURL string, depth string, body string) (*multistatus, error) {
+	headers := map[string]string{
+		"Depth":        depth,
+		"Content-Type": "application/xml; charset=utf-8",
+	}
+	code, _, data, err := davRequest("PROPFIND", rawURL, w.username, w.password, strings.NewReader(body), headers)
+	if err != nil {
+		return nil, err
+	}
+	if code != http.StatusMultiStatus {
+		return nil, gowebdav.NewPathError("PROPFIND", rawURL, code)
+	}
+	return parseMultistatus(data)
+}
+
+// proppatch sets and removes dead properties of name. Fails unless the
+// server applied every change.
+func (w *WebdavClient) proppatch(name string, set map[xml.Name]string, remove []xml.Name) error {
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?><d:propertyupdate xmlns:d="DAV:">`)
+	writeProp := func(n xml.Name, value *string) {
+		body.WriteString(`<x:`)
+		body.WriteString(n.Local)
+		body.WriteString(` xmlns:x="`)
+		_ = xml.EscapeText(&body, []byte(n.Space))
+		if value == nil {
+			body.WriteString(`"/>`)
+			return
+		}
+		body.WriteString(`">`)
+		_ = xml.EscapeText(&body, []byte(*value))
+		body.WriteString(`</x:` + n.Local + `>`)
+	}
+	if len(set) > 0 {
+		body.WriteString(`<d:set><d:prop>`)
+		for n, v := range set {
+			writeProp(n, &v)
+		}
+		body.WriteString(`</d:prop></d:set>`)
+	}
+	if len(remove) > 0 {
+		body.WriteString(`<d:remove><d:prop>`)
+		for _, n := range remove {
+			writeProp(n, nil)
+		}
+		body.WriteString(`</d:prop></d:remove>`)
+	}
+	body.WriteString(`</d:propertyupdate>`)
+
+	headers := w.withLockTokens(map[string]string{"Content-Type": "application/xml; charset=utf-8"}, name)
+	code, _, data, err := davRequest("PROPPATCH", buildURL(w.baseURL, name), w.username, w.password, strings.NewReader(body.String()), headers)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusMultiStatus {
+		if code >= 200 && code < 300 {
+			return nil
+		}
+		return statusErr("PROPPATCH", name, code)
+	}
+	ms, err := parseMultistatus(data)
+	if err != nil {
+		return err
+	}
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstats {
+			if !statusOK(ps.Status) {
+				return statusErr("PROPPATCH", name, statusCode(ps.Status))
+			}
+		}
+		if r.Status != "" && !statusOK(r.Status) {
+			return statusErr("PROPPATCH", name, statusCode(r.Status))
+		}
+	}
+	return nil
+}
+
+// statusCode returns the code of an "HTTP/1.1 200 OK" style status line,
+// 500 when it has none.
+func statusCode(status string) int {
+	fields := strings.Fields(status)
+	if len(fields) >= 2 {
+		if code, err := strconv.Atoi(fields[1]); err == nil {
+			return code
+		}
+	}
+	return http.StatusInternalServerError
+}
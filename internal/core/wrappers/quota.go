@@ -0,0 +1,59 @@
+package wrappers
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// quotaProps asks for the quota properties of RFC 4331.
+const quotaProps = `<?xml version="1.0" encoding="utf-8"?>` +
+	`<d:propfind xmlns:d="DAV:"><d:prop>` +
+	`<d:quota-available-bytes/><d:quota-used-bytes/>` +
+	`</d:prop></d:propfind>`
+
+var (
+	quotaAvailable = xml.Name{Space: davNS, Local: "quota-available-bytes"}
+	quotaUsed      = xml.Name{Space: davNS, Local: "quota-used-bytes"}
+
+	// ErrNoQuota is returned by Quota when the server reports neither
+	// property.
+	ErrNoQuota = errors.New("server reports no quota")
+)
+
+// Quota returns the bytes used and available below the mount root as the
+// server reports them (RFC 4331). Either is -1 when it is not reported, as
+// is available when the space is unlimited (negative values, which
+// ownCloud and Nextcloud use for "unknown" and "unlimited").
+func (w *WebdavClient) Quota() (used, available int64, err error) {
+	ms, err := w.davPropfind(buildURL(w.baseURL, "/"), "0", quotaProps)
+	if err != nil {
+		return -1, -1, err
+	}
+	if len(ms.Responses) == 0 {
+		return -1, -1, fmt.Errorf("PROPFIND /: empty multistatus")
+	}
+
+	props := ms.Responses[0].props()
+	used, available = quotaValue(props, quotaUsed), quotaValue(props, quotaAvailable)
+	if used < 0 && available < 0 {
+		return -1, -1, ErrNoQuota
+	}
+	return used, available, nil
+}
+
+// quotaValue returns the byte count of a quota property, -1 when it is
+// missing or not a count.
+func quotaValue(props map[xml.Name]string, name xml.Name) int64 {
+	v, ok := props[name]
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
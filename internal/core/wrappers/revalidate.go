@@ -0,0 +1,87 @@
+package wrappers
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	csNS = "http://calendarserver.org/ns/"
+	ocNS = "http://owncloud.org/ns"
+)
+
+// versionProps asks for the tags that change with a resource: getetag and
+// the collection tags of CalDAV/CardDAV style servers and ownCloud/Nextcloud.
+const versionProps = `<?xml version="1.0" encoding="utf-8"?>` +
+	`<d:propfind xmlns:d="DAV:" xmlns:cs="` + csNS + `" xmlns:oc="` + ocNS + `">` +
+	`<d:prop><d:getetag/><cs:getctag/><oc:etag/></d:prop></d:propfind>`
+
+var (
+	fileTags = []xml.Name{{Space: davNS, Local: "getetag"}, {Space: ocNS, Local: "etag"}}
+	// the getetag of a collection does not change with its members on
+	// every server, so it is not trusted for listings
+	collectionTags = []xml.Name{{Space: csNS, Local: "getctag"}, {Space: ocNS, Local: "etag"}}
+)
+
+// version returns the tag identifying the current state of name with a
+// Depth 0 PROPFIND: the getetag of a file, the ctag or oc:etag of a
+// collection, which change whenever a member does. Returns "" when the
+// server reports none.
+func (w *WebdavClient) version(name string, collection bool) (string, error) {
+	u := buildURL(w.baseURL, name)
+	if collection && !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	ms, err := w.davPropfind(u, "0", versionProps)
+	if err != nil {
+		return "", err
+	}
+	if len(ms.Responses) == 0 {
+		return "", fmt.Errorf("PROPFIND %s: empty multistatus", u)
+	}
+
+	tags := fileTags
+	if collection {
+		tags = collectionTags
+	}
+	props := ms.Responses[0].props()
+	for _, t := range tags {
+		if v := strings.TrimSpace(innerText(props[t])); v != "" {
+			return v, nil
+		}
+	}
+	return "", nil
+}
+
+// unchanged reports whether the file name still has version etag. The
+// conditional HEAD it asks with is answered with 304 Not Modified, or the
+// current ETag by servers ignoring If-None-Match, and costs the server less
+// than the PROPFIND of version.
+func (w *WebdavClient) unchanged(name, etag string) bool {
+	headers := map[string]string{"If-None-Match": etag}
+	code, hdr, _, err := davRequest(http.MethodHead, buildURL(w.baseURL, name), w.username, w.password, nil, headers)
+	if err != nil {
+		return false
+	}
+	return code == http.StatusNotModified || code == http.StatusOK && hdr.Get("ETag") == etag
+}
+
+// collectionVersion is version for a collection. Once a server turned out
+// not to report collection tags it is not asked again.
+func (w *WebdavClient) collectionVersion(name string) (string, error) {
+	if w.noCollectionTags.Load() {
+		return "", nil
+	}
+	tag, err := w.version(name, true)
+	if err == nil && tag == "" {
+		w.noCollectionTags.Store(true)
+	}
+	return tag, err
+}
+
+// dirKey is the cache key of the listing of name.
+func dirKey(name string) string {
+	return strings.TrimRight(name, "/") + "/"
+}
@@ -0,0 +1,164 @@
+package wrappers
+
+import (
+	"encoding/xml"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+// statProps asks for the attributes Stat and ReadDir report, the target of
+// symbolic links and stored permissions included.
+const statProps = `<?xml version="1.0" encoding="utf-8"?>` +
+	`<d:propfind xmlns:d="DAV:" xmlns:m="` + mimicNS + `">` +
+	`<d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/><d:getetag/>` +
+	`<m:symlink-target/><m:mode/><m:uid/><m:gid/></d:prop></d:propfind>`
+
+var (
+	getContentLength = xml.Name{Space: davNS, Local: "getcontentlength"}
+	getLastModified  = xml.Name{Space: davNS, Local: "getlastmodified"}
+)
+
+// fileInfo is what a PROPFIND reports about a resource.
+type fileInfo struct {
+	name     string
+	size     int64
+	modified time.Time
+	etag     string
+	dir      bool
+	target   string // symbolic link target, "" for other resources
+
+	// set with chmod and chown, nil when never set
+	perm, uid, gid *uint32
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) ModTime() time.Time { return fi.modified }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() any           { return nil }
+func (fi *fileInfo) ETag() string       { return fi.etag }
+
+// Target returns where a symbolic link points, "" if fi is none.
+func (fi *fileInfo) Target() string { return fi.target }
+
+// Size returns the length of the target for symbolic links, like lstat.
+func (fi *fileInfo) Size() int64 {
+	if fi.target != "" {
+		return int64(len(fi.target))
+	}
+	return fi.size
+}
+
+// Mode reports the stored permission bits, or those gowebdav does, as
+// WebDAV has none.
+func (fi *fileInfo) Mode() os.FileMode {
+	switch {
+	case fi.dir:
+		return fi.permOr(0775) | os.ModeDir
+	case fi.target != "":
+		return 0777 | os.ModeSymlink
+	}
+	return fi.permOr(0664)
+}
+
+func (fi *fileInfo) permOr(def os.FileMode) os.FileMode {
+	if fi.perm == nil {
+		return def
+	}
+	return os.FileMode(*fi.perm) & os.ModePerm
+}
+
+// Ownership returns the permission bits, owner and group stored with
+// chmod and chown, nil for those that never were.
+func (fi *fileInfo) Ownership() (perm, uid, gid *uint32) { return fi.perm, fi.uid, fi.gid }
+
+// newFileInfo builds the attributes of a PROPFIND response named name.
+// Returns nil when the response carries no properties.
+func newFileInfo(r *msResponse, name string) *fileInfo {
+	props := r.props()
+	if len(props) == 0 {
+		return nil
+	}
+	fi := &fileInfo{
+		name:     name,
+		modified: time.Unix(0, 0),
+		etag:     strings.TrimSpace(innerText(props[getETag])),
+		dir:      strings.Contains(props[resourceType], "collection"),
+	}
+	if t, err := time.Parse(time.RFC1123, strings.TrimSpace(props[getLastModified])); err == nil {
+		fi.modified = t
+	}
+	fi.perm, fi.uid, fi.gid = parseOwnership(props)
+	if fi.dir {
+		return fi
+	}
+	fi.size, _ = strconv.ParseInt(strings.TrimSpace(props[getContentLength]), 10, 64)
+	fi.target = innerText(props[symlinkTarget])
+	return fi
+}
+
+// propfind returns the attributes of name and, with depth "1", of its
+// members.
+func (w *WebdavClient) propfind(name, depth string) (*fileInfo, []os.FileInfo, error) {
+	u := buildURL(w.baseURL, name)
+	if depth != "0" && !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	headers := map[string]string{
+		"Depth":        depth,
+		"Content-Type": "application/xml; charset=utf-8",
+	}
+	code, _, data, err := davRequest("PROPFIND", u, w.username, w.password, strings.NewReader(statProps), headers)
+	if err != nil {
+		return nil, nil, err
+	}
+	if code != http.StatusMultiStatus {
+		// a collection named without its slash may be redirected to a GET
+		// answered with 200, which callers retry with the slash
+		return nil, nil, gowebdav.NewPathError("PROPFIND", name, code)
+	}
+	ms, err := parseMultistatus(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	self := path.Clean("/" + name)
+	var (
+		info    *fileInfo
+		members = make([]os.FileInfo, 0, len(ms.Responses))
+	)
+	for i := range ms.Responses {
+		r := &ms.Responses[i]
+		if w.hrefName(r.Href) == self {
+			if info == nil {
+				info = newFileInfo(r, path.Base(self))
+			}
+			continue
+		}
+		if fi := newFileInfo(r, r.name()); fi != nil {
+			members = append(members, fi)
+		}
+	}
+	if info == nil {
+		return nil, nil, gowebdav.NewPathError("PROPFIND", name, http.StatusNotFound)
+	}
+	return info, members, nil
+}
+
+// updateCached applies a change of attributes made with a PROPPATCH to the
+// cached ones of name.
+func (w *WebdavClient) updateCached(name string, change func(*fileInfo)) {
+	entry, ok := w.cache.Get(name)
+	// the parent listing holds the old attributes
+	w.cache.Invalidate(name)
+	if ok && entry.Info != nil {
+		fi := infoOf(entry.Info)
+		change(fi)
+		w.cache.Set(name, w.cache.NewEntry(fi))
+	}
+}
@@ -0,0 +1,45 @@
+package wrappers
+
+import (
+	"encoding/xml"
+	"errors"
+	"os"
+)
+
+// mimicNS is the namespace of the dead properties mimic stores.
+const mimicNS = "urn:mimic:"
+
+// symlinkTarget marks a resource as a symbolic link and holds its target.
+var symlinkTarget = xml.Name{Space: mimicNS, Local: "symlink-target"}
+
+// ErrNotSymlink is returned by Readlink for resources that are no
+// symbolic link.
+var ErrNotSymlink = errors.New("not a symbolic link")
+
+// Symlink creates name as a symbolic link to target: a small file holding
+// the target, so clients that do not know the property still see where it
+// points, with the target in the mimic:symlink-target dead property. The
+// file is removed again when the server does not store the property.
+func (w *WebdavClient) Symlink(target, name string) error {
+	defer w.cache.Invalidate(name)
+	if err := w.commit(name, []byte(target)); err != nil {
+		return err
+	}
+	if err := w.proppatch(name, map[xml.Name]string{symlinkTarget: target}, nil); err != nil {
+		_ = w.client.Remove(name)
+		return err
+	}
+	return nil
+}
+
+// Readlink returns the target of the symbolic link name.
+func (w *WebdavClient) Readlink(name string) (string, error) {
+	fi, err := w.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	if l, ok := fi.(interface{ Target() string }); ok && l.Target() != "" {
+		return l.Target(), nil
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: ErrNotSymlink}
+}
@@ -0,0 +1,334 @@
+package wrappers
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syncReport asks for the changes below the root since a sync token
+// (RFC 6578). An empty token returns the current state and a first token.
+const syncReport = `<?xml version="1.0" encoding="utf-8"?>` +
+	`<d:sync-collection xmlns:d="DAV:"><d:sync-token>%s</d:sync-token>` +
+	`<d:sync-level>infinite</d:sync-level><d:prop><d:getetag/><d:resourcetype/></d:prop>` +
+	`</d:sync-collection>`
+
+// syncTokenProp asks for the sync token of a collection (RFC 6578 section
+// 4), which servers supporting sync-collection report.
+const syncTokenProp = `<?xml version="1.0" encoding="utf-8"?>` +
+	`<d:propfind xmlns:d="DAV:"><d:prop><d:sync-token/></d:prop></d:propfind>`
+
+// memberProps is versionProps plus the resource type of the members.
+const memberProps = `<?xml version="1.0" encoding="utf-8"?>` +
+	`<d:propfind xmlns:d="DAV:" xmlns:cs="` + csNS + `" xmlns:oc="` + ocNS + `">` +
+	`<d:prop><d:resourcetype/><d:getetag/><cs:getctag/><oc:etag/></d:prop></d:propfind>`
+
+var (
+	resourceType = xml.Name{Space: davNS, Local: "resourcetype"}
+	getETag      = xml.Name{Space: davNS, Local: "getetag"}
+	syncToken    = xml.Name{Space: davNS, Local: "sync-token"}
+
+	errSyncUnsupported  = errors.New("sync-collection not supported")
+	errSyncTokenInvalid = errors.New("sync token no longer valid")
+)
+
+// Watch asks the server every interval for changes made by other clients
+// and drops the cache entries of what changed. changed is called for every
+// changed file with its new ETag, "" when it was removed, so the caller can
+// drop data it cached itself. When the server can no longer tell what
+// changed, changed is called with the name "/" and no ETag: anything may
+// have changed. Servers supporting sync-collection report
+// exactly what changed; others are polled for the collection tag of the
+// root, and the collections whose tag changed are listed to find the
+// members that differ. Call the returned function to stop watching.
+func (w *WebdavClient) Watch(interval time.Duration, changed func(name, etag string)) (stop func()) {
+	wt := &watcher{
+		w:       w,
+		changed: changed,
+		sync:    true,
+		members: make(map[string]map[string]member),
+	}
+	done := make(chan struct{})
+	go func() {
+		wt.start()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				// failures are retried on the next tick
+				_ = wt.poll()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// member is what a listing reports about an entry of a collection.
+type member struct {
+	tag string
+	dir bool
+}
+
+// watcher is the state of a Watch loop.
+type watcher struct {
+	w       *WebdavClient
+	changed func(name, etag string)
+
+	sync  bool   // the server answers sync-collection
+	token string // last sync token
+
+	// fallback: the collection tag of the root and the members of every
+	// collection listed so far, by name
+	rootTag string
+	members map[string]map[string]member
+}
+
+// start records the state changes are detected against.
+func (wt *watcher) start() {
+	if wt.sync {
+		token, err := wt.w.syncToken()
+		if err == nil {
+			wt.token = token
+			return
+		}
+		if !errors.Is(err, errSyncUnsupported) {
+			return
+		}
+		wt.sync = false
+	}
+	if tag, err := wt.w.collectionVersion("/"); err == nil && tag != "" {
+		wt.rootTag = tag
+		if cur, err := wt.w.members("/"); err == nil {
+			wt.members["/"] = cur
+		}
+	}
+}
+
+func (wt *watcher) poll() error {
+	if wt.sync {
+		err := wt.pollSync()
+		if !errors.Is(err, errSyncUnsupported) {
+			return err
+		}
+		wt.sync = false
+	}
+
+	tag, err := wt.w.collectionVersion("/")
+	if err != nil || tag == "" || tag == wt.rootTag {
+		// without collection tags there is nothing cheap to poll
+		return err
+	}
+	if err := wt.visit("/"); err != nil {
+		return err
+	}
+	wt.rootTag = tag
+	return nil
+}
+
+// pollSync applies the changes reported since the last sync token. When the
+// server no longer knows the token everything cached may be outdated.
+func (wt *watcher) pollSync() error {
+	if wt.token == "" {
+		wt.start()
+		return nil
+	}
+	ms, err := wt.w.syncCollection(wt.token)
+	if errors.Is(err, errSyncTokenInvalid) {
+		wt.w.cache.InvalidateTree("")
+		wt.token = ""
+		wt.start()
+		wt.changed("/", "")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, r := range ms.Responses {
+		name := wt.w.hrefName(r.Href)
+		if name == "/" {
+			continue
+		}
+		removed := r.Status != "" && !statusOK(r.Status)
+		props := r.props()
+		dir := strings.HasSuffix(r.Href, "/") ||
+			strings.Contains(props[resourceType], "collection")
+		wt.apply(name, strings.TrimSpace(innerText(props[getETag])), dir, removed)
+	}
+	if ms.SyncToken != "" {
+		wt.token = ms.SyncToken
+	}
+	return nil
+}
+
+// visit lists dir and applies what changed since it was listed last, going
+// down into the collections whose tag changed. The first time a collection
+// is visited the changed members cannot be told apart, so everything cached
+// below it is dropped.
+func (wt *watcher) visit(dir string) error {
+	cur, err := wt.w.members(dir)
+	if err != nil {
+		return err
+	}
+	prev, known := wt.members[dir]
+	wt.members[dir] = cur
+
+	if !known {
+		wt.w.cache.Invalidate(dir)
+		wt.w.cache.InvalidateTree(dirKey(dir))
+		for name, m := range cur {
+			if !m.dir {
+				wt.changed(path.Join(dir, name), m.tag)
+			}
+		}
+		return nil
+	}
+
+	for name, m := range cur {
+		p, ok := prev[name]
+		if ok && p == m {
+			continue
+		}
+		child := path.Join(dir, name)
+		if m.dir && ok && p.dir {
+			if err := wt.visit(child); err != nil {
+				return err
+			}
+			continue
+		}
+		wt.forget(child)
+		wt.apply(child, m.tag, m.dir, false)
+	}
+	for name, p := range prev {
+		if _, ok := cur[name]; !ok {
+			child := path.Join(dir, name)
+			wt.forget(child)
+			wt.apply(child, "", p.dir, true)
+		}
+	}
+	return nil
+}
+
+// forget drops the recorded listings of dir and below.
+func (wt *watcher) forget(dir string) {
+	for k := range wt.members {
+		if k == dir || strings.HasPrefix(k, dirKey(dir)) {
+			delete(wt.members, k)
+		}
+	}
+}
+
+// apply drops the cache entries of a changed name and reports changed
+// files.
+func (wt *watcher) apply(name, etag string, dir, removed bool) {
+	wt.w.cache.Invalidate(name)
+	if dir {
+		wt.w.cache.InvalidateTree(dirKey(name))
+		return
+	}
+	if removed {
+		etag = ""
+	}
+	wt.changed(name, etag)
+}
+
+// syncToken returns the current sync token of the root, asked for with a
+// Depth 0 PROPFIND rather than a sync-collection without a token, which
+// lists the whole tree.
+func (w *WebdavClient) syncToken() (string, error) {
+	ms, err := w.davPropfind(buildURL(w.baseURL, "/"), "0", syncTokenProp)
+	if err != nil {
+		return "", err
+	}
+	for i := range ms.Responses {
+		if token := strings.TrimSpace(innerText(ms.Responses[i].props()[syncToken])); token != "" {
+			return token, nil
+		}
+	}
+	return "", fmt.Errorf("%w: no sync-token on the root", errSyncUnsupported)
+}
+
+// syncCollection sends a sync-collection REPORT for the root.
+func (w *WebdavClient) syncCollection(token string) (*multistatus, error) {
+	u := buildURL(w.baseURL, "/")
+	headers := map[string]string{
+		"Depth":        "0",
+		"Content-Type": "application/xml; charset=utf-8",
+	}
+	var esc strings.Builder
+	_ = xml.EscapeText(&esc, []byte(token))
+	body := fmt.Sprintf(syncReport, esc.String())
+	code, _, data, err := davRequest("REPORT", u, w.username, w.password, strings.NewReader(body), headers)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case code == 207:
+		return parseMultistatus(data)
+	case (code == 403 || code == 409) && strings.Contains(string(data), "valid-sync-token"):
+		return nil, errSyncTokenInvalid
+	case code >= 500 && code != 501:
+		return nil, statusErr("REPORT", "/", code)
+	default:
+		return nil, fmt.Errorf("%w: REPORT %s: %d", errSyncUnsupported, u, code)
+	}
+}
+
+// members lists name with a Depth 1 PROPFIND and returns the version tag
+// of every member.
+func (w *WebdavClient) members(name string) (map[string]member, error) {
+	u := buildURL(w.baseURL, name)
+	if !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	ms, err := w.davPropfind(u, "1", memberProps)
+	if err != nil {
+		return nil, err
+	}
+
+	self := path.Clean("/" + name)
+	out := make(map[string]member)
+	for i := range ms.Responses {
+		r := &ms.Responses[i]
+		if w.hrefName(r.Href) == self {
+			continue
+		}
+		props := r.props()
+		m := member{dir: strings.HasSuffix(r.Href, "/") ||
+			strings.Contains(props[resourceType], "collection")}
+		tags := fileTags
+		if m.dir {
+			tags = collectionTags
+		}
+		for _, t := range tags {
+			if v := strings.TrimSpace(innerText(props[t])); v != "" {
+				m.tag = v
+				break
+			}
+		}
+		out[r.name()] = m
+	}
+	return out, nil
+}
+
+// hrefName maps a response href to the name of the resource below the
+// base URL, e.g. "/remote.php/dav/files/u/docs/a.txt" to "/docs/a.txt".
+func (w *WebdavClient) hrefName(href string) string {
+	p := href
+	if u, err := url.Parse(href); err == nil {
+		p = u.Path
+	}
+	if u, err := url.Parse(w.baseURL); err == nil {
+		p = strings.TrimPrefix(p, strings.TrimRight(u.Path, "/"))
+	}
+	return path.Clean("/" + p)
+}
@@ -4,9 +4,13 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mimic/internal/core/cache"
 	"github.com/mimic/internal/core/helpers"
@@ -22,9 +26,36 @@ type WebdavClient struct {
 	baseURL  string
 	username string
 	password string
+
+	partialOnce sync.Once
+	partial     atomic.Int32 // partialMode
+
+	// chunked uploads, see SetChunking
+	chunkThreshold int64
+	chunkSize      int64
+	uploadsURL     string
+	chunkUploads   sync.Map // name -> *chunkUpload, see chunkedUpload
+
+	guards sync.Map // name -> *guard, see Guarded
+
+	noCollectionTags atomic.Bool // the server reports no ctag/oc:etag
+
+	modTimes sync.Map     // name -> *modTime, see ModTimed
+	mtime    atomic.Int32 // mtimeMode
+
+	// server locks backing write locks, see SetServerLocks
+	serverLocks bool
+	lockTimeout time.Duration
+	davMu       sync.Mutex
+	davLocks    map[string]*davLock
+	// closed once the UNLOCK of a released server lock finished
+	davUnlocks map[string]chan struct{}
 }
 
-const streamThreshold = 4 * 1024 * 1024 // 4 MB
+const (
+	streamThreshold = 4 * 1024 * 1024 // 4 MB
+	partialWindow   = 8 * 1024 * 1024 // bytes per partial update of WriteOffsetFrom
+)
 
 func NewWebdavClient(cache *cache.NodeCache, baseURL, username, password string) *WebdavClient {
 	client := gowebdav.NewClient(baseURL, username, password)
@@ -45,19 +76,40 @@ func NewWebdavClient(cache *cache.NodeCache, baseURL, username, password string)
 	}
 }
 
+// Stat returns the attributes of name. A cached entry that expired is
+// revalidated with its ETag before the attributes are fetched again: with a
+// conditional HEAD for a file, the version PROPFIND for a collection.
 func (w *WebdavClient) Stat(name string) (os.FileInfo, error) {
 	if fi, ok := w.cache.Get(name); ok {
 		// fmt.Println("[Cache] Stat cache hit for", name)
 		return fi.Info, nil
 	}
+	if w.cache.Missing(name) {
+		return nil, gowebdav.NewPathError("PROPFIND", name, http.StatusNotFound)
+	}
+	if entry, ok := w.cache.Stale(name); ok && entry.Info != nil {
+		if entry.IsDir {
+			if tag, err := w.version(name, false); err == nil && tag == entry.ETag {
+				w.cache.Revalidated(name)
+				return entry.Info, nil
+			}
+		} else if w.unchanged(name, entry.ETag) {
+			w.cache.Revalidated(name)
+			return entry.Info, nil
+		}
+	}
 
+	orig := name
 retry:
-	stat, err := w.client.Stat(name)
+	stat, _, err := w.propfind(name, "0")
 	if err != nil {
-		if !strings.HasSuffix(name, "/") && strings.Contains(err.Error(), "200") {
+		if !strings.HasSuffix(name, "/") && helpers.StatusCode(err) == http.StatusOK {
 			name += "/"
 			goto retry
 		}
+		if helpers.IsNotExistErr(err) {
+			w.cache.SetMissing(orig)
+		}
 		return nil, err
 	}
 
@@ -66,23 +118,43 @@ retry:
 	return stat, nil
 }
 
+// ReadDir lists name. An expired listing is kept when the collection tag
+// shows that the collection did not change.
 func (w *WebdavClient) ReadDir(name string) ([]os.FileInfo, error) {
-	if children, ok := w.cache.GetChildren(name + "/"); ok && children != nil {
+	key := dirKey(name)
+	if children, ok := w.cache.GetChildren(key); ok && children != nil {
 		fmt.Println("[Cache] ReadDir cache hit for", name)
 		return children, nil
 	}
+	if entry, ok := w.cache.Stale(key); ok && entry.Children != nil {
+		if tag, err := w.collectionVersion(name); err == nil && tag == entry.ETag {
+			w.cache.Revalidated(key)
+			w.cacheChildren(name, entry.Children)
+			return entry.Children, nil
+		}
+	}
 
-	infos, err := w.client.ReadDir(name)
+	// taken before the listing: a change in between fails the next check
+	tag, _ := w.collectionVersion(name)
+	self, infos, err := w.propfind(name, "1")
 	if err != nil {
 		return nil, err
 	}
+	if !self.IsDir() {
+		return nil, gowebdav.NewPathError("ReadDir", name, http.StatusMethodNotAllowed)
+	}
+
+	w.cache.SetChildren(key, infos, tag)
+	w.cacheChildren(name, infos)
+
+	return infos, nil
+}
 
-	w.cache.SetChildren(name, infos)
+// cacheChildren caches the attributes of the members of a listing.
+func (w *WebdavClient) cacheChildren(name string, infos []os.FileInfo) {
 	for _, fi := range infos {
 		w.cache.Set(path.Join(name, fi.Name()), w.cache.NewEntry(fi))
 	}
-
-	return infos, nil
 }
 
 func (w *WebdavClient) Read(name string) ([]byte, error) {
@@ -106,11 +178,60 @@ func (w *WebdavClient) ReadRange(name string, offset, length int64) ([]byte, err
 	return buf, nil
 }
 
+// ReadRangeVersion is ReadRange that also returns the ETag of the version
+// the data was read from, "" when the server does not report one.
+func (w *WebdavClient) ReadRangeVersion(name string, offset, length int64) ([]byte, string, error) {
+	req, err := http.NewRequest(http.MethodGet, buildURL(w.baseURL, name), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	req.SetBasicAuth(w.username, w.password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the range
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			if err == io.EOF {
+				return nil, resp.Header.Get("ETag"), nil
+			}
+			return nil, "", err
+		}
+	default:
+		return nil, "", statusErr("GET", name, resp.StatusCode)
+	}
+
+	buf := make([]byte, length)
+	n, err := io.ReadFull(resp.Body, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, "", err
+	}
+	return buf[:n], resp.Header.Get("ETag"), nil
+}
+
 func (w *WebdavClient) Write(name string, data []byte) error {
 	return w.commit(name, data)
 }
 
+// WriteOffset writes data at offset into the remote file. Servers that
+// support partial updates get only the changed range; otherwise the file is
+// downloaded, patched and uploaded whole.
 func (w *WebdavClient) WriteOffset(name string, data []byte, offset int64) error {
+	ok, err := w.writePartial(name, data, offset)
+	if err != nil {
+		return err
+	}
+	if ok {
+		w.cache.Invalidate(name)
+		return nil
+	}
+
 	existing, err := w.fetch(name)
 	if err != nil {
 		if helpers.IsNotExistErr(err) && offset == 0 {
@@ -134,6 +255,58 @@ func (w *WebdavClient) WriteOffset(name string, data []byte, offset int64) error
 	return w.commit(name, merged)
 }
 
+// WriteFrom replaces the remote file with size bytes read from r.
+func (w *WebdavClient) WriteFrom(name string, r io.ReaderAt, size int64) error {
+	return w.commitFrom(name, r, size)
+}
+
+// WriteOffsetFrom is WriteOffset for data too large to keep in memory: r
+// provides size bytes for offset. Data replacing the whole file is
+// streamed, partial updates are sent in windows, and only servers without
+// either get the fetch-merge-upload of WriteOffset.
+func (w *WebdavClient) WriteOffsetFrom(name string, r io.ReaderAt, size, offset int64) error {
+	if size <= partialWindow {
+		data, err := readSection(r, 0, size)
+		if err != nil {
+			return err
+		}
+		return w.WriteOffset(name, data, offset)
+	}
+
+	fi, err := w.client.Stat(name)
+	switch {
+	case err != nil && helpers.IsNotExistErr(err) && offset == 0:
+		return w.commitFrom(name, r, size)
+	case err != nil:
+		return err
+	case offset == 0 && fi.Size() <= size:
+		return w.commitFrom(name, r, size)
+	}
+
+	if w.partialMode(name) != partialNone && offset <= fi.Size() {
+		sent := true
+		for off := int64(0); off < size && sent; off += partialWindow {
+			window, err := readSection(r, off, min(partialWindow, size-off))
+			if err != nil {
+				return err
+			}
+			if sent, err = w.writePartial(name, window, offset+off); err != nil {
+				return err
+			}
+		}
+		if sent {
+			w.cache.Invalidate(name)
+			return nil
+		}
+	}
+
+	data, err := readSection(r, 0, size)
+	if err != nil {
+		return err
+	}
+	return w.WriteOffset(name, data, offset)
+}
+
 func (w *WebdavClient) Create(name string) error {
 	if strings.HasSuffix(name, "/") {
 		return &os.PathError{Op: "create", Path: name, Err: os.ErrInvalid}
@@ -153,6 +326,9 @@ func (w *WebdavClient) Remove(name string) error {
 	}
 	defer w.cache.InvalidateTree(parent + "/")
 	defer w.cache.Invalidate(name)
+	if w.lockToken(name) != "" {
+		return w.remove(name)
+	}
 	return w.client.Remove(name)
 }
 
@@ -177,97 +353,134 @@ func (w *WebdavClient) Rmdir(name string) error {
 }
 
 func (w *WebdavClient) Rename(oldname, newname string) error {
-	oldParent := path.Dir(strings.TrimRight(oldname, "/"))
-	if oldParent == "." {
-		oldParent = "/"
-	}
-	newParent := path.Dir(strings.TrimRight(newname, "/"))
-	if newParent == "." {
-		newParent = "/"
-	}
-
+	// Invalidate also drops the parent listings, which the negative
+	// lookups of both names rely on
+	defer w.cache.Invalidate(oldname)
+	defer w.cache.Invalidate(newname)
 	defer w.cache.InvalidateTree(oldname)
 	defer w.cache.InvalidateTree(newname)
 
+	if w.lockToken(oldname) != "" || w.lockToken(newname) != "" {
+		return w.move(oldname, newname)
+	}
 	w.client.SetHeader("Host", w.baseURL)
 	return w.client.Rename(oldname, newname, true)
 }
 
-// Truncate resizes the remote file to `size`.
-// Strategy:
-//   - stat current size
-//   - if shrinking: read range [0,size) (prefer ReadStreamRange) and PUT that slice
-//   - if extending: read whole file (or available prefix), append zero bytes to requested size and PUT
+// Copy copies the remote file oldname to newname, replacing newname.
+func (w *WebdavClient) Copy(oldname, newname string) error {
+	parent := path.Dir(strings.TrimRight(newname, "/"))
+	if parent == "." {
+		parent = "/"
+	}
+	defer w.cache.InvalidateTree(parent + "/")
+	defer w.cache.Invalidate(newname)
+	return w.client.Copy(oldname, newname, true)
+}
+
+// Truncate resizes the remote file to `size` without downloading more than
+// it keeps:
+//   - size 0 is a single empty PUT
+//   - shrinking reads the range [0,size) and PUTs it back
+//   - extending appends zeros in place when the server supports partial
+//     updates, otherwise the file is fetched and re-uploaded padded
 func (w *WebdavClient) Truncate(name string, size int64) error {
 	defer w.cache.Invalidate(name)
 	if strings.HasSuffix(name, "/") && name != "/" {
 		name = strings.TrimSuffix(name, "/")
 	}
 
-	// get current size
+	if size == 0 {
+		return w.Create(name)
+	}
+
 	fi, err := w.client.Stat(name)
 	if err != nil {
-		// create empty file if it doesn't exist and size == 0
-		if helpers.IsNotExistErr(err) && size == 0 {
-			return w.Create(name)
+		// create zero-filled if it doesn't exist
+		if helpers.IsNotExistErr(err) {
+			return w.commitFrom(name, zeroPadded{size: size}, size)
 		}
 		return err
 	}
 	cur := fi.Size()
 
-	// nothing to do
-	if int64(cur) == size {
+	switch {
+	case cur == size:
 		return nil
-	}
 
-	// extend
-	existing, err := w.fetch(name)
-	if err != nil {
-		// if not exists and size > 0 create zero-filled
-		if helpers.IsNotExistErr(err) {
-			buf := make([]byte, size)
-			return w.commit(name, buf)
+	case cur > size:
+		head, err := w.ReadRange(name, 0, size)
+		if err != nil {
+			return err
 		}
-		return err
-	}
-
-	// shrink
-	if int64(cur) > size {
-		// ensure slice length equals requested size
-		if int64(len(existing)) > size {
-			existing = existing[:size]
-		} else if int64(len(existing)) < size {
-			// unexpected but pad with zeros
-			padded := make([]byte, size)
-			copy(padded, existing)
-			existing = padded
+		if int64(len(head)) != size {
+			return fmt.Errorf("truncate %s: short range read: got %d of %d bytes", name, len(head), size)
+		}
+		return w.commit(name, head)
+
+	default:
+		// the zeros go out in windows, never held in memory at once
+		zeros := make([]byte, min(size-cur, partialWindow))
+		sent := true
+		for off := cur; off < size && sent; off += int64(len(zeros)) {
+			if sent, err = w.writePartial(name, zeros[:min(int64(len(zeros)), size-off)], off); err != nil {
+				return err
+			}
+		}
+		if sent {
+			return nil
 		}
-		return w.commit(name, existing)
-	}
 
-	if int64(len(existing)) >= size {
-		// already >= size (shouldn't happen due to earlier check) but handle defensively
-		return w.commit(name, existing[:size])
+		existing, err := w.fetch(name)
+		if err != nil {
+			return err
+		}
+		return w.commitFrom(name, zeroPadded{data: existing, size: size}, size)
 	}
-
-	buf := make([]byte, size)
-	copy(buf, existing)
-	return w.commit(name, buf)
 }
 
 // Range-locking API used by FS layer. These are intentionally not part of
 // interfaces.WebClient to avoid breaking the interface; the FS will type-assert
-// to use them when present.
+// to use them when present. With SetServerLocks, write locks also hold a
+// lock on the server.
 func (w *WebdavClient) Lock(name string, owner []byte, start, end uint64, lockType locking.LockType) error {
-	return w.lm.Acquire(name, owner, start, end, lockType)
+	prev := w.lm.Owned(name, owner, start, end)
+	if err := w.lm.Acquire(name, owner, start, end, lockType); err != nil {
+		return err
+	}
+	if err := w.serverLock(name, lockType); err != nil {
+		// back to the locks owner held before, a read lock it tried to
+		// upgrade stays
+		w.lm.Restore(name, owner, start, end, prev)
+		return err
+	}
+	return nil
 }
 
 func (w *WebdavClient) LockWait(ctx context.Context, name string, owner []byte, start, end uint64, lockType locking.LockType) error {
-	return w.lm.AcquireWait(ctx, name, owner, start, end, lockType)
+	prev := w.lm.Owned(name, owner, start, end)
+	if err := w.lm.AcquireWait(ctx, name, owner, start, end, lockType); err != nil {
+		return err
+	}
+	if err := w.serverLockWait(ctx, name, lockType); err != nil {
+		w.lm.Restore(name, owner, start, end, prev)
+		return err
+	}
+	return nil
 }
 
 func (w *WebdavClient) Unlock(name string, owner []byte, start, end uint64) error {
-	return w.lm.Release(name, owner, start, end)
+	if err := w.lm.Release(name, owner, start, end); err != nil {
+		return err
+	}
+	return w.serverUnlock(name)
+}
+
+// UnlockOwner releases every lock owner holds on name, as closing a file
+// does for fcntl locks.
+func (w *WebdavClient) UnlockOwner(name string, owner []byte) error {
+	w.lm.ReleaseOwner(name, owner)
+	return w.serverUnlock(name)
 }
 
 func (w *WebdavClient) Query(name string, start, end uint64) *locking.LockInfo {
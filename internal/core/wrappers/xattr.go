@@ -0,0 +1,214 @@
+package wrappers
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// XattrPrefix is the namespace of the extended attributes stored as
+	// dead properties. Others have no place on the server.
+	XattrPrefix = "user."
+	// DAVXattrPrefix names the read-only attributes exposing live
+	// properties of the server.
+	DAVXattrPrefix = "user.dav."
+
+	// xattrNS is the namespace of the dead properties holding attributes.
+	xattrNS = mimicNS + "xattr:"
+)
+
+// xattrProps asks for all dead properties and the live ones exposed as
+// attributes.
+const xattrProps = `<?xml version="1.0" encoding="utf-8"?>` +
+	`<d:propfind xmlns:d="DAV:" xmlns:oc="` + ocNS + `"><d:allprop/><d:include>` +
+	`<d:getetag/><d:getcontenttype/><oc:fileid/><oc:permissions/><oc:checksums/>` +
+	`</d:include></d:propfind>`
+
+// liveXattrs maps the live properties exposed below DAVXattrPrefix to the
+// rest of their attribute name.
+var liveXattrs = map[xml.Name]string{
+	getETag:                                 "etag",
+	{Space: davNS, Local: "getcontenttype"}: "content-type",
+	{Space: ocNS, Local: "fileid"}:          "oc.fileid",
+	{Space: ocNS, Local: "permissions"}:     "oc.permissions",
+	{Space: ocNS, Local: "checksums"}:       "oc.checksums",
+}
+
+var (
+	// ErrNoXattr is returned for attributes a resource does not have.
+	ErrNoXattr = errors.New("no such attribute")
+	// ErrXattrReadOnly is returned when changing an attribute backed by a
+	// live property.
+	ErrXattrReadOnly = errors.New("attribute is read-only")
+	// ErrXattrNotSupported is returned for attributes outside XattrPrefix.
+	ErrXattrNotSupported = errors.New("attribute namespace not supported")
+)
+
+// Xattrs returns the extended attributes of name: its dead properties in
+// the attribute namespace and the live properties the server reports.
+func (w *WebdavClient) Xattrs(name string) (map[string][]byte, error) {
+	ms, err := w.davPropfind(buildURL(w.baseURL, name), "0", xattrProps)
+	if err != nil {
+		return nil, err
+	}
+	if len(ms.Responses) == 0 {
+		return nil, fmt.Errorf("PROPFIND %s: empty multistatus", name)
+	}
+
+	out := make(map[string][]byte)
+	for prop, v := range ms.Responses[0].props() {
+		if prop.Space == xattrNS {
+			if attr, ok := decodeXattrName(prop.Local); ok && !strings.HasPrefix(attr, DAVXattrPrefix) {
+				out[attr] = decodeXattrValue(innerText(v))
+			}
+			continue
+		}
+		if suffix, ok := liveXattrs[prop]; ok {
+			if v = strings.TrimSpace(innerText(v)); v != "" {
+				out[DAVXattrPrefix+suffix] = []byte(v)
+			}
+		}
+	}
+	return out, nil
+}
+
+// Xattr returns the extended attribute attr of name.
+func (w *WebdavClient) Xattr(name, attr string) ([]byte, error) {
+	if !strings.HasPrefix(attr, XattrPrefix) {
+		return nil, ErrNoXattr
+	}
+	attrs, err := w.Xattrs(name)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := attrs[attr]
+	if !ok {
+		return nil, ErrNoXattr
+	}
+	return v, nil
+}
+
+// SetXattr stores the extended attribute attr of name as a dead property.
+func (w *WebdavClient) SetXattr(name, attr string, value []byte) error {
+	prop, err := xattrProp(attr)
+	if err != nil {
+		return err
+	}
+	return w.proppatch(name, map[xml.Name]string{prop: encodeXattrValue(value)}, nil)
+}
+
+// RemoveXattr removes the extended attribute attr of name. Fails with
+// ErrNoXattr when name does not have it.
+func (w *WebdavClient) RemoveXattr(name, attr string) error {
+	prop, err := xattrProp(attr)
+	if err != nil {
+		return err
+	}
+	// removing a property that is not there succeeds in WebDAV
+	if _, err := w.Xattr(name, attr); err != nil {
+		return err
+	}
+	return w.proppatch(name, nil, []xml.Name{prop})
+}
+
+// xattrProp returns the dead property holding the writable attribute attr.
+func xattrProp(attr string) (xml.Name, error) {
+	switch {
+	case strings.HasPrefix(attr, DAVXattrPrefix):
+		return xml.Name{}, &os.PathError{Op: "setxattr", Path: attr, Err: ErrXattrReadOnly}
+	case !strings.HasPrefix(attr, XattrPrefix) || attr == XattrPrefix:
+		return xml.Name{}, &os.PathError{Op: "setxattr", Path: attr, Err: ErrXattrNotSupported}
+	}
+	return xml.Name{Space: xattrNS, Local: encodeXattrName(attr)}, nil
+}
+
+// encodeXattrName turns an attribute name into an XML local name: bytes
+// other than letters, digits, '.' and '-' become "_XX". Names below
+// XattrPrefix start with a letter, as XML requires.
+func encodeXattrName(attr string) string {
+	var sb strings.Builder
+	for i := 0; i < len(attr); i++ {
+		c := attr[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '-' {
+			sb.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&sb, "_%02X", c)
+	}
+	return sb.String()
+}
+
+func decodeXattrName(local string) (string, bool) {
+	var sb strings.Builder
+	for i := 0; i < len(local); i++ {
+		if local[i] != '_' {
+			sb.WriteByte(local[i])
+			continue
+		}
+		if i+2 >= len(local) {
+			return "", false
+		}
+		c, err := strconv.ParseUint(local[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", false
+		}
+		sb.WriteByte(byte(c))
+		i += 2
+	}
+	return sb.String(), true
+}
+
+// binaryValuePrefix marks values stored base64 encoded.
+const binaryValuePrefix = "base64:"
+
+// encodeXattrValue keeps text values readable for other clients and
+// encodes values XML cannot carry unchanged.
+func encodeXattrValue(value []byte) string {
+	text := utf8.Valid(value) && !strings.HasPrefix(string(value), binaryValuePrefix)
+	for _, c := range value {
+		if c < 0x20 && c != '\t' && c != '\n' || c == 0x7f {
+			text = false
+			break
+		}
+	}
+	if text {
+		return string(value)
+	}
+	return binaryValuePrefix + base64.StdEncoding.EncodeToString(value)
+}
+
+func decodeXattrValue(v string) []byte {
+	if rest, ok := strings.CutPrefix(v, binaryValuePrefix); ok {
+		if data, err := base64.StdEncoding.DecodeString(rest); err == nil {
+			return data
+		}
+	}
+	return []byte(v)
+}
+
+// innerText returns the character data of the raw inner XML of a
+// property, e.g. the checksums of
+// "<oc:checksum>SHA1:... MD5:...</oc:checksum>".
+func innerText(inner string) string {
+	if !strings.Contains(inner, "<") && !strings.Contains(inner, "&") {
+		return inner
+	}
+	var sb strings.Builder
+	d := xml.NewDecoder(strings.NewReader(inner))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		if cd, ok := tok.(xml.CharData); ok {
+			sb.Write(cd)
+		}
+	}
+	return sb.String()
+}
@@ -1,12 +1,19 @@
 package fs
 
 import (
+	"errors"
+	"maps"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/mimic/internal/core/casters"
 	"github.com/mimic/internal/core/checks"
+	"github.com/mimic/internal/core/config"
 	"github.com/mimic/internal/core/flags"
 	"github.com/mimic/internal/core/helpers"
+	"github.com/mimic/internal/core/wrappers"
 	fuselib "github.com/winfsp/cgofuse/fuse"
 )
 
@@ -18,11 +25,11 @@ const (
 
 func (fs *FuseFS) Getattr(p string, stat *fuselib.Stat_t, fh uint64) int {
 	if p == "/" {
-		stat.Mode = fuselib.S_IFDIR | 0o777
+		stat.Mode = fuselib.S_IFDIR | fs.owner.DirPerm()
 		stat.Nlink = 2
 		stat.Size = 0
-		stat.Uid = 1000
-		stat.Gid = 1000
+		stat.Uid = fs.owner.UID
+		stat.Gid = fs.owner.GID
 		stat.Mtim = fuselib.Now()
 		stat.Atim = fuselib.Now()
 		stat.Ctim = fuselib.Now()
@@ -41,11 +48,7 @@ func (fs *FuseFS) Getattr(p string, stat *fuselib.Stat_t, fh uint64) int {
 		*stat = *fi.stat
 
 		if fi.buffer != nil {
-			bufSize := fi.buffer.Size()
-			bufBase := fi.buffer.BasePos()
-			if bufBase+bufSize > stat.Size {
-				stat.Size = bufBase + bufSize
-			}
+			stat.Size = max(stat.Size, fi.buffer.Size())
 		}
 
 		fs.logger.Logf("[Getattr] found handle path=%s fh=%d mode=%#o size=%d", norm, fh, stat.Mode, stat.Size)
@@ -67,13 +70,19 @@ func (fs *FuseFS) Getattr(p string, stat *fuselib.Stat_t, fh uint64) int {
 		return -ENOENT
 	}
 
-	*stat = *casters.FileInfoCast(file)
+	*stat = *casters.FileInfoCast(file, fs.owner)
 
 	buf, ok := fs.bufferCache.Get(norm)
 	if ok {
-		bufSize := buf.Size()
-		bufBase := buf.BasePos()
-		stat.Size = max(stat.Size, bufBase+bufSize)
+		// the server still has the old size until the upload resizes it
+		if size, truncated := buf.Truncation(); truncated {
+			stat.Size = size
+		}
+		stat.Size = max(stat.Size, buf.Size())
+		if mtime := buf.ModTime(); !mtime.IsZero() {
+			// set locally, the upload keeps it on the server
+			stat.Mtim = fuselib.NewTimespec(mtime)
+		}
 	}
 
 	fs.logger.Logf("[Getattr] path=%s has fh=%t mode=%#o size=%d", norm, fh^(^uint64(0)) == 0, file.Mode(), file.Size())
@@ -102,39 +111,171 @@ func (fs *FuseFS) Open(path string, oflags int) (int, uint64) {
 		return -EEXIST, 0
 	}
 
-	handle := fs.NewHandle(path, casters.FileInfoCast(fi), uint32(flags))
+	handle := fs.NewHandle(path, casters.FileInfoCast(fi, fs.owner), uint32(flags))
+	if fh, ok := fs.GetHandle(handle); ok && !checks.IsNilInterface(fi) {
+		// uploads through this handle expect the version seen here
+		fh.buffer.Revalidate(casters.ETag(fi))
+	}
 
 	fs.logger.Logf("[Open] path=%s flags=%d handle=%d", path, flags, handle)
 
 	return 0, handle
 }
 
+// OpenEx is Open that also tells the kernel whether it may keep the pages
+// it cached of path from earlier opens.
+func (fs *FuseFS) OpenEx(path string, fi *fuselib.FileInfo_t) int {
+	errc, handle := fs.Open(path, fi.Flags)
+	if errc != 0 {
+		return errc
+	}
+	fi.Fh = handle
+	if fh, ok := fs.GetHandle(handle); ok {
+		fi.KeepCache = fs.keepPageCache(path, fh.ETag())
+	}
+	return 0
+}
+
+// CreateEx is Create for hosts calling OpenEx.
+func (fs *FuseFS) CreateEx(path string, mode uint32, fi *fuselib.FileInfo_t) int {
+	errc, handle := fs.Create(path, fi.Flags, mode)
+	if errc != 0 {
+		return errc
+	}
+	fi.Fh = handle
+	// pages cached of a file created over are outdated
+	fs.pageETags.Delete(path)
+	return 0
+}
+
+// keepPageCache reports whether the kernel pages of path are still valid
+// at version etag: under KernelCacheAuto, when the file has the version it
+// had when it was opened last.
+func (fs *FuseFS) keepPageCache(path, etag string) bool {
+	if fs.kernelCache != config.KernelCacheAuto {
+		return fs.kernelCache == config.KernelCacheAlways
+	}
+	if etag == "" {
+		fs.pageETags.Delete(path)
+		return false
+	}
+	prev, ok := fs.pageETags.Swap(path, etag)
+	return ok && prev.(string) == etag
+}
+
+// Rename moves the file or directory on the server once the data buffered
+// for it is uploaded, so no upload recreates the old name afterwards. The
+// buffers and open handles follow it; those of a replaced file are
+// discarded.
 func (fs *FuseFS) Rename(oldPath string, newPath string) int {
 	fs.logger.Logf("[Rename] from=%s to=%s", oldPath, newPath)
+	if oldPath == newPath {
+		return 0
+	}
+
+	if err := fs.commitBelow(oldPath); err != nil {
+		errc := uploadErrno(err)
+		fs.logger.Errorf("[Rename] upload of %s before the rename failed: %v returning %d", oldPath, err, errc)
+		return errc
+	}
+	replaced := fs.uploads.Cancel(newPath)
 
 	err := fs.client.Rename(oldPath, newPath)
 	if err != nil {
 		fs.logger.Errorf("[Rename] rename error from %s to %s: %v returning EIO", oldPath, newPath, err)
+		if fb, ok := fs.bufferCache.Get(newPath); ok && replaced {
+			// the dropped upload goes out with the next flush
+			fb.MarkDirty()
+		}
 		return -EIO
 	}
+	fs.discardBuffered(newPath)
+	fs.bufferCache.Rename(oldPath, newPath)
+	fs.handles.Range(func(_, v any) bool {
+		fh := v.(*FileHandle)
+		if p := fh.Path(); below(p, oldPath) {
+			fh.SetPath(newPath + strings.TrimPrefix(p, oldPath))
+		}
+		return true
+	})
+	if fs.content != nil {
+		fs.content.Remove(oldPath)
+	}
+	fs.pageETags.Delete(oldPath)
+	fs.pageETags.Delete(newPath)
 
 	return 0
 }
 
+// Utimens sets the modification time of path. The access time is not
+// kept. Files with changes still to be uploaded get it with the upload, so
+// the upload does not replace it with the time of the upload.
 func (fs *FuseFS) Utimens(path string, times []fuselib.Timespec) int {
 	fs.logger.Logf("[Utimens] path=%s times=%#v", path, times)
-	// no direct support for setting times in WebDAV; ignore for now
+	norm, err := casters.NormalizePath(path)
+	if err != nil {
+		fs.logger.Errorf("[Utimens] Path normalize error for path=%s error=%v returning EIO", path, err)
+		return -EIO
+	}
+
+	mtime := time.Now()
+	if len(times) > 1 {
+		switch times[1].Nsec {
+		case UTIME_OMIT:
+			return 0
+		case UTIME_NOW:
+		default:
+			mtime = times[1].Time()
+		}
+	}
+
+	if fb, ok := fs.bufferCache.Get(norm); ok && (fb.IsDirty() || fs.uploads.Pending(norm)) {
+		fb.SetModTime(mtime)
+		if _, err := fs.queueBuffer(norm, fb, false); err != nil {
+			fs.logger.Errorf("[Utimens] queue upload failed for %s: %v returning EIO", norm, err)
+			return -EIO
+		}
+	} else if err := fs.client.SetModTime(norm, mtime); err != nil {
+		switch {
+		case errors.Is(err, wrappers.ErrModTimeUnsupported):
+			// tools setting times should not fail on such servers
+			fs.logger.Logf("[Utimens] server keeps its own times, ignoring path=%s", norm)
+			return 0
+		case helpers.IsNotExistErr(err):
+			return -ENOENT
+		case helpers.IsForbiddenErr(err):
+			fs.logger.Errorf("[Utimens] server refused times of %s: %v returning EACCES", norm, err)
+			return -EACCES
+		}
+		fs.logger.Errorf("[Utimens] set time error for path=%s: %v returning EIO", norm, err)
+		return -EIO
+	}
+
+	stamp := fuselib.NewTimespec(mtime)
+	fs.updateHandleStats(norm, func(stat *fuselib.Stat_t) {
+		stat.Mtim = stamp
+		stat.Ctim = stamp
+	})
 	return 0
 }
 
+// Statfs reports the quota the server has for the mount root (RFC 4331).
+// Without a quota, or with an unlimited one, plenty of free space is
+// reported so tools checking for it go ahead.
 func (fs *FuseFS) Statfs(path string, stat *fuselib.Statfs_t) int {
 	fs.logger.Logf("[Statfs] path=%s", path)
 
+	used, available := fs.quota()
+	used = max(used, 0)
+	if available < 0 {
+		available = unlimitedBytes
+	}
+
 	stat.Bsize = DEFAULT_BLOCK_SIZE
 	stat.Frsize = DEFAULT_BLOCK_SIZE
-	stat.Blocks = 1024 * 1024 // 1M blocks
-	stat.Bfree = 512 * 1024   // 50% free
-	stat.Bavail = 512 * 1024  // 50% free
+	stat.Bfree = uint64(available) / DEFAULT_BLOCK_SIZE
+	stat.Bavail = stat.Bfree
+	stat.Blocks = stat.Bfree + (uint64(used)+DEFAULT_BLOCK_SIZE-1)/DEFAULT_BLOCK_SIZE
 	stat.Files = 1024 * 1024
 	stat.Ffree = 512 * 1024
 	stat.Favail = 512 * 1024
@@ -143,18 +284,111 @@ func (fs *FuseFS) Statfs(path string, stat *fuselib.Statfs_t) int {
 	return 0
 }
 
+// Chmod stores the permission bits of path on the server when permissions
+// are persisted and succeeds without effect otherwise.
 func (fs *FuseFS) Chmod(path string, mode uint32) int {
 	fs.logger.Logf("[Chmod] path=%s mode=%#o", path, mode)
-	return -ENOSYS
+	if !fs.persistPerms {
+		return 0
+	}
+	norm, err := casters.NormalizePath(path)
+	if err != nil {
+		fs.logger.Errorf("[Chmod] Path normalize error for path=%s error=%v returning EIO", path, err)
+		return -EIO
+	}
+
+	if err := fs.client.SetMode(norm, mode); err != nil {
+		return fs.permsErrno("Chmod", norm, err)
+	}
+	fs.updateHandleStats(norm, func(stat *fuselib.Stat_t) {
+		stat.Mode = stat.Mode&^0o7777 | mode&0o7777
+	})
+	return 0
 }
 
+// Chown stores the owner and group of path on the server when permissions
+// are persisted and succeeds without effect otherwise. An id of -1 is left
+// unchanged.
 func (fs *FuseFS) Chown(path string, uid uint32, gid uint32) int {
 	fs.logger.Logf("[Chown] path=%s uid=%d gid=%d", path, uid, gid)
-	return -ENOSYS
+	if !fs.persistPerms {
+		return 0
+	}
+	norm, err := casters.NormalizePath(path)
+	if err != nil {
+		fs.logger.Errorf("[Chown] Path normalize error for path=%s error=%v returning EIO", path, err)
+		return -EIO
+	}
+
+	var newUID, newGID *uint32
+	if uid != ^uint32(0) {
+		newUID = &uid
+	}
+	if gid != ^uint32(0) {
+		newGID = &gid
+	}
+	if err := fs.client.SetOwner(norm, newUID, newGID); err != nil {
+		return fs.permsErrno("Chown", norm, err)
+	}
+	fs.updateHandleStats(norm, func(stat *fuselib.Stat_t) {
+		if newUID != nil {
+			stat.Uid = uid
+		}
+		if newGID != nil {
+			stat.Gid = gid
+		}
+	})
+	return 0
+}
+
+// permsErrno maps an error storing permissions to the errno returned by op.
+func (fs *FuseFS) permsErrno(op, path string, err error) int {
+	switch {
+	case helpers.IsNotExistErr(err):
+		return -ENOENT
+	case helpers.IsForbiddenErr(err):
+		// the server does not keep the properties
+		fs.logger.Errorf("[%s] server refused permissions of %s: %v returning EPERM", op, path, err)
+		return -EPERM
+	}
+	fs.logger.Errorf("[%s] storing permissions failed for path=%s: %v returning EIO", op, path, err)
+	return -EIO
+}
+
+// updateHandleStats applies change to the attributes open handles of path
+// report.
+func (fs *FuseFS) updateHandleStats(path string, change func(*fuselib.Stat_t)) {
+	fs.handles.Range(func(_, v any) bool {
+		fh := v.(*FileHandle)
+		if fh.Path() == path {
+			fh.MLock()
+			if fh.stat != nil {
+				change(fh.stat)
+			}
+			fh.MUnlock()
+		}
+		return true
+	})
 }
 
 func (fs *FuseFS) Destroy() {
 	fs.logger.Logf("[Destroy] called")
+	if fs.stopWatch != nil {
+		fs.stopWatch()
+	}
+	// let queued uploads finish before the journal is closed
+	fs.uploads.Close()
+	if fs.journal != nil {
+		if err := fs.journal.Close(); err != nil {
+			fs.logger.Errorf("[Destroy] journal close error: %v", err)
+		}
+	}
+	if err := fs.bufferCache.Close(); err != nil {
+		fs.logger.Errorf("[Destroy] buffer cache close error: %v", err)
+	}
+	if fs.content != nil {
+		fs.logger.Logf("[Destroy] content cache %s", fs.content.Stats())
+	}
 }
 
 func (fs *FuseFS) Fsyncdir(path string, datasync bool, fh uint64) int {
@@ -164,7 +398,22 @@ func (fs *FuseFS) Fsyncdir(path string, datasync bool, fh uint64) int {
 
 func (fs *FuseFS) Getxattr(path string, name string) (int, []byte) {
 	fs.logger.Logf("[Getxattr] path=%s name=%s", path, name)
-	return -ENOSYS, nil
+	if !strings.HasPrefix(name, wrappers.XattrPrefix) {
+		// only user attributes are stored; spares a request per lookup of
+		// security.* and the like
+		return -ENODATA, nil
+	}
+	norm, err := casters.NormalizePath(path)
+	if err != nil {
+		fs.logger.Errorf("[Getxattr] Path normalize error for path=%s error=%v returning EIO", path, err)
+		return -EIO, nil
+	}
+
+	value, err := fs.client.Xattr(norm, name)
+	if err != nil {
+		return fs.xattrErrno("Getxattr", norm, name, err), nil
+	}
+	return 0, value
 }
 
 func (fs *FuseFS) Init() {
@@ -178,7 +427,22 @@ func (fs *FuseFS) Link(oldpath string, newpath string) int {
 
 func (fs *FuseFS) Listxattr(path string, fill func(name string) bool) int {
 	fs.logger.Logf("[Listxattr] path=%s", path)
-	return -ENOSYS
+	norm, err := casters.NormalizePath(path)
+	if err != nil {
+		fs.logger.Errorf("[Listxattr] Path normalize error for path=%s error=%v returning EIO", path, err)
+		return -EIO
+	}
+
+	attrs, err := fs.client.Xattrs(norm)
+	if err != nil {
+		return fs.xattrErrno("Listxattr", norm, "", err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(attrs)) {
+		if !fill(name) {
+			return -ERANGE
+		}
+	}
+	return 0
 }
 
 func (fs *FuseFS) Mknod(path string, mode uint32, dev uint64) int {
@@ -188,20 +452,101 @@ func (fs *FuseFS) Mknod(path string, mode uint32, dev uint64) int {
 
 func (fs *FuseFS) Readlink(path string) (int, string) {
 	fs.logger.Logf("[Readlink] path=%s", path)
-	return -ENOSYS, ""
+	norm, err := casters.NormalizePath(path)
+	if err != nil {
+		fs.logger.Errorf("[Readlink] Path normalize error for path=%s error=%v returning EIO", path, err)
+		return -EIO, ""
+	}
+
+	target, err := fs.client.Readlink(norm)
+	switch {
+	case err == nil:
+		return 0, target
+	case errors.Is(err, wrappers.ErrNotSymlink):
+		return -EINVAL, ""
+	case helpers.IsNotExistErr(err):
+		return -ENOENT, ""
+	}
+	fs.logger.Errorf("[Readlink] readlink error for path=%s: %v returning EIO", norm, err)
+	return -EIO, ""
 }
 
 func (fs *FuseFS) Removexattr(path string, name string) int {
 	fs.logger.Logf("[Removexattr] path=%s name=%s", path, name)
-	return -ENOSYS
+	norm, err := casters.NormalizePath(path)
+	if err != nil {
+		fs.logger.Errorf("[Removexattr] Path normalize error for path=%s error=%v returning EIO", path, err)
+		return -EIO
+	}
+
+	if err := fs.client.RemoveXattr(norm, name); err != nil {
+		return fs.xattrErrno("Removexattr", norm, name, err)
+	}
+	return 0
 }
 
 func (fs *FuseFS) Setxattr(path string, name string, value []byte, flags int) int {
 	fs.logger.Logf("[Setxattr] path=%s name=%s flags=%d", path, name, flags)
-	return -ENOSYS
+	norm, err := casters.NormalizePath(path)
+	if err != nil {
+		fs.logger.Errorf("[Setxattr] Path normalize error for path=%s error=%v returning EIO", path, err)
+		return -EIO
+	}
+
+	if flags&(fuselib.XATTR_CREATE|fuselib.XATTR_REPLACE) != 0 && strings.HasPrefix(name, wrappers.XattrPrefix) {
+		_, err := fs.client.Xattr(norm, name)
+		exists := err == nil
+		switch {
+		case err != nil && !errors.Is(err, wrappers.ErrNoXattr):
+			return fs.xattrErrno("Setxattr", norm, name, err)
+		case exists && flags&fuselib.XATTR_CREATE != 0:
+			return -EEXIST
+		case !exists && flags&fuselib.XATTR_REPLACE != 0:
+			return -ENODATA
+		}
+	}
+	if err := fs.client.SetXattr(norm, name, value); err != nil {
+		return fs.xattrErrno("Setxattr", norm, name, err)
+	}
+	return 0
+}
+
+// xattrErrno maps an error of an extended attribute operation to the errno
+// returned to the kernel.
+func (fs *FuseFS) xattrErrno(op, path, name string, err error) int {
+	switch {
+	case errors.Is(err, wrappers.ErrNoXattr):
+		return -ENODATA
+	case errors.Is(err, wrappers.ErrXattrReadOnly):
+		return -EPERM
+	case errors.Is(err, wrappers.ErrXattrNotSupported):
+		return -ENOTSUP
+	case helpers.IsNotExistErr(err):
+		return -ENOENT
+	case helpers.IsForbiddenErr(err):
+		fs.logger.Errorf("[%s] server refused %s of %s: %v returning EACCES", op, name, path, err)
+		return -EACCES
+	}
+	fs.logger.Errorf("[%s] error for %s of %s: %v returning EIO", op, name, path, err)
+	return -EIO
 }
 
 func (fs *FuseFS) Symlink(target string, newpath string) int {
 	fs.logger.Logf("[Symlink] target=%s newpath=%s", target, newpath)
-	return -ENOSYS
+	norm, err := casters.NormalizePath(newpath)
+	if err != nil {
+		fs.logger.Errorf("[Symlink] Path normalize error for path=%s error=%v returning EIO", newpath, err)
+		return -EIO
+	}
+
+	if err := fs.client.Symlink(target, norm); err != nil {
+		if helpers.IsForbiddenErr(err) {
+			// the server does not keep the property marking links
+			fs.logger.Errorf("[Symlink] server refused the link %s: %v returning EPERM", norm, err)
+			return -EPERM
+		}
+		fs.logger.Errorf("[Symlink] symlink error for path=%s: %v returning EIO", norm, err)
+		return -EIO
+	}
+	return 0
 }
@@ -6,17 +6,23 @@ import (
 
 	"github.com/mimic/internal/core/cache"
 	"github.com/mimic/internal/core/flags"
+	"github.com/mimic/internal/core/helpers"
 	fuselib "github.com/winfsp/cgofuse/fuse"
 )
 
 type FileHandle struct {
-	path       string
+	path       atomic.Pointer[string] // follows renames, see SetPath
 	flags      flags.OpenFlag
 	stat       *fuselib.Stat_t
 	remoteSize int64
 
 	mu     sync.Mutex
 	buffer *cache.FileBuffer
+	// unlinked is set once the file was removed or replaced; what is
+	// written to it afterwards is not uploaded
+	unlinked bool
+
+	readahead *helpers.Readahead // nil when prefetching is disabled
 }
 
 func NewFilehandle(path string, oflags flags.OpenFlag, stat *fuselib.Stat_t) *FileHandle {
@@ -24,12 +30,13 @@ func NewFilehandle(path string, oflags flags.OpenFlag, stat *fuselib.Stat_t) *Fi
 	if stat != nil {
 		remoteSize = stat.Size
 	}
-	return &FileHandle{
-		path:       path,
+	fh := &FileHandle{
 		flags:      oflags,
 		stat:       stat,
 		remoteSize: remoteSize,
 	}
+	fh.path.Store(&path)
+	return fh
 }
 
 func (fh *FileHandle) MLock() {
@@ -40,20 +47,18 @@ func (fh *FileHandle) MUnlock() {
 	fh.mu.Unlock()
 }
 
-func (fh *FileHandle) AddToBuffer(offset int64, data []byte) {
+func (fh *FileHandle) AddToBuffer(offset int64, data []byte) error {
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
 	if len(data) == 0 {
-		return
+		return nil
 	}
 	if fh.buffer == nil {
 		// defensive: create per-handle buffer if not set (should be set by fs.NewHandle)
 		fh.buffer = &cache.FileBuffer{}
-		fh.buffer.Data = make([]byte, 0)
 		fh.buffer.IncHandle()
 	}
-	// Use absolute offsets (current code treats buffer Data[0] as file offset 0).
-	_ = fh.buffer.WriteAt(offset, data)
+	return fh.buffer.WriteAt(offset, data)
 }
 
 // AddRemoteToBuffer inserts data fetched from remote into the per-handle buffer
@@ -67,32 +72,56 @@ func (fh *FileHandle) AddRemoteToBuffer(offset int64, data []byte) {
 	}
 	if fh.buffer == nil {
 		fh.buffer = &cache.FileBuffer{}
-		fh.buffer.Data = make([]byte, 0)
 		fh.buffer.IncHandle()
 	}
 	_ = fh.buffer.WriteRemoteAt(offset, data)
 }
 
-// ClearBuffer clears the shared buffer (used after a successful Flush/Release).
-func (fh *FileHandle) ClearBuffer() {
+// PinBuffer keeps the buffer pages touched from now on present until the
+// returned function is called.
+func (fh *FileHandle) PinBuffer() func() {
+	fb := fh.buffer
+	if fb == nil {
+		return func() {}
+	}
+	fb.Pin()
+	return fb.Unpin
+}
+
+// BufferPresent reports whether the buffer holds [offset, offset+length).
+func (fh *FileHandle) BufferPresent(offset, length int64) bool {
+	return fh.buffer != nil && fh.buffer.Present(offset, length)
+}
+
+// ReadBuffer copies the buffered bytes at offset into dst and returns how
+// many contiguous bytes it found.
+func (fh *FileHandle) ReadBuffer(dst []byte, offset int64) (int, error) {
 	if fh.buffer == nil {
-		return
+		return 0, nil
 	}
-	fh.buffer.Clear()
-	fh.buffer.DecHandle()
-	fh.buffer = nil
+	return fh.buffer.ReadInto(dst, offset)
+}
+
+// ETag returns the version of the remote file the buffer matches, "" when
+// it is unknown.
+func (fh *FileHandle) ETag() string {
+	if fh.buffer == nil {
+		return ""
+	}
+	return fh.buffer.ETag()
 }
 
-// nil, 0 if no buffer
-func (fh *FileHandle) CopyBuffer() *cache.BufferSnapshot {
+// Truncated reports whether the buffer holds a truncation not yet uploaded.
+func (fh *FileHandle) Truncated() bool {
 	if fh.buffer == nil {
-		return &cache.BufferSnapshot{}
+		return false
 	}
-	return fh.buffer.CopyBuffer()
+	_, truncated := fh.buffer.Truncation()
+	return truncated
 }
 
 func (fh *FileHandle) IsDirty() bool {
-	return fh.buffer != nil && fh.buffer.Dirty
+	return fh.buffer != nil && fh.buffer.IsDirty()
 }
 
 func (fh *FileHandle) Flags() flags.OpenFlag {
@@ -100,16 +129,35 @@ func (fh *FileHandle) Flags() flags.OpenFlag {
 }
 
 func (fh *FileHandle) Path() string {
-	return fh.path
+	return *fh.path.Load()
+}
+
+// SetPath moves the handle to the new path of its renamed file.
+func (fh *FileHandle) SetPath(p string) {
+	fh.path.Store(&p)
+}
+
+// Unlink detaches the handle from its removed or replaced file.
+func (fh *FileHandle) Unlink() {
+	fh.mu.Lock()
+	fh.unlinked = true
+	fh.mu.Unlock()
 }
 
 func (fs *FuseFS) NewHandle(path string, stat *fuselib.Stat_t, oflags uint32) uint64 {
 	file_handle := atomic.AddUint64(&fs.nextHandle, 1)
 	fh := NewFilehandle(path, flags.OpenFlag(oflags), stat)
 
-	fb := fs.bufferCache.GetOrCreate(path)
-	fb.IncHandle()
-	fh.buffer = fb
+	fh.buffer = fs.bufferCache.Acquire(path)
+	if fs.readahead > 0 {
+		fh.readahead = helpers.NewReadahead(fs.readahead)
+	}
+	if size, truncated := fh.buffer.Truncation(); truncated {
+		if fh.stat != nil {
+			fh.stat.Size = size
+		}
+		fh.remoteSize = min(fh.remoteSize, size)
+	}
 
 	fs.handles.Store(file_handle, fh)
 	return file_handle
@@ -129,9 +177,28 @@ func (fs *FuseFS) ReleaseHandle(handle uint64) {
 	if !ok {
 		return
 	}
-	if fh.buffer != nil {
-		fh.buffer.DecHandle()
-		fh.buffer = nil
-	}
+	fh.mu.Lock()
+	fb, unlinked := fh.buffer, fh.unlinked
+	fh.buffer = nil
+	fh.mu.Unlock()
 	fs.handles.Delete(handle)
+	if fb == nil {
+		return
+	}
+	if unlinked {
+		// the buffer of a removed file left the cache, see discardBuffered
+		fb.DecHandle()
+		if fb.Idle() {
+			fb.Clear()
+		}
+		return
+	}
+	fs.releaseBuffer(fh.Path(), fb)
+}
+
+// releaseBuffer drops a reference on fb, the buffer of p, and drops the
+// buffer once it is idle.
+func (fs *FuseFS) releaseBuffer(p string, fb *cache.FileBuffer) {
+	fb.DecHandle()
+	fs.bufferCache.DropIdle(p, fs.uploads.Pending)
 }
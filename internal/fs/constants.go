@@ -10,5 +10,16 @@ const (
 	EACCES  = 13
 	ENOTDIR = 20
 	EEXIST  = 17
+	EINVAL  = 22
+	ENOSPC  = 28
 	ENOSYS  = 38
+	ERANGE  = 34
+	ENODATA = 61 // ENOATTR: no such extended attribute
+	ENOTSUP = 95
+)
+
+// Timespec.Nsec values of utimensat(2)
+const (
+	UTIME_NOW  = (1 << 30) - 1
+	UTIME_OMIT = (1 << 30) - 2
 )
@@ -22,13 +22,13 @@ func (fs *FuseFS) Opendir(path string) (int, uint64) {
 		return -EIO, 0
 	}
 
-	handle := fs.NewHandle(path, casters.FileInfoCast(f), 0)
+	handle := fs.NewHandle(path, casters.FileInfoCast(f, fs.owner), 0)
 	return 0, handle
 }
 
 func (fs *FuseFS) Releasedir(path string, fh uint64) int {
 	fs.logger.Logf("[Releasedir] path=%s fh=%d", path, fh)
-	fs.handles.Delete(fh)
+	fs.ReleaseHandle(fh)
 	return 0
 }
 
@@ -50,7 +50,7 @@ func (fs *FuseFS) Readdir(filepath string, fill func(string, *fuse.Stat_t, int64
 			continue
 		}
 
-		stat := casters.FileInfoCast(file)
+		stat := casters.FileInfoCast(file, fs.owner)
 
 		fs.logger.Logf("[ReaddirEntry] idx=%d name=%s dir=%v size=%d", i, name, file.IsDir(), file.Size())
 
@@ -70,9 +70,19 @@ func (fs *FuseFS) Mkdir(p string, mode uint32) int {
 
 	err = fs.client.Mkdir(s, os.FileMode(mode))
 	if err != nil {
+		if helpers.IsInsufficientStorageErr(err) {
+			fs.quotaChanged()
+			fs.logger.Errorf("[Mkdir] server out of space for path=%s returning ENOSPC", s)
+			return -ENOSPC
+		}
 		fs.logger.Errorf("[Mkdir] mkdir error for path=%s error=%v returning EIO", s, err)
 		return -EIO
 	}
+	if perm := mode & 0o7777; fs.persistPerms && perm != fs.owner.DirPerm() {
+		if err := fs.client.SetMode(s, perm); err != nil {
+			fs.logger.Errorf("[Mkdir] storing mode=%#o failed for path=%s: %v", perm, s, err)
+		}
+	}
 
 	return 0
 }
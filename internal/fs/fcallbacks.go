@@ -1,12 +1,21 @@
 package fs
 
 import (
+	"fmt"
+	"io"
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/mimic/internal/core/cache"
 	"github.com/mimic/internal/core/casters"
+	"github.com/mimic/internal/core/checks"
+	"github.com/mimic/internal/core/config"
 	"github.com/mimic/internal/core/helpers"
+	"github.com/mimic/internal/core/upload"
 )
 
 func (fs *FuseFS) Truncate(p string, size int64, fh uint64) int {
@@ -16,8 +25,8 @@ func (fs *FuseFS) Truncate(p string, size int64, fh uint64) int {
 		p = strings.TrimSuffix(p, "/")
 	}
 
-	file, ok := fs.GetHandle(fh)
-	if ok && file != nil && !file.Flags().WriteAllowed() {
+	file, _ := fs.GetHandle(fh)
+	if file != nil && !file.Flags().WriteAllowed() {
 		fs.logger.Errorf("[Truncate] access denied for %s, flag state: %+v return EACCES", p, file.Flags())
 		return -EACCES
 	}
@@ -28,15 +37,58 @@ func (fs *FuseFS) Truncate(p string, size int64, fh uint64) int {
 		return -EIO
 	}
 
+	// an open file is truncated in its buffer, the upload resizes the remote
+	// file before writing the data
+	if fb, ok := fs.bufferCache.Get(norm); ok {
+		if err := fb.Truncate(size); err != nil {
+			fs.logger.Errorf("[Truncate] buffer truncate failed for path=%s size=%d: %v return EINVAL", p, size, err)
+			return -EINVAL
+		}
+		if fs.journal != nil {
+			if err := fs.journal.Truncate(norm, size); err != nil {
+				fs.logger.Errorf("[Truncate] journal append failed for %s size=%d: %v", norm, size, err)
+			}
+		}
+		fs.resizeHandles(norm, size)
+
+		// without a handle nobody is going to flush the buffer
+		if file == nil {
+			if _, err := fs.queueBuffer(norm, fb, false); err != nil {
+				fs.logger.Errorf("[Truncate] queue upload failed for %s: %v return EIO", norm, err)
+				return -EIO
+			}
+		}
+		return 0
+	}
+
 	err = fs.client.Truncate(norm, size)
 	if err != nil {
-		fs.logger.Errorf("[Truncate] truncate error for path=%s size=%d: %v return EIO", p, size, err)
-		return -EIO
+		errc := uploadErrno(err)
+		fs.logger.Errorf("[Truncate] truncate error for path=%s size=%d: %v return %d", p, size, err, errc)
+		return errc
 	}
 
 	return 0
 }
 
+// resizeHandles updates the size seen through every handle open on p after
+// a truncate. Remote data past the new size must not be read anymore.
+func (fs *FuseFS) resizeHandles(p string, size int64) {
+	fs.handles.Range(func(_, v any) bool {
+		fh := v.(*FileHandle)
+		if fh.Path() != p {
+			return true
+		}
+		fh.MLock()
+		if fh.stat != nil {
+			fh.stat.Size = size
+		}
+		fh.remoteSize = min(fh.remoteSize, size)
+		fh.MUnlock()
+		return true
+	})
+}
+
 func (fs *FuseFS) Unlink(p string) int {
 	// Add handle deletion after successful removal
 	fs.logger.Logf("[Unlink]: path=%s", p)
@@ -48,14 +100,75 @@ func (fs *FuseFS) Unlink(p string) int {
 		fs.logger.Errorf("[Unlink] Path normalize error for path=%s error=%v return EIO", p, err)
 		return -EIO
 	}
+	// a running upload must not recreate the file
+	dropped := fs.uploads.Cancel(norm)
 	if err := fs.client.Remove(norm); err != nil {
 		fs.logger.Errorf("[Unlink] remove error for path=%s: %v return EIO", p, err)
+		if fb, ok := fs.bufferCache.Get(norm); ok && dropped {
+			// the dropped upload goes out with the next flush
+			fb.MarkDirty()
+		}
 		return -EIO
 	}
+	if fs.content != nil {
+		fs.content.Remove(norm)
+	}
+	fs.pageETags.Delete(norm)
+	fs.discardBuffered(norm)
 
 	return 0
 }
 
+// commitBelow uploads the data buffered for p and the files below it and
+// waits for the uploads, so that renaming p moves the data on the server.
+func (fs *FuseFS) commitBelow(p string) error {
+	for _, bp := range fs.bufferCache.Under(p) {
+		if fb, ok := fs.bufferCache.Get(bp); ok && fb.IsDirty() {
+			if _, err := fs.queueBuffer(bp, fb, true); err != nil {
+				return err
+			}
+		}
+		if err := fs.uploads.Wait(bp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discardBuffered forgets the data of the removed or replaced file p that
+// was not uploaded: its journal, which would resurrect it on the next
+// replay, its buffer and whatever its open handles write from now on.
+// Uploads to p must have been cancelled.
+func (fs *FuseFS) discardBuffered(p string) {
+	if fs.journal != nil {
+		gen, err := fs.journal.Seal(p)
+		if err == nil {
+			err = fs.journal.Discard(p, gen)
+		}
+		if err != nil {
+			fs.logger.Errorf("[Journal] discard failed for path=%s: %v", p, err)
+		}
+	}
+	if fb, ok := fs.bufferCache.Get(p); ok {
+		fs.bufferCache.Delete(p)
+		fb.MarkClean()
+		if fb.Idle() {
+			fb.Clear()
+		}
+	}
+	fs.handles.Range(func(_, v any) bool {
+		if fh := v.(*FileHandle); fh.Path() == p {
+			fh.Unlink()
+		}
+		return true
+	})
+}
+
+// below reports whether p is dir or a path below it.
+func below(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
+
 func (fs *FuseFS) Write(path string, buffer []byte, offset int64, file_handle uint64) int {
 	file, ok := fs.GetHandle(file_handle)
 	if !ok {
@@ -68,8 +181,13 @@ func (fs *FuseFS) Write(path string, buffer []byte, offset int64, file_handle ui
 		return -EACCES
 	}
 
+	// unpin before reclaiming so the pages of this write count as well
+	defer fs.bufferCache.Reclaim(fs.uploads.Pending)
+	defer file.PinBuffer()()
+
 	reqPageOffset, reqPageLen := helpers.PageAlignedRange(offset, int64(len(buffer)), file.remoteSize)
-	if reqPageOffset != offset || reqPageLen != int64(len(buffer)) && !file.buffer.DirtyRange(reqPageOffset, reqPageLen) {
+	// nothing is read past the remote end, e.g. of a file just created
+	if reqPageLen > 0 && (reqPageOffset != offset || reqPageLen != int64(len(buffer)) && !file.BufferPresent(reqPageOffset, reqPageLen)) {
 		fs.logger.Logf("[Write] adjusted write range for %s from offset=%d len=%d to offset=%d len=%d", path, offset, len(buffer), reqPageOffset, reqPageLen)
 		remoteBuf, err := fs.client.ReadRange(path, reqPageOffset, reqPageLen)
 		if err != nil && !helpers.IsNotExistErr(err) {
@@ -85,14 +203,21 @@ func (fs *FuseFS) Write(path string, buffer []byte, offset int64, file_handle ui
 		}
 	}
 
-	file.AddToBuffer(offset, buffer)
+	if err := file.AddToBuffer(offset, buffer); err != nil {
+		fs.logger.Errorf("[Write] buffer write failed for %s offset=%d len=%d: %v returning EIO", path, offset, len(buffer), err)
+		return -EIO
+	}
+	if fs.journal != nil {
+		if err := fs.journal.Append(file.Path(), offset, buffer); err != nil {
+			fs.logger.Errorf("[Write] journal append failed for %s offset=%d len=%d: %v", file.Path(), offset, len(buffer), err)
+		}
+	}
 	end := offset + int64(len(buffer))
 	if end > file.stat.Size {
 		file.stat.Size = end
 	}
 
-	buf := file.CopyBuffer()
-	fs.logger.Logf("[Write] buffer len=%d offset=%d, after write: path=%s base=%d len=%d dirty=%v", len(buffer), offset, path, buf.Base, len(buf.Data), file.IsDirty())
+	fs.logger.Logf("[Write] buffer len=%d offset=%d, after write: path=%s buffer=%v", len(buffer), offset, path, file.buffer)
 
 	return len(buffer)
 }
@@ -107,15 +232,31 @@ func (fs *FuseFS) Create(p string, flags int, mode uint32) (int, uint64) {
 			fs.logger.Errorf("[Create]: permission denied for path=%s returning EACCES", p)
 			return -EACCES, 0
 		}
+		if helpers.IsInsufficientStorageErr(err) {
+			fs.quotaChanged()
+			fs.logger.Errorf("[Create]: server out of space for path=%s returning ENOSPC", p)
+			return -ENOSPC, 0
+		}
 		fs.logger.Errorf("[Create]: remote write failed path=%s err=%v returning EIO", p, err)
 		return -EIO, 0
 	}
 
 	// synthesize Stat_t immediately so Create is one RPC (PUT)
 	isHidden := strings.HasPrefix(path.Base(p), ".")
-	stat := casters.EmptyFileStat(isHidden)
+	stat := casters.EmptyFileStat(isHidden, fs.owner)
+	if perm := mode & 0o7777; fs.persistPerms && perm != fs.owner.FilePerm() {
+		if err := fs.client.SetMode(p, perm); err != nil {
+			fs.logger.Errorf("[Create]: storing mode=%#o failed for path=%s: %v", perm, p, err)
+		} else {
+			stat.Mode = stat.Mode&^0o7777 | perm
+		}
+	}
 
 	h := fs.NewHandle(p, stat, uint32(flags))
+	if fh, ok := fs.GetHandle(h); ok {
+		// the create replaced whatever version the buffer was based on
+		fh.buffer.SetETag("")
+	}
 
 	go func(h uint64, p string) {
 		fi, err := fs.client.Stat(p)
@@ -127,7 +268,7 @@ func (fs *FuseFS) Create(p string, flags int, mode uint32) (int, uint64) {
 			return
 		}
 		fh.MLock()
-		fh.stat = casters.FileInfoCast(fi)
+		fh.stat = casters.FileInfoCast(fi, fs.owner)
 		fh.remoteSize = fi.Size()
 		fh.MUnlock()
 	}(h, p)
@@ -136,13 +277,25 @@ func (fs *FuseFS) Create(p string, flags int, mode uint32) (int, uint64) {
 	return 0, h
 }
 
-// Release should flush buffered segments (if any) to remote before closing.
+// Release hands a still dirty buffer to the upload queue before closing.
 func (fs *FuseFS) Release(path string, file_handle uint64) (errc int) {
 	fs.logger.Logf("[Release] path=%s handle=%d", path, file_handle)
 	defer fs.ReleaseHandle(file_handle)
+
+	fh, ok := fs.GetHandle(file_handle)
+	if !ok || !fh.Flags().WriteAllowed() || !fh.IsDirty() {
+		return 0
+	}
+	if err := fs.queueUpload(fh); err != nil {
+		fs.logger.Errorf("[Release] queue upload failed for %s: %v returning EIO", fh.Path(), err)
+		return -EIO
+	}
 	return 0
 }
 
+// Flush queues the handle's dirty buffer for a background upload and
+// returns without waiting for it. Failures of earlier uploads of the same
+// path are reported here.
 func (fs *FuseFS) Flush(path string, file_handle uint64) (errc int) {
 	fh, ok := fs.GetHandle(file_handle)
 	if !ok {
@@ -150,51 +303,322 @@ func (fs *FuseFS) Flush(path string, file_handle uint64) (errc int) {
 		return 0
 	}
 
-	if !fh.IsDirty() {
+	if !fh.Flags().WriteAllowed() {
 		return 0
 	}
 
-	if !fh.Flags().WriteAllowed() {
-		return 0
+	if fh.IsDirty() {
+		if err := fs.queueUpload(fh); err != nil {
+			fs.logger.Errorf("[Flush] queue upload failed for %s: %v returning EIO", fh.Path(), err)
+			return -EIO
+		}
 	}
 
+	if err := fs.uploads.Err(fh.Path()); err != nil {
+		errc := uploadErrno(err)
+		fs.logger.Errorf("[Flush] earlier upload failed for %s: %v; returning %d", fh.Path(), err, errc)
+		return errc
+	}
+
+	return 0
+}
+
+// uploadErrno maps a failed commit to the errno reported to the caller.
+func uploadErrno(err error) int {
+	switch {
+	case helpers.IsInsufficientStorageErr(err):
+		return -ENOSPC
+	case helpers.IsForbiddenErr(err):
+		return -EACCES
+	default:
+		return -EIO
+	}
+}
+
+// queueUpload snapshots the handle's buffer, marks it clean and hands the
+// snapshot to the upload manager. Handles of removed files upload nothing.
+func (fs *FuseFS) queueUpload(fh *FileHandle) error {
 	fh.MLock()
 	defer fh.MUnlock()
-	buf := fh.CopyBuffer()
-	fs.logger.Logf("[Flush] about to write path=%s buffer_len=%d buffer_off=%d", fh.Path(), len(buf.Data), buf.Base)
-	if err := fs.client.WriteOffset(fh.Path(), buf.Data, buf.Base); err != nil {
-		if helpers.IsForbiddenErr(err) {
-			fs.logger.Logf("[Flush] WriteOffset forbidden for %s: %v; returning EACCES", fh.Path(), err)
-			return -EACCES
+
+	if fh.buffer == nil || fh.unlinked {
+		return nil
+	}
+
+	snap, err := fs.queueBuffer(fh.Path(), fh.buffer, fh.Flags().Create())
+	if err != nil {
+		return err
+	}
+	fh.remoteSize = max(fh.remoteSize, snap.End())
+	return nil
+}
+
+// queueBuffer seals the journal of p, snapshots fb and enqueues the
+// snapshot. On failure the buffer stays dirty.
+func (fs *FuseFS) queueBuffer(p string, fb *cache.FileBuffer, create bool) (*cache.Snapshot, error) {
+	var gen uint64
+	if fs.journal != nil {
+		g, err := fs.journal.Seal(p)
+		if err != nil {
+			fs.logger.Errorf("[Flush] journal seal failed for %s: %v", p, err)
 		}
-		if helpers.IsNotExistErr(err) && fh.Flags().Create() {
-			end := buf.Base + int64(len(buf.Data))
-			if end > int64(^uint(0)>>1) {
-				fs.logger.Logf("[Flush] too large allocate for %s; returning EIO", fh.Path())
-				return -EIO
-			}
-			full := make([]byte, int(end))
-			copy(full[int(buf.Base):], buf.Data)
-			if werr := fs.client.Write(fh.Path(), full); werr != nil {
-				fs.logger.Logf("[Flush] Write error for %s: %v; returning EIO", fh.Path(), werr)
-				return -EIO
-			}
-		} else {
-			fs.logger.Logf("[Flush] WriteOffset error for %s: %v; returning EIO", fh.Path(), err)
-			return -EIO
+		gen = g
+	}
+
+	snap, err := fb.TakeSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	fs.logger.Logf("[Flush] queueing upload path=%s extents=%d len=%d truncated=%v", p, len(snap.Extents), snap.Len(), snap.Truncated)
+	job := &upload.Job{
+		Path:      p,
+		Source:    snap,
+		Extents:   make([]upload.Extent, 0, len(snap.Extents)),
+		Create:    create,
+		Truncated: snap.Truncated,
+		TruncSize: snap.TruncSize,
+		ModTime:   snap.ModTime,
+		Gen:       gen,
+		Seq:       snap.Seq,
+		Release:   snap.Release,
+	}
+	for _, e := range snap.Extents {
+		job.Extents = append(job.Extents, upload.Extent{Offset: e.Offset, Length: e.Length})
+	}
+	if err := fs.uploads.Enqueue(job); err != nil {
+		snap.Release()
+		fb.MarkDirty()
+		return nil, err
+	}
+	return snap, nil
+}
+
+// commitJob runs one upload, conditional on the version of the file the
+// buffer is based on. A conflicting change on the server is resolved with
+// the conflict policy.
+func (fs *FuseFS) commitJob(job *upload.Job) error {
+	fb, ok := fs.bufferCache.Get(job.Path)
+	var etag string
+	if ok {
+		etag = fb.ETag()
+	}
+
+	etag, err := fs.client.Guarded(job.Path, etag, func() error {
+		if job.ModTime.IsZero() {
+			return fs.writeJob(job.Path, job)
 		}
+		return fs.client.ModTimed(job.Path, job.ModTime, func() error {
+			return fs.writeJob(job.Path, job)
+		})
+	})
+	switch {
+	case helpers.IsPreconditionFailedErr(err):
+		etag, err = fs.resolveConflict(job, err)
+	case err != nil && ok:
+		// requests of the job that went through moved the version on,
+		// which the retry has to expect
+		fb.SetETag(etag)
+	}
+	if err == nil && ok {
+		fb.SetETag(etag)
 	}
-	fh.ClearBuffer()
-	fh.remoteSize = buf.Base + int64(len(buf.Data))
+	return err
+}
 
-	return 0
+// writeJob writes the job to the remote file p: a pending truncation first,
+// then the extents.
+func (fs *FuseFS) writeJob(p string, job *upload.Job) error {
+	ranges := job.Ranges()
+	r := job.Reader()
+	if job.Truncated {
+		// a rewrite from the start replaces the file in one PUT
+		if rewritesFile(job) {
+			return fs.client.WriteFrom(p, io.NewSectionReader(r, 0, job.Len()), job.Len())
+		}
+		if err := fs.client.Truncate(p, job.TruncSize); err != nil {
+			return err
+		}
+	}
+	for _, e := range ranges {
+		if err := fs.upload(p, io.NewSectionReader(r, e.Offset, e.Length), e.Length, e.Offset, job.Create); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewritesFile reports whether the job replaces the whole file.
+func rewritesFile(job *upload.Job) bool {
+	ranges := job.Ranges()
+	switch {
+	case !job.Truncated:
+		return false
+	case len(ranges) == 0:
+		return job.TruncSize == 0
+	default:
+		return len(ranges) == 1 && ranges[0].Offset == 0 && ranges[0].Length >= job.TruncSize
+	}
+}
+
+// resolveConflict applies the conflict policy to a job whose upload found
+// the file changed on the server. Returns the version of the file the buffer
+// is based on afterwards.
+func (fs *FuseFS) resolveConflict(job *upload.Job, cause error) (string, error) {
+	switch fs.conflict {
+	case config.ConflictOverwrite:
+		fs.logger.Logf("[Upload] conflict path=%s: overwriting the version on the server", job.Path)
+		return fs.client.Guarded(job.Path, "", func() error {
+			return fs.writeJob(job.Path, job)
+		})
+	case config.ConflictCopy:
+		return fs.saveConflictCopy(job)
+	default:
+		return "", cause
+	}
+}
+
+// saveConflictCopy writes the job next to the file changed on the server
+// and rebases the buffer onto the server's version. Unless the job rewrites
+// the whole file, the copy starts out as the server's version with the
+// locally changed pages on top, since the rest of the local version may not
+// be buffered anymore. A retried job writes the copy it made before again.
+func (fs *FuseFS) saveConflictCopy(job *upload.Job) (string, error) {
+	if job.ConflictCopy == "" {
+		host, err := os.Hostname()
+		if err != nil || host == "" {
+			host = "mimic"
+		}
+		job.ConflictCopy = helpers.ConflictName(job.Path, host, time.Now())
+	}
+	name := job.ConflictCopy
+
+	if !rewritesFile(job) {
+		if err := fs.client.Copy(job.Path, name); err != nil {
+			return "", err
+		}
+	}
+	if err := fs.writeJob(name, job); err != nil {
+		return "", err
+	}
+	fmt.Fprintf(os.Stderr, "Conflict: %s was changed on the server, local changes saved as %s\n", job.Path, name)
+	fs.logger.Errorf("[Upload] conflict path=%s: local changes saved as %s", job.Path, name)
+
+	fi, err := fs.client.Stat(job.Path)
+	if err != nil || checks.IsNilInterface(fi) {
+		return "", err
+	}
+	// pages of the local version must not be read as the server's
+	if fb, ok := fs.bufferCache.Get(job.Path); ok {
+		fb.MarkCommitted(job.Seq)
+		if job.Truncated {
+			fb.CommitTruncate(job.Seq)
+		}
+		fb.DiscardClean()
+	}
+	fs.handles.Range(func(_, v any) bool {
+		fh := v.(*FileHandle)
+		if fh.Path() == job.Path {
+			fh.MLock()
+			fh.stat = casters.FileInfoCast(fi, fs.owner)
+			fh.remoteSize = fi.Size()
+			fh.MUnlock()
+		}
+		return true
+	})
+	return casters.ETag(fi), nil
 }
 
+// upload commits size bytes from r located at base to the remote file p.
+// When the remote file is gone and create is set, the file is recreated with
+// the data at its position and zeros before it.
+func (fs *FuseFS) upload(p string, r io.ReaderAt, size, base int64, create bool) error {
+	err := fs.client.WriteOffsetFrom(p, r, size, base)
+	if err == nil || !create || !helpers.IsNotExistErr(err) {
+		return err
+	}
+	return fs.client.WriteFrom(p, paddedReader{r: r, off: base}, base+size)
+}
+
+// paddedReader reads as off zero bytes followed by the contents of r.
+type paddedReader struct {
+	r   io.ReaderAt
+	off int64
+}
+
+func (pr paddedReader) ReadAt(b []byte, at int64) (int, error) {
+	n := 0
+	if at < pr.off {
+		k := min(int64(len(b)), pr.off-at)
+		clear(b[:k])
+		n, at, b = int(k), at+k, b[k:]
+	}
+	if len(b) == 0 {
+		return n, nil
+	}
+	m, err := pr.r.ReadAt(b, at-pr.off)
+	return n + m, err
+}
+
+// Fsync commits the handle's dirty buffer and waits until the server has it.
+// Without datasync the handle's metadata (size, mtime) is refreshed from the
+// server as well, so fstat after fsync reflects the committed file.
 func (fs *FuseFS) Fsync(path string, datasync bool, file_handle uint64) (errc int) {
 	fs.logger.Logf("[Fsync]: path=%s fh=%d datasync=%v", path, file_handle, datasync)
+
+	fh, ok := fs.GetHandle(file_handle)
+	if !ok {
+		norm, err := casters.NormalizePath(path)
+		if err != nil {
+			fs.logger.Errorf("[Fsync] Path normalize error for path=%s error=%v returning EIO", path, err)
+			return -EIO
+		}
+		if err := fs.uploads.Wait(norm); err != nil {
+			errc := uploadErrno(err)
+			fs.logger.Errorf("[Fsync] upload failed for %s: %v returning %d", norm, err, errc)
+			return errc
+		}
+		return 0
+	}
+
+	if fh.Flags().WriteAllowed() && fh.IsDirty() {
+		if err := fs.queueUpload(fh); err != nil {
+			fs.logger.Errorf("[Fsync] queue upload failed for %s: %v returning EIO", fh.Path(), err)
+			return -EIO
+		}
+	}
+
+	if err := fs.uploads.Wait(fh.Path()); err != nil {
+		errc := uploadErrno(err)
+		fs.logger.Errorf("[Fsync] upload failed for %s: %v returning %d", fh.Path(), err, errc)
+		return errc
+	}
+
+	if !datasync {
+		fs.refreshHandleStat(fh)
+	}
+
 	return 0
 }
 
+// refreshHandleStat replaces the handle's cached attributes with the
+// server's view of the file while keeping a locally larger size.
+func (fs *FuseFS) refreshHandleStat(fh *FileHandle) {
+	fi, err := fs.client.Stat(fh.Path())
+	if err != nil || checks.IsNilInterface(fi) {
+		fs.logger.Errorf("[Fsync] metadata refresh failed for %s: %v", fh.Path(), err)
+		return
+	}
+
+	stat := casters.FileInfoCast(fi, fs.owner)
+	fh.MLock()
+	if fh.stat != nil && fh.stat.Size > stat.Size {
+		stat.Size = fh.stat.Size
+	}
+	fh.stat = stat
+	fh.remoteSize = max(fh.remoteSize, fi.Size())
+	fh.MUnlock()
+}
+
 func (fs *FuseFS) Access(path string, mode uint32) int {
 	fs.logger.Logf("[Access]: path=%s mode=%#o", path, mode)
 	norm, err := casters.NormalizePath(path)
@@ -245,9 +669,16 @@ func (fs *FuseFS) Read(path string, buffer []byte, offset int64, file_handle uin
 		return 0
 	}
 
-	buf := fh.CopyBuffer()
+	// fetched pages stay until they were read; unpin before reclaiming
+	defer fs.bufferCache.Reclaim(fs.uploads.Pending)
+	defer fh.PinBuffer()()
+
+	var window int64
+	if fh.readahead != nil {
+		window = fh.readahead.Observe(reqStart, reqLen)
+	}
 
-	if buf.Mask.IsDirtyRange(reqStart, reqLen) {
+	if fh.BufferPresent(reqStart, reqLen) {
 		fs.logger.Logf("[Read] dirty buffer full hit for %s offset=%d len=%d", path, reqStart, reqLen)
 		goto merge
 	}
@@ -260,7 +691,7 @@ func (fs *FuseFS) Read(path string, buffer []byte, offset int64, file_handle uin
 
 		reqPageStart, reqPageLen := helpers.PageAlignedRange(reqStart, actualLen, fh.remoteSize)
 
-		remoteBuf, err := fs.client.ReadRange(fh.Path(), reqPageStart, reqPageLen)
+		remoteBuf, err := fs.fetchRange(fh.Path(), fh.ETag(), reqPageStart, reqPageLen)
 		if err == nil {
 			if len(remoteBuf) > 0 {
 				fs.logger.Logf("[Read] fetched remote data to fill buffer gap for %s offset=%d len=%d", path, reqPageStart, reqPageLen)
@@ -281,9 +712,106 @@ func (fs *FuseFS) Read(path string, buffer []byte, offset int64, file_handle uin
 	}
 
 merge:
-	dirtyBufRangeStart := max(reqStart-buf.Base, 0)
-	dirtyBufRangeEnd := min(dirtyBufRangeStart+reqLen, int64(len(buf.Data)))
-	n := copy(buffer, buf.Data[dirtyBufRangeStart:dirtyBufRangeEnd])
+	n, err := fh.ReadBuffer(buffer, reqStart)
+	if err != nil {
+		fs.logger.Errorf("[Read] buffer read error for %s offset=%d len=%d: %v return EIO", path, reqStart, reqLen, err)
+		return -EIO
+	}
+
+	// past the data of a file extended by truncate reads return zeros
+	fh.MLock()
+	size := int64(0)
+	if fh.stat != nil {
+		size = fh.stat.Size
+	}
+	fh.MUnlock()
+	if end := min(reqStart+reqLen, size); reqStart+int64(n) < end {
+		clear(buffer[n : end-reqStart])
+		n = int(end - reqStart)
+	}
+
+	if window > 0 {
+		fs.prefetch(fh, reqStart+reqLen, window)
+	}
 
 	return n
 }
+
+// fetchRange returns the remote data of p at [offset, offset+length), from
+// the content cache when it holds version etag.
+func (fs *FuseFS) fetchRange(p, etag string, offset, length int64) ([]byte, error) {
+	if fs.content != nil && etag != "" {
+		data := make([]byte, length)
+		if fs.content.ReadAt(p, etag, data, offset) {
+			fs.logger.Logf("[Read] content cache hit for %s offset=%d len=%d", p, offset, length)
+			return data, nil
+		}
+	}
+
+	data, etag, err := fs.client.ReadRangeVersion(p, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	if fs.content != nil && len(data) > 0 {
+		if err := fs.content.WriteAt(p, etag, data, offset); err != nil {
+			fs.logger.Errorf("[Read] content cache write failed for %s offset=%d len=%d: %v", p, offset, len(data), err)
+		}
+	}
+	return data, nil
+}
+
+// prefetch fetches the window after offset in the background, split into
+// parts fetched in parallel, so a sequential reader finds it buffered. The
+// fetch holds a reference of its own on the buffer, as the handle may be
+// released before it is done.
+func (fs *FuseFS) prefetch(fh *FileHandle, offset, window int64) {
+	fh.MLock()
+	fb, remoteSize := fh.buffer, fh.remoteSize
+	if fb != nil {
+		fb.IncHandle()
+	}
+	fh.MUnlock()
+	if fb == nil {
+		return
+	}
+	start, end, ok := fh.readahead.Claim(offset, window, remoteSize)
+	if !ok {
+		fs.releaseBuffer(fh.Path(), fb)
+		return
+	}
+	p, etag := fh.Path(), fb.ETag()
+
+	go func() {
+		// the handle follows renames
+		defer func() { fs.releaseBuffer(fh.Path(), fb) }()
+		var (
+			wg     sync.WaitGroup
+			failed atomic.Bool
+		)
+		for _, part := range helpers.PrefetchParts(start, end, prefetchParallel) {
+			off, length := part[0], part[1]-part[0]
+			if fb.Present(off, length) {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				data, err := fs.fetchRange(p, etag, off, length)
+				if err != nil {
+					failed.Store(true)
+					fs.logger.Errorf("[Prefetch] fetch failed for %s offset=%d len=%d: %v", p, off, length, err)
+					return
+				}
+				// data of an older version must not fill in around new writes
+				if _, truncated := fb.Truncation(); truncated || fb.ETag() != etag {
+					return
+				}
+				_ = fb.WriteRemoteAt(off, data)
+			}()
+		}
+		wg.Wait()
+		fh.readahead.Done(start, !failed.Load())
+		fs.logger.Logf("[Prefetch] path=%s offset=%d len=%d window=%d", p, start, end-start, window)
+		fs.bufferCache.Reclaim(fs.uploads.Pending)
+	}()
+}
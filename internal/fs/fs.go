@@ -1,11 +1,21 @@
 package fs
 
 import (
+	"bytes"
 	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/mimic/internal/core/cache"
+	"github.com/mimic/internal/core/casters"
+	"github.com/mimic/internal/core/config"
+	"github.com/mimic/internal/core/contentcache"
+	"github.com/mimic/internal/core/helpers"
+	"github.com/mimic/internal/core/journal"
 	"github.com/mimic/internal/core/logger"
+	"github.com/mimic/internal/core/upload"
 	"github.com/mimic/internal/interfaces"
 	"github.com/winfsp/cgofuse/fuse"
 )
@@ -24,17 +34,228 @@ type FuseFS struct {
 	host        *fuse.FileSystemHost
 	mpoint      string
 	bufferCache *cache.BufferCache
+	journal     *journal.Journal // nil when journaling is disabled
+	uploads     *upload.Manager
+	conflict    string              // config.Conflict* policy
+	content     *contentcache.Cache // nil when disabled
+	readahead   int64               // largest prefetch window, 0: no prefetching
+
+	watchInterval time.Duration // 0: remote changes are not watched
+	stopWatch     func()
+
+	kernelCache string   // config.KernelCache* policy
+	pageETags   sync.Map // path -> ETag the kernel page cache was filled from
+
+	owner        casters.Owner // for files without stored ownership
+	persistPerms bool          // chmod and chown are stored on the server
+
+	quotaCache quotaCache // what Statfs reports
 }
 
-func New(webdavClient interfaces.WebClient, logger logger.FullLogger) *FuseFS {
-	return &FuseFS{
+const (
+	defaultWatchInterval  = 5 * time.Second
+	defaultContentCacheMB = 1024
+	prefetchParallel      = 4 // requests per prefetch window
+)
+
+func New(webdavClient interfaces.WebClient, logger logger.FullLogger, cfg *config.Config) (*FuseFS, error) {
+	fs := &FuseFS{
 		client:      webdavClient,
 		logger:      logger,
 		bufferCache: cache.NewBufferCache(),
 	}
+
+	if cfg.CacheDir != "" {
+		err := fs.bufferCache.SetSpill(filepath.Join(cfg.CacheDir, "buffers"), int64(cfg.BufferFileLimitMB)<<20, int64(cfg.BufferMemoryLimitMB)<<20)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.BufferBudgetMB != 0 {
+		fs.bufferCache.SetBudget(int64(cfg.BufferBudgetMB) << 20)
+	}
+
+	switch {
+	case cfg.ReadaheadMaxMB == 0:
+		fs.readahead = helpers.READAHEAD_MAX
+	case cfg.ReadaheadMaxMB > 0:
+		fs.readahead = int64(cfg.ReadaheadMaxMB) << 20
+	}
+
+	if cfg.CacheDir != "" && cfg.ContentCacheMB >= 0 {
+		limit := cfg.ContentCacheMB
+		if limit == 0 {
+			limit = defaultContentCacheMB
+		}
+		content, err := contentcache.Open(filepath.Join(cfg.CacheDir, "content", journal.Namespace(cfg.URL, cfg.Username)), int64(limit)<<20)
+		if err != nil {
+			return nil, err
+		}
+		fs.content = content
+	}
+
+	switch cfg.ConflictPolicy {
+	case "":
+		fs.conflict = config.ConflictCopy
+	case config.ConflictFail, config.ConflictOverwrite, config.ConflictCopy:
+		fs.conflict = cfg.ConflictPolicy
+	default:
+		return nil, fmt.Errorf("unknown conflict-policy %q", cfg.ConflictPolicy)
+	}
+
+	fs.watchInterval = watchInterval(cfg)
+
+	switch cfg.KernelCache {
+	case "":
+		fs.kernelCache = config.KernelCacheAuto
+	case config.KernelCacheAuto, config.KernelCacheAlways, config.KernelCacheOff:
+		fs.kernelCache = cfg.KernelCache
+	default:
+		return nil, fmt.Errorf("unknown kernel-cache %q", cfg.KernelCache)
+	}
+
+	owner, err := Ownership(cfg)
+	if err != nil {
+		return nil, err
+	}
+	fs.owner = owner
+	fs.persistPerms = cfg.PersistPermissions
+
+	if cfg.SpoolDir != "" && cfg.SpoolDir != config.SpoolDisabled {
+		jr, err := journal.Open(filepath.Join(cfg.SpoolDir, journal.Namespace(cfg.URL, cfg.Username)))
+		if err != nil {
+			return nil, err
+		}
+		fs.journal = jr
+	}
+
+	fs.uploads = upload.NewManager(upload.Options{
+		Workers: cfg.UploadWorkers,
+		Retries: cfg.UploadRetries,
+		Upload:  fs.commitJob,
+		Retryable: func(err error) bool {
+			return !helpers.IsForbiddenErr(err) && !helpers.IsNotExistErr(err) && !helpers.IsPreconditionFailedErr(err) &&
+				!helpers.IsInsufficientStorageErr(err)
+		},
+		Done: fs.uploadDone,
+	})
+
+	return fs, nil
+}
+
+// uploadDone runs after a background upload finished. On success the journal
+// segments covered by the snapshot are dropped and an unused buffer is
+// released; on failure the buffer is marked dirty again so the next
+// Flush/Release retries its pages.
+func (fs *FuseFS) uploadDone(job *upload.Job, err error) {
+	if err != nil {
+		fs.logger.Errorf("[Upload] commit failed path=%s extents=%d len=%d: %v", job.Path, len(job.Ranges()), job.Len(), err)
+		if helpers.IsInsufficientStorageErr(err) {
+			fs.quotaChanged()
+		}
+		// the retries are used up; the next upload sends the data afresh
+		fs.client.DiscardUpload(job.Path)
+		if fb, ok := fs.bufferCache.Get(job.Path); ok {
+			fb.MarkDirty()
+		}
+		return
+	}
+
+	fs.logger.Logf("[Upload] committed path=%s extents=%d len=%d", job.Path, len(job.Ranges()), job.Len())
+	if fb, ok := fs.bufferCache.Get(job.Path); ok {
+		fb.MarkCommitted(job.Seq)
+		if job.Truncated {
+			fb.CommitTruncate(job.Seq)
+		}
+	}
+	if fs.journal != nil {
+		if err := fs.journal.Discard(job.Path, job.Gen); err != nil {
+			fs.logger.Errorf("[Upload] journal discard failed for %s gen=%d: %v", job.Path, job.Gen, err)
+		}
+	}
+	fs.bufferCache.DropIdle(job.Path, fs.uploads.Pending)
+}
+
+// remoteChanged drops what the buffer of name cached from a version another
+// client replaced. Buffers with local changes keep them; their upload
+// detects the conflict.
+func (fs *FuseFS) remoteChanged(name, etag string) {
+	if name == "/" {
+		fs.remoteTreeChanged()
+		return
+	}
+	if etag == "" && fs.content != nil {
+		fs.content.Remove(name)
+	}
+	fb, ok := fs.bufferCache.Get(name)
+	if !ok {
+		return
+	}
+	if etag == "" {
+		if fs.bufferCache.DropIdle(name, fs.uploads.Pending) {
+			fs.logger.Logf("[Watch] %s removed on the server, dropped its buffer", name)
+		}
+		return
+	}
+	if old := fb.ETag(); old != etag {
+		fb.Revalidate(etag)
+		fs.logger.Logf("[Watch] %s changed on the server etag=%s (was %s)", name, etag, old)
+	}
+}
+
+// remoteTreeChanged asks the server for the version of every buffered file
+// after the watcher lost track of the changes, and handles those that
+// changed like reported changes.
+func (fs *FuseFS) remoteTreeChanged() {
+	fs.logger.Logf("[Watch] server changes unknown, revalidating the buffered files")
+	for _, p := range fs.bufferCache.Under("/") {
+		info, err := fs.client.Stat(p)
+		switch {
+		case helpers.IsNotExistErr(err):
+			fs.remoteChanged(p, "")
+		case err != nil:
+			fs.logger.Errorf("[Watch] revalidate failed path=%s: %v", p, err)
+		default:
+			if e, ok := info.(interface{ ETag() string }); ok && e.ETag() != "" {
+				fs.remoteChanged(p, e.ETag())
+			}
+		}
+	}
+}
+
+// replayJournal uploads data left in the spool by a previous run that ended
+// before it could be committed, and reports what was recovered.
+func (fs *FuseFS) replayJournal() {
+	if fs.journal == nil {
+		return
+	}
+
+	report, err := fs.journal.Replay(func(p string, offset int64, data []byte) error {
+		return fs.upload(p, bytes.NewReader(data), int64(len(data)), offset, true)
+	}, fs.client.Truncate)
+	if err != nil {
+		fs.logger.Errorf("[Journal] replay failed dir=%s: %v", fs.journal.Dir(), err)
+		return
+	}
+
+	for _, r := range report {
+		if r.Err != nil {
+			fmt.Fprintf(os.Stderr, "Journal: could not recover %s, keeping it for the next mount: %v\n", r.Path, r.Err)
+			fs.logger.Errorf("[Journal] recover failed path=%s bytes=%d: %v", r.Path, r.Bytes, r.Err)
+			continue
+		}
+		fmt.Printf("Journal: recovered %d bytes in %d extent(s) for %s\n", r.Bytes, r.Extents, r.Path)
+		fs.logger.Logf("[Journal] recovered path=%s bytes=%d extents=%d", r.Path, r.Bytes, r.Extents)
+	}
 }
 
 func (fs *FuseFS) Mount(mountpoint string, flags []string) error {
+	fs.replayJournal()
+	if fs.watchInterval > 0 {
+		fs.stopWatch = fs.client.Watch(fs.watchInterval, fs.remoteChanged)
+	}
+
 	fs.logger.Logf("Mounting FUSE filesystem at %s with flags: %v", mountpoint, flags)
 	fs.mpoint = mountpoint
 	fs.host = fuse.NewFileSystemHost(fs)
@@ -0,0 +1,70 @@
+package fs
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mimic/internal/core/cache"
+	"github.com/mimic/internal/core/config"
+)
+
+// MountOptions returns the FUSE options for cfg. Unless configured, the
+// kernel keeps attributes and names as long as the metadata cache would,
+// but no longer than it takes the watcher to notice a remote change.
+func MountOptions(cfg *config.Config) []string {
+	limit := max(cfg.TTL, 0)
+	negative := cfg.NegativeTTL
+	if negative == 0 {
+		negative = cache.DefaultNegTTL
+	}
+	if watch := watchInterval(cfg); watch > 0 {
+		limit = min(limit, watch)
+		negative = min(negative, watch)
+	}
+
+	timeouts := []string{
+		"attr_timeout=" + seconds(timeout(cfg.AttrTimeout, limit)),
+		"entry_timeout=" + seconds(timeout(cfg.EntryTimeout, limit)),
+		"negative_timeout=" + seconds(timeout(cfg.NegativeTimeout, negative)),
+	}
+	if cfg.KernelCache == config.KernelCacheAlways {
+		timeouts = append(timeouts, "kernel_cache")
+	}
+	if cfg.DirectIO {
+		timeouts = append(timeouts, "direct_io")
+	}
+
+	opts := []string{"-o", strings.Join(timeouts, ",")}
+	for _, o := range cfg.MountOptions {
+		opts = append(opts, "-o", o)
+	}
+	return opts
+}
+
+// timeout returns configured, derived when it is zero, 0 when negative.
+func timeout(configured, derived time.Duration) time.Duration {
+	switch {
+	case configured < 0:
+		return 0
+	case configured == 0:
+		return max(derived, 0)
+	}
+	return configured
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// watchInterval returns how often remote changes are polled, 0 when they
+// are not.
+func watchInterval(cfg *config.Config) time.Duration {
+	switch {
+	case cfg.WatchInterval == 0:
+		return defaultWatchInterval
+	case cfg.WatchInterval > 0:
+		return cfg.WatchInterval
+	}
+	return 0
+}
@@ -0,0 +1,48 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/mimic/internal/core/casters"
+	"github.com/mimic/internal/core/config"
+)
+
+const defaultUmask = 0o022
+
+// Ownership returns the owner and permission bits cfg gives files that
+// have none stored.
+func Ownership(cfg *config.Config) (casters.Owner, error) {
+	o := casters.Owner{UID: uint32(os.Getuid()), GID: uint32(os.Getgid())}
+	if cfg.UID != nil {
+		o.UID = *cfg.UID
+	}
+	if cfg.GID != nil {
+		o.GID = *cfg.GID
+	}
+
+	umask, err := parseMask("umask", cfg.Umask, defaultUmask)
+	if err != nil {
+		return o, err
+	}
+	if o.DirMask, err = parseMask("dmask", cfg.DMask, umask); err != nil {
+		return o, err
+	}
+	if o.FileMask, err = parseMask("fmask", cfg.FMask, umask); err != nil {
+		return o, err
+	}
+	return o, nil
+}
+
+// parseMask reads an octal mask, def when it is empty.
+func parseMask(option, s string, def uint32) (uint32, error) {
+	if s == "" {
+		return def, nil
+	}
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0o777 {
+		return 0, fmt.Errorf("invalid %s %q", option, s)
+	}
+	return uint32(m), nil
+}
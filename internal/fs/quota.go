@@ -0,0 +1,50 @@
+package fs
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mimic/internal/core/wrappers"
+)
+
+const (
+	// how long Statfs answers from the last quota the server reported
+	quotaTTL = 10 * time.Second
+	// free space reported when the server has no or an unlimited quota
+	unlimitedBytes = 1 << 50
+)
+
+// quotaCache holds the last quota the server reported.
+type quotaCache struct {
+	mu              sync.Mutex
+	used, available int64 // -1: not reported
+	fetched         time.Time
+}
+
+// quota returns the bytes used and available on the server, -1 for what it
+// does not report. Failures are remembered like answers, so df does not
+// ask a server without quota support on every call.
+func (fs *FuseFS) quota() (used, available int64) {
+	q := &fs.quotaCache
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.fetched.IsZero() && time.Since(q.fetched) < quotaTTL {
+		return q.used, q.available
+	}
+	used, available, err := fs.client.Quota()
+	if err != nil && !errors.Is(err, wrappers.ErrNoQuota) {
+		fs.logger.Errorf("[Statfs] quota query failed: %v", err)
+	}
+	q.used, q.available, q.fetched = used, available, time.Now()
+	return used, available
+}
+
+// quotaChanged makes the next Statfs ask the server again, e.g. after it
+// ran out of space.
+func (fs *FuseFS) quotaChanged() {
+	fs.quotaCache.mu.Lock()
+	fs.quotaCache.fetched = time.Time{}
+	fs.quotaCache.mu.Unlock()
+}
@@ -2,7 +2,9 @@ package interfaces
 
 import (
 	"context"
+	"io"
 	"os"
+	"time"
 
 	"github.com/mimic/internal/core/locking"
 )
@@ -18,10 +20,16 @@ type WebClient interface {
 	// Read helpers
 	Read(name string) ([]byte, error) // read whole file
 	ReadRange(name string, offset, length int64) ([]byte, error)
+	// ReadRangeVersion also returns the ETag of the version read
+	ReadRangeVersion(name string, offset, length int64) ([]byte, string, error)
 
 	// Write
 	Write(name string, data []byte) error // write/overwrite with byte slice
 	WriteOffset(name string, data []byte, offset int64) error
+	WriteFrom(name string, r io.ReaderAt, size int64) error // like Write, streaming from r
+	WriteOffsetFrom(name string, r io.ReaderAt, size, offset int64) error
+	// DiscardUpload drops what a failed upload of name left to resume from
+	DiscardUpload(name string)
 
 	// create / remove
 	Create(name string) error                  // create new file with data (can alias Write)
@@ -30,10 +38,45 @@ type WebClient interface {
 	Mkdir(name string, mode os.FileMode) error // create directory
 	Rmdir(name string) error                   // remove directory
 	Rename(oldname, newname string) error      // rename/move
+	Copy(oldname, newname string) error        // copy a file, replacing newname
+
+	// Symbolic links
+	Symlink(target, name string) error    // create name pointing to target
+	Readlink(name string) (string, error) // target of the link name
+
+	// Extended attributes, stored as dead properties
+	Xattrs(name string) (map[string][]byte, error)
+	Xattr(name, attr string) ([]byte, error)
+	SetXattr(name, attr string, value []byte) error
+	RemoveXattr(name, attr string) error
+
+	// Guarded runs fn with the writes to name conditional on the server
+	// still holding version etag and returns the version fn produced.
+	Guarded(name, etag string, fn func() error) (string, error)
+
+	// SetModTime sets the modification time of name; ModTimed runs fn
+	// with the uploads of name keeping mtime as their modification time.
+	SetModTime(name string, mtime time.Time) error
+	ModTimed(name string, mtime time.Time, fn func() error) error
+
+	// SetMode and SetOwner store what chmod and chown set for name; a nil
+	// uid or gid is left unchanged.
+	SetMode(name string, mode uint32) error
+	SetOwner(name string, uid, gid *uint32) error
+
+	// Quota returns the bytes used and available on the server, -1 for
+	// those it does not report.
+	Quota() (used, available int64, err error)
+
+	// Watch reports changes other clients make on the server every
+	// interval: changed gets each changed file and its new ETag, "" when
+	// it was removed. Call stop to end watching.
+	Watch(interval time.Duration, changed func(name, etag string)) (stop func())
 
 	// Locking
 	Lock(name string, owner []byte, start, end uint64, lockType locking.LockType) error
 	Unlock(name string, owner []byte, start, end uint64) error
+	UnlockOwner(name string, owner []byte) error
 	LockWait(ctx context.Context, name string, owner []byte, start, end uint64, lockType locking.LockType) error
 	Query(name string, start, end uint64) *locking.LockInfo
 }
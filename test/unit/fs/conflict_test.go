@@ -0,0 +1,60 @@
+package fs
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConflictCopySurvivesRetries(t *testing.T) {
+	f, backend := newTestFS(t)
+	backend.Set("doc.txt", []byte("first"))
+
+	errc, h := f.Open("/doc.txt", os.O_RDWR)
+	if errc != 0 {
+		t.Fatalf("Open: %d", errc)
+	}
+	if n := f.Write("/doc.txt", []byte("local"), 0, h); n != 5 {
+		t.Fatalf("Write: %d", n)
+	}
+	backend.Set("doc.txt", []byte("other"))
+
+	// once the copy is saved, refreshing the file fails twice, so the job
+	// is retried across a change of the second in the copy's name
+	var mu sync.Mutex
+	saved, failures := false, 0
+	backend.Fail = func(r *http.Request) int {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "(conflict "):
+			saved = true
+		case r.Method == "PROPFIND" && r.URL.Path == "/doc.txt" && saved && failures < 2:
+			failures++
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	}
+	if errc := f.Release("/doc.txt", h); errc != 0 {
+		t.Fatalf("Release: %d", errc)
+	}
+	f.Destroy()
+
+	var copies []string
+	for k := range backend.M {
+		if strings.Contains(k, "(conflict ") {
+			copies = append(copies, k)
+		}
+	}
+	if len(copies) != 1 {
+		t.Fatalf("got conflict copies %q, want one", copies)
+	}
+	if got, _ := backend.Get(copies[0]); string(got) != "local" {
+		t.Fatalf("conflict copy holds %q", got)
+	}
+	if got, _ := backend.Get("doc.txt"); string(got) != "other" {
+		t.Fatalf("server version replaced with %q", got)
+	}
+}
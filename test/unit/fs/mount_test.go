@@ -0,0 +1,46 @@
+package fs
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mimic/internal/core/config"
+	"github.com/mimic/internal/fs"
+)
+
+func TestMountOptionsDerivedFromCachePolicy(t *testing.T) {
+	cfg := &config.Config{TTL: time.Minute, WatchInterval: 2 * time.Second}
+	got := fs.MountOptions(cfg)
+	want := []string{"-o", "attr_timeout=2,entry_timeout=2,negative_timeout=2"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("options %q, want %q", got, want)
+	}
+
+	// without watching the kernel may cache as long as the metadata cache
+	cfg = &config.Config{TTL: 1500 * time.Millisecond, NegativeTTL: 30 * time.Second, WatchInterval: -1}
+	want = []string{"-o", "attr_timeout=1.5,entry_timeout=1.5,negative_timeout=30"}
+	if got := fs.MountOptions(cfg); !slices.Equal(got, want) {
+		t.Fatalf("options %q, want %q", got, want)
+	}
+}
+
+func TestMountOptionsConfigured(t *testing.T) {
+	cfg := &config.Config{
+		TTL:             time.Minute,
+		AttrTimeout:     10 * time.Second,
+		EntryTimeout:    -1,
+		NegativeTimeout: -1,
+		KernelCache:     config.KernelCacheAlways,
+		DirectIO:        true,
+		MountOptions:    []string{"allow_other", "max_read=131072"},
+	}
+	want := []string{
+		"-o", "attr_timeout=10,entry_timeout=0,negative_timeout=0,kernel_cache,direct_io",
+		"-o", "allow_other",
+		"-o", "max_read=131072",
+	}
+	if got := fs.MountOptions(cfg); !slices.Equal(got, want) {
+		t.Fatalf("options %q, want %q", got, want)
+	}
+}
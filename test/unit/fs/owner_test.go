@@ -0,0 +1,43 @@
+package fs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mimic/internal/core/config"
+	"github.com/mimic/internal/fs"
+)
+
+func TestOwnershipDefaults(t *testing.T) {
+	o, err := fs.Ownership(&config.Config{})
+	if err != nil {
+		t.Fatalf("Ownership failed: %v", err)
+	}
+	if o.UID != uint32(os.Getuid()) || o.GID != uint32(os.Getgid()) {
+		t.Fatalf("owner %d:%d, want the mounting user", o.UID, o.GID)
+	}
+	if o.DirPerm() != 0o755 || o.FilePerm() != 0o644 {
+		t.Fatalf("perms dir=%#o file=%#o", o.DirPerm(), o.FilePerm())
+	}
+}
+
+func TestOwnershipConfigured(t *testing.T) {
+	uid, gid := uint32(0), uint32(100)
+	o, err := fs.Ownership(&config.Config{UID: &uid, GID: &gid, Umask: "002", FMask: "137"})
+	if err != nil {
+		t.Fatalf("Ownership failed: %v", err)
+	}
+	if o.UID != 0 || o.GID != 100 {
+		t.Fatalf("owner %d:%d", o.UID, o.GID)
+	}
+	// dmask falls back to umask, fmask overrides it
+	if o.DirPerm() != 0o775 || o.FilePerm() != 0o640 {
+		t.Fatalf("perms dir=%#o file=%#o", o.DirPerm(), o.FilePerm())
+	}
+
+	for _, mask := range []string{"8", "1000", "-1"} {
+		if _, err := fs.Ownership(&config.Config{DMask: mask}); err == nil {
+			t.Fatalf("dmask %q accepted", mask)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package fs
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestReleaseWhilePrefetching(t *testing.T) {
+	f, backend := newTestFS(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<10) // 1 MiB
+	backend.Set("big.bin", data)
+
+	for range 20 {
+		errc, h := f.Open("/big.bin", os.O_RDONLY)
+		if errc != 0 {
+			t.Fatalf("Open: %d", errc)
+		}
+		buf := make([]byte, 4096)
+		// sequential reads start a prefetch the release does not wait for
+		for off := int64(0); off < 3*4096; off += 4096 {
+			if n := f.Read("/big.bin", buf, off, h); n != len(buf) || !bytes.Equal(buf, data[off:off+4096]) {
+				t.Fatalf("Read at %d: %d", off, n)
+			}
+		}
+		if errc := f.Release("/big.bin", h); errc != 0 {
+			t.Fatalf("Release: %d", errc)
+		}
+	}
+	f.Destroy()
+}
@@ -0,0 +1,100 @@
+package fs
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mimic/internal/core/cache"
+	"github.com/mimic/internal/core/config"
+	"github.com/mimic/internal/core/logger"
+	"github.com/mimic/internal/core/wrappers"
+	"github.com/mimic/internal/fs"
+	"github.com/mimic/test/utils/memserver"
+)
+
+// newTestFS serves the callbacks, without mounting, against a test server.
+func newTestFS(t *testing.T) (*fs.FuseFS, *memserver.MemBackend) {
+	t.Helper()
+	srv, backend := memserver.NewTestServer()
+	t.Cleanup(srv.Close)
+
+	log, err := logger.New(false, "discard", "discard")
+	if err != nil {
+		t.Fatalf("logger: %v", err)
+	}
+	wc := wrappers.NewWebdavClient(cache.NewNodeCache(time.Minute, 100), srv.URL, "", "")
+	f, err := fs.New(wc, log, &config.Config{SpoolDir: config.SpoolDisabled})
+	if err != nil {
+		t.Fatalf("fs.New: %v", err)
+	}
+	return f, backend
+}
+
+// newSlowUploadFS is newTestFS with PUTs taking a while, so uploads are
+// still pending when the next callback runs.
+func newSlowUploadFS(t *testing.T) (*fs.FuseFS, *memserver.MemBackend) {
+	t.Helper()
+	f, backend := newTestFS(t)
+	backend.Fail = func(r *http.Request) int {
+		if r.Method == http.MethodPut {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return 0
+	}
+	return f, backend
+}
+
+// writeAndClose creates p with data and closes it, which only queues the
+// upload.
+func writeAndClose(t *testing.T, f *fs.FuseFS, p string, data []byte) {
+	t.Helper()
+	errc, h := f.Create(p, os.O_RDWR|os.O_CREATE, 0o644)
+	if errc != 0 {
+		t.Fatalf("Create %s: %d", p, errc)
+	}
+	if n := f.Write(p, data, 0, h); n != len(data) {
+		t.Fatalf("Write %s: %d", p, n)
+	}
+	if errc := f.Flush(p, h); errc != 0 {
+		t.Fatalf("Flush %s: %d", p, errc)
+	}
+	if errc := f.Release(p, h); errc != 0 {
+		t.Fatalf("Release %s: %d", p, errc)
+	}
+}
+
+func TestRenameAfterCloseMovesTheData(t *testing.T) {
+	f, backend := newSlowUploadFS(t)
+	backend.Set("doc.txt", []byte("old"))
+
+	// the save of an editor: write a temporary file, rename it over
+	writeAndClose(t, f, "/doc.txt.tmp", []byte("new content"))
+	if errc := f.Rename("/doc.txt.tmp", "/doc.txt"); errc != 0 {
+		t.Fatalf("Rename: %d", errc)
+	}
+	f.Destroy()
+
+	if got, _ := backend.Get("doc.txt"); string(got) != "new content" {
+		t.Fatalf("target holds %q", got)
+	}
+	if _, ok := backend.Get("doc.txt.tmp"); ok {
+		t.Fatalf("an upload recreated the temporary file")
+	}
+}
+
+func TestUnlinkDropsPendingUpload(t *testing.T) {
+	f, backend := newSlowUploadFS(t)
+
+	writeAndClose(t, f, "/a.txt", []byte("first"))
+	writeAndClose(t, f, "/a.txt", []byte("second"))
+	if errc := f.Unlink("/a.txt"); errc != 0 {
+		t.Fatalf("Unlink: %d", errc)
+	}
+	f.Destroy()
+
+	if got, ok := backend.Get("a.txt"); ok {
+		t.Fatalf("an upload recreated the removed file with %q", got)
+	}
+}
@@ -2,6 +2,7 @@ package locking_test
 
 import (
 	"context"
+	"runtime"
 	"testing"
 	"time"
 
@@ -86,3 +87,155 @@ func TestNonOverlappingLocks(t *testing.T) {
 		t.Fatalf("Acquire B failed: %v", err)
 	}
 }
+
+func TestReleaseSplitsAndAcquireMerges(t *testing.T) {
+	lm := locking.NewLockManager()
+	owner := []byte("o")
+
+	if err := lm.Acquire("file", owner, 0, 100, locking.F_WRLCK); err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	// unlocking the middle leaves both ends locked
+	if err := lm.Release("file", owner, 40, 60); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if _, ok := lm.Query("file", 40, 60); ok {
+		t.Fatalf("released range still locked")
+	}
+	for _, r := range [][2]uint64{{0, 40}, {60, 100}} {
+		if info, ok := lm.Query("file", r[0], r[1]); !ok || info.Start != r[0] || info.End != r[1] {
+			t.Fatalf("range %v: got %+v ok=%v", r, info, ok)
+		}
+	}
+
+	// relocking the gap joins the pieces again
+	if err := lm.Acquire("file", owner, 40, 60, locking.F_WRLCK); err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	if info, ok := lm.Query("file", 50, 51); !ok || info.Start != 0 || info.End != 100 {
+		t.Fatalf("merged lock %+v ok=%v", info, ok)
+	}
+
+	// a lock to the end of the file reports End 0
+	if err := lm.Acquire("file", owner, 100, 0, locking.F_WRLCK); err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	if info, ok := lm.Query("file", 1<<40, 0); !ok || info.Start != 0 || info.End != 0 {
+		t.Fatalf("lock to EOF %+v ok=%v", info, ok)
+	}
+}
+
+func TestUpgradeAndDowngrade(t *testing.T) {
+	lm := locking.NewLockManager()
+	a, b := []byte("a"), []byte("b")
+
+	if err := lm.Acquire("file", a, 0, 100, locking.F_RDLCK); err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	// the owner's own read lock does not stand in the way
+	if err := lm.Acquire("file", a, 0, 100, locking.F_WRLCK); err != nil {
+		t.Fatalf("upgrade failed: %v", err)
+	}
+	if err := lm.Acquire("file", b, 0, 10, locking.F_RDLCK); err != locking.ErrWouldBlock {
+		t.Fatalf("expected ErrWouldBlock, got %v", err)
+	}
+
+	// downgrading part of the range lets readers in there only
+	if err := lm.Acquire("file", a, 0, 50, locking.F_RDLCK); err != nil {
+		t.Fatalf("downgrade failed: %v", err)
+	}
+	if err := lm.Acquire("file", b, 0, 50, locking.F_RDLCK); err != nil {
+		t.Fatalf("read lock after downgrade failed: %v", err)
+	}
+	if err := lm.Acquire("file", b, 40, 60, locking.F_RDLCK); err != locking.ErrWouldBlock {
+		t.Fatalf("expected ErrWouldBlock on the write locked part, got %v", err)
+	}
+	// with another reader the owner cannot upgrade again
+	if err := lm.Acquire("file", a, 0, 50, locking.F_WRLCK); err != locking.ErrWouldBlock {
+		t.Fatalf("expected ErrWouldBlock, got %v", err)
+	}
+}
+
+func TestAcquireWaitWokenByDowngrade(t *testing.T) {
+	lm := locking.NewLockManager()
+	a, b := []byte("a"), []byte("b")
+
+	if err := lm.Acquire("file", a, 0, 0, locking.F_WRLCK); err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = lm.Acquire("file", a, 0, 0, locking.F_RDLCK)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := lm.AcquireWait(ctx, "file", b, 0, 0, locking.F_RDLCK); err != nil {
+		t.Fatalf("AcquireWait failed: %v", err)
+	}
+}
+
+func TestAcquireWaitDetectsDeadlock(t *testing.T) {
+	lm := locking.NewLockManager()
+	a, b := []byte("a"), []byte("b")
+
+	if err := lm.Acquire("x", a, 0, 0, locking.F_WRLCK); err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	if err := lm.Acquire("y", b, 0, 0, locking.F_WRLCK); err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	waited := make(chan error, 1)
+	go func() { waited <- lm.AcquireWait(ctx, "y", a, 0, 0, locking.F_WRLCK) }()
+	time.Sleep(50 * time.Millisecond)
+
+	// b waiting for x would wait for a, which waits for b
+	if err := lm.AcquireWait(ctx, "x", b, 0, 0, locking.F_WRLCK); err != locking.ErrDeadlock {
+		t.Fatalf("expected ErrDeadlock, got %v", err)
+	}
+	lm.ReleaseOwner("y", b)
+	if err := <-waited; err != nil {
+		t.Fatalf("AcquireWait of a failed: %v", err)
+	}
+}
+
+func TestReleaseOwner(t *testing.T) {
+	lm := locking.NewLockManager()
+	a, b := []byte("a"), []byte("b")
+
+	_ = lm.Acquire("file", a, 0, 10, locking.F_WRLCK)
+	_ = lm.Acquire("file", a, 20, 30, locking.F_RDLCK)
+	_ = lm.Acquire("file", b, 40, 50, locking.F_WRLCK)
+	_ = lm.Acquire("other", a, 0, 10, locking.F_WRLCK)
+
+	lm.ReleaseOwner("file", a)
+	if info, ok := lm.Query("file", 0, 0); !ok || string(info.Owner) != "b" {
+		t.Fatalf("left %+v ok=%v, want only b's lock", info, ok)
+	}
+	if _, ok := lm.Query("other", 0, 0); !ok {
+		t.Fatalf("lock on another file was released")
+	}
+}
+
+func TestAcquireWaitCancelledLeavesNoGoroutines(t *testing.T) {
+	lm := locking.NewLockManager()
+	if err := lm.Acquire("file", []byte("a"), 0, 0, locking.F_WRLCK); err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	before := runtime.NumGoroutine()
+	for range 20 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		if err := lm.AcquireWait(ctx, "file", []byte("b"), 0, 0, locking.F_WRLCK); err != context.DeadlineExceeded {
+			t.Fatalf("expected DeadlineExceeded, got %v", err)
+		}
+		cancel()
+	}
+	time.Sleep(10 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("goroutines grew from %d to %d", before, after)
+	}
+}
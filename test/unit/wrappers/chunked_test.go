@@ -0,0 +1,184 @@
+package wrappers
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mimic/internal/core/cache"
+	"github.com/mimic/internal/core/helpers"
+	"github.com/mimic/internal/core/wrappers"
+	"github.com/mimic/test/utils/memserver"
+)
+
+// newNextcloudWrapper serves the backend below a Nextcloud style files URL so
+// the uploads collection is derived from it.
+func newNextcloudWrapper(t *testing.T) (*wrappers.WebdavClient, *memserver.MemBackend, func()) {
+	t.Helper()
+	srv, backend := memserver.NewTestServer()
+	backend.Dirs["remote.php/dav/files/alice"] = true
+	backend.Dirs["remote.php/dav/uploads/alice"] = true
+	cache := cache.NewNodeCache(1*time.Minute, 100)
+	wc := wrappers.NewWebdavClient(cache, srv.URL+"/remote.php/dav/files/alice", "", "")
+	wc.SetChunking(16, 8, "")
+	return wc, backend, func() { srv.Close() }
+}
+
+func TestChunkedUploadAssembles(t *testing.T) {
+	wc, backend, cleanup := newNextcloudWrapper(t)
+	defer cleanup()
+
+	payload := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCD") // 40 bytes, 5 chunks
+	if err := wc.Write("big file.bin", payload); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	got, ok := backend.Get("remote.php/dav/files/alice/big file.bin")
+	if !ok || !bytes.Equal(got, payload) {
+		t.Fatalf("assembled content mismatch: got=%q want=%q", got, payload)
+	}
+	if n := backend.Count(http.MethodPut); n != 5 {
+		t.Fatalf("expected 5 chunk PUTs, got %d", n)
+	}
+	if n := backend.Count("MOVE"); n != 1 {
+		t.Fatalf("expected 1 MOVE, got %d", n)
+	}
+	for k := range backend.M {
+		if strings.HasPrefix(k, "remote.php/dav/uploads/alice/") {
+			t.Fatalf("upload collection left behind: %s", k)
+		}
+	}
+}
+
+func TestChunkedUploadBelowThresholdIsSinglePut(t *testing.T) {
+	wc, backend, cleanup := newNextcloudWrapper(t)
+	defer cleanup()
+
+	if err := wc.Write("small.txt", []byte("tiny")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if n := backend.Count("MKCOL"); n != 0 {
+		t.Fatalf("small file should not be chunked, got %d MKCOL", n)
+	}
+	if got, _ := backend.Get("remote.php/dav/files/alice/small.txt"); string(got) != "tiny" {
+		t.Fatalf("unexpected content %q", got)
+	}
+}
+
+func TestChunkedUploadResumes(t *testing.T) {
+	wc, backend, cleanup := newNextcloudWrapper(t)
+	defer cleanup()
+
+	failed := false
+	backend.Fail = func(r *http.Request) int {
+		if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/00003") && !failed {
+			failed = true
+			return http.StatusBadGateway
+		}
+		return 0
+	}
+
+	payload := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCD")
+	if err := wc.Write("resume.bin", payload); err == nil {
+		t.Fatalf("expected first attempt to fail")
+	}
+	if _, ok := backend.Get("remote.php/dav/files/alice/resume.bin"); ok {
+		t.Fatalf("file must not exist after a failed upload")
+	}
+
+	before := backend.Count(http.MethodPut)
+	if err := wc.Write("resume.bin", payload); err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	// chunks 1 and 2 survived the first attempt
+	if n := backend.Count(http.MethodPut) - before; n != 3 {
+		t.Fatalf("expected 3 PUTs on resume, got %d", n)
+	}
+	got, _ := backend.Get("remote.php/dav/files/alice/resume.bin")
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("resumed content mismatch: got=%q want=%q", got, payload)
+	}
+}
+
+func TestChunkedUploadReportsStatus(t *testing.T) {
+	wc, backend, cleanup := newNextcloudWrapper(t)
+	defer cleanup()
+
+	backend.Fail = func(r *http.Request) int {
+		if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/00004") {
+			return http.StatusBadGateway
+		}
+		return 0
+	}
+
+	// 40 bytes of 8 byte chunks; a failing chunk is reported with the
+	// status of its PUT, not with its number
+	err := wc.Write("status.bin", []byte("0123456789abcdefghijklmnopqrstuvwxyzABCD"))
+	if code := helpers.StatusCode(err); code != http.StatusBadGateway {
+		t.Fatalf("expected status 502, got %d (%v)", code, err)
+	}
+	if helpers.IsNotExistErr(err) || strings.Contains(err.Error(), "00004") {
+		t.Fatalf("error misreports the chunk: %v", err)
+	}
+}
+
+func TestChunkedUploadResumesOnlySameContent(t *testing.T) {
+	wc, backend, cleanup := newNextcloudWrapper(t)
+	defer cleanup()
+
+	failed := false
+	backend.Fail = func(r *http.Request) int {
+		if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/00003") && !failed {
+			failed = true
+			return http.StatusBadGateway
+		}
+		return 0
+	}
+
+	if err := wc.Write("mixed.bin", bytes.Repeat([]byte("A"), 40)); err == nil {
+		t.Fatalf("expected first attempt to fail")
+	}
+	// new data of the same size must not be assembled with the old chunks
+	want := bytes.Repeat([]byte("B"), 40)
+	if err := wc.Write("mixed.bin", want); err != nil {
+		t.Fatalf("second upload failed: %v", err)
+	}
+	if got, _ := backend.Get("remote.php/dav/files/alice/mixed.bin"); !bytes.Equal(got, want) {
+		t.Fatalf("server holds %q, want %q", got, want)
+	}
+}
+
+func TestDiscardUploadStartsOver(t *testing.T) {
+	wc, backend, cleanup := newNextcloudWrapper(t)
+	defer cleanup()
+
+	failed := false
+	backend.Fail = func(r *http.Request) int {
+		if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/00003") && !failed {
+			failed = true
+			return http.StatusBadGateway
+		}
+		return 0
+	}
+
+	payload := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCD")
+	if err := wc.Write("gone.bin", payload); err == nil {
+		t.Fatalf("expected first attempt to fail")
+	}
+	wc.DiscardUpload("gone.bin")
+	for k := range backend.M {
+		if strings.HasPrefix(k, "remote.php/dav/uploads/alice/") {
+			t.Fatalf("chunks left behind: %s", k)
+		}
+	}
+
+	before := backend.Count(http.MethodPut)
+	if err := wc.Write("gone.bin", payload); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if n := backend.Count(http.MethodPut) - before; n != 5 {
+		t.Fatalf("expected all 5 chunks sent again, got %d", n)
+	}
+}
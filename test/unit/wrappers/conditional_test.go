@@ -0,0 +1,186 @@
+package wrappers
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/mimic/internal/core/casters"
+	"github.com/mimic/internal/core/helpers"
+)
+
+func TestGuardedWriteAdvancesETag(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+
+	name := "doc.txt"
+	backend.Set(name, []byte("v1"))
+
+	etag, err := wc.Guarded(name, backend.ETag(name), func() error {
+		if err := wc.Write(name, []byte("v2")); err != nil {
+			return err
+		}
+		// the second write expects the version the first one produced
+		return wc.Write(name, []byte("v3"))
+	})
+	if err != nil {
+		t.Fatalf("Guarded write failed: %v", err)
+	}
+	if got, _ := backend.Get(name); !bytes.Equal(got, []byte("v3")) {
+		t.Fatalf("unexpected content: %q", got)
+	}
+	if etag != backend.ETag(name) {
+		t.Fatalf("etag: want %s got %s", backend.ETag(name), etag)
+	}
+}
+
+func TestGuardedWriteDetectsConflict(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+
+	name := "doc.txt"
+	backend.Set(name, []byte("ours"))
+	seen := backend.ETag(name)
+	backend.Set(name, []byte("theirs"))
+
+	_, err := wc.Guarded(name, seen, func() error {
+		return wc.Write(name, []byte("mine"))
+	})
+	if !helpers.IsPreconditionFailedErr(err) {
+		t.Fatalf("expected 412 error, got %v", err)
+	}
+	if got, _ := backend.Get(name); !bytes.Equal(got, []byte("theirs")) {
+		t.Fatalf("conflicting write replaced the server's version: %q", got)
+	}
+
+	// outside Guarded the write is unconditional
+	if err := wc.Write(name, []byte("mine")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+}
+
+func TestGuardedKeepsETagOnFailure(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+
+	name := "doc.txt"
+	backend.Set(name, []byte("v1"))
+	puts := 0
+	backend.Fail = func(r *http.Request) int {
+		if r.Method == http.MethodPut {
+			if puts++; puts == 2 {
+				return http.StatusBadGateway
+			}
+		}
+		return 0
+	}
+
+	etag, err := wc.Guarded(name, backend.ETag(name), func() error {
+		if err := wc.Write(name, []byte("v2")); err != nil {
+			return err
+		}
+		return wc.Write(name, []byte("v3"))
+	})
+	if err == nil {
+		t.Fatalf("expected the second write to fail")
+	}
+	// a retry has to expect the version the first write produced
+	if etag != backend.ETag(name) {
+		t.Fatalf("etag: want %s got %s", backend.ETag(name), etag)
+	}
+}
+
+func TestGuardedWriteWithEscapedETags(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+	backend.EscapeETags = true
+
+	name := "doc.txt"
+	backend.Set(name, []byte("v1"))
+	fi, err := wc.Stat(name)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	etag := casters.ETag(fi)
+	if etag != backend.ETag(name) {
+		t.Fatalf("etag: want %s got %s", backend.ETag(name), etag)
+	}
+
+	// the decoded tag matches as If-Match
+	if _, err := wc.Guarded(name, etag, func() error {
+		return wc.Write(name, []byte("v2"))
+	}); err != nil {
+		t.Fatalf("Guarded write failed: %v", err)
+	}
+}
+
+func TestGuardedPartialUpdate(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+	backend.SabrePatch = true
+
+	name := "log.txt"
+	backend.Set(name, []byte("HelloWorld"))
+	seen := backend.ETag(name)
+
+	etag, err := wc.Guarded(name, seen, func() error {
+		if err := wc.WriteOffset(name, []byte("123"), 5); err != nil {
+			return err
+		}
+		return wc.WriteOffset(name, []byte("++"), 10)
+	})
+	if err != nil {
+		t.Fatalf("Guarded partial update failed: %v", err)
+	}
+	if got, _ := backend.Get(name); !bytes.Equal(got, []byte("Hello123ld++")) {
+		t.Fatalf("unexpected content: %q", got)
+	}
+
+	// a stale version fails instead of falling back to a whole-file upload
+	_, err = wc.Guarded(name, seen, func() error {
+		return wc.WriteOffset(name, []byte("X"), 0)
+	})
+	if !helpers.IsPreconditionFailedErr(err) {
+		t.Fatalf("expected 412 error, got %v", err)
+	}
+	if got, _ := backend.Get(name); got[0] != 'H' {
+		t.Fatalf("stale partial update was applied: %q", got)
+	}
+	if etag != backend.ETag(name) {
+		t.Fatalf("etag: want %s got %s", backend.ETag(name), etag)
+	}
+}
+
+func TestGuardedChunkedUploadDetectsConflict(t *testing.T) {
+	wc, backend, cleanup := newNextcloudWrapper(t)
+	defer cleanup()
+
+	name := "remote.php/dav/files/alice/big.bin"
+	backend.Set(name, []byte("old"))
+	seen := backend.ETag(name)
+	backend.Set(name, []byte("changed"))
+
+	payload := bytes.Repeat([]byte("x"), 40)
+	_, err := wc.Guarded("big.bin", seen, func() error {
+		return wc.Write("big.bin", payload)
+	})
+	if !helpers.IsPreconditionFailedErr(err) {
+		t.Fatalf("expected 412 error, got %v", err)
+	}
+	if got, _ := backend.Get(name); !bytes.Equal(got, []byte("changed")) {
+		t.Fatalf("assembled upload replaced the server's version: %q", got)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+
+	backend.Set("a.txt", []byte("data"))
+	if err := wc.Copy("a.txt", "a (conflict).txt"); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if got, ok := backend.Get("a (conflict).txt"); !ok || !bytes.Equal(got, []byte("data")) {
+		t.Fatalf("copy content: %q ok=%v", got, ok)
+	}
+}
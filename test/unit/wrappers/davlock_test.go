@@ -0,0 +1,260 @@
+package wrappers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mimic/internal/core/cache"
+	"github.com/mimic/internal/core/locking"
+	"github.com/mimic/internal/core/wrappers"
+	"github.com/mimic/test/utils/memserver"
+)
+
+// newLockingClients returns two clients of one server, like two machines,
+// both holding write locks on the server.
+func newLockingClients(t *testing.T, timeout time.Duration) (*wrappers.WebdavClient, *wrappers.WebdavClient, *memserver.MemBackend) {
+	t.Helper()
+	srv, backend := memserver.NewTestServer()
+	t.Cleanup(srv.Close)
+	clients := make([]*wrappers.WebdavClient, 2)
+	for i := range clients {
+		clients[i] = wrappers.NewWebdavClient(cache.NewNodeCache(time.Minute, 100), srv.URL, "", "")
+		clients[i].SetServerLocks(true, timeout)
+	}
+	return clients[0], clients[1], backend
+}
+
+func TestServerLockSeenByOtherClients(t *testing.T) {
+	a, b, backend := newLockingClients(t, 0)
+	backend.Set("doc.odt", []byte("v1"))
+
+	if err := a.Lock("doc.odt", []byte("a"), 0, 0, locking.F_WRLCK); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	if backend.LockToken("doc.odt") == "" {
+		t.Fatalf("no lock on the server")
+	}
+	if err := b.Lock("doc.odt", []byte("b"), 0, 0, locking.F_WRLCK); !errors.Is(err, locking.ErrWouldBlock) {
+		t.Fatalf("other client got the lock: %v", err)
+	}
+	// read locks stay local
+	if err := b.Lock("doc.odt", []byte("b"), 0, 0, locking.F_RDLCK); err != nil {
+		t.Fatalf("read lock failed: %v", err)
+	}
+
+	if err := b.Write("doc.odt", []byte("theirs")); err == nil || !strings.Contains(err.Error(), "423") {
+		t.Fatalf("write without the token: %v", err)
+	}
+	if err := a.Write("doc.odt", []byte("v2")); err != nil {
+		t.Fatalf("write with the token failed: %v", err)
+	}
+	if data, _ := backend.Get("doc.odt"); string(data) != "v2" {
+		t.Fatalf("server holds %q", data)
+	}
+
+	if err := a.Unlock("doc.odt", []byte("a"), 0, 0); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if backend.LockToken("doc.odt") != "" {
+		t.Fatalf("lock left on the server")
+	}
+	if err := b.Lock("doc.odt", []byte("b"), 0, 0, locking.F_WRLCK); err != nil {
+		t.Fatalf("Lock after release failed: %v", err)
+	}
+}
+
+func TestServerLockKeptAcrossSaveByRename(t *testing.T) {
+	a, b, backend := newLockingClients(t, 0)
+	backend.Set("doc.odt", []byte("v1"))
+
+	if err := a.Lock("doc.odt", []byte("a"), 0, 0, locking.F_WRLCK); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	// save to a temporary file and move it over the locked document
+	if err := a.Write("~doc.tmp", []byte("v2")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := a.Rename("~doc.tmp", "doc.odt"); err != nil {
+		t.Fatalf("Rename onto the locked file failed: %v", err)
+	}
+	if data, _ := backend.Get("doc.odt"); string(data) != "v2" {
+		t.Fatalf("server holds %q", data)
+	}
+	if err := b.Lock("doc.odt", []byte("b"), 0, 0, locking.F_WRLCK); !errors.Is(err, locking.ErrWouldBlock) {
+		t.Fatalf("lock lost with the rename: %v", err)
+	}
+	if err := a.Write("doc.odt", []byte("v3")); err != nil {
+		t.Fatalf("write after the rename failed: %v", err)
+	}
+}
+
+func TestServerLockRefreshed(t *testing.T) {
+	a, b, backend := newLockingClients(t, 2*time.Second)
+	backend.Set("doc.odt", []byte("v1"))
+
+	if err := a.Lock("doc.odt", []byte("a"), 0, 0, locking.F_WRLCK); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	time.Sleep(2500 * time.Millisecond)
+	if n := backend.Count("LOCK"); n < 2 {
+		t.Fatalf("lock not refreshed, %d LOCK requests", n)
+	}
+	if err := b.Lock("doc.odt", []byte("b"), 0, 0, locking.F_WRLCK); !errors.Is(err, locking.ErrWouldBlock) {
+		t.Fatalf("lock expired while held: %v", err)
+	}
+}
+
+func TestServerLockWaitForOtherClient(t *testing.T) {
+	a, b, backend := newLockingClients(t, 0)
+	backend.Set("doc.odt", []byte("v1"))
+
+	if err := a.Lock("doc.odt", []byte("a"), 0, 0, locking.F_WRLCK); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_ = a.Unlock("doc.odt", []byte("a"), 0, 0)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.LockWait(ctx, "doc.odt", []byte("b"), 0, 0, locking.F_WRLCK); err != nil {
+		t.Fatalf("LockWait failed: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := a.LockWait(ctx, "doc.odt", []byte("a"), 0, 0, locking.F_WRLCK); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait to time out, got %v", err)
+	}
+	// the local lock taken for the failed wait was released
+	if a.Query("doc.odt", 0, 0) != nil {
+		t.Fatalf("local lock left after the failed wait")
+	}
+}
+
+func TestServerLockKeptWhileAnotherOwnerUnlocks(t *testing.T) {
+	a, _, backend := newLockingClients(t, 0)
+	backend.Set("doc.odt", []byte("v1"))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 50 {
+			_ = a.Lock("doc.odt", []byte("y"), 100, 110, locking.F_WRLCK)
+			_ = a.Unlock("doc.odt", []byte("y"), 100, 110)
+		}
+	}()
+	for range 50 {
+		if err := a.Lock("doc.odt", []byte("z"), 0, 10, locking.F_WRLCK); err != nil {
+			t.Fatalf("Lock failed: %v", err)
+		}
+		if backend.LockToken("doc.odt") == "" {
+			t.Fatalf("server lock dropped while a write lock is held")
+		}
+		if err := a.Unlock("doc.odt", []byte("z"), 0, 10); err != nil {
+			t.Fatalf("Unlock failed: %v", err)
+		}
+	}
+	wg.Wait()
+	if backend.LockToken("doc.odt") != "" {
+		t.Fatalf("lock left on the server")
+	}
+}
+
+func TestServerLockTakenAgainDuringUnlock(t *testing.T) {
+	a, _, backend := newLockingClients(t, 0)
+	backend.Set("doc.odt", []byte("v1"))
+	backend.Fail = func(r *http.Request) int {
+		if r.Method == "UNLOCK" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return 0
+	}
+
+	if err := a.Lock("doc.odt", []byte("y"), 0, 0, locking.F_WRLCK); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	unlocked := make(chan error, 1)
+	go func() { unlocked <- a.Unlock("doc.odt", []byte("y"), 0, 0) }()
+	time.Sleep(50 * time.Millisecond)
+
+	// the UNLOCK is still on its way
+	if err := a.Lock("doc.odt", []byte("z"), 0, 0, locking.F_WRLCK); err != nil {
+		t.Fatalf("Lock during the UNLOCK failed: %v", err)
+	}
+	if err := <-unlocked; err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if backend.LockToken("doc.odt") == "" {
+		t.Fatalf("no lock on the server for the write lock held")
+	}
+	if err := a.Write("doc.odt", []byte("v2")); err != nil {
+		t.Fatalf("Write under the new lock failed: %v", err)
+	}
+}
+
+func TestServerLockRequestDoesNotBlockWrites(t *testing.T) {
+	a, _, backend := newLockingClients(t, 0)
+	backend.Set("doc.odt", []byte("v1"))
+	backend.Fail = func(r *http.Request) int {
+		if r.Method == "LOCK" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return 0
+	}
+
+	locked := make(chan error, 1)
+	go func() { locked <- a.Lock("doc.odt", []byte("a"), 0, 0, locking.F_WRLCK) }()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if err := a.Write("other.txt", []byte("x")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Fatalf("write waited %v for a LOCK of another file", d)
+	}
+	if err := <-locked; err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+}
+
+func TestServerLockFailureKeepsReadLock(t *testing.T) {
+	a, b, backend := newLockingClients(t, 0)
+	backend.Set("doc.odt", []byte("v1"))
+
+	if err := b.Lock("doc.odt", []byte("b"), 0, 0, locking.F_WRLCK); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	if err := a.Lock("doc.odt", []byte("a"), 0, 100, locking.F_RDLCK); err != nil {
+		t.Fatalf("read lock failed: %v", err)
+	}
+	// the upgrade fails on the server, the read lock stays
+	if err := a.Lock("doc.odt", []byte("a"), 0, 0, locking.F_WRLCK); !errors.Is(err, locking.ErrWouldBlock) {
+		t.Fatalf("upgrade got the lock: %v", err)
+	}
+	info := a.Query("doc.odt", 0, 0)
+	if info == nil || info.Type != locking.F_RDLCK || info.Start != 0 || info.End != 100 {
+		t.Fatalf("lock after the failed upgrade: %+v", info)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := a.LockWait(ctx, "doc.odt", []byte("a"), 50, 200, locking.F_WRLCK); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait to time out, got %v", err)
+	}
+	info = a.Query("doc.odt", 0, 0)
+	if info == nil || info.Type != locking.F_RDLCK || info.Start != 0 || info.End != 100 {
+		t.Fatalf("lock after the failed wait: %+v", info)
+	}
+	if a.Query("doc.odt", 100, 0) != nil {
+		t.Fatalf("lock left beyond the read lock")
+	}
+}
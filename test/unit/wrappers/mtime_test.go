@@ -0,0 +1,98 @@
+package wrappers
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mimic/internal/core/wrappers"
+)
+
+var mtime = time.Date(2020, 5, 17, 12, 30, 0, 0, time.UTC)
+
+func TestModTimedUploadKeepsTime(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+	backend.OCMTime = true
+
+	_, err := wc.Guarded("a.txt", "", func() error {
+		return wc.ModTimed("a.txt", mtime, func() error {
+			return wc.WriteFrom("a.txt", bytes.NewReader([]byte("abc")), 3)
+		})
+	})
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if got := backend.ModTime("a.txt"); !got.Equal(mtime) {
+		t.Fatalf("server mtime %v, want %v", got, mtime)
+	}
+	if backend.Count("PROPPATCH") != 0 {
+		t.Fatalf("X-OC-MTime was accepted, no PROPPATCH expected")
+	}
+}
+
+func TestModTimedFallsBackToProppatch(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+
+	err := wc.ModTimed("a.txt", mtime, func() error {
+		return wc.WriteFrom("a.txt", bytes.NewReader([]byte("abc")), 3)
+	})
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if got := backend.ModTime("a.txt"); !got.Equal(mtime) {
+		t.Fatalf("server mtime %v, want %v", got, mtime)
+	}
+	// lastmodified was tried first and does not linger as a dead property
+	if _, ok := backend.Prop("a.txt", xml.Name{Space: "DAV:", Local: "lastmodified"}); ok {
+		t.Fatalf("dead lastmodified property left behind")
+	}
+}
+
+func TestSetModTimeUpdatesCache(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+	backend.OCMTime = true
+	backend.Set("docs/a.txt", []byte("a"))
+	names(t, wc, "/docs")
+
+	if err := wc.SetModTime("/docs/a.txt", mtime); err != nil {
+		t.Fatalf("SetModTime failed: %v", err)
+	}
+	if got := backend.ModTime("docs/a.txt"); !got.Equal(mtime) {
+		t.Fatalf("server mtime %v, want %v", got, mtime)
+	}
+	propfinds := backend.Count("PROPFIND")
+	fi, err := wc.Stat("/docs/a.txt")
+	if err != nil || !fi.ModTime().Equal(mtime) {
+		t.Fatalf("Stat = %v, %v", fi, err)
+	}
+	if backend.Count("PROPFIND") != propfinds {
+		t.Fatalf("Stat after SetModTime went to the server")
+	}
+	infos, err := wc.ReadDir("/docs")
+	if err != nil || len(infos) != 1 || !infos[0].ModTime().Equal(mtime) {
+		t.Fatalf("listing kept the old time: %v, %v", infos, err)
+	}
+}
+
+func TestSetModTimeUnsupported(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+	backend.NoDeadProps = true
+	backend.Set("a.txt", []byte("a"))
+
+	if err := wc.SetModTime("a.txt", mtime); !errors.Is(err, wrappers.ErrModTimeUnsupported) {
+		t.Fatalf("expected ErrModTimeUnsupported, got %v", err)
+	}
+	patches := backend.Count("PROPPATCH")
+	if err := wc.SetModTime("a.txt", mtime); !errors.Is(err, wrappers.ErrModTimeUnsupported) {
+		t.Fatalf("expected ErrModTimeUnsupported, got %v", err)
+	}
+	if backend.Count("PROPPATCH") != patches {
+		t.Fatalf("server asked again after it refused")
+	}
+}
@@ -0,0 +1,88 @@
+package wrappers
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mimic/internal/core/helpers"
+)
+
+func TestStatCachesMissingPaths(t *testing.T) {
+	wc, _, seen, cleanup := newRevalidatingWrapper(t)
+	defer cleanup()
+
+	for range 3 {
+		if _, err := wc.Stat("nope.txt"); !helpers.IsNotExistErr(err) {
+			t.Fatalf("expected not found, got %v", err)
+		}
+	}
+	if d := seen(); len(d) != 1 {
+		t.Fatalf("expected a single PROPFIND, got %v", d)
+	}
+}
+
+func TestStatAnswersFromListing(t *testing.T) {
+	wc, backend, seen, cleanup := newRevalidatingWrapper(t)
+	defer cleanup()
+
+	backend.Set("docs/a.txt", []byte("a"))
+	names(t, wc, "/docs")
+	seen()
+
+	if _, err := wc.Stat("/docs/b.txt"); !helpers.IsNotExistErr(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if d := seen(); len(d) != 0 {
+		t.Fatalf("expected no request, got %v", d)
+	}
+}
+
+func TestChangesClearMissingPaths(t *testing.T) {
+	wc, _, _, cleanup := newRevalidatingWrapper(t)
+	defer cleanup()
+
+	stat := func(name string) error {
+		t.Helper()
+		_, err := wc.Stat(name)
+		return err
+	}
+	for _, name := range []string{"/new.txt", "/dir", "/moved.txt"} {
+		if err := stat(name); !helpers.IsNotExistErr(err) {
+			t.Fatalf("%s: expected not found, got %v", name, err)
+		}
+	}
+
+	if err := wc.Create("/new.txt"); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := wc.Mkdir("/dir", os.ModePerm); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := wc.Rename("/new.txt", "/moved.txt"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+
+	for _, name := range []string{"/dir", "/moved.txt"} {
+		if err := stat(name); err != nil {
+			t.Fatalf("%s: still missing after the change: %v", name, err)
+		}
+	}
+	if err := stat("/new.txt"); !helpers.IsNotExistErr(err) {
+		t.Fatalf("renamed file still found: %v", err)
+	}
+}
+
+func TestStatMissingNameWithDigits(t *testing.T) {
+	wc, _, seen, cleanup := newRevalidatingWrapper(t)
+	defer cleanup()
+
+	// "200" in the name is not the status of the reply
+	for range 3 {
+		if _, err := wc.Stat("/photos/2000.jpg"); !helpers.IsNotExistErr(err) {
+			t.Fatalf("expected not found, got %v", err)
+		}
+	}
+	if d := seen(); len(d) != 1 {
+		t.Fatalf("expected a single PROPFIND, got %v", d)
+	}
+}
@@ -0,0 +1,77 @@
+package wrappers
+
+import (
+	"testing"
+
+	"github.com/mimic/internal/core/casters"
+	"github.com/mimic/internal/core/helpers"
+)
+
+func TestSetModeAndOwnerRoundTrip(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+
+	backend.Set("bin/run.sh", []byte("#!/bin/sh\n"))
+	backend.Set("bin/other", []byte("x"))
+	if _, err := wc.Stat("bin/run.sh"); err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+
+	if err := wc.SetMode("bin/run.sh", 0o100755); err != nil {
+		t.Fatalf("SetMode failed: %v", err)
+	}
+	uid := uint32(0)
+	if err := wc.SetOwner("bin/run.sh", &uid, nil); err != nil {
+		t.Fatalf("SetOwner failed: %v", err)
+	}
+
+	// the cached attributes follow without another PROPFIND
+	fi, err := wc.Stat("bin/run.sh")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if fi.Mode().Perm() != 0o755 {
+		t.Fatalf("cached mode %v", fi.Mode())
+	}
+
+	infos, err := wc.ReadDir("bin")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	for _, fi := range infos {
+		perm, u, g := casters.Ownership(fi)
+		switch fi.Name() {
+		case "run.sh":
+			if perm == nil || *perm != 0o755 || u == nil || *u != 0 || g != nil {
+				t.Fatalf("listing reports perm=%v uid=%v gid=%v", perm, u, g)
+			}
+		case "other":
+			if perm != nil || u != nil || g != nil {
+				t.Fatalf("unchanged file reports perm=%v uid=%v gid=%v", perm, u, g)
+			}
+		}
+	}
+
+	// an upload replaces the content, not the properties
+	if err := wc.Write("bin/run.sh", []byte("#!/bin/sh\nexit 0\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	fi, err = wc.Stat("bin/run.sh")
+	if err != nil || fi.Mode().Perm() != 0o755 {
+		t.Fatalf("after upload mode=%v err=%v", fi.Mode(), err)
+	}
+}
+
+func TestSetModeWithoutDeadProperties(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+	backend.NoDeadProps = true
+
+	backend.Set("a.sh", []byte("x"))
+	if err := wc.SetMode("a.sh", 0o755); !helpers.IsForbiddenErr(err) {
+		t.Fatalf("expected forbidden, got %v", err)
+	}
+	if fi, err := wc.Stat("a.sh"); err != nil || fi.Mode().Perm() != 0o664 {
+		t.Fatalf("mode=%v err=%v", fi.Mode(), err)
+	}
+}
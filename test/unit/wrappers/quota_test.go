@@ -0,0 +1,44 @@
+package wrappers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mimic/internal/core/helpers"
+	"github.com/mimic/internal/core/wrappers"
+)
+
+func TestQuotaReported(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+	backend.Quota = 100
+
+	backend.Set("a.txt", make([]byte, 30))
+	backend.Set("docs/b.txt", make([]byte, 10))
+	used, available, err := wc.Quota()
+	if err != nil || used != 40 || available != 60 {
+		t.Fatalf("Quota = %d, %d, %v; want 40, 60", used, available, err)
+	}
+
+	// the server refuses what does not fit
+	err = wc.Write("c.bin", make([]byte, 61))
+	if !helpers.IsInsufficientStorageErr(err) {
+		t.Fatalf("expected insufficient storage, got %v", err)
+	}
+	if _, ok := backend.Get("c.bin"); ok {
+		t.Fatalf("file stored beyond the quota")
+	}
+	if err := wc.Write("c.bin", make([]byte, 60)); err != nil {
+		t.Fatalf("Write within the quota failed: %v", err)
+	}
+}
+
+func TestQuotaUnsupported(t *testing.T) {
+	wc, _, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+
+	used, available, err := wc.Quota()
+	if !errors.Is(err, wrappers.ErrNoQuota) || used != -1 || available != -1 {
+		t.Fatalf("Quota = %d, %d, %v; want ErrNoQuota", used, available, err)
+	}
+}
@@ -0,0 +1,138 @@
+package wrappers
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mimic/internal/core/cache"
+	"github.com/mimic/internal/core/wrappers"
+	"github.com/mimic/test/utils/memserver"
+)
+
+const shortTTL = 30 * time.Millisecond
+
+// newRevalidatingWrapper returns a wrapper whose cache entries expire after
+// shortTTL and a function reporting the Depth of the PROPFINDs sent so far.
+func newRevalidatingWrapper(t *testing.T) (*wrappers.WebdavClient, *memserver.MemBackend, func() []string, func()) {
+	t.Helper()
+	srv, backend := memserver.NewTestServer()
+	var (
+		mu     sync.Mutex
+		depths []string
+	)
+	backend.Fail = func(r *http.Request) int {
+		if r.Method == "PROPFIND" {
+			mu.Lock()
+			depths = append(depths, r.Header.Get("Depth"))
+			mu.Unlock()
+		}
+		return 0
+	}
+	seen := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		out := depths
+		depths = nil
+		return out
+	}
+	wc := wrappers.NewWebdavClient(cache.NewNodeCache(shortTTL, 100), srv.URL, "", "")
+	seen()
+	return wc, backend, seen, func() { srv.Close() }
+}
+
+func names(t *testing.T, wc *wrappers.WebdavClient, dir string) map[string]bool {
+	t.Helper()
+	infos, err := wc.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir %s failed: %v", dir, err)
+	}
+	out := make(map[string]bool)
+	for _, fi := range infos {
+		out[fi.Name()] = true
+	}
+	return out
+}
+
+func TestReadDirRevalidatesUnchangedListing(t *testing.T) {
+	wc, backend, seen, cleanup := newRevalidatingWrapper(t)
+	defer cleanup()
+
+	backend.Set("docs/a.txt", []byte("a"))
+	backend.Set("docs/b.txt", []byte("b"))
+
+	if got := names(t, wc, "/docs"); len(got) != 2 {
+		t.Fatalf("listing: %v", got)
+	}
+	seen()
+
+	time.Sleep(2 * shortTTL)
+	if got := names(t, wc, "/docs"); len(got) != 2 {
+		t.Fatalf("revalidated listing: %v", got)
+	}
+	if d := seen(); len(d) != 1 || d[0] != "0" {
+		t.Fatalf("expected a single Depth 0 PROPFIND, got %v", d)
+	}
+
+	// a change below the collection fails the check
+	time.Sleep(2 * shortTTL)
+	backend.Set("docs/c.txt", []byte("c"))
+	if got := names(t, wc, "/docs"); !got["c.txt"] {
+		t.Fatalf("stale listing served after a change: %v", got)
+	}
+	if d := seen(); len(d) < 2 || d[len(d)-1] != "1" {
+		t.Fatalf("expected the collection to be listed again, got %v", d)
+	}
+}
+
+func TestReadDirWithoutCollectionTags(t *testing.T) {
+	wc, backend, seen, cleanup := newRevalidatingWrapper(t)
+	defer cleanup()
+	backend.NoCollectionTags = true
+
+	backend.Set("docs/a.txt", []byte("a"))
+	names(t, wc, "/docs")
+	seen()
+
+	time.Sleep(2 * shortTTL)
+	backend.Set("docs/b.txt", []byte("b"))
+	if got := names(t, wc, "/docs"); !got["b.txt"] {
+		t.Fatalf("stale listing served: %v", got)
+	}
+	// the server was probed once and is not asked for tags again
+	if d := seen(); len(d) != 1 || d[0] != "1" {
+		t.Fatalf("expected only the listing, got %v", d)
+	}
+}
+
+func TestStatRevalidatesWithETag(t *testing.T) {
+	wc, backend, seen, cleanup := newRevalidatingWrapper(t)
+	defer cleanup()
+
+	backend.Set("f.txt", []byte("12345"))
+	if _, err := wc.Stat("f.txt"); err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+
+	time.Sleep(2 * shortTTL)
+	seen()
+	fi, err := wc.Stat("f.txt")
+	if err != nil || fi.Size() != 5 {
+		t.Fatalf("revalidated Stat: size=%v err=%v", fi, err)
+	}
+	// a conditional HEAD, no PROPFIND
+	if d := seen(); len(d) != 0 || backend.Count("HEAD") != 1 {
+		t.Fatalf("expected only a HEAD, got PROPFINDs %v and %d HEADs", d, backend.Count("HEAD"))
+	}
+
+	time.Sleep(2 * shortTTL)
+	backend.Set("f.txt", []byte("1234567"))
+	fi, err = wc.Stat("f.txt")
+	if err != nil || fi.Size() != 7 {
+		t.Fatalf("Stat after change: %v err=%v", fi, err)
+	}
+	if d := seen(); len(d) != 1 || backend.Count("HEAD") != 2 {
+		t.Fatalf("expected a failed check and a new Stat, got PROPFINDs %v and %d HEADs", d, backend.Count("HEAD"))
+	}
+}
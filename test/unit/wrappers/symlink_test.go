@@ -0,0 +1,97 @@
+package wrappers
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/mimic/internal/core/helpers"
+	"github.com/mimic/internal/core/wrappers"
+)
+
+func TestSymlinkRoundTrip(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+
+	backend.Set("docs/a.txt", []byte("a"))
+	if err := wc.Symlink("../docs/a.txt", "/links/a"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if data, _ := backend.Get("links/a"); string(data) != "../docs/a.txt" {
+		t.Fatalf("placeholder holds %q", data)
+	}
+
+	target, err := wc.Readlink("/links/a")
+	if err != nil || target != "../docs/a.txt" {
+		t.Fatalf("Readlink = %q, %v", target, err)
+	}
+	fi, err := wc.Stat("/links/a")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 || fi.Size() != int64(len(target)) {
+		t.Fatalf("unexpected attributes mode=%v size=%d", fi.Mode(), fi.Size())
+	}
+
+	infos, err := wc.ReadDir("/links")
+	if err != nil || len(infos) != 1 {
+		t.Fatalf("ReadDir = %v, %v", infos, err)
+	}
+	if infos[0].Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("listing reports mode %v", infos[0].Mode())
+	}
+
+	if _, err := wc.Readlink("/docs/a.txt"); !errors.Is(err, wrappers.ErrNotSymlink) {
+		t.Fatalf("expected ErrNotSymlink, got %v", err)
+	}
+}
+
+func TestSymlinkTargetWithEntities(t *testing.T) {
+	wc, _, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+
+	// the property value travels escaped both ways
+	const target = `it's & <odd> "name"`
+	if err := wc.Symlink(target, "/link"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	infos, err := wc.ReadDir("/")
+	if err != nil || len(infos) != 1 {
+		t.Fatalf("ReadDir = %v, %v", infos, err)
+	}
+	if got := infos[0].(interface{ Target() string }).Target(); got != target {
+		t.Fatalf("listing reports target %q", got)
+	}
+	if got, err := wc.Readlink("/link"); err != nil || got != target {
+		t.Fatalf("Readlink = %q, %v", got, err)
+	}
+}
+
+func TestSymlinkSurvivesRename(t *testing.T) {
+	wc, _, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+
+	if err := wc.Symlink("/etc/hosts", "old"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if err := wc.Rename("old", "new"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if target, err := wc.Readlink("new"); err != nil || target != "/etc/hosts" {
+		t.Fatalf("Readlink = %q, %v", target, err)
+	}
+}
+
+func TestSymlinkWithoutDeadProperties(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+	backend.NoDeadProps = true
+
+	err := wc.Symlink("target", "link")
+	if !helpers.IsForbiddenErr(err) {
+		t.Fatalf("expected forbidden, got %v", err)
+	}
+	if _, ok := backend.Get("link"); ok {
+		t.Fatalf("placeholder left behind")
+	}
+}
@@ -0,0 +1,200 @@
+package wrappers
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mimic/internal/core/cache"
+	"github.com/mimic/internal/core/wrappers"
+	"github.com/mimic/test/utils/memserver"
+)
+
+const watchInterval = 10 * time.Millisecond
+
+// changeLog collects what a Watch reported.
+type changeLog struct {
+	mu      sync.Mutex
+	changes map[string]string
+}
+
+func (l *changeLog) changed(name, etag string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.changes == nil {
+		l.changes = make(map[string]string)
+	}
+	l.changes[name] = etag
+}
+
+// wait returns the ETag reported for name, failing the test if it is not
+// reported in time.
+func (l *changeLog) wait(t *testing.T, name string) string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		l.mu.Lock()
+		etag, ok := l.changes[name]
+		l.mu.Unlock()
+		if ok {
+			return etag
+		}
+		time.Sleep(watchInterval)
+	}
+	t.Fatalf("no change reported for %s", name)
+	return ""
+}
+
+func (l *changeLog) names() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []string
+	for name := range l.changes {
+		out = append(out, name)
+	}
+	return out
+}
+
+// newWatchedWrapper returns a wrapper with long lived cache entries, so
+// only the watcher can make it notice remote changes.
+func newWatchedWrapper(t *testing.T, setup func(*memserver.MemBackend)) (*wrappers.WebdavClient, *memserver.MemBackend, *changeLog) {
+	t.Helper()
+	srv, backend := memserver.NewTestServer()
+	t.Cleanup(srv.Close)
+	if setup != nil {
+		setup(backend)
+	}
+	wc := wrappers.NewWebdavClient(cache.NewNodeCache(time.Hour, 100), srv.URL, "", "")
+	return wc, backend, &changeLog{}
+}
+
+func statSize(t *testing.T, wc *wrappers.WebdavClient, name string) int64 {
+	t.Helper()
+	fi, err := wc.Stat(name)
+	if err != nil {
+		t.Fatalf("Stat %s failed: %v", name, err)
+	}
+	return fi.Size()
+}
+
+func TestWatchSyncCollection(t *testing.T) {
+	wc, backend, log := newWatchedWrapper(t, func(b *memserver.MemBackend) {
+		b.Set("docs/a.txt", []byte("a"))
+		b.Set("docs/gone.txt", []byte("g"))
+	})
+	if statSize(t, wc, "/docs/a.txt") != 1 {
+		t.Fatalf("unexpected size")
+	}
+	names(t, wc, "/docs")
+
+	stop := wc.Watch(watchInterval, log.changed)
+	defer stop()
+	// let the watcher take its first token
+	time.Sleep(3 * watchInterval)
+
+	backend.Set("docs/a.txt", []byte("changed"))
+	backend.Set("docs/new.txt", []byte("n"))
+	if etag := log.wait(t, "/docs/a.txt"); etag != backend.ETag("docs/a.txt") {
+		t.Fatalf("reported etag %q, want %q", etag, backend.ETag("docs/a.txt"))
+	}
+	if statSize(t, wc, "/docs/a.txt") != 7 {
+		t.Fatalf("cached attributes survived the remote change")
+	}
+	if got := names(t, wc, "/docs"); !got["new.txt"] {
+		t.Fatalf("listing misses the new file: %v", got)
+	}
+	if backend.Count("REPORT") == 0 {
+		t.Fatalf("expected sync-collection to be used")
+	}
+
+	if _, err := wc.Stat("/docs/gone.txt"); err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	backend.Delete("docs/gone.txt")
+	if etag := log.wait(t, "/docs/gone.txt"); etag != "" {
+		t.Fatalf("removal reported with etag %q", etag)
+	}
+	if _, err := wc.Stat("/docs/gone.txt"); err == nil {
+		t.Fatalf("removed file still cached")
+	}
+}
+
+func TestWatchExpiredSyncToken(t *testing.T) {
+	wc, backend, log := newWatchedWrapper(t, func(b *memserver.MemBackend) {
+		b.Set("a.txt", []byte("a"))
+	})
+	statSize(t, wc, "/a.txt")
+
+	stop := wc.Watch(watchInterval, log.changed)
+	defer stop()
+	time.Sleep(3 * watchInterval)
+
+	backend.ForgetSyncTokens()
+	backend.Set("a.txt", []byte("abc"))
+	deadline := time.Now().Add(2 * time.Second)
+	for statSize(t, wc, "/a.txt") != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("cache not dropped after the sync token expired")
+		}
+		time.Sleep(watchInterval)
+	}
+	// the caller is told that anything may have changed
+	if etag := log.wait(t, "/"); etag != "" {
+		t.Fatalf("tree change reported with etag %q", etag)
+	}
+}
+
+func TestWatchStartsWithoutListingTheTree(t *testing.T) {
+	wc, backend, log := newWatchedWrapper(t, func(b *memserver.MemBackend) {
+		for _, name := range []string{"a.txt", "docs/b.txt", "docs/sub/c.txt"} {
+			b.Set(name, []byte(name))
+		}
+	})
+
+	stop := wc.Watch(time.Hour, log.changed)
+	defer stop()
+	deadline := time.Now().Add(2 * time.Second)
+	for backend.Count("PROPFIND") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("watcher did not ask for a sync token")
+		}
+		time.Sleep(watchInterval)
+	}
+	if n := backend.Count("REPORT"); n != 0 {
+		t.Fatalf("first sync token taken with %d REPORTs", n)
+	}
+}
+
+func TestWatchFallsBackToCollectionTags(t *testing.T) {
+	wc, backend, log := newWatchedWrapper(t, func(b *memserver.MemBackend) {
+		b.NoSyncCollection = true
+		b.Set("docs/a.txt", []byte("a"))
+		b.Set("docs/b.txt", []byte("b"))
+		b.Set("other/c.txt", []byte("c"))
+	})
+	statSize(t, wc, "/docs/a.txt")
+
+	stop := wc.Watch(watchInterval, log.changed)
+	defer stop()
+	time.Sleep(3 * watchInterval)
+
+	// the first change below docs drops everything cached there
+	backend.Set("docs/a.txt", []byte("changed"))
+	log.wait(t, "/docs/a.txt")
+	if statSize(t, wc, "/docs/a.txt") != 7 {
+		t.Fatalf("cached attributes survived the remote change")
+	}
+
+	// once docs was listed, only the member that differs is reported
+	log.mu.Lock()
+	log.changes = nil
+	log.mu.Unlock()
+	backend.Set("docs/b.txt", []byte("bb"))
+	if etag := log.wait(t, "/docs/b.txt"); etag != backend.ETag("docs/b.txt") {
+		t.Fatalf("reported etag %q, want %q", etag, backend.ETag("docs/b.txt"))
+	}
+	time.Sleep(3 * watchInterval)
+	if got := log.names(); len(got) != 1 {
+		t.Fatalf("expected only docs/b.txt, got %v", got)
+	}
+}
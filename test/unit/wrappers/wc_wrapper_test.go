@@ -2,10 +2,13 @@ package wrappers
 
 import (
 	"bytes"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/mimic/internal/core/cache"
+	"github.com/mimic/internal/core/helpers"
 	"github.com/mimic/internal/core/wrappers"
 	"github.com/mimic/test/utils/memserver"
 )
@@ -71,6 +74,30 @@ func TestReadRange(t *testing.T) {
 	}
 }
 
+func TestReadRangeVersion(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+
+	name := "alphabet.txt"
+	data := []byte("abcdefghijklmnopqrstuvwxyz")
+	backend.Set(name, data)
+
+	rb, etag, err := wc.ReadRangeVersion(name, 20, 10)
+	if err != nil {
+		t.Fatalf("ReadRangeVersion failed: %v", err)
+	}
+	if !bytes.Equal(rb, data[20:]) {
+		t.Fatalf("range mismatch: got=%q want=%q", rb, data[20:])
+	}
+	if etag != backend.ETag(name) {
+		t.Fatalf("etag %q, want %q", etag, backend.ETag(name))
+	}
+
+	if _, _, err := wc.ReadRangeVersion("missing.txt", 0, 10); !helpers.IsNotExistErr(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
 func TestWriteOffsetMergeAndExtend(t *testing.T) {
 	wc, backend, cleanup := newWrapperWithServer(t)
 	defer cleanup()
@@ -115,3 +142,191 @@ func TestCreateRejectsDirPath(t *testing.T) {
 		t.Fatalf("expected error when creating with trailing slash")
 	}
 }
+
+func TestWriteOffsetSabrePatch(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+	backend.SabrePatch = true
+
+	name := "log.txt"
+	backend.Set(name, []byte("HelloWorld"))
+
+	// in place update and an append at the current end
+	if err := wc.WriteOffset(name, []byte("123"), 5); err != nil {
+		t.Fatalf("WriteOffset failed: %v", err)
+	}
+	if err := wc.WriteOffset(name, []byte("++"), 10); err != nil {
+		t.Fatalf("WriteOffset append failed: %v", err)
+	}
+
+	got, _ := backend.Get(name)
+	if !bytes.Equal(got, []byte("Hello123ld++")) {
+		t.Fatalf("unexpected content: %q", got)
+	}
+	if n := backend.Count("PATCH"); n != 2 {
+		t.Fatalf("expected 2 PATCH requests, got %d", n)
+	}
+	if n := backend.Count("GET"); n != 0 {
+		t.Fatalf("partial updates should not download the file, got %d GETs", n)
+	}
+}
+
+func TestWriteOffsetContentRangePut(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+	backend.ContentRangePut = true
+
+	name := "big.bin"
+	backend.Set(name, bytes.Repeat([]byte{'a'}, 1<<20))
+
+	if err := wc.WriteOffset(name, []byte("XYZ"), 1000); err != nil {
+		t.Fatalf("WriteOffset failed: %v", err)
+	}
+
+	got, _ := backend.Get(name)
+	if len(got) != 1<<20 || string(got[1000:1003]) != "XYZ" || got[999] != 'a' || got[1003] != 'a' {
+		t.Fatalf("unexpected content around offset 1000: %q", got[995:1008])
+	}
+	// the only GET allowed is the one verifying the capability probe
+	if n := backend.Count("GET"); n > 1 {
+		t.Fatalf("partial PUT should not download the file, got %d GETs", n)
+	}
+}
+
+func TestWriteOffsetIgnoredContentRangeFallsBack(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+	// server accepts Content-Range PUTs but replaces the file with the body
+	backend.IgnoreContentRange = true
+
+	name := "merge.txt"
+	backend.Set(name, []byte("HelloWorld"))
+
+	if err := wc.WriteOffset(name, []byte("123"), 5); err != nil {
+		t.Fatalf("WriteOffset failed: %v", err)
+	}
+	got, _ := backend.Get(name)
+	if !bytes.Equal(got, []byte("Hello123ld")) {
+		t.Fatalf("probe should detect the broken server and fall back, got %q", got)
+	}
+}
+
+func TestWriteOffsetPastEndFallsBack(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+	backend.SabrePatch = true
+
+	name := "hole.txt"
+	backend.Set(name, []byte("abc"))
+
+	if err := wc.WriteOffset(name, []byte("Z"), 6); err != nil {
+		t.Fatalf("WriteOffset failed: %v", err)
+	}
+	got, _ := backend.Get(name)
+	if !bytes.Equal(got, []byte("abc\x00\x00\x00Z")) {
+		t.Fatalf("unexpected content: %q", got)
+	}
+}
+
+func TestTruncateToZeroIsSinglePut(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+
+	backend.Set("big.bin", bytes.Repeat([]byte("x"), 1<<20))
+	if err := wc.Truncate("big.bin", 0); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if got, _ := backend.Get("big.bin"); len(got) != 0 {
+		t.Fatalf("expected empty file, got %d bytes", len(got))
+	}
+	if n := backend.Count("GET"); n != 0 {
+		t.Fatalf("truncate to zero must not download, got %d GETs", n)
+	}
+}
+
+func TestTruncateShrinkAndExtend(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+
+	backend.SabrePatch = true
+	backend.Set("f.txt", []byte("HelloWorld"))
+
+	if err := wc.Truncate("f.txt", 5); err != nil {
+		t.Fatalf("Truncate shrink failed: %v", err)
+	}
+	if got, _ := backend.Get("f.txt"); string(got) != "Hello" {
+		t.Fatalf("after shrink: got %q", got)
+	}
+
+	gets := backend.Count("GET")
+	if err := wc.Truncate("f.txt", 8); err != nil {
+		t.Fatalf("Truncate extend failed: %v", err)
+	}
+	if got, _ := backend.Get("f.txt"); !bytes.Equal(got, []byte("Hello\x00\x00\x00")) {
+		t.Fatalf("after extend: got %q", got)
+	}
+	if n := backend.Count("GET") - gets; n != 0 {
+		t.Fatalf("extend with partial updates must not download, got %d GETs", n)
+	}
+}
+
+func TestTruncateExtendWithoutPartialUpdates(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+
+	backend.Set("f.txt", []byte("Hello"))
+	// large enough to be streamed
+	size := int64(5 << 20)
+	if err := wc.Truncate("f.txt", size); err != nil {
+		t.Fatalf("Truncate extend failed: %v", err)
+	}
+	got, _ := backend.Get("f.txt")
+	if int64(len(got)) != size || string(got[:5]) != "Hello" || bytes.ContainsFunc(got[5:], func(r rune) bool { return r != 0 }) {
+		t.Fatalf("after extend: %d bytes, starting %q", len(got), got[:min(len(got), 8)])
+	}
+
+	if err := wc.Truncate("new.bin", 10); err != nil {
+		t.Fatalf("Truncate of a missing file failed: %v", err)
+	}
+	if got, _ := backend.Get("new.bin"); !bytes.Equal(got, make([]byte, 10)) {
+		t.Fatalf("created %q", got)
+	}
+}
+
+func TestPartialProbeNextToTheFile(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+	backend.ContentRangePut = true
+
+	failedDelete, downloaded := false, false
+	backend.Fail = func(r *http.Request) int {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/docs/big.bin":
+			downloaded = true
+		case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/.mimic-probe"):
+			// the root is read-only
+			return http.StatusForbidden
+		case r.Method == http.MethodDelete && !failedDelete:
+			failedDelete = true
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	}
+
+	name := "docs/big.bin"
+	backend.Set(name, bytes.Repeat([]byte("a"), 1<<20))
+	if err := wc.WriteOffset(name, []byte("XYZ"), 1000); err != nil {
+		t.Fatalf("WriteOffset failed: %v", err)
+	}
+	if got, _ := backend.Get(name); string(got[999:1004]) != "aXYZa" {
+		t.Fatalf("unexpected content around offset 1000: %q", got[995:1008])
+	}
+	if downloaded {
+		t.Fatalf("partial PUT should not download the file")
+	}
+	for k := range backend.M {
+		if strings.Contains(k, ".mimic-probe") {
+			t.Fatalf("probe file left behind: %s", k)
+		}
+	}
+}
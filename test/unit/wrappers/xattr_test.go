@@ -0,0 +1,65 @@
+package wrappers
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"testing"
+
+	"github.com/mimic/internal/core/wrappers"
+)
+
+func TestXattrRoundTrip(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+	backend.Set("a.txt", []byte("a"))
+
+	binary := []byte{0, 1, 2, 0xff}
+	if err := wc.SetXattr("a.txt", "user.tag", []byte("red & blue")); err != nil {
+		t.Fatalf("SetXattr failed: %v", err)
+	}
+	if err := wc.SetXattr("a.txt", "user.odd name:x", binary); err != nil {
+		t.Fatalf("SetXattr failed: %v", err)
+	}
+	// text values stay readable for other clients
+	if v, ok := backend.Prop("a.txt", xml.Name{Space: "urn:mimic:xattr:", Local: "user.tag"}); !ok || v != "red & blue" {
+		t.Fatalf("stored property %q ok=%v", v, ok)
+	}
+
+	attrs, err := wc.Xattrs("a.txt")
+	if err != nil {
+		t.Fatalf("Xattrs failed: %v", err)
+	}
+	if string(attrs["user.tag"]) != "red & blue" || !bytes.Equal(attrs["user.odd name:x"], binary) {
+		t.Fatalf("unexpected attributes %q", attrs)
+	}
+	if string(attrs["user.dav.etag"]) != backend.ETag("a.txt") {
+		t.Fatalf("user.dav.etag = %q, want %q", attrs["user.dav.etag"], backend.ETag("a.txt"))
+	}
+
+	if err := wc.RemoveXattr("a.txt", "user.tag"); err != nil {
+		t.Fatalf("RemoveXattr failed: %v", err)
+	}
+	if _, err := wc.Xattr("a.txt", "user.tag"); !errors.Is(err, wrappers.ErrNoXattr) {
+		t.Fatalf("expected ErrNoXattr, got %v", err)
+	}
+	if err := wc.RemoveXattr("a.txt", "user.tag"); !errors.Is(err, wrappers.ErrNoXattr) {
+		t.Fatalf("expected ErrNoXattr removing twice, got %v", err)
+	}
+}
+
+func TestXattrNamespaces(t *testing.T) {
+	wc, backend, cleanup := newWrapperWithServer(t)
+	defer cleanup()
+	backend.Set("a.txt", []byte("a"))
+
+	if err := wc.SetXattr("a.txt", "user.dav.etag", []byte("x")); !errors.Is(err, wrappers.ErrXattrReadOnly) {
+		t.Fatalf("expected ErrXattrReadOnly, got %v", err)
+	}
+	if err := wc.SetXattr("a.txt", "security.selinux", []byte("x")); !errors.Is(err, wrappers.ErrXattrNotSupported) {
+		t.Fatalf("expected ErrXattrNotSupported, got %v", err)
+	}
+	if backend.Count("PROPPATCH") != 0 {
+		t.Fatalf("refused attributes reached the server")
+	}
+}
@@ -1,34 +1,125 @@
 package memserver
 
 import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // simple in-memory WebDAV-ish backend used by tests.
-// supports PUT (store), GET (full) and Range GET (partial).
+// supports PUT (store, optionally partial), PATCH (SabreDAV partial update),
+// GET (full, or 304 for a matching If-None-Match) and Range GET (partial), PROPFIND, MKCOL, DELETE, MOVE and COPY.
+// MOVE of "<dir>/.file" assembles the chunks in dir like Nextcloud's chunked
+// upload endpoint. PUT, PATCH and MOVE honour If-Match. REPORT answers
+// sync-collection (RFC 6578) by diffing against the state each token was
+// issued for. PROPPATCH stores dead properties, which PROPFIND reports and
+// MOVE and COPY carry along, and sets the modification time through
+// getlastmodified. LOCK and UNLOCK manage exclusive write locks, which
+// writes, MOVE, DELETE and PROPPATCH of a locked resource must submit in an
+// If header.
 type MemBackend struct {
-	mu sync.Mutex
-	M  map[string][]byte
+	mu       sync.Mutex
+	M        map[string][]byte
+	Dirs     map[string]bool
+	Modified map[string]time.Time
+	// Props holds the dead properties of a resource by key
+	Props map[string]map[xml.Name]string
+
+	// ContentRangePut makes PUT honour a Content-Range header (Apache style).
+	ContentRangePut bool
+	// IgnoreContentRange makes PUT replace the whole file with the body even
+	// when a Content-Range header is present, like servers that do not
+	// support partial PUT but do not reject it either.
+	IgnoreContentRange bool
+	// SabrePatch enables PATCH with X-Update-Range and advertises
+	// sabredav-partialupdate in the DAV header.
+	SabrePatch bool
+	// NoCollectionTags omits the oc:etag PROPFIND reports for collections.
+	NoCollectionTags bool
+	// NoSyncCollection makes REPORT fail like on servers without
+	// sync-collection support.
+	NoSyncCollection bool
+	// NoDeadProps makes PROPPATCH refuse every property, like servers
+	// that do not store dead properties.
+	NoDeadProps bool
+	// OCMTime makes PUT and the MOVE assembling a chunked upload honour
+	// X-OC-MTime and PROPPATCH of lastmodified set the modification time,
+	// like ownCloud and Nextcloud.
+	OCMTime bool
+	// EscapeETags writes the quotes of getetag as &quot; entities, like
+	// SabreDAV and Nextcloud.
+	EscapeETags bool
+
+	// Quota limits the bytes all files may take: writes beyond it fail
+	// with 507 Insufficient Storage and collections report
+	// quota-used-bytes and quota-available-bytes (RFC 4331). Zero means
+	// no quota, which is not reported.
+	Quota int64
+
+	// Fail, when set, is consulted before a request is handled; a non-zero
+	// status is returned to the client instead of handling the request.
+	Fail func(r *http.Request) int
+
+	// Requests counts handled requests per method.
+	Requests map[string]int
+
+	// syncs holds the state each sync token was issued for, by token index
+	syncs []map[string]string
+
+	// locks holds the write lock of a resource by key
+	locks     map[string]memLock
+	lockCount int
+}
+
+// memLock is an exclusive write lock.
+type memLock struct {
+	token   string
+	expires time.Time
 }
 
 func NewMemBackend() *MemBackend {
-	return &MemBackend{M: make(map[string][]byte)}
+	return &MemBackend{
+		M:        make(map[string][]byte),
+		Dirs:     make(map[string]bool),
+		Modified: make(map[string]time.Time),
+		Props:    make(map[string]map[xml.Name]string),
+		Requests: make(map[string]int),
+	}
 }
 
 func (b *MemBackend) Reset() {
 	b.mu.Lock()
 	b.M = make(map[string][]byte)
+	b.Dirs = make(map[string]bool)
+	b.Modified = make(map[string]time.Time)
+	b.Props = make(map[string]map[xml.Name]string)
+	b.Requests = make(map[string]int)
+	b.syncs = nil
+	b.locks = nil
+	b.mu.Unlock()
+}
+
+// ForgetSyncTokens makes every sync token issued so far invalid.
+func (b *MemBackend) ForgetSyncTokens() {
+	b.mu.Lock()
+	b.syncs = nil
 	b.mu.Unlock()
 }
 
 func (b *MemBackend) Set(key string, val []byte) {
 	b.mu.Lock()
 	b.M[key] = val
+	b.Modified[key] = time.Now()
 	b.mu.Unlock()
 }
 func (b *MemBackend) Get(key string) ([]byte, bool) {
@@ -38,8 +129,138 @@ func (b *MemBackend) Get(key string) ([]byte, bool) {
 	return val, ok
 }
 
+// Delete removes the file key, like another client deleting it.
+func (b *MemBackend) Delete(key string) {
+	b.mu.Lock()
+	delete(b.M, key)
+	delete(b.Modified, key)
+	delete(b.Props, key)
+	b.mu.Unlock()
+}
+
+// ModTime returns the modification time of key.
+func (b *MemBackend) ModTime(key string) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Modified[key]
+}
+
+// Prop returns the dead property name of key.
+func (b *MemBackend) Prop(key string, name xml.Name) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	v, ok := b.Props[key][name]
+	return v, ok
+}
+
+// Count returns how many requests with the given method were handled.
+func (b *MemBackend) Count(method string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Requests[method]
+}
+
+func etagOf(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// etagXMLLocked returns the getetag value of data as PROPFIND writes it.
+// Caller holds b.mu.
+func (b *MemBackend) etagXMLLocked(data []byte) string {
+	if b.EscapeETags {
+		return strings.ReplaceAll(etagOf(data), `"`, "&quot;")
+	}
+	return etagOf(data)
+}
+
+// ETag returns the entity tag the server reports for key.
+func (b *MemBackend) ETag(key string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return etagOf(b.M[key])
+}
+
+// ifMatchLocked reports whether the If-Match precondition of r holds for
+// key. Caller holds b.mu.
+func (b *MemBackend) ifMatchLocked(r *http.Request, key string) bool {
+	want := r.Header.Get("If-Match")
+	if want == "" {
+		return true
+	}
+	data, ok := b.M[key]
+	return ok && (want == "*" || want == etagOf(data))
+}
+
+// isDirLocked reports whether key names a collection. Caller holds b.mu.
+func (b *MemBackend) isDirLocked(key string) bool {
+	key = strings.Trim(key, "/")
+	if key == "" || b.Dirs[key] {
+		return true
+	}
+	prefix := key + "/"
+	for k := range b.M {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRange parses "bytes start-end[/total]" (Content-Range) or
+// "bytes=start-end" (X-Update-Range).
+func parseRange(v string) (start, end int64, ok bool) {
+	v = strings.TrimPrefix(v, "bytes=")
+	v = strings.TrimPrefix(v, "bytes ")
+	if i := strings.IndexByte(v, '/'); i >= 0 {
+		v = v[:i]
+	}
+	parts := strings.SplitN(v, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	start, err1 := strconv.ParseInt(parts[0], 10, 64)
+	end, err2 := strconv.ParseInt(parts[1], 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// splice writes body at offset into data, growing it when needed.
+func splice(data []byte, offset int64, body []byte) []byte {
+	end := offset + int64(len(body))
+	if end > int64(len(data)) {
+		grown := make([]byte, end)
+		copy(grown, data)
+		data = grown
+	} else {
+		data = append([]byte(nil), data...)
+	}
+	copy(data[offset:end], body)
+	return data
+}
+
 func (b *MemBackend) handler(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/")
+
+	b.mu.Lock()
+	b.Requests[r.Method]++
+	fail := b.Fail
+	b.mu.Unlock()
+
+	if fail != nil {
+		if code := fail(r); code != 0 {
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+	}
+
+	if b.lockedOut(r, strings.Trim(path, "/")) {
+		http.Error(w, "locked", http.StatusLocked)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodPut:
 		body, err := io.ReadAll(r.Body)
@@ -48,10 +269,86 @@ func (b *MemBackend) handler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		b.mu.Lock()
+		if !b.ifMatchLocked(r, path) {
+			b.mu.Unlock()
+			http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+		if cr := r.Header.Get("Content-Range"); cr != "" && !b.IgnoreContentRange {
+			if !b.ContentRangePut {
+				b.mu.Unlock()
+				http.Error(w, "partial put not supported", http.StatusNotImplemented)
+				return
+			}
+			start, _, ok := parseRange(cr)
+			cur, exists := b.M[path]
+			if !ok || !exists || start > int64(len(cur)) {
+				b.mu.Unlock()
+				http.Error(w, "range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			body = splice(cur, start, body)
+		}
+		if !b.fitsLocked(path, body) {
+			b.mu.Unlock()
+			http.Error(w, "insufficient storage", http.StatusInsufficientStorage)
+			return
+		}
 		b.M[path] = body
+		b.Modified[path] = b.mtimeLocked(w, r)
+		tag := etagOf(b.M[path])
 		b.mu.Unlock()
 		// respond like a WebDAV PUT might
+		w.Header().Set("ETag", tag)
 		w.WriteHeader(http.StatusCreated)
+	case "PATCH":
+		if !b.SabrePatch {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/x-sabredav-partialupdate" {
+			http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "read body", http.StatusInternalServerError)
+			return
+		}
+		b.mu.Lock()
+		cur, exists := b.M[path]
+		if !exists {
+			b.mu.Unlock()
+			http.NotFound(w, r)
+			return
+		}
+		if !b.ifMatchLocked(r, path) {
+			b.mu.Unlock()
+			http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+		var start int64
+		if ur := r.Header.Get("X-Update-Range"); ur == "append" {
+			start = int64(len(cur))
+		} else if s, _, ok := parseRange(ur); ok && s <= int64(len(cur)) {
+			start = s
+		} else {
+			b.mu.Unlock()
+			http.Error(w, "range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		body = splice(cur, start, body)
+		if !b.fitsLocked(path, body) {
+			b.mu.Unlock()
+			http.Error(w, "insufficient storage", http.StatusInsufficientStorage)
+			return
+		}
+		b.M[path] = body
+		b.Modified[path] = time.Now()
+		tag := etagOf(b.M[path])
+		b.mu.Unlock()
+		w.Header().Set("ETag", tag)
+		w.WriteHeader(http.StatusNoContent)
 	case http.MethodGet, http.MethodHead:
 		b.mu.Lock()
 		data, ok := b.M[path]
@@ -60,6 +357,11 @@ func (b *MemBackend) handler(w http.ResponseWriter, r *http.Request) {
 			http.NotFound(w, r)
 			return
 		}
+		w.Header().Set("ETag", etagOf(data))
+		if inm := r.Header.Get("If-None-Match"); inm != "" && (inm == "*" || strings.Contains(inm, etagOf(data))) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
 
 		// Range support
 		if rng := r.Header.Get("Range"); rng != "" {
@@ -101,14 +403,631 @@ func (b *MemBackend) handler(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
 			_, _ = w.Write(data)
 		}
+	case http.MethodDelete:
+		b.mu.Lock()
+		key := strings.Trim(path, "/")
+		_, file := b.M[key]
+		dir := b.isDirLocked(key)
+		delete(b.M, key)
+		delete(b.Modified, key)
+		delete(b.Props, key)
+		delete(b.locks, key)
+		if dir {
+			delete(b.Dirs, key)
+			for k := range b.M {
+				if strings.HasPrefix(k, key+"/") {
+					delete(b.M, k)
+				}
+			}
+			for k := range b.Props {
+				if strings.HasPrefix(k, key+"/") {
+					delete(b.Props, k)
+				}
+			}
+		}
+		b.mu.Unlock()
+		if !file && !dir {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "MKCOL":
+		b.mu.Lock()
+		key := strings.Trim(path, "/")
+		if b.isDirLocked(key) {
+			b.mu.Unlock()
+			http.Error(w, "exists", http.StatusMethodNotAllowed)
+			return
+		}
+		b.Dirs[key] = true
+		b.Modified[key] = time.Now()
+		b.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	case "MOVE", "COPY":
+		b.moveCopy(w, r, strings.Trim(path, "/"))
+	case "LOCK":
+		b.lock(w, r, strings.Trim(path, "/"))
+	case "UNLOCK":
+		b.mu.Lock()
+		l, ok := b.locks[strings.Trim(path, "/")]
+		if !ok || r.Header.Get("Lock-Token") != "<"+l.token+">" {
+			b.mu.Unlock()
+			http.Error(w, "no such lock", http.StatusConflict)
+			return
+		}
+		delete(b.locks, strings.Trim(path, "/"))
+		b.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case "PROPFIND":
+		b.propfind(w, r, strings.Trim(path, "/"))
+	case "PROPPATCH":
+		b.proppatch(w, r, strings.Trim(path, "/"))
+	case "REPORT":
+		if b.NoSyncCollection {
+			http.Error(w, "not implemented", http.StatusNotImplemented)
+			return
+		}
+		b.syncCollection(w, r, strings.Trim(path, "/"))
 	case "OPTIONS":
-		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT")
+		dav := "1, 2"
+		if b.SabrePatch {
+			dav += ", sabredav-partialupdate"
+		}
+		w.Header().Set("DAV", dav)
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, PATCH, DELETE, MKCOL, PROPFIND, PROPPATCH, MOVE, COPY, REPORT, LOCK, UNLOCK")
 		w.WriteHeader(http.StatusOK)
 	default:
 		http.Error(w, "not implemented", http.StatusNotImplemented)
 	}
 }
 
+// moveCopy implements MOVE and COPY of files and collections.
+func (b *MemBackend) moveCopy(w http.ResponseWriter, r *http.Request, key string) {
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || dest.Path == "" {
+		http.Error(w, "bad destination", http.StatusBadRequest)
+		return
+	}
+	dstKey := strings.Trim(dest.Path, "/")
+	move := r.Method == "MOVE"
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, dstExists := b.M[dstKey]
+	dstExists = dstExists || b.isDirLocked(dstKey)
+	// the assembled upload is conditional on the destination
+	dir, chunked := strings.CutSuffix(key, "/.file")
+	chunked = chunked && move && b.isDirLocked(dir)
+	if !chunked && !b.ifMatchLocked(r, key) || chunked && !b.ifMatchLocked(r, dstKey) {
+		http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+	if dstExists && r.Header.Get("Overwrite") == "F" {
+		http.Error(w, "destination exists", http.StatusPreconditionFailed)
+		return
+	}
+	// locks stay with the resources they were taken on
+	if move {
+		delete(b.locks, key)
+	}
+	delete(b.locks, dstKey)
+
+	// chunked upload assembly
+	if chunked {
+		var chunks []string
+		for k := range b.M {
+			if strings.HasPrefix(k, dir+"/") {
+				chunks = append(chunks, k)
+			}
+		}
+		sort.Strings(chunks)
+		var data []byte
+		for _, k := range chunks {
+			data = append(data, b.M[k]...)
+			delete(b.M, k)
+		}
+		delete(b.Dirs, dir)
+		if total := r.Header.Get("OC-Total-Length"); total != "" && total != strconv.Itoa(len(data)) {
+			http.Error(w, "length mismatch", http.StatusBadRequest)
+			return
+		}
+		b.M[dstKey] = data
+		b.Modified[dstKey] = b.mtimeLocked(w, r)
+		w.Header().Set("ETag", etagOf(data))
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	if data, ok := b.M[key]; ok {
+		b.M[dstKey] = data
+		b.Modified[dstKey] = time.Now()
+		b.copyPropsLocked(key, dstKey)
+		if move {
+			delete(b.M, key)
+			delete(b.Modified, key)
+			delete(b.Props, key)
+		}
+	} else if b.isDirLocked(key) {
+		b.Dirs[dstKey] = true
+		b.Modified[dstKey] = time.Now()
+		b.copyPropsLocked(key, dstKey)
+		for k, v := range b.M {
+			if rest, ok := strings.CutPrefix(k, key+"/"); ok {
+				b.M[dstKey+"/"+rest] = v
+				b.copyPropsLocked(k, dstKey+"/"+rest)
+				if move {
+					delete(b.M, k)
+					delete(b.Props, k)
+				}
+			}
+		}
+		for k := range b.Dirs {
+			if rest, ok := strings.CutPrefix(k, key+"/"); ok {
+				b.Dirs[dstKey+"/"+rest] = true
+				if move {
+					delete(b.Dirs, k)
+				}
+			}
+		}
+		if move {
+			delete(b.Dirs, key)
+			delete(b.Props, key)
+		}
+	} else {
+		http.NotFound(w, r)
+		return
+	}
+
+	if dstExists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (b *MemBackend) writeResponse(sb *strings.Builder, key string) {
+	b.writeResponseWith(sb, key, "")
+}
+
+// writeResponseWith is writeResponse adding the properties in extra to a
+// collection. Caller holds b.mu.
+func (b *MemBackend) writeResponseWith(sb *strings.Builder, key, extra string) {
+	href := "/" + key
+	if b.isDirLocked(key) {
+		if !strings.HasSuffix(href, "/") {
+			href += "/"
+		}
+		fmt.Fprintf(sb, `<d:response><d:href>%s</d:href><d:propstat><d:prop>`+
+			`<d:displayname>%s</d:displayname><d:resourcetype><d:collection/></d:resourcetype>`+
+			`<d:getlastmodified>%s</d:getlastmodified>`,
+			href, lastSegment(key), b.Modified[key].UTC().Format(http.TimeFormat))
+		if !b.NoCollectionTags {
+			fmt.Fprintf(sb, `<oc:etag>%s</oc:etag>`, b.collectionTagLocked(key))
+		}
+		if b.Quota > 0 {
+			used := b.usedLocked()
+			fmt.Fprintf(sb, `<d:quota-used-bytes>%d</d:quota-used-bytes><d:quota-available-bytes>%d</d:quota-available-bytes>`,
+				used, max(b.Quota-used, 0))
+		}
+		b.writePropsLocked(sb, key)
+		sb.WriteString(extra)
+		sb.WriteString(`</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`)
+		return
+	}
+	data := b.M[key]
+	fmt.Fprintf(sb, `<d:response><d:href>%s</d:href><d:propstat><d:prop>`+
+		`<d:displayname>%s</d:displayname><d:resourcetype/>`+
+		`<d:getcontentlength>%d</d:getcontentlength><d:getetag>%s</d:getetag>`+
+		`<d:getlastmodified>%s</d:getlastmodified>`,
+		href, lastSegment(key), len(data), b.etagXMLLocked(data), b.Modified[key].UTC().Format(http.TimeFormat))
+	b.writePropsLocked(sb, key)
+	sb.WriteString(`</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`)
+}
+
+// lock takes or refreshes the write lock of key. A lock without an If
+// header is a new one, which creates a missing file; with one it refreshes
+// the lock whose token it submits.
+func (b *MemBackend) lock(w http.ResponseWriter, r *http.Request, key string) {
+	timeout := 600
+	if v, ok := strings.CutPrefix(r.Header.Get("Timeout"), "Second-"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			timeout = n
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l, held := b.locks[key]
+	held = held && time.Now().Before(l.expires)
+	code := http.StatusOK
+	switch {
+	case r.Header.Get("If") != "":
+		if !held || !strings.Contains(r.Header.Get("If"), "<"+l.token+">") {
+			http.Error(w, "no such lock", http.StatusPreconditionFailed)
+			return
+		}
+	case held:
+		http.Error(w, "locked", http.StatusLocked)
+		return
+	default:
+		b.lockCount++
+		l.token = fmt.Sprintf("opaquelocktoken:mem-%d", b.lockCount)
+		if _, ok := b.M[key]; !ok && !b.isDirLocked(key) {
+			b.M[key] = []byte{}
+			b.Modified[key] = time.Now()
+			code = http.StatusCreated
+		}
+	}
+	l.expires = time.Now().Add(time.Duration(timeout) * time.Second)
+	if b.locks == nil {
+		b.locks = make(map[string]memLock)
+	}
+	b.locks[key] = l
+
+	w.Header().Set("Lock-Token", "<"+l.token+">")
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?><d:prop xmlns:d="DAV:"><d:lockdiscovery><d:activelock>`+
+		`<d:locktype><d:write/></d:locktype><d:lockscope><d:exclusive/></d:lockscope><d:depth>0</d:depth>`+
+		`<d:timeout>Second-%d</d:timeout><d:locktoken><d:href>%s</d:href></d:locktoken>`+
+		`</d:activelock></d:lockdiscovery></d:prop>`, timeout, l.token)
+}
+
+// lockedOut reports whether r changes a resource locked with a token it
+// does not submit.
+func (b *MemBackend) lockedOut(r *http.Request, key string) bool {
+	var keys []string
+	switch r.Method {
+	case http.MethodPut, "PATCH", http.MethodDelete, "PROPPATCH":
+		keys = []string{key}
+	case "MOVE", "COPY":
+		if dest, err := url.Parse(r.Header.Get("Destination")); err == nil {
+			keys = append(keys, strings.Trim(dest.Path, "/"))
+		}
+		if r.Method == "MOVE" {
+			keys = append(keys, key)
+		}
+	default:
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, k := range keys {
+		l, ok := b.locks[k]
+		if ok && time.Now().Before(l.expires) && !strings.Contains(r.Header.Get("If"), "<"+l.token+">") {
+			return true
+		}
+	}
+	return false
+}
+
+// LockToken returns the token of the write lock held on key, "" for none.
+func (b *MemBackend) LockToken(key string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if l, ok := b.locks[key]; ok && time.Now().Before(l.expires) {
+		return l.token
+	}
+	return ""
+}
+
+// usedLocked returns the bytes all files take. Caller holds b.mu.
+func (b *MemBackend) usedLocked() int64 {
+	var used int64
+	for _, data := range b.M {
+		used += int64(len(data))
+	}
+	return used
+}
+
+// fitsLocked reports whether key may hold data within the quota. Caller
+// holds b.mu.
+func (b *MemBackend) fitsLocked(key string, data []byte) bool {
+	return b.Quota <= 0 || b.usedLocked()-int64(len(b.M[key]))+int64(len(data)) <= b.Quota
+}
+
+// mtimeLocked returns the modification time a write request asks for with
+// X-OC-MTime when the server honours it, now otherwise. Caller holds b.mu.
+func (b *MemBackend) mtimeLocked(w http.ResponseWriter, r *http.Request) time.Time {
+	if v := r.Header.Get("X-OC-MTime"); v != "" && b.OCMTime {
+		if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+			w.Header().Set("X-OC-MTime", "accepted")
+			return time.Unix(sec, 0)
+		}
+	}
+	return time.Now()
+}
+
+// setLivePropLocked applies a PROPPATCH of a live property and reports
+// whether name is one. Caller holds b.mu.
+func (b *MemBackend) setLivePropLocked(key string, name xml.Name, value string) bool {
+	switch {
+	case name == xml.Name{Space: "DAV:", Local: "getlastmodified"}:
+		if t, err := http.ParseTime(strings.TrimSpace(value)); err == nil {
+			b.Modified[key] = t
+		}
+		return true
+	case name == xml.Name{Space: "DAV:", Local: "lastmodified"} && b.OCMTime:
+		if sec, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil {
+			b.Modified[key] = time.Unix(sec, 0)
+		}
+		return true
+	}
+	return false
+}
+
+// writePropsLocked writes the dead properties of key, each declaring its
+// namespace. Caller holds b.mu.
+func (b *MemBackend) writePropsLocked(sb *strings.Builder, key string) {
+	names := make([]xml.Name, 0, len(b.Props[key]))
+	for name := range b.Props[key] {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i].Space+names[i].Local < names[j].Space+names[j].Local
+	})
+	for _, name := range names {
+		fmt.Fprintf(sb, `<x:%s xmlns:x="`, name.Local)
+		_ = xml.EscapeText(sb, []byte(name.Space))
+		sb.WriteString(`">`)
+		_ = xml.EscapeText(sb, []byte(b.Props[key][name]))
+		fmt.Fprintf(sb, `</x:%s>`, name.Local)
+	}
+}
+
+// copyPropsLocked gives dst the dead properties of src. Caller holds b.mu.
+func (b *MemBackend) copyPropsLocked(src, dst string) {
+	delete(b.Props, dst)
+	if len(b.Props[src]) == 0 {
+		return
+	}
+	props := make(map[xml.Name]string, len(b.Props[src]))
+	for name, v := range b.Props[src] {
+		props[name] = v
+	}
+	b.Props[dst] = props
+}
+
+// proppatch sets and removes the dead properties of key and answers with
+// the status of every property.
+func (b *MemBackend) proppatch(w http.ResponseWriter, r *http.Request, key string) {
+	type prop struct {
+		Values []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	}
+	var req struct {
+		XMLName xml.Name `xml:"DAV: propertyupdate"`
+		Set     []struct {
+			Prop prop `xml:"DAV: prop"`
+		} `xml:"DAV: set"`
+		Remove []struct {
+			Prop prop `xml:"DAV: prop"`
+		} `xml:"DAV: remove"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.M[key]; !ok && !b.isDirLocked(key) {
+		http.NotFound(w, r)
+		return
+	}
+
+	status := "HTTP/1.1 200 OK"
+	if b.NoDeadProps {
+		status = "HTTP/1.1 403 Forbidden"
+	}
+	var names []xml.Name
+	for _, s := range req.Set {
+		for _, v := range s.Prop.Values {
+			names = append(names, v.XMLName)
+			if b.NoDeadProps || b.setLivePropLocked(key, v.XMLName, v.Value) {
+				continue
+			}
+			if b.Props[key] == nil {
+				b.Props[key] = make(map[xml.Name]string)
+			}
+			b.Props[key][v.XMLName] = v.Value
+		}
+	}
+	for _, rm := range req.Remove {
+		for _, v := range rm.Prop.Values {
+			names = append(names, v.XMLName)
+			if !b.NoDeadProps {
+				delete(b.Props[key], v.XMLName)
+			}
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<?xml version="1.0" encoding="utf-8"?><d:multistatus xmlns:d="DAV:"><d:response><d:href>/%s</d:href><d:propstat><d:prop>`, key)
+	for _, name := range names {
+		fmt.Fprintf(&sb, `<x:%s xmlns:x="`, name.Local)
+		_ = xml.EscapeText(&sb, []byte(name.Space))
+		fmt.Fprintf(&sb, `"/>`)
+	}
+	fmt.Fprintf(&sb, `</d:prop><d:status>%s</d:status></d:propstat></d:response></d:multistatus>`, status)
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	_, _ = io.WriteString(w, sb.String())
+}
+
+// collectionTagLocked derives an ownCloud style oc:etag for a collection
+// that changes whenever anything below it does. Caller holds b.mu.
+func (b *MemBackend) collectionTagLocked(key string) string {
+	prefix := ""
+	if key != "" {
+		prefix = key + "/"
+	}
+	var members []string
+	for k, v := range b.M {
+		if strings.HasPrefix(k, prefix) {
+			members = append(members, k+"\x00"+etagOf(v))
+		}
+	}
+	for k := range b.Dirs {
+		if strings.HasPrefix(k, prefix) {
+			members = append(members, k+"/")
+		}
+	}
+	sort.Strings(members)
+	sum := md5.Sum([]byte(strings.Join(members, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+func lastSegment(key string) string {
+	if i := strings.LastIndexByte(key, '/'); i >= 0 {
+		return key[i+1:]
+	}
+	return key
+}
+
+func (b *MemBackend) propfind(w http.ResponseWriter, r *http.Request, key string) {
+	body, _ := io.ReadAll(r.Body)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, isFile := b.M[key]
+	isDir := b.isDirLocked(key)
+	if !isFile && !isDir {
+		http.NotFound(w, r)
+		return
+	}
+
+	// the sync-token property (RFC 6578 section 4) issues a token for the
+	// current state, when asked for
+	var extra string
+	if isDir && !b.NoSyncCollection && strings.Contains(string(body), "sync-token") {
+		b.syncs = append(b.syncs, b.syncStateLocked(key))
+		extra = fmt.Sprintf(`<d:sync-token>%s%d</d:sync-token>`, syncTokenPrefix, len(b.syncs)-1)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`<?xml version="1.0" encoding="utf-8"?><d:multistatus xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">`)
+	b.writeResponseWith(&sb, key, extra)
+
+	if isDir && r.Header.Get("Depth") == "1" {
+		prefix := ""
+		if key != "" {
+			prefix = key + "/"
+		}
+		children := map[string]bool{}
+		for k := range b.M {
+			if rest, ok := strings.CutPrefix(k, prefix); ok && rest != "" {
+				children[prefix+strings.SplitN(rest, "/", 2)[0]] = true
+			}
+		}
+		for k := range b.Dirs {
+			if rest, ok := strings.CutPrefix(k, prefix); ok && rest != "" {
+				children[prefix+strings.SplitN(rest, "/", 2)[0]] = true
+			}
+		}
+		names := make([]string, 0, len(children))
+		for k := range children {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			b.writeResponse(&sb, k)
+		}
+	}
+	sb.WriteString(`</d:multistatus>`)
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	_, _ = io.WriteString(w, sb.String())
+}
+
+const syncTokenPrefix = "http://memserver/sync/"
+
+// syncStateLocked maps the files below key to their ETag and the
+// collections (with a trailing slash) to "". Caller holds b.mu.
+func (b *MemBackend) syncStateLocked(key string) map[string]string {
+	prefix := ""
+	if key != "" {
+		prefix = key + "/"
+	}
+	state := make(map[string]string)
+	for k, v := range b.M {
+		if strings.HasPrefix(k, prefix) {
+			state[k] = etagOf(v)
+		}
+	}
+	for k := range b.Dirs {
+		if strings.HasPrefix(k, prefix) {
+			state[k+"/"] = ""
+		}
+	}
+	return state
+}
+
+// syncCollection answers a sync-collection REPORT with the members that
+// changed since the token in the request, all of them without one.
+func (b *MemBackend) syncCollection(w http.ResponseWriter, r *http.Request, key string) {
+	var req struct {
+		XMLName xml.Name `xml:"DAV: sync-collection"`
+		Token   string   `xml:"DAV: sync-token"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var prev map[string]string
+	if req.Token != "" {
+		n, err := strconv.Atoi(strings.TrimPrefix(req.Token, syncTokenPrefix))
+		if err != nil || !strings.HasPrefix(req.Token, syncTokenPrefix) || n < 0 || n >= len(b.syncs) {
+			w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?><d:error xmlns:d="DAV:"><d:valid-sync-token/></d:error>`)
+			return
+		}
+		prev = b.syncs[n]
+	}
+	cur := b.syncStateLocked(key)
+	b.syncs = append(b.syncs, cur)
+
+	var changed []string
+	for k, tag := range cur {
+		if old, ok := prev[k]; !ok || old != tag {
+			changed = append(changed, k)
+		}
+	}
+	for k := range prev {
+		if _, ok := cur[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+
+	var sb strings.Builder
+	sb.WriteString(`<?xml version="1.0" encoding="utf-8"?><d:multistatus xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">`)
+	for _, k := range changed {
+		if _, ok := cur[k]; ok {
+			b.writeResponse(&sb, strings.TrimSuffix(k, "/"))
+			continue
+		}
+		fmt.Fprintf(&sb, `<d:response><d:href>/%s</d:href><d:status>HTTP/1.1 404 Not Found</d:status></d:response>`, k)
+	}
+	fmt.Fprintf(&sb, `<d:sync-token>%s%d</d:sync-token></d:multistatus>`, syncTokenPrefix, len(b.syncs)-1)
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	_, _ = io.WriteString(w, sb.String())
+}
+
 func NewTestServer() (*httptest.Server, *MemBackend) {
 	b := NewMemBackend()
 	s := httptest.NewServer(http.HandlerFunc(b.handler))